@@ -4,6 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/MlDenis/prometheus_wannabe/internal/config"
 	"github.com/MlDenis/prometheus_wannabe/internal/hash"
@@ -13,6 +17,7 @@ import (
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/provider/custom"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/provider/gopsutil"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/provider/runtime"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/provider/self"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/sendler/http"
 	"github.com/MlDenis/prometheus_wannabe/internal/worker"
 
@@ -30,7 +35,8 @@ func main() {
 
 	signer := hash.NewSigner(conf)
 	converter := model.NewMetricsConverter(conf, signer)
-	metricPusher, err := http.NewMetricsPusher(conf, converter)
+	agentMetricsProvider := self.NewAgentMetricsProvider()
+	metricPusher, err := http.NewMetricsPusher(conf, converter, agentMetricsProvider)
 	if err != nil {
 		panic(logger.WrapError("create new metrics pusher", err))
 	}
@@ -39,20 +45,42 @@ func main() {
 	customMetricsProvider := custom.NewCustomMetricsProvider()
 	gopsutilMetricsProvider := gopsutil.NewGopsutilMetricsProvider()
 	aggregateMetricsProvider := agregate.NewAggregateMetricsProvider(
-		runtimeMetricsProvider,
-		customMetricsProvider,
-		gopsutilMetricsProvider,
+		agentMetricsProvider.Track("runtime", runtimeMetricsProvider),
+		agentMetricsProvider.Track("custom", customMetricsProvider),
+		agentMetricsProvider.Track("gopsutil", gopsutilMetricsProvider),
+		agentMetricsProvider,
 	)
 	getMetricsWorker := worker.NewHardWorker(aggregateMetricsProvider.Update)
 	pushMetricsWorker := worker.NewHardWorker(func(workerContext context.Context) error {
 		return metricPusher.Push(workerContext, aggregateMetricsProvider.GetMetrics())
 	})
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer cancel()
 
-	go getMetricsWorker.StartWork(ctx, conf.UpdateMetricsInterval)
+	updateWG := sync.WaitGroup{}
+	updateWG.Add(1)
+	go func() {
+		defer updateWG.Done()
+		getMetricsWorker.StartWork(ctx, conf.UpdateMetricsInterval)
+	}()
 	pushMetricsWorker.StartWork(ctx, conf.SendMetricsInterval)
+
+	// the final push reads the metrics only after the running update is finished
+	cancel()
+	updateWG.Wait()
+
+	// push metrics collected since the last report before exit
+	logger.SugarLogger.Info("Agent is stopping, push remaining metrics")
+	pushCtx, cancelPush := context.WithTimeout(context.Background(), conf.FinalPushTimeout())
+	defer cancelPush()
+
+	err = metricPusher.Push(pushCtx, aggregateMetricsProvider.GetMetrics())
+	if err != nil {
+		logger.SugarLogger.Errorf("failed to push remaining metrics: %v", err)
+	}
+
+	logger.SugarLogger.Sync()
 }
 
 func createConfig() (*config.Config, error) {
@@ -92,6 +120,12 @@ func createConfig() (*config.Config, error) {
 	flag.IntVar(&conf.PushTimeout, "t", 10, "Push metrics timeout")
 	flag.IntVar(&conf.SendMetricsInterval, "r", 10, "Send metrics interval")
 	flag.IntVar(&conf.UpdateMetricsInterval, "p", 2, "Update metrics interval")
+	flag.StringVar(&conf.TLSCA, "tls-ca", "", "Trusted server CA certificate file (pins the server CA)")
+	flag.StringVar(&conf.TLSCert, "tls-cert", "", "Agent client certificate file for mTLS")
+	flag.StringVar(&conf.TLSKey, "tls-key", "", "Agent client private key file for mTLS")
+	flag.StringVar(&conf.Token, "token", "", "API bearer token with ingest scope")
+	flag.StringVar(&conf.TenantID, "tenant", "", "Tenant the metrics are pushed to")
+	flag.IntVar(&conf.ShutdownTimeout, "shutdown-timeout", 5, "Final metrics push timeout on shutdown")
 	flag.Parse()
 
 	err := env.Parse(conf)
@@ -8,23 +8,51 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/MlDenis/prometheus_wannabe/internal/auth"
+	"github.com/MlDenis/prometheus_wannabe/internal/cluster"
 	"github.com/MlDenis/prometheus_wannabe/internal/converter"
 	"github.com/MlDenis/prometheus_wannabe/internal/database"
 	"github.com/MlDenis/prometheus_wannabe/internal/database/postgre"
 	"github.com/MlDenis/prometheus_wannabe/internal/database/stub"
+	"github.com/MlDenis/prometheus_wannabe/internal/dump"
+	"github.com/MlDenis/prometheus_wannabe/internal/federation"
+	"github.com/MlDenis/prometheus_wannabe/internal/follower"
 	"github.com/MlDenis/prometheus_wannabe/internal/hash"
+	"github.com/MlDenis/prometheus_wannabe/internal/health"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/leader"
+	"github.com/MlDenis/prometheus_wannabe/internal/limiter"
 	"github.com/MlDenis/prometheus_wannabe/internal/logger"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/html"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/provider/agregate"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/db"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/file"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+	"github.com/MlDenis/prometheus_wannabe/internal/quota"
+	"github.com/MlDenis/prometheus_wannabe/internal/relay"
+	"github.com/MlDenis/prometheus_wannabe/internal/replication"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/stream"
+	"github.com/MlDenis/prometheus_wannabe/internal/transport"
+	"github.com/MlDenis/prometheus_wannabe/internal/webhook"
 	"github.com/MlDenis/prometheus_wannabe/internal/worker"
 
 	"github.com/caarlos0/env/v7"
@@ -37,11 +65,32 @@ import (
 const (
 	counterMetricName = "counter"
 	gaugeMetricName   = "gauge"
+
+	maxPageRefreshSeconds = 3600
+
+	defaultGraphRange = time.Hour
+	graphWidth        = 800
+	graphHeight       = 300
+
+	defaultStreamHeartbeat = 15 * time.Second
+
+	webhooksFileSuffix = ".webhooks.json"
+
+	defaultLeaderLockKey = 0x6d657472 // "metr"
+)
+
+var (
+	errTokensDBUnsupported   = errors.New("database does not support tokens, set DATABASE_DSN")
+	errWebhooksDBUnsupported = errors.New("database does not support webhooks")
+	errLocksDBUnsupported    = errors.New("database does not support locks")
+	errAllowedAgentsNoCA     = errors.New("allowed agents require the client CA, set TLS_CLIENT_CA_FILE")
+	errImportReplicated      = errors.New("import is not replicated to the peers, import with replication disabled")
 )
 
 var compressContentTypes = []string{
 	"application/javascript",
 	"application/json",
+	"image/svg+xml",
 	"text/css",
 	"text/html",
 	"text/plain",
@@ -56,6 +105,114 @@ type config struct {
 	Restore       bool            `env:"RESTORE"`
 	DB            string          `env:"DATABASE_DSN"`
 	LogLevel      zap.AtomicLevel `env:"LOG_LEVEL"`
+	TLSCert       string          `env:"TLS_CERT_FILE"`
+	TLSKey        string          `env:"TLS_KEY_FILE"`
+	TLSClientCA   string          `env:"TLS_CLIENT_CA_FILE"`
+	AllowedAgents []string        `env:"TLS_ALLOWED_AGENTS" envSeparator:","`
+	TokensFile    string          `env:"API_TOKENS_FILE"`
+	TokensDB      bool            `env:"API_TOKENS_DB"`
+	Upstreams     []string        `env:"FEDERATE_UPSTREAMS" envSeparator:","`
+	FederateMatch []string        `env:"FEDERATE_MATCH" envSeparator:","`
+	FederateToken string          `env:"FEDERATE_TOKEN"`
+	RelayUpstream string          `env:"RELAY_UPSTREAM"`
+	RelayDir      string          `env:"RELAY_QUEUE_DIR"`
+	RelayLocal    bool            `env:"RELAY_WRITE_LOCAL"`
+	RelayToken    string          `env:"RELAY_API_TOKEN"`
+	RelayCA       string          `env:"RELAY_TLS_CA_FILE"`
+	RelayCert     string          `env:"RELAY_TLS_CERT_FILE"`
+	RelayKey      string          `env:"RELAY_TLS_KEY_FILE"`
+	NodeID        string          `env:"REPLICATION_NODE_ID"`
+	Peers         []string        `env:"REPLICATION_PEERS" envSeparator:","`
+	ReplicaDir    string          `env:"REPLICATION_DIR"`
+	ReplicaToken  string          `env:"REPLICATION_TOKEN"`
+	ClusterFile   string          `env:"CLUSTER_CONFIG"`
+	ClusterID     string          `env:"CLUSTER_NODE_ID"`
+	ClusterSecret string          `env:"CLUSTER_TOKEN"`
+	LeaderEnabled bool            `env:"LEADER_ELECTION"`
+	LeaderKey     int64           `env:"LEADER_LOCK_KEY"`
+	FollowPath    string          `env:"FOLLOW_FILE"`
+	StoreFsync    string          `env:"STORE_FSYNC"`
+	StoreFormat   string          `env:"STORE_ENCODING"`
+	StoreKeyFile  string          `env:"STORE_ENCRYPTION_KEY_FILE"`
+	StoreKeys     string          `env:"STORE_ENCRYPTION_KEYS"`
+	RestoreFrom   string          `env:"RESTORE_FROM"`
+
+	QuotaTenantSeries   int `env:"QUOTA_TENANT_SERIES"`
+	QuotaAgentSeries    int `env:"QUOTA_AGENT_SERIES"`
+	QuotaTenantSamples  int `env:"QUOTA_TENANT_SAMPLES_PER_SECOND"`
+	QuotaAgentSamples   int `env:"QUOTA_AGENT_SAMPLES_PER_SECOND"`
+	QuotaBatchSize      int `env:"QUOTA_BATCH_SIZE"`
+	SelfMetricsInterval int `env:"SELF_METRICS_INTERVAL"`
+	ShutdownTimeout     int `env:"SHUTDOWN_TIMEOUT"`
+	ReadinessTimeout    int `env:"READINESS_TIMEOUT"`
+	HistorySize         int `env:"HISTORY_SIZE"`
+	StreamHeartbeat     int `env:"STREAM_HEARTBEAT"`
+	StreamReplay        int `env:"STREAM_REPLAY_SIZE"`
+	StreamSubscribers   int `env:"STREAM_MAX_SUBSCRIBERS"`
+	WebhookQueue        int `env:"WEBHOOK_QUEUE_SIZE"`
+	WebhookWorkerCount  int `env:"WEBHOOK_WORKERS"`
+	WebhookAttempts     int `env:"WEBHOOK_MAX_ATTEMPTS"`
+	WebhookTimeoutSec   int `env:"WEBHOOK_TIMEOUT"`
+	FederateInterval    int `env:"FEDERATE_INTERVAL"`
+	FederateTimeoutSec  int `env:"FEDERATE_TIMEOUT"`
+	RelayMaxBatches     int `env:"RELAY_QUEUE_MAX_BATCHES"`
+	RelayBatch          int `env:"RELAY_BATCH_SIZE"`
+	RelayTimeoutSec     int `env:"RELAY_PUSH_TIMEOUT"`
+	ReplicaRetention    int `env:"REPLICATION_LOG_RETENTION"`
+	ReplicaBatch        int `env:"REPLICATION_BATCH_SIZE"`
+	ReplicaTimeoutSec   int `env:"REPLICATION_TIMEOUT"`
+	ClusterTimeoutSec   int `env:"CLUSTER_TIMEOUT"`
+	LeaderLeaseSec      int `env:"LEADER_LEASE"`
+	FollowInterval      int `env:"FOLLOW_INTERVAL"`
+	StoreFsyncMillis    int `env:"STORE_FSYNC_INTERVAL_MS"`
+	StoreSnapshotEvery  int `env:"STORE_SNAPSHOT_THRESHOLD"`
+	StoreHourly         int `env:"STORE_KEEP_HOURLY"`
+	StoreDaily          int `env:"STORE_KEEP_DAILY"`
+	FollowMaxLagSec     int `env:"FOLLOW_MAX_LAG"`
+
+	// loaded from StoreKeyFile or StoreKeys
+	keyring *file.Keyring
+
+	IngestInFlight int `env:"INGEST_MAX_IN_FLIGHT"`
+	IngestRate     int `env:"INGEST_REQUESTS_PER_SECOND"`
+	IngestBurstMax int `env:"INGEST_BURST"`
+	ReadInFlight   int `env:"READ_MAX_IN_FLIGHT"`
+}
+
+type routerOptions struct {
+	allowedAgents []string
+	authenticator *auth.Authenticator
+	quotaLimiter  *quota.QuotaLimiter
+	loadShedder   *limiter.LoadShedder
+	healthChecker *health.Checker
+	restored      *health.Latch
+	registry      *selfmetrics.Registry
+	selfMetrics   metrics.MetricsProvider
+	broker        *stream.Broker
+	heartbeat     time.Duration
+	webhooks      *webhook.Dispatcher
+	replicator    *replication.Replicator
+	snapshots     storage.SnapshotStorage
+	// the local state exported and imported by the admin api
+	state storage.StateStorage
+	// a follower serves the state of the primary and rejects writes
+	readOnly bool
+	// the storage of the series owned by this node in cluster mode
+	clusterLocal storage.MetricsStorage
+}
+
+type importResult struct {
+	Mode    dump.Mode `json:"mode"`
+	Tenants int       `json:"tenants"`
+	Series  int       `json:"series"`
+}
+
+type streamEvent struct {
+	Name      string    `json:"id"`
+	Type      string    `json:"type"`
+	Value     float64   `json:"value"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 type metricInfoContextKey struct {
@@ -68,7 +225,7 @@ type metricsRequestContext struct {
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer cancel()
 
 	conf, err := createConfig()
@@ -80,53 +237,309 @@ func main() {
 
 	logger.SugarLogger.Infof("Starting server with the following configuration:%v", conf)
 
+	registry := selfmetrics.NewRegistry()
+
 	var base database.DataBase
 	var backupStorage storage.MetricsStorage
-	if conf.DB == "" {
+	if conf.FollowPath != "" {
+		// the backup belongs to the primary, a follower never writes it
+		base = &stub.StubDataBase{}
+		backupStorage = db.NewDBStorage(base)
+	} else if conf.DB == "" {
 		base = &stub.StubDataBase{}
 		backupStorage = file.NewFileStorage(conf)
+		// runs after the final backup
+		defer closeWithLog("backup storage", backupStorage.(io.Closer))
 	} else {
-		base, err = postgre.NewPostgresDataBase(ctx, conf)
+		base, err = postgre.NewPostgresDataBase(ctx, conf, registry)
 		if err != nil {
 			panic(logger.WrapError("create database", err))
 		}
 
 		backupStorage = db.NewDBStorage(base)
 	}
-	defer base.Close()
+	defer closeWithLog("database", base)
 
-	inMemoryStorage := memory.NewInMemoryStorage()
-	storageStrategy := storage.NewStorageStrategy(conf, inMemoryStorage, backupStorage)
-	defer storageStrategy.Close()
+	elector, err := createElector(conf, base, registry)
+	if err != nil {
+		panic(logger.WrapError("create leader elector", err))
+	}
+	// the workers are stopped after the server, before the final backup and the storages are closed
+	var workers sync.WaitGroup
+	if elector != nil {
+		runWorker(&workers, func() { elector.Run(ctx) })
+	}
+	// hands the leadership over after the final backup
+	defer elector.Release(context.Background())
+
+	inMemoryStorage := memory.NewInMemoryStorageWithHistory(conf.HistorySize)
+	storageStrategy := storage.NewStorageStrategy(conf, inMemoryStorage, backupStorage, registry)
+	restored := health.NewLatch()
+	// runs before the database is closed and takes the final backup
+	defer closeStorage(storageStrategy, conf.SyncMode(), restored)
 
 	signer := hash.NewSigner(conf)
 	converter := model.NewMetricsConverter(conf, signer)
-	htmlPageBuilder := html.NewSimplePageBuilder()
-	router := initRouter(storageStrategy, converter, htmlPageBuilder, base)
+	htmlPageBuilder := html.NewDashboardPageBuilder()
+
+	tokenStore, err := createTokenStore(conf, base)
+	if err != nil {
+		panic(logger.WrapError("create token store", err))
+	}
+
+	quotaLimiter := quota.NewQuotaLimiter(conf)
+	loadShedder := limiter.NewLoadShedder(conf)
 
-	if conf.Restore {
-		logger.SugarLogger.Error("Restore metrics from backup")
-		err = storageStrategy.RestoreFromBackup(ctx)
+	selfMetrics := agregate.NewAggregateMetricsProvider(registry, quotaLimiter, loadShedder)
+
+	broker := stream.NewBroker(conf, registry)
+	storageStrategy.AddObserver(broker)
+
+	// a follower applies the changes of the primary, so its webhooks would deliver them once more
+	var webhooks *webhook.Dispatcher
+	if conf.FollowPath == "" {
+		webhookStore, err := createWebhookStore(conf, base)
+		if err != nil {
+			panic(logger.WrapError("create webhook store", err))
+		}
+
+		webhooks = webhook.NewDispatcher(conf, webhookStore, registry)
+		err = webhooks.Load(ctx)
 		if err != nil {
-			logger.SugarLogger.Errorf("failed to restore state from backup: %v", err)
+			panic(logger.WrapError("load webhooks", err))
 		}
+		webhooks.Start(ctx)
+		runWorker(&workers, webhooks.Wait)
+		storageStrategy.AddObserver(webhooks)
 	}
 
-	if !conf.SyncMode() {
-		logger.SugarLogger.Infof("Start periodic backup serice")
-		backgroundStore := worker.NewHardWorker(func(ctx context.Context) error { return storageStrategy.CreateBackup(ctx) })
-		go backgroundStore.StartWork(ctx, conf.StoreInterval)
+	var primary *follower.Follower
+	if conf.FollowPath != "" {
+		logger.SugarLogger.Infof("Follow the primary backup %v", conf.FollowPath)
+		primary = follower.NewFollower(conf, storageStrategy, registry)
+	}
+
+	healthChecker := createHealthChecker(conf, base, storageStrategy, restored, elector, primary)
+
+	replicator, err := createReplicator(conf, storageStrategy, registry)
+	if err != nil {
+		panic(logger.WrapError("create replicator", err))
+	}
+
+	var localStorage storage.MetricsStorage = storageStrategy
+	if replicator != nil {
+		defer closeWithLog("replication log", replicator)
+		localStorage = replication.NewReplicatingStorage(storageStrategy, replicator)
+		runWorker(&workers, func() { replicator.Run(ctx) })
+	}
+
+	var clusterLocal storage.MetricsStorage
+	if conf.ClusterFile != "" {
+		clusterLocal = localStorage
+		localStorage, err = createCluster(conf, localStorage, converter, registry)
+		if err != nil {
+			panic(logger.WrapError("create cluster", err))
+		}
+	}
+
+	metricsStorage, err := createRelay(ctx, conf, localStorage, converter, registry, &workers)
+	if err != nil {
+		panic(logger.WrapError("create relay", err))
+	}
+
+	router := initRouter(metricsStorage, converter, htmlPageBuilder, base, routerOptions{
+		allowedAgents: conf.AllowedAgents,
+		authenticator: auth.NewAuthenticator(tokenStore),
+		quotaLimiter:  quotaLimiter,
+		loadShedder:   loadShedder,
+		healthChecker: healthChecker,
+		restored:      restored,
+		registry:      registry,
+		selfMetrics:   selfMetrics,
+		broker:        broker,
+		heartbeat:     time.Duration(conf.StreamHeartbeat) * time.Second,
+		webhooks:      webhooks,
+		replicator:    replicator,
+		snapshots:     storageStrategy,
+		state:         storageStrategy,
+		readOnly:      primary != nil,
+		clusterLocal:  clusterLocal,
+	})
+
+	tlsConfig, err := transport.NewServerTLSConfig(conf)
+	if err != nil {
+		panic(logger.WrapError("create tls config", err))
+	}
+
+	// the server is not ready and rejects metrics requests until restore is finished
+	runWorker(&workers, func() {
+		if primary != nil {
+			err := primary.Sync(ctx)
+			if err != nil {
+				logger.SugarLogger.Errorf("failed to sync with the primary: %v", err)
+			}
+			restored.Done()
+
+			followPrimary := worker.NewHardWorker(primary.Sync)
+			followPrimary.StartWork(ctx, conf.FollowInterval)
+			return
+		}
+
+		restoreFromBackup := conf.Restore
+		if conf.RestoreFrom != "" {
+			logger.SugarLogger.Infof("Restore metrics from backup snapshot %v", conf.RestoreFrom)
+			err := storageStrategy.RestoreSnapshot(ctx, conf.RestoreFrom)
+			if err != nil {
+				logger.SugarLogger.Errorf("failed to restore state from snapshot: %v", err)
+			} else {
+				restoreFromBackup = false
+			}
+		}
+
+		if restoreFromBackup {
+			logger.SugarLogger.Info("Restore metrics from backup")
+			err := storageStrategy.RestoreFromBackup(ctx)
+			if err != nil {
+				logger.SugarLogger.Errorf("failed to restore state from backup: %v", err)
+			}
+		}
+
+		// the writes are rejected until restore is finished, so no series is charged twice
+		err := seedQuota(ctx, quotaLimiter, storageStrategy)
+		if err != nil {
+			logger.SugarLogger.Errorf("failed to seed quota usage: %v", err)
+		}
+		restored.Done()
+
+		if !conf.SyncMode() {
+			logger.SugarLogger.Infof("Start periodic backup serice")
+			backgroundStore := worker.NewHardWorker(afterRestore(restored, storageStrategy.CreateBackup))
+			backgroundStore.StartWork(ctx, conf.StoreInterval)
+		}
+	})
+
+	if len(conf.Upstreams) > 0 {
+		puller, err := federation.NewPuller(conf, storageStrategy, converter, registry)
+		if err != nil {
+			panic(logger.WrapError("create federation puller", err))
+		}
+
+		logger.SugarLogger.Infof("Start pulling upstreams %v", conf.Upstreams)
+		// the servers sharing the database would copy the same upstreams into it
+		federationPull := worker.NewHardWorker(elector.Singleton(puller.Pull))
+		runWorker(&workers, func() { federationPull.StartWork(ctx, conf.FederateInterval) })
+	}
+
+	if conf.SelfMetricsInterval > 0 {
+		logger.SugarLogger.Infof("Start self metrics export")
+		selfMetricsExport := worker.NewHardWorker(exportSelfMetrics(storageStrategy, selfMetrics))
+		runWorker(&workers, func() { selfMetricsExport.StartWork(ctx, conf.SelfMetricsInterval) })
+	}
+
+	server := &http.Server{
+		Addr:      conf.ServerURL,
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}
+	// streams are endless, so they are closed to let the server drain other requests
+	server.RegisterOnShutdown(broker.Close)
+
+	listener, err := net.Listen("tcp", conf.ServerURL)
+	if err != nil {
+		panic(logger.WrapError("listen "+conf.ServerURL, err))
 	}
 
 	logger.SugarLogger.Infof("Start listen " + conf.ServerURL)
-	err = http.ListenAndServe(conf.ServerURL, router)
+	err = serve(ctx, server, listener, time.Duration(conf.ShutdownTimeout)*time.Second)
 	if err != nil {
 		logger.SugarLogger.Error(err)
 	}
 
+	// the server may stop on its own, so the workers are stopped explicitly
+	cancel()
+	workers.Wait()
+
+	logger.SugarLogger.Info("Server stopped")
 	logger.SugarLogger.Sync()
 }
 
+// runWorker runs the work in background and counts it in the workers.
+func runWorker(workers *sync.WaitGroup, work func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		work()
+	}()
+}
+
+// serve handles requests until ctx is done, then drains in-flight requests within the timeout.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, shutdownTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// certificates are already loaded into TLSConfig
+			serveErr <- server.ServeTLS(listener, "", "")
+		} else {
+			serveErr <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return logger.WrapError("serve", err)
+	case <-ctx.Done():
+	}
+
+	logger.SugarLogger.Info("Shutdown server, drain in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		return logger.WrapError("shutdown server", err)
+	}
+
+	err = <-serveErr
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return logger.WrapError("serve", err)
+	}
+
+	return nil
+}
+
+// closeStorage takes the final backup.
+// The backup is skipped until restore is finished, so a half-restored state never overwrites the backup.
+// In sync mode every write is already backed up, and a shared database may hold newer values
+// written by other servers, so the memory is not written over it.
+func closeStorage(storageStrategy *storage.StorageStrategy, syncMode bool, restored *health.Latch) {
+	if !restored.IsDone() {
+		logger.SugarLogger.Warn("Restore is not finished, the final backup is skipped")
+		return
+	}
+
+	if !syncMode {
+		closeWithLog("storage", storageStrategy)
+	}
+}
+
+// afterRestore skips the backup until restore is finished.
+func afterRestore(restored *health.Latch, backup func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if !restored.IsDone() {
+			return nil
+		}
+
+		return backup(ctx)
+	}
+}
+
+func closeWithLog(name string, closer io.Closer) {
+	err := closer.Close()
+	if err != nil {
+		logger.SugarLogger.Errorf("failed to close %v: %v", name, err)
+	}
+}
+
 func createConfig() (*config, error) {
 	conf := &config{}
 
@@ -135,25 +548,253 @@ func createConfig() (*config, error) {
 	flag.IntVar(&conf.StoreInterval, "i", 300, "Store backup interval")
 	flag.StringVar(&conf.ServerURL, "a", "localhost:8080", "Server listen URL")
 	flag.StringVar(&conf.StoreFile, "f", "/tmp/metrics-db.json", "Backup storage file path")
+	flag.StringVar(&conf.RestoreFrom, "restore-from", "", "Backup snapshot id to restore on start instead of the current backup")
+	flag.IntVar(&conf.StoreHourly, "store-keep-hourly", 24, "Hours to keep the newest backup snapshot of each hour for")
+	flag.IntVar(&conf.StoreDaily, "store-keep-daily", 7, "Days to keep the newest backup snapshot of each day for")
+	flag.StringVar(&conf.StoreFormat, "store-encoding", string(file.EncodingJSON), "Backup snapshot encoding: json, gzip or gob")
+	flag.StringVar(&conf.StoreKeyFile, "store-key-file", "", "File with id=base64 AES keys of the backup snapshot encryption, the first key encrypts (enables encryption)")
+	flag.StringVar(&conf.StoreFsync, "store-fsync", string(file.FsyncInterval), "Backup write-ahead log fsync policy: always, interval or never")
+	flag.IntVar(&conf.StoreFsyncMillis, "store-fsync-interval", 1000, "Backup write-ahead log fsync interval in milliseconds for the interval policy")
+	flag.IntVar(&conf.StoreSnapshotEvery, "store-snapshot-threshold", 10000, "Backup write-ahead log entries written to a new snapshot at once (0 - only on periodic backup)")
 	flag.StringVar(&conf.DB, "d", "", "Database connection stirng")
+	flag.StringVar(&conf.TLSCert, "tls-cert", "", "Server TLS certificate file")
+	flag.StringVar(&conf.TLSKey, "tls-key", "", "Server TLS private key file")
+	flag.StringVar(&conf.TLSClientCA, "tls-client-ca", "", "CA certificate file to verify agent certificates (enables mTLS)")
+	flag.Func("tls-allowed-agents", "Comma separated list of agent certificate CNs allowed to connect", func(value string) error {
+		conf.AllowedAgents = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("federate-upstreams", "Comma separated list of name=url upstream servers to pull /federate from", func(value string) error {
+		conf.Upstreams = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("federate-match", "Comma separated list of series patterns pulled from upstreams (default *)", func(value string) error {
+		conf.FederateMatch = strings.Split(value, ",")
+		return nil
+	})
+	flag.StringVar(&conf.FederateToken, "federate-token", "", "Bearer token for upstream servers")
+	flag.IntVar(&conf.FederateInterval, "federate-interval", 15, "Pull upstreams interval")
+	flag.IntVar(&conf.FederateTimeoutSec, "federate-timeout", 10, "Upstream pull request timeout")
+	flag.StringVar(&conf.RelayUpstream, "relay-upstream", "", "Upstream server URL to forward the received metrics to (enables relay mode)")
+	flag.StringVar(&conf.RelayDir, "relay-queue-dir", "/tmp/metrics-relay", "Directory of the relay forwarding queue")
+	flag.IntVar(&conf.RelayMaxBatches, "relay-queue-max-batches", 10000, "Maximum queued update requests, updates are rejected when the queue is full (0 - unlimited)")
+	flag.IntVar(&conf.RelayBatch, "relay-batch-size", 1000, "Maximum metrics forwarded at once")
+	flag.BoolVar(&conf.RelayLocal, "relay-write-local", true, "Keep the relayed metrics in the local storage too")
+	flag.StringVar(&conf.RelayToken, "relay-token", "", "Bearer token for the upstream server")
+	flag.IntVar(&conf.RelayTimeoutSec, "relay-push-timeout", 10, "Upstream push request timeout")
+	flag.StringVar(&conf.RelayCA, "relay-tls-ca", "", "CA certificate file to verify the upstream server")
+	flag.StringVar(&conf.RelayCert, "relay-tls-cert", "", "Client certificate file for the upstream server")
+	flag.StringVar(&conf.RelayKey, "relay-tls-key", "", "Client private key file for the upstream server")
+	flag.StringVar(&conf.NodeID, "replication-node-id", "", "Unique node name in the replication cluster (enables replication)")
+	flag.Func("replication-peers", "Comma separated list of name=url peers to replicate the mutations to", func(value string) error {
+		conf.Peers = strings.Split(value, ",")
+		return nil
+	})
+	flag.StringVar(&conf.ReplicaDir, "replication-dir", "", "Durable directory of the replication log and state, required with replication")
+	flag.IntVar(&conf.ReplicaRetention, "replication-log-retention", 100000, "Mutations kept in the replication log for peers to catch up")
+	flag.IntVar(&conf.ReplicaBatch, "replication-batch-size", 1000, "Maximum mutations sent to a peer at once")
+	flag.StringVar(&conf.ReplicaToken, "replication-token", "", "Bearer token with the admin scope for the peers")
+	flag.IntVar(&conf.ReplicaTimeoutSec, "replication-timeout", 5, "Peer request timeout")
+	flag.StringVar(&conf.ClusterFile, "cluster-config", "", "JSON file with the cluster members (enables cluster mode)")
+	flag.StringVar(&conf.ClusterID, "cluster-node-id", "", "Name of this node in the cluster config")
+	flag.StringVar(&conf.ClusterSecret, "cluster-token", "", "Bearer token with the admin scope for the other nodes")
+	flag.IntVar(&conf.ClusterTimeoutSec, "cluster-timeout", 5, "Node request timeout")
+	flag.BoolVar(&conf.LeaderEnabled, "leader-election", true, "Run federation pulls only on the leader among the servers sharing the database")
+	flag.Int64Var(&conf.LeaderKey, "leader-lock-key", defaultLeaderLockKey, "Postgres advisory lock key of the leader election")
+	flag.IntVar(&conf.LeaderLeaseSec, "leader-lease", 15, "Leader lease, the leader steps down when it is not renewed in time")
+	flag.StringVar(&conf.FollowPath, "follow-file", "", "Backup file of the primary server to follow (enables read-only follower mode)")
+	flag.IntVar(&conf.FollowInterval, "follow-interval", 2, "Primary backup check interval")
+	flag.IntVar(&conf.FollowMaxLagSec, "follow-max-lag", 0, "Replication lag the follower is ready with (0 - unlimited)")
+	flag.StringVar(&conf.TokensFile, "tokens-file", "", "JSON file with hashed API tokens (enables authentication)")
+	flag.BoolVar(&conf.TokensDB, "tokens-db", false, "Read hashed API tokens from the database (enables authentication)")
+	flag.IntVar(&conf.QuotaTenantSeries, "quota-tenant-series", 0, "Maximum series per tenant (0 - unlimited)")
+	flag.IntVar(&conf.QuotaAgentSeries, "quota-agent-series", 0, "Maximum series per agent (0 - unlimited)")
+	flag.IntVar(&conf.QuotaTenantSamples, "quota-tenant-samples", 0, "Maximum samples per second per tenant (0 - unlimited)")
+	flag.IntVar(&conf.QuotaAgentSamples, "quota-agent-samples", 0, "Maximum samples per second per agent (0 - unlimited)")
+	flag.IntVar(&conf.QuotaBatchSize, "quota-batch-size", 0, "Maximum metrics in one update request (0 - unlimited)")
+	flag.IntVar(&conf.IngestInFlight, "ingest-max-in-flight", 0, "Maximum concurrent update requests (0 - unlimited)")
+	flag.IntVar(&conf.IngestRate, "ingest-rate", 0, "Maximum update requests per second (0 - unlimited)")
+	flag.IntVar(&conf.IngestBurstMax, "ingest-burst", 0, "Update requests burst over the rate (0 - same as rate)")
+	flag.IntVar(&conf.ReadInFlight, "read-max-in-flight", 0, "Maximum concurrent read requests (0 - unlimited)")
+	flag.IntVar(&conf.ShutdownTimeout, "shutdown-timeout", 10, "Drain in-flight requests timeout on shutdown")
+	flag.IntVar(&conf.ReadinessTimeout, "readiness-timeout", 2, "Readiness component check timeout")
+	flag.IntVar(&conf.HistorySize, "history-size", memory.DefaultHistorySize, "Samples kept in memory per metric for charts (0 - disabled)")
+	flag.IntVar(&conf.StreamHeartbeat, "stream-heartbeat", 15, "Metrics stream heartbeat interval")
+	flag.IntVar(&conf.StreamReplay, "stream-replay-size", 1024, "Metric change events kept to resume streams")
+	flag.IntVar(&conf.StreamSubscribers, "stream-max-subscribers", 0, "Maximum concurrent metrics streams (0 - unlimited)")
+	flag.IntVar(&conf.WebhookQueue, "webhook-queue-size", 1000, "Webhook events waiting for delivery, the overflow goes to the dead-letter log")
+	flag.IntVar(&conf.WebhookWorkerCount, "webhook-workers", 2, "Concurrent webhook deliveries")
+	flag.IntVar(&conf.WebhookAttempts, "webhook-max-attempts", 5, "Webhook delivery attempts before the event goes to the dead-letter log")
+	flag.IntVar(&conf.WebhookTimeoutSec, "webhook-timeout", 5, "Webhook request timeout")
+	flag.IntVar(&conf.SelfMetricsInterval, "self-metrics-interval", 0, "Store server self metrics as ordinary metrics interval (0 - disabled)")
 	flag.Parse()
 
 	err := env.Parse(conf)
-	return conf, err
+	if err != nil {
+		return conf, err
+	}
+
+	err = conf.StoreEncoding().Validate()
+	if err != nil {
+		return conf, err
+	}
+
+	err = validateAllowedAgents(conf)
+	if err != nil {
+		return conf, err
+	}
+
+	// keys are taken from the environment rather than the command line, which other users may see
+	conf.keyring, err = file.LoadKeyring(conf.StoreKeyFile, conf.StoreKeys)
+	if err != nil {
+		return conf, err
+	}
+
+	return conf, conf.StoreFsyncPolicy().Validate()
+}
+
+// validateAllowedAgents rejects the allowlist without mTLS, agents present no certificates then and every request would pass.
+func validateAllowedAgents(conf *config) error {
+	for _, agent := range conf.AllowedAgents {
+		if strings.TrimSpace(agent) != "" && conf.TLSClientCA == "" {
+			return logger.WrapError("check allowed agents", errAllowedAgentsNoCA)
+		}
+	}
+
+	return nil
+}
+
+func createTokenStore(conf *config, base database.DataBase) (auth.TokenStore, error) {
+	if conf.TokensFile != "" {
+		logger.SugarLogger.Infof("Load API tokens from %v", conf.TokensFile)
+		return auth.NewFileTokenStore(conf.TokensFile)
+	}
+
+	if conf.TokensDB {
+		tokenDB, ok := base.(database.TokenDataBase)
+		if !ok {
+			return nil, logger.WrapError("read tokens from database", errTokensDBUnsupported)
+		}
+
+		logger.SugarLogger.Info("Read API tokens from database")
+		return auth.NewDBTokenStore(tokenDB), nil
+	}
+
+	logger.SugarLogger.Info("API tokens are not configured, authentication is disabled")
+	return nil, nil
+}
+
+// createReplicator returns nil unless the node id is configured, the peer mutations are applied to storageStrategy.
+func createReplicator(conf *config, storageStrategy *storage.StorageStrategy, registry *selfmetrics.Registry) (*replication.Replicator, error) {
+	if conf.NodeID == "" {
+		return nil, nil
+	}
+
+	replicator, err := replication.NewReplicator(conf, storageStrategy, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.SugarLogger.Infof("Replicate mutations of node %v to peers %v", conf.NodeID, conf.Peers)
+	return replicator, nil
+}
+
+// createElector returns nil unless servers share the database, a nil elector runs every job.
+func createElector(conf *config, base database.DataBase, registry *selfmetrics.Registry) (*leader.Elector, error) {
+	if conf.DB == "" || conf.FollowPath != "" || !conf.LeaderEnabled {
+		return nil, nil
+	}
+
+	locker, ok := base.(database.LockDataBase)
+	if !ok {
+		return nil, errLocksDBUnsupported
+	}
+
+	logger.SugarLogger.Infof("Campaign for leadership with lock %v", conf.LeaderKey)
+	return leader.NewElector(conf, locker, registry), nil
+}
+
+// createCluster returns the storage forwarding the series owned by other nodes to them.
+func createCluster(conf *config, localStorage storage.MetricsStorage, converter *model.MetricsConverter, registry *selfmetrics.Registry) (storage.MetricsStorage, error) {
+	nodes, err := cluster.NewCluster(conf, converter, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.SugarLogger.Infof("Join cluster %v as node %v", nodes.Nodes(), nodes.Self())
+	return cluster.NewShardedStorage(localStorage, nodes), nil
+}
+
+// createRelay returns the storage for the incoming metrics, in relay mode it queues them for the upstream server
+// and starts forwarding.
+func createRelay(ctx context.Context, conf *config, localStorage storage.MetricsStorage, converter *model.MetricsConverter, registry *selfmetrics.Registry, workers *sync.WaitGroup) (storage.MetricsStorage, error) {
+	if conf.RelayUpstream == "" {
+		return localStorage, nil
+	}
+
+	queue, err := relay.NewDiskQueue(conf.RelayDir, conf.RelayMaxBatches)
+	if err != nil {
+		return nil, logger.WrapError("open relay queue", err)
+	}
+
+	forwarder, err := relay.NewForwarder(conf, queue, converter, registry)
+	if err != nil {
+		return nil, logger.WrapError("create relay forwarder", err)
+	}
+
+	var local storage.MetricsStorage
+	if conf.RelayLocal {
+		local = localStorage
+	}
+
+	logger.SugarLogger.Infof("Relay metrics to %v, %v batches are queued", conf.RelayUpstream, queue.Len())
+	runWorker(workers, func() { forwarder.Run(ctx) })
+
+	return relay.NewRelayStorage(queue, local, forwarder), nil
+}
+
+// createWebhookStore keeps webhooks in the database or next to the backup file.
+func createWebhookStore(conf *config, base database.DataBase) (webhook.SubscriptionStore, error) {
+	if conf.DB != "" {
+		webhookDB, ok := base.(database.WebhookDataBase)
+		if !ok {
+			return nil, logger.WrapError("keep webhooks in database", errWebhooksDBUnsupported)
+		}
+
+		return webhook.NewDBSubscriptionStore(webhookDB), nil
+	}
+
+	if conf.StoreFile == "" {
+		logger.SugarLogger.Info("Backup file is not configured, webhooks are not persisted")
+		return webhook.NewFileSubscriptionStore(""), nil
+	}
+
+	return webhook.NewFileSubscriptionStore(conf.StoreFile + webhooksFileSuffix), nil
 }
 
-func initRouter(metricsStorage storage.MetricsStorage, converter *model.MetricsConverter, htmlPageBuilder html.HTMLPageBuilder, dbStorage database.DataBase) *chi.Mux {
+func initRouter(metricsStorage storage.MetricsStorage, converter *model.MetricsConverter, htmlPageBuilder html.HTMLPageBuilder, dbStorage database.DataBase, options routerOptions) *chi.Mux {
 	router := chi.NewRouter()
 
 	router.Use(middleware.Logger)
+	router.Use(selfmetrics.Middleware(options.registry))
+	router.Use(fillAgentIdentity(options.allowedAgents))
+	router.Use(fillTenant)
 	router.Use(middleware.Compress(gzip.BestSpeed, compressContentTypes...))
-	router.Mount("/debug", middleware.Profiler())
+	router.Route("/debug", func(r chi.Router) {
+		r.Use(options.authenticator.Require(auth.ScopeAdmin))
+		r.Mount("/", middleware.Profiler())
+	})
+
 	router.Route("/update", func(r chi.Router) {
-		r.With(fillSingleJSONContext, updateMetrics(metricsStorage, converter)).
+		r.Use(rejectWrites(options.readOnly))
+		r.Use(options.authenticator.Require(auth.ScopeIngest))
+		r.Use(options.loadShedder.Limit(limiter.ClassIngest))
+		r.Use(waitRestore(options.restored))
+		r.With(fillSingleJSONContext, checkQuota(options.quotaLimiter), updateMetrics(metricsStorage, converter, options.registry)).
 			Post("/", successSingleJSONResponse())
-		r.With(fillCommonURLContext, fillGaugeURLContext, updateMetrics(metricsStorage, converter)).
+		r.With(fillCommonURLContext, fillGaugeURLContext, checkQuota(options.quotaLimiter), updateMetrics(metricsStorage, converter, options.registry)).
 			Post("/gauge/{metricName}/{metricValue}", successURLResponse())
-		r.With(fillCommonURLContext, fillCounterURLContext, updateMetrics(metricsStorage, converter)).
+		r.With(fillCommonURLContext, fillCounterURLContext, checkQuota(options.quotaLimiter), updateMetrics(metricsStorage, converter, options.registry)).
 			Post("/counter/{metricName}/{metricValue}", successURLResponse())
 		r.Post("/{metricType}/{metricName}/{metricValue}", func(w http.ResponseWriter, r *http.Request) {
 			message := fmt.Sprintf("unknown metric type: %s", chi.URLParam(r, "metricType"))
@@ -163,11 +804,18 @@ func initRouter(metricsStorage storage.MetricsStorage, converter *model.MetricsC
 	})
 
 	router.Route("/updates", func(r chi.Router) {
-		r.With(fillMultiJSONContext, updateMetrics(metricsStorage, converter)).
+		r.Use(rejectWrites(options.readOnly))
+		r.Use(options.authenticator.Require(auth.ScopeIngest))
+		r.Use(options.loadShedder.Limit(limiter.ClassIngest))
+		r.Use(waitRestore(options.restored))
+		r.With(fillMultiJSONContext, checkQuota(options.quotaLimiter), updateMetrics(metricsStorage, converter, options.registry)).
 			Post("/", successMultiJSONResponse())
 	})
 
 	router.Route("/value", func(r chi.Router) {
+		r.Use(options.authenticator.Require(auth.ScopeRead))
+		r.Use(options.loadShedder.Limit(limiter.ClassRead))
+		r.Use(waitRestore(options.restored))
 		r.With(fillSingleJSONContext, fillMetricValues(metricsStorage, converter)).
 			Post("/", successSingleJSONResponse())
 
@@ -175,18 +823,125 @@ func initRouter(metricsStorage storage.MetricsStorage, converter *model.MetricsC
 			Get("/{metricType}/{metricName}", successURLValueResponse(converter))
 	})
 
+	router.Route("/api/admin", func(r chi.Router) {
+		r.Use(options.authenticator.Require(auth.ScopeAdmin))
+		r.Get("/quotas", handleQuotaUsage(options.quotaLimiter))
+		r.Get("/limits", handleLimiterStats(options.loadShedder))
+		r.Get("/webhooks", handleWebhooks(options.webhooks))
+		r.With(rejectWrites(options.readOnly)).Post("/webhooks", handleAddWebhook(options.webhooks))
+		r.With(rejectWrites(options.readOnly)).Delete("/webhooks/{webhookID}", handleRemoveWebhook(options.webhooks))
+		r.Get("/webhooks/dead-letters", handleWebhookDeadLetters(options.webhooks))
+		r.With(rejectWrites(options.readOnly)).Delete("/metrics/{metricType}/{metricName}", handleDeleteMetric(metricsStorage, options.quotaLimiter))
+		r.Get("/snapshots", handleSnapshots(options.snapshots))
+		r.With(rejectWrites(options.readOnly), waitRestore(options.restored)).
+			Post("/snapshots/{snapshotID}/restore", handleRestoreSnapshot(options.snapshots))
+		r.With(waitRestore(options.restored)).Get("/export", handleExport(options.state))
+		r.With(rejectWrites(options.readOnly), waitRestore(options.restored)).
+			Post("/import", handleImport(options.state, options.quotaLimiter, options.replicator != nil))
+	})
+
+	// serves only the series owned by this node, so the requests of other nodes are never forwarded again
+	router.Route(cluster.MetricsPath, func(r chi.Router) {
+		r.Use(waitRestore(options.restored))
+		r.Use(options.authenticator.Require(auth.ScopeAdmin))
+		r.Get("/", handleClusterMetrics(options.clusterLocal, converter))
+		r.With(rejectWrites(options.readOnly)).Post("/", handleClusterWrite(options.clusterLocal, converter))
+		r.Get("/{metricType}/{metricName}", handleClusterMetric(options.clusterLocal, converter))
+		r.With(rejectWrites(options.readOnly)).Delete("/{metricType}/{metricName}", handleDeleteMetric(options.clusterLocal, options.quotaLimiter))
+	})
+
+	// restore replaces the memory state, so the peer mutations are applied after it
+	router.Route(replication.ApplyPath, func(r chi.Router) {
+		r.Use(rejectWrites(options.readOnly))
+		r.Use(waitRestore(options.restored))
+		r.Use(options.authenticator.Require(auth.ScopeAdmin))
+		r.Post("/", handleReplicationApply(options.replicator))
+	})
+
+	// streams are long-lived and limited by the broker instead of the load shedder
+	router.Route("/api/stream", func(r chi.Router) {
+		r.Use(waitRestore(options.restored))
+		r.Use(options.authenticator.Require(auth.ScopeRead))
+		r.Get("/", handleStream(options.broker, options.heartbeat))
+	})
+
+	router.Route("/federate", func(r chi.Router) {
+		r.Use(options.authenticator.Require(auth.ScopeRead))
+		r.Use(options.loadShedder.Limit(limiter.ClassRead))
+		r.Use(waitRestore(options.restored))
+		r.Get("/", handleFederate(metricsStorage, converter))
+	})
+
 	router.Route("/ping", func(r chi.Router) {
 		r.Get("/", handleDBPing(dbStorage))
 	})
 
+	router.Route("/internal/metrics", func(r chi.Router) {
+		r.Use(options.authenticator.Require(auth.ScopeAdmin))
+		r.Get("/", handleSelfMetrics(options.selfMetrics))
+	})
+
+	router.Get("/healthz", handleLiveness())
+	router.Get("/readyz", handleReadiness(options.healthChecker))
+
 	router.Route("/", func(r chi.Router) {
+		r.Use(options.authenticator.Require(auth.ScopeRead))
+		r.Use(options.loadShedder.Limit(limiter.ClassRead))
+		r.Use(waitRestore(options.restored))
 		r.Get("/", handleMetricsPage(htmlPageBuilder, metricsStorage))
 		r.Get("/metrics", handleMetricsPage(htmlPageBuilder, metricsStorage))
+		r.Get("/graph/{metricType}/{metricName}", handleGraph(metricsStorage))
 	})
 
 	return router
 }
 
+func fillAgentIdentity(allowedAgents []string) func(next http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, agent := range allowedAgents {
+		if agent = strings.TrimSpace(agent); agent != "" {
+			allowed[agent] = true
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			agent, ok := transport.PeerCommonName(r.TLS)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if len(allowed) > 0 && !allowed[agent] {
+				logger.SugarLogger.Errorf("Reject request from unknown agent: %v", agent)
+				http.Error(w, fmt.Sprintf("agent %s is not allowed", agent), http.StatusForbidden)
+				return
+			}
+
+			logger.SugarLogger.Debugf("Request %v %v from agent %v", r.Method, r.URL.Path, agent)
+			next.ServeHTTP(w, r.WithContext(identity.WithAgent(r.Context(), agent)))
+		})
+	}
+}
+
+func fillTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get(identity.TenantHeader)
+		if tenant == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := identity.ValidateTenant(tenant)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(identity.WithTenant(r.Context(), tenant)))
+	})
+}
+
 func fillCommonURLContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx, metricsContext := ensureMetricsContext(r)
@@ -325,12 +1080,57 @@ func fillMultiJSONContext(next http.Handler) http.Handler {
 	})
 }
 
-func updateMetrics(storage storage.MetricsStorage, converter *model.MetricsConverter) func(next http.Handler) http.Handler {
+func checkQuota(quotaLimiter *quota.QuotaLimiter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if quotaLimiter == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, metricsContext := ensureMetricsContext(r)
+			batch := make([]quota.Series, len(metricsContext.requestMetrics))
+			for i, requestMetric := range metricsContext.requestMetrics {
+				batch[i] = quota.Series{Type: requestMetric.MType, Name: requestMetric.ID}
+			}
+
+			tenant := identity.Tenant(ctx)
+			agent, _ := identity.Agent(ctx)
+			err := quotaLimiter.Admit(tenant, agent, batch)
+
+			var errExceeded *quota.ExceededError
+			if errors.As(err, &errExceeded) {
+				logger.SugarLogger.Errorf("Reject update from tenant %v agent %v: %v", tenant, agent, err)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(errExceeded.RetryAfter.Seconds()))))
+				http.Error(w, errExceeded.Error(), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+
+			// the result metrics are set once the batch is stored, the failed writes charge no series
+			if metricsContext.resultMetrics != nil {
+				quotaLimiter.Charge(tenant, agent, batch)
+			}
+		})
+	}
+}
+
+func updateMetrics(storage storage.MetricsStorage, converter *model.MetricsConverter, registry *selfmetrics.Registry) func(next http.Handler) http.Handler {
+	batchSize := registry.Histogram("UpdateBatchSize", selfmetrics.BatchSizeBuckets)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx, metricsContext := ensureMetricsContext(r)
+			batchSize.Observe(float64(len(metricsContext.requestMetrics)))
+
 			metricsList := make([]metrics.Metric, len(metricsContext.requestMetrics))
 			for i, metricContext := range metricsContext.requestMetrics {
+				if strings.HasPrefix(metricContext.ID, selfmetrics.ReservedPrefix) {
+					message := fmt.Sprintf("metric name prefix %s is reserved", selfmetrics.ReservedPrefix)
+					logger.SugarLogger.Errorf("Fail to update metric %v: %v", metricContext.ID, message)
+					http.Error(w, message, http.StatusBadRequest)
+					return
+				}
+
 				metric, err := converter.FromModelMetric(metricContext)
 				if err != nil {
 					logger.SugarLogger.Errorf("Fail to parse metric: %v", err)
@@ -349,7 +1149,13 @@ func updateMetrics(storage storage.MetricsStorage, converter *model.MetricsConve
 
 			resultMetrics, err := storage.AddMetricValues(ctx, metricsList)
 			if err != nil {
-				http.Error(w, logger.WrapError("update metric", err).Error(), http.StatusInternalServerError)
+				status := http.StatusInternalServerError
+				if errors.Is(err, relay.ErrQueueFull) {
+					w.Header().Set("Retry-After", "1")
+					status = http.StatusServiceUnavailable
+				}
+
+				http.Error(w, logger.WrapError("update metric", err).Error(), status)
 				return
 			}
 
@@ -361,7 +1167,8 @@ func updateMetrics(storage storage.MetricsStorage, converter *model.MetricsConve
 					return
 				}
 
-				logger.SugarLogger.Errorf("Updated metric: %v. newValue: %v", resultMetric.GetName(), newValue)
+				agent, _ := identity.Agent(ctx)
+				logger.SugarLogger.Errorf("Updated metric: %v. newValue: %v. agent: %v. tenant: %v", resultMetric.GetName(), newValue, agent, identity.Tenant(ctx))
 				metricsContext.resultMetrics[i] = newValue
 			}
 
@@ -417,74 +1224,894 @@ func successURLValueResponse(converter *model.MetricsConverter) func(w http.Resp
 	}
 }
 
-func handleMetricsPage(builder html.HTMLPageBuilder, storage storage.MetricsStorage) func(w http.ResponseWriter, r *http.Request) {
+func handleMetricsPage(builder html.HTMLPageBuilder, metricsStorage storage.MetricsStorage) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		values, err := storage.GetMetricValues(r.Context())
+		values, err := metricsStorage.GetMetricValues(r.Context())
 		if err != nil {
 			http.Error(w, logger.WrapError("get metric values", err).Error(), http.StatusInternalServerError)
 			return
 		}
-		successResponse(w, "text/html", builder.BuildMetricsPage(values))
-	}
-}
 
-func successURLResponse() func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		successResponse(w, "text/plain", "ok")
-	}
-}
+		options := html.PageOptions{
+			Tenant:      identity.Tenant(r.Context()),
+			GeneratedAt: time.Now(),
+		}
 
-func successSingleJSONResponse() func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		_, metricsContext := ensureMetricsContext(r)
+		if refresh := r.URL.Query().Get("refresh"); refresh != "" {
+			seconds, err := strconv.Atoi(refresh)
+			if err != nil || seconds < 0 || seconds > maxPageRefreshSeconds {
+				http.Error(w, fmt.Sprintf("refresh must be a number of seconds from 0 to %d", maxPageRefreshSeconds), http.StatusBadRequest)
+				return
+			}
+
+			options.RefreshInterval = time.Duration(seconds) * time.Second
+		}
+
+		if history, ok := metricsStorage.(storage.HistoryStorage); ok {
+			// the whole history is read for the update times of the metrics unchanged for the graph range,
+			// the zero time is out of the UnixNano range
+			samples, err := history.GetHistory(r.Context(), time.Unix(0, 0))
+			if err != nil && !errors.Is(err, metrics.ErrHistoryNotSupported) {
+				logger.SugarLogger.Errorf("failed to get metrics history: %v", err)
+			}
+			if err == nil {
+				options.History, options.UpdatedAt = splitHistory(samples, options.GeneratedAt.Add(-defaultGraphRange))
+			}
+		}
+
+		successResponse(w, "text/html", builder.BuildMetricsPage(values, options))
+	}
+}
+
+// splitHistory returns the samples not older than since and the time of the last sample of every series.
+func splitHistory(history map[string]map[string][]storage.Sample, since time.Time) (map[string]map[string][]storage.Sample, map[string]map[string]time.Time) {
+	recent := map[string]map[string][]storage.Sample{}
+	updatedAt := map[string]map[string]time.Time{}
+	for metricType, samplesByName := range history {
+		recent[metricType] = map[string][]storage.Sample{}
+		updatedAt[metricType] = map[string]time.Time{}
+		for metricName, samples := range samplesByName {
+			if len(samples) == 0 {
+				continue
+			}
+
+			updatedAt[metricType][metricName] = samples[len(samples)-1].Time
+			first := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(since) })
+			recent[metricType][metricName] = samples[first:]
+		}
+	}
+
+	return recent, updatedAt
+}
+
+func successURLResponse() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successResponse(w, "text/plain", "ok")
+	}
+}
+
+func successSingleJSONResponse() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, metricsContext := ensureMetricsContext(r)
+
+		if len(metricsContext.resultMetrics) != 1 {
+			logger.SugarLogger.Error("successSingleJSONResponse: wrong context")
+			http.Error(w, "successSingleJSONResponse: wrong context", http.StatusInternalServerError)
+			return
+		}
+
+		result, err := json.Marshal(metricsContext.resultMetrics[0])
+		if err != nil {
+			http.Error(w, logger.WrapError("serialise result", err).Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(result)
+		if err != nil {
+			logger.SugarLogger.Errorf("failed to write response: %v", err)
+		}
+	}
+}
+
+func successMultiJSONResponse() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		stubResult := &model.Metrics{}
+		result, err := json.Marshal(stubResult)
+		if err != nil {
+			http.Error(w, logger.WrapError("serialise result", err).Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(result)
+		if err != nil {
+			logger.SugarLogger.Errorf("failed to write response: %v", err)
+		}
+	}
+}
+
+func successResponse(w http.ResponseWriter, contentType string, message string) {
+	w.Header().Add("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte(message))
+	if err != nil {
+		logger.SugarLogger.Errorf("failed to write response: %v", err)
+	}
+}
+
+func handleQuotaUsage(quotaLimiter *quota.QuotaLimiter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := struct {
+			Usage    []quota.Usage    `json:"usage"`
+			Rejected map[string]int64 `json:"rejected"`
+		}{Usage: []quota.Usage{}, Rejected: map[string]int64{}}
+
+		if quotaLimiter != nil {
+			result.Usage = quotaLimiter.Usage()
+			result.Rejected = quotaLimiter.Rejected()
+		}
+
+		successJSONResponse(w, result)
+	}
+}
+
+func handleLimiterStats(loadShedder *limiter.LoadShedder) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successJSONResponse(w, loadShedder.Stats())
+	}
+}
+
+// handleFederate exports the current values of the series selected by the match parameters.
+func handleFederate(metricsStorage storage.MetricsStorage, converter *model.MetricsConverter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		matcher, err := federation.NewMatcher(r.URL.Query()["match"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		metricsList, err := federation.Export(r.Context(), metricsStorage, matcher)
+		if err != nil {
+			http.Error(w, logger.WrapError("export metrics", err).Error(), http.StatusInternalServerError)
+			return
+		}
+
+		metricsJSONResponse(w, converter, metricsList)
+	}
+}
+
+func handleWebhooks(webhooks *webhook.Dispatcher) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if webhooks == nil {
+			http.Error(w, "webhooks are not supported", http.StatusNotImplemented)
+			return
+		}
+
+		successJSONResponse(w, webhooks.Subscriptions(identity.Tenant(r.Context())))
+	}
+}
+
+// handleAddWebhook creates the subscription for the request tenant, the response holds the only copy of the secret.
+func handleAddWebhook(webhooks *webhook.Dispatcher) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if webhooks == nil {
+			http.Error(w, "webhooks are not supported", http.StatusNotImplemented)
+			return
+		}
+
+		subscription := &webhook.Subscription{}
+		err := json.NewDecoder(r.Body).Decode(subscription)
+		if err != nil {
+			http.Error(w, logger.WrapError("decode webhook", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		subscription.ID = ""
+		subscription.Tenant = identity.Tenant(r.Context())
+		result, err := webhooks.AddSubscription(r.Context(), subscription)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, webhook.ErrInvalidSubscription) {
+				status = http.StatusBadRequest
+			}
+
+			http.Error(w, logger.WrapError("add webhook", err).Error(), status)
+			return
+		}
+
+		jsonResponse(w, http.StatusCreated, result)
+	}
+}
+
+func handleRemoveWebhook(webhooks *webhook.Dispatcher) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if webhooks == nil {
+			http.Error(w, "webhooks are not supported", http.StatusNotImplemented)
+			return
+		}
+
+		err := webhooks.RemoveSubscription(r.Context(), identity.Tenant(r.Context()), chi.URLParam(r, "webhookID"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, webhook.ErrSubscriptionNotFound) {
+				status = http.StatusNotFound
+			}
+
+			http.Error(w, logger.WrapError("remove webhook", err).Error(), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleWebhookDeadLetters(webhooks *webhook.Dispatcher) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if webhooks == nil {
+			http.Error(w, "webhooks are not supported", http.StatusNotImplemented)
+			return
+		}
+
+		successJSONResponse(w, webhooks.DeadLetters(identity.Tenant(r.Context())))
+	}
+}
+
+func handleDeleteMetric(metricsStorage storage.MetricsStorage, quotaLimiter *quota.QuotaLimiter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deleter, ok := metricsStorage.(storage.MetricsDeleter)
+		if !ok {
+			http.Error(w, metrics.ErrDeleteNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		series := quota.Series{Type: chi.URLParam(r, "metricType"), Name: chi.URLParam(r, "metricName")}
+		err := deleter.DeleteMetric(r.Context(), series.Type, series.Name)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, metrics.ErrMetricNotFound) {
+				status = http.StatusNotFound
+			} else if errors.Is(err, metrics.ErrDeleteNotSupported) {
+				status = http.StatusNotImplemented
+			}
+
+			http.Error(w, logger.WrapError("delete metric", err).Error(), status)
+			return
+		}
+
+		if quotaLimiter != nil {
+			quotaLimiter.Release(identity.Tenant(r.Context()), series)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleSnapshots(snapshots storage.SnapshotStorage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if snapshots == nil {
+			http.Error(w, metrics.ErrSnapshotsNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		list, err := snapshots.ListSnapshots(r.Context())
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, metrics.ErrSnapshotsNotSupported) {
+				status = http.StatusNotImplemented
+			}
+
+			http.Error(w, logger.WrapError("list snapshots", err).Error(), status)
+			return
+		}
+
+		successJSONResponse(w, list)
+	}
+}
+
+// handleRestoreSnapshot replaces the state of all tenants, so it requires a token not bound to a tenant.
+func handleRestoreSnapshot(snapshots storage.SnapshotStorage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if snapshots == nil {
+			http.Error(w, metrics.ErrSnapshotsNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		if token, ok := auth.TokenFromContext(r.Context()); ok && token.Tenant != "" {
+			http.Error(w, "snapshot restore requires a token not bound to a tenant", http.StatusForbidden)
+			return
+		}
+
+		err := snapshots.RestoreSnapshot(r.Context(), chi.URLParam(r, "snapshotID"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, metrics.ErrSnapshotNotFound) {
+				status = http.StatusNotFound
+			} else if errors.Is(err, metrics.ErrSnapshotsNotSupported) {
+				status = http.StatusNotImplemented
+			}
+
+			http.Error(w, logger.WrapError("restore snapshot", err).Error(), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleExport streams the state of all tenants, so it requires a token not bound to a tenant.
+func handleExport(state storage.StateStorage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if state == nil {
+			http.Error(w, "export is not supported", http.StatusNotImplemented)
+			return
+		}
+
+		if token, ok := auth.TokenFromContext(r.Context()); ok && token.Tenant != "" {
+			http.Error(w, "export requires a token not bound to a tenant", http.StatusForbidden)
+			return
+		}
+
+		format := dump.Format(r.URL.Query().Get("format"))
+		if format == "" {
+			format = dump.FormatNDJSON
+		}
+
+		err := format.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="metrics.%s"`, format))
+		w.WriteHeader(http.StatusOK)
+
+		// the status is already sent, so a failed export is only logged and leaves the dump truncated
+		err = dump.Export(r.Context(), state, format, w)
+		if err != nil {
+			logger.SugarLogger.Errorf("failed to export metrics: %v", err)
+		}
+	}
+}
+
+// handleImport applies a dump of any tenants, so it requires a token not bound to a tenant.
+// The format is taken from the format parameter or from the content type, NDJSON by default.
+// The import bypasses the replication log, so it is rejected when replication is enabled.
+// The quota usage is seeded again from the imported state.
+func handleImport(state storage.StateStorage, quotaLimiter *quota.QuotaLimiter, replicated bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if state == nil {
+			http.Error(w, "import is not supported", http.StatusNotImplemented)
+			return
+		}
+
+		if replicated {
+			http.Error(w, errImportReplicated.Error(), http.StatusConflict)
+			return
+		}
+
+		if token, ok := auth.TokenFromContext(r.Context()); ok && token.Tenant != "" {
+			http.Error(w, "import requires a token not bound to a tenant", http.StatusForbidden)
+			return
+		}
+
+		format := dump.Format(r.URL.Query().Get("format"))
+		if format == "" {
+			format = dump.FormatNDJSON
+			if r.Header.Get("Content-Type") == dump.FormatTar.ContentType() {
+				format = dump.FormatTar
+			}
+		}
+
+		mode := dump.Mode(r.URL.Query().Get("mode"))
+		if mode == "" {
+			mode = dump.ModeMerge
+		}
+
+		err := format.Validate()
+		if err == nil {
+			err = mode.Validate()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var reader io.Reader = r.Body
+		if r.Header.Get(`Content-Encoding`) == `gzip` {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, logger.WrapError("create gzip reader", err).Error(), http.StatusBadRequest)
+				return
+			}
+			reader = gz
+			defer gz.Close()
+		}
+
+		values, count, err := dump.Read(format, reader)
+		if err != nil {
+			http.Error(w, logger.WrapError("read dump", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = state.ImportMetricValues(r.Context(), values, mode == dump.ModeReplace)
+		if err != nil {
+			http.Error(w, logger.WrapError("import metrics", err).Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if quotaLimiter != nil {
+			err = seedQuota(r.Context(), quotaLimiter, state)
+			if err != nil {
+				http.Error(w, logger.WrapError("seed quota usage", err).Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		successJSONResponse(w, &importResult{Mode: mode, Tenants: len(values), Series: count})
+	}
+}
+
+func handleClusterMetrics(local storage.MetricsStorage, converter *model.MetricsConverter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if local == nil {
+			http.Error(w, "cluster mode is not enabled", http.StatusNotImplemented)
+			return
+		}
+
+		metricsList, err := listMetrics(r.Context(), local)
+		if err != nil {
+			http.Error(w, logger.WrapError("list metrics", err).Error(), http.StatusInternalServerError)
+			return
+		}
+
+		metricsJSONResponse(w, converter, metricsList)
+	}
+}
+
+// listMetrics returns every series of the tenant sorted by type and name.
+func listMetrics(ctx context.Context, metricsStorage storage.MetricsStorage) ([]metrics.Metric, error) {
+	values, err := metricsStorage.GetMetricValues(ctx)
+	if err != nil {
+		return nil, logger.WrapError("get metric values", err)
+	}
+
+	result := []metrics.Metric{}
+	for metricType, metricValues := range values {
+		metricFactory := types.NewGaugeMetric
+		if metricType == "counter" {
+			metricFactory = types.NewCounterMetric
+		}
+
+		for name, value := range metricValues {
+			floatValue, err := converter.ToFloat64(value)
+			if err != nil {
+				return nil, logger.WrapError("parse metric value", err)
+			}
+
+			metric := metricFactory(name)
+			metric.SetValue(floatValue)
+			result = append(result, metric)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].GetType() != result[j].GetType() {
+			return result[i].GetType() < result[j].GetType()
+		}
+		return result[i].GetName() < result[j].GetName()
+	})
+
+	return result, nil
+}
+
+func handleClusterWrite(local storage.MetricsStorage, converter *model.MetricsConverter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if local == nil {
+			http.Error(w, "cluster mode is not enabled", http.StatusNotImplemented)
+			return
+		}
+
+		modelMetrics := []*model.Metrics{}
+		err := json.NewDecoder(r.Body).Decode(&modelMetrics)
+		if err != nil {
+			http.Error(w, logger.WrapError("decode metrics", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		metricsList := make([]metrics.Metric, len(modelMetrics))
+		for i, modelMetric := range modelMetrics {
+			metricsList[i], err = converter.FromModelMetric(modelMetric)
+			if err != nil {
+				http.Error(w, logger.WrapError("convert metric", err).Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		result, err := local.AddMetricValues(r.Context(), metricsList)
+		if err != nil {
+			http.Error(w, logger.WrapError("update metrics", err).Error(), http.StatusInternalServerError)
+			return
+		}
+
+		metricsJSONResponse(w, converter, result)
+	}
+}
+
+func handleClusterMetric(local storage.MetricsStorage, converter *model.MetricsConverter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if local == nil {
+			http.Error(w, "cluster mode is not enabled", http.StatusNotImplemented)
+			return
+		}
+
+		metric, err := local.GetMetric(r.Context(), chi.URLParam(r, "metricType"), chi.URLParam(r, "metricName"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, metrics.ErrMetricNotFound) {
+				status = http.StatusNotFound
+			}
+
+			http.Error(w, logger.WrapError("get metric", err).Error(), status)
+			return
+		}
+
+		result, err := converter.ToModelMetric(metric)
+		if err != nil {
+			http.Error(w, logger.WrapError("convert metric", err).Error(), http.StatusInternalServerError)
+			return
+		}
+
+		successJSONResponse(w, result)
+	}
+}
+
+func metricsJSONResponse(w http.ResponseWriter, converter *model.MetricsConverter, metricsList []metrics.Metric) {
+	result := make([]*model.Metrics, len(metricsList))
+	for i, metric := range metricsList {
+		modelMetric, err := converter.ToModelMetric(metric)
+		if err != nil {
+			http.Error(w, logger.WrapError("convert metric", err).Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result[i] = modelMetric
+	}
+
+	successJSONResponse(w, result)
+}
+
+// handleReplicationApply applies the mutations of a peer, they carry tenants, so a tenant bound token is rejected.
+func handleReplicationApply(replicator *replication.Replicator) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if replicator == nil {
+			http.Error(w, "replication is not enabled", http.StatusNotImplemented)
+			return
+		}
 
-		if len(metricsContext.resultMetrics) != 1 {
-			logger.SugarLogger.Error("successSingleJSONResponse: wrong context")
-			http.Error(w, "successSingleJSONResponse: wrong context", http.StatusInternalServerError)
+		if token, ok := auth.TokenFromContext(r.Context()); ok && token.Tenant != "" {
+			http.Error(w, "replication requires a token not bound to a tenant", http.StatusForbidden)
 			return
 		}
 
-		result, err := json.Marshal(metricsContext.resultMetrics[0])
+		request := &replication.ApplyRequest{}
+		err := json.NewDecoder(r.Body).Decode(request)
 		if err != nil {
-			http.Error(w, logger.WrapError("serialise result", err).Error(), http.StatusInternalServerError)
+			http.Error(w, logger.WrapError("decode mutations", err).Error(), http.StatusBadRequest)
 			return
 		}
 
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write(result)
+		applied, err := replicator.Apply(r.Context(), request)
 		if err != nil {
-			logger.SugarLogger.Errorf("failed to write response: %v", err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, replication.ErrInvalidNodeID) || errors.Is(err, replication.ErrOwnMutations) || errors.Is(err, replication.ErrUnknownOperation) {
+				status = http.StatusBadRequest
+			}
+
+			http.Error(w, logger.WrapError("apply mutations", err).Error(), status)
+			return
 		}
+
+		successJSONResponse(w, &replication.ApplyResponse{Applied: applied})
 	}
 }
 
-func successMultiJSONResponse() func(w http.ResponseWriter, r *http.Request) {
+func successJSONResponse(w http.ResponseWriter, value any) {
+	jsonResponse(w, http.StatusOK, value)
+}
+
+func jsonResponse(w http.ResponseWriter, status int, value any) {
+	result, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, logger.WrapError("serialise result", err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(result)
+	if err != nil {
+		logger.SugarLogger.Errorf("failed to write response: %v", err)
+	}
+}
+
+// exportSelfMetrics stores self metrics to the default tenant as gauges with the reserved name prefix.
+func exportSelfMetrics(metricsStorage storage.MetricsStorage, provider metrics.MetricsProvider) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		metricsList := []metrics.Metric{}
+		for metric := range provider.GetMetrics() {
+			selfMetric := types.NewGaugeMetric(selfmetrics.ReservedPrefix + metric.GetName())
+			selfMetric.SetValue(metric.GetValue())
+			metricsList = append(metricsList, selfMetric)
+		}
+
+		if len(metricsList) == 0 {
+			return nil
+		}
+
+		_, err := metricsStorage.AddMetricValues(ctx, metricsList)
+		if err != nil {
+			return logger.WrapError("store self metrics", err)
+		}
+
+		return nil
+	}
+}
+
+// seedQuota sets the tenant series to the stored ones, the self metrics are not charged.
+func seedQuota(ctx context.Context, quotaLimiter *quota.QuotaLimiter, metricsStorage storage.MetricsStorage) error {
+	tenants, err := metricsStorage.GetTenants(ctx)
+	if err != nil {
+		return logger.WrapError("get tenants", err)
+	}
+
+	for _, tenant := range tenants {
+		values, err := metricsStorage.GetMetricValues(identity.WithTenant(ctx, tenant))
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("get tenant %s metrics", tenant), err)
+		}
+
+		batch := []quota.Series{}
+		for metricType, metricsByName := range values {
+			for metricName := range metricsByName {
+				if !strings.HasPrefix(metricName, selfmetrics.ReservedPrefix) {
+					batch = append(batch, quota.Series{Type: metricType, Name: metricName})
+				}
+			}
+		}
+
+		quotaLimiter.Seed(tenant, batch)
+	}
+
+	return nil
+}
+
+func handleSelfMetrics(provider metrics.MetricsProvider) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		lines := []string{}
+		if provider != nil {
+			for metric := range provider.GetMetrics() {
+				lines = append(lines, metric.GetName()+" "+metric.GetStringValue())
+			}
+		}
+		sort.Strings(lines)
 
-		stubResult := &model.Metrics{}
-		result, err := json.Marshal(stubResult)
+		successResponse(w, "text/plain", strings.Join(lines, "\n"))
+	}
+}
+
+func handleGraph(metricsStorage storage.MetricsStorage) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history, ok := metricsStorage.(storage.HistoryStorage)
+		if !ok {
+			http.Error(w, metrics.ErrHistoryNotSupported.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		graphRange := defaultGraphRange
+		if rangeParam := r.URL.Query().Get("range"); rangeParam != "" {
+			var err error
+			graphRange, err = time.ParseDuration(rangeParam)
+			if err != nil || graphRange <= 0 {
+				http.Error(w, "range must be a positive duration, e.g. 15m or 1h", http.StatusBadRequest)
+				return
+			}
+		}
+
+		metricType := chi.URLParam(r, "metricType")
+		metricName := chi.URLParam(r, "metricName")
+		samples, err := history.GetMetricHistory(r.Context(), metricType, metricName, time.Now().Add(-graphRange))
 		if err != nil {
-			http.Error(w, logger.WrapError("serialise result", err).Error(), http.StatusInternalServerError)
+			status := http.StatusInternalServerError
+			if errors.Is(err, metrics.ErrMetricNotFound) {
+				status = http.StatusNotFound
+			} else if errors.Is(err, metrics.ErrHistoryNotSupported) {
+				status = http.StatusNotImplemented
+			}
+
+			http.Error(w, logger.WrapError("get metric history", err).Error(), status)
 			return
 		}
 
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write(result)
+		successResponse(w, "image/svg+xml", html.RenderLineChart(samples, html.ChartOptions{
+			Title:  fmt.Sprintf("%s (%s), last %v", metricName, metricType, graphRange),
+			Width:  graphWidth,
+			Height: graphHeight,
+		}))
+	}
+}
+
+// handleStream sends the tenant metric changes as Server-Sent Events, filtered by the name and type query parameters.
+func handleStream(broker *stream.Broker, heartbeat time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if broker == nil || !ok {
+			http.Error(w, "metrics streaming is not supported", http.StatusNotImplemented)
+			return
+		}
+
+		var lastEventID uint64
+		if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+			var err error
+			lastEventID, err = strconv.ParseUint(lastID, 10, 64)
+			if err != nil {
+				http.Error(w, "Last-Event-ID must be an event id", http.StatusBadRequest)
+				return
+			}
+		}
+
+		query := r.URL.Query()
+		filter := stream.NewFilter(identity.Tenant(r.Context()), query["name"], query["type"])
+		subscription, err := broker.Subscribe(filter, lastEventID)
 		if err != nil {
-			logger.SugarLogger.Errorf("failed to write response: %v", err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, logger.WrapError("subscribe to metric changes", err).Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer broker.Unsubscribe(subscription)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		if subscription.Missed() {
+			// the client should reload the current values, the stream continues after the kept events
+			writeStreamMessage(w, "event: reset\ndata: {}\n\n")
+		}
+		for _, event := range subscription.Replay() {
+			writeStreamEvent(w, &event)
+		}
+		flusher.Flush()
+
+		if heartbeat <= 0 {
+			heartbeat = defaultStreamHeartbeat
+		}
+		heartbeatTicker := time.NewTicker(heartbeat)
+		defer heartbeatTicker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeatTicker.C:
+				writeStreamMessage(w, ": heartbeat\n\n")
+			case event, ok := <-subscription.Events():
+				if !ok {
+					if subscription.Lagged() {
+						logger.SugarLogger.Errorf("Metrics stream subscriber is too slow, close the stream")
+					}
+					return
+				}
+
+				writeStreamEvent(w, &event)
+			}
+
+			flusher.Flush()
 		}
 	}
 }
 
-func successResponse(w http.ResponseWriter, contentType string, message string) {
-	w.Header().Add("Content-Type", contentType)
-	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte(message))
+func writeStreamEvent(w http.ResponseWriter, event *stream.Event) {
+	data, err := json.Marshal(&streamEvent{
+		Name:      event.Name,
+		Type:      event.Type,
+		Value:     event.Value,
+		Tenant:    event.Tenant,
+		Timestamp: event.Time,
+	})
 	if err != nil {
-		logger.SugarLogger.Errorf("failed to write response: %v", err)
+		logger.SugarLogger.Errorf("failed to serialise stream event: %v", err)
+		return
+	}
+
+	writeStreamMessage(w, fmt.Sprintf("id: %d\nevent: metric\ndata: %s\n\n", event.ID, data))
+}
+
+func writeStreamMessage(w http.ResponseWriter, message string) {
+	_, err := io.WriteString(w, message)
+	if err != nil {
+		logger.SugarLogger.Errorf("failed to write stream message: %v", err)
+	}
+}
+
+func handleLiveness() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successResponse(w, "application/json", `{"status":"alive"}`)
+	}
+}
+
+func handleReadiness(healthChecker *health.Checker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := healthChecker.Check(r.Context())
+		if report.Ready() {
+			jsonResponse(w, http.StatusOK, report)
+			return
+		}
+
+		logger.SugarLogger.Errorf("Server is not ready: %v", report.Components)
+		jsonResponse(w, http.StatusServiceUnavailable, report)
+	}
+}
+
+func waitRestore(restored *health.Latch) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !restored.IsDone() {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "restore from backup in progress", http.StatusServiceUnavailable)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rejectWrites answers 405 to the metric writes of a read-only follower.
+func rejectWrites(readOnly bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !readOnly {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "server is a read-only follower", http.StatusMethodNotAllowed)
+		})
+	}
+}
+
+func createHealthChecker(conf *config, base database.DataBase, storageStrategy *storage.StorageStrategy, restored *health.Latch, elector *leader.Elector, primary *follower.Follower) *health.Checker {
+	healthChecker := health.NewChecker(time.Duration(conf.ReadinessTimeout) * time.Second)
+	healthChecker.Add("restore", restored.Check)
+
+	if primary != nil {
+		// a follower has no backup of its own
+		healthChecker.AddWithDetail("follower", primary.Check)
+		return healthChecker
 	}
+
+	if conf.DB != "" {
+		healthChecker.Add("database", base.Ping)
+	} else if conf.StoreFile != "" {
+		healthChecker.Add("backup_storage", health.FileWritable(conf.StoreFile))
+	}
+
+	if !conf.SyncMode() {
+		// a backup may be missed once, e.g. on a short database outage
+		maxAge := 2*time.Duration(conf.StoreInterval)*time.Second + time.Duration(conf.ReadinessTimeout)*time.Second
+		healthChecker.Add("last_backup", health.Freshness(storageStrategy.LastBackup, maxAge))
+	}
+
+	if elector != nil {
+		healthChecker.AddWithDetail("leader", elector.Check)
+	}
+
+	return healthChecker
 }
 
 func handleDBPing(dbStorage database.DataBase) func(w http.ResponseWriter, r *http.Request) {
@@ -514,13 +2141,41 @@ func (c *config) StoreFilePath() string {
 	return c.StoreFile
 }
 
+func (c *config) StoreEncoding() file.Encoding {
+	return file.Encoding(c.StoreFormat)
+}
+
+func (c *config) StoreKeyring() *file.Keyring {
+	return c.keyring
+}
+
+func (c *config) StoreFsyncPolicy() file.FsyncPolicy {
+	return file.FsyncPolicy(c.StoreFsync)
+}
+
+func (c *config) StoreFsyncInterval() time.Duration {
+	return time.Duration(c.StoreFsyncMillis) * time.Millisecond
+}
+
+func (c *config) StoreSnapshotThreshold() int {
+	return c.StoreSnapshotEvery
+}
+
+func (c *config) StoreKeepHourly() int {
+	return c.StoreHourly
+}
+
+func (c *config) StoreKeepDaily() int {
+	return c.StoreDaily
+}
+
 func (c *config) SyncMode() bool {
 	return c.DB != "" || c.StoreInterval == 0
 }
 
 func (c *config) String() string {
-	return fmt.Sprintf("\nServerURL:\t%v\nStoreInterval:\t%v\nStoreFile:\t%v\nRestore:\t%v\nDb:\t%v",
-		c.ServerURL, c.StoreInterval, c.StoreFile, c.Restore, c.DB)
+	return fmt.Sprintf("\nServerURL:\t%v\nStoreInterval:\t%v\nStoreFile:\t%v\nRestore:\t%v\nDb:\t%v\nTLSCert:\t%v\nTLSClientCA:\t%v",
+		c.ServerURL, c.StoreInterval, c.StoreFile, c.Restore, c.DB, c.TLSCert, c.TLSClientCA)
 }
 
 func (c *config) GetKey() []byte {
@@ -534,3 +2189,183 @@ func (c *config) SignMetrics() bool {
 func (c *config) GetConnectionString() string {
 	return c.DB
 }
+
+func (c *config) MaxSeriesPerTenant() int {
+	return c.QuotaTenantSeries
+}
+
+func (c *config) MaxSeriesPerAgent() int {
+	return c.QuotaAgentSeries
+}
+
+func (c *config) MaxSamplesPerTenant() int {
+	return c.QuotaTenantSamples
+}
+
+func (c *config) MaxSamplesPerAgent() int {
+	return c.QuotaAgentSamples
+}
+
+func (c *config) MaxBatchSize() int {
+	return c.QuotaBatchSize
+}
+
+func (c *config) MaxIngestInFlight() int {
+	return c.IngestInFlight
+}
+
+func (c *config) IngestRequestsPerSecond() int {
+	return c.IngestRate
+}
+
+func (c *config) IngestBurst() int {
+	return c.IngestBurstMax
+}
+
+func (c *config) MaxReadInFlight() int {
+	return c.ReadInFlight
+}
+
+func (c *config) WebhookQueueSize() int {
+	return c.WebhookQueue
+}
+
+func (c *config) WebhookWorkers() int {
+	return c.WebhookWorkerCount
+}
+
+func (c *config) WebhookMaxAttempts() int {
+	return c.WebhookAttempts
+}
+
+func (c *config) WebhookTimeout() time.Duration {
+	return time.Duration(c.WebhookTimeoutSec) * time.Second
+}
+
+func (c *config) FederationUpstreams() []string {
+	return c.Upstreams
+}
+
+func (c *config) FederationMatch() []string {
+	if len(c.FederateMatch) == 0 {
+		return []string{"*"}
+	}
+
+	return c.FederateMatch
+}
+
+func (c *config) FederationToken() string {
+	return c.FederateToken
+}
+
+func (c *config) FederationTimeout() time.Duration {
+	return time.Duration(c.FederateTimeoutSec) * time.Second
+}
+
+func (c *config) RelayUpstreamURL() string {
+	return c.RelayUpstream
+}
+
+func (c *config) RelayAPIToken() string {
+	return c.RelayToken
+}
+
+func (c *config) RelayPushTimeout() time.Duration {
+	return time.Duration(c.RelayTimeoutSec) * time.Second
+}
+
+func (c *config) RelayTLSCAFile() string {
+	return c.RelayCA
+}
+
+func (c *config) RelayTLSCertFile() string {
+	return c.RelayCert
+}
+
+func (c *config) RelayTLSKeyFile() string {
+	return c.RelayKey
+}
+
+func (c *config) RelayBatchSize() int {
+	return c.RelayBatch
+}
+
+func (c *config) LeaderLockKey() int64 {
+	return c.LeaderKey
+}
+
+func (c *config) LeaderLease() time.Duration {
+	return time.Duration(c.LeaderLeaseSec) * time.Second
+}
+
+func (c *config) FollowFile() string {
+	return c.FollowPath
+}
+
+func (c *config) FollowMaxLag() time.Duration {
+	return time.Duration(c.FollowMaxLagSec) * time.Second
+}
+
+func (c *config) ClusterConfigFile() string {
+	return c.ClusterFile
+}
+
+func (c *config) ClusterNodeID() string {
+	return c.ClusterID
+}
+
+func (c *config) ClusterToken() string {
+	return c.ClusterSecret
+}
+
+func (c *config) ClusterTimeout() time.Duration {
+	return time.Duration(c.ClusterTimeoutSec) * time.Second
+}
+
+func (c *config) ReplicationNodeID() string {
+	return c.NodeID
+}
+
+func (c *config) ReplicationPeers() []string {
+	return c.Peers
+}
+
+func (c *config) ReplicationDir() string {
+	return c.ReplicaDir
+}
+
+func (c *config) ReplicationRetention() int {
+	return c.ReplicaRetention
+}
+
+func (c *config) ReplicationBatchSize() int {
+	return c.ReplicaBatch
+}
+
+func (c *config) ReplicationToken() string {
+	return c.ReplicaToken
+}
+
+func (c *config) ReplicationTimeout() time.Duration {
+	return time.Duration(c.ReplicaTimeoutSec) * time.Second
+}
+
+func (c *config) StreamReplaySize() int {
+	return c.StreamReplay
+}
+
+func (c *config) StreamMaxSubscribers() int {
+	return c.StreamSubscribers
+}
+
+func (c *config) TLSCertFile() string {
+	return c.TLSCert
+}
+
+func (c *config) TLSKeyFile() string {
+	return c.TLSKey
+}
+
+func (c *config) TLSClientCAFile() string {
+	return c.TLSClientCA
+}
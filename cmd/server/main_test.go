@@ -1,29 +1,49 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/MlDenis/prometheus_wannabe/internal/auth"
+	"github.com/MlDenis/prometheus_wannabe/internal/cluster"
 	"github.com/MlDenis/prometheus_wannabe/internal/converter"
 	"github.com/MlDenis/prometheus_wannabe/internal/database"
+	"github.com/MlDenis/prometheus_wannabe/internal/follower"
 	"github.com/MlDenis/prometheus_wannabe/internal/hash"
+	"github.com/MlDenis/prometheus_wannabe/internal/health"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/limiter"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/html"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/file"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+	"github.com/MlDenis/prometheus_wannabe/internal/quota"
+	"github.com/MlDenis/prometheus_wannabe/internal/replication"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/stream"
+	"github.com/MlDenis/prometheus_wannabe/internal/webhook"
 
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type callResult struct {
@@ -62,6 +82,14 @@ type testConf struct {
 
 type testDBStorage struct{}
 
+type testFollowerConf struct {
+	path string
+}
+
+type testTokenStore struct {
+	tokens map[string]*auth.Token
+}
+
 func Test_UpdateUrlRequest(t *testing.T) {
 	tests := []testDescription{}
 	for _, method := range getMethods() {
@@ -156,7 +184,7 @@ func Test_UpdateUrlRequest(t *testing.T) {
 			conf := &testConf{key: nil, singEnabled: false}
 			signer := hash.NewSigner(conf)
 			converter := model.NewMetricsConverter(conf, signer)
-			router := initRouter(metricsStorage, converter, htmlPageBuilder, &testDBStorage{})
+			router := initRouter(metricsStorage, converter, htmlPageBuilder, &testDBStorage{}, routerOptions{})
 			router.ServeHTTP(w, request)
 			actual := w.Result()
 
@@ -344,7 +372,7 @@ func Test_GetMetricUrlRequest(t *testing.T) {
 			conf := &testConf{key: nil, singEnabled: false}
 			signer := hash.NewSigner(conf)
 			converter := model.NewMetricsConverter(conf, signer)
-			router := initRouter(metricsStorage, converter, htmlPageBuilder, &testDBStorage{})
+			router := initRouter(metricsStorage, converter, htmlPageBuilder, &testDBStorage{}, routerOptions{})
 			router.ServeHTTP(w, request)
 			actual := w.Result()
 
@@ -460,6 +488,1178 @@ func Test_GetMetricJsonRequest_MetricType(t *testing.T) {
 	}
 }
 
+func Test_AgentIdentity(t *testing.T) {
+	tests := []struct {
+		name           string
+		agent          string
+		allowedAgents  []string
+		expectedStatus int
+	}{
+		{
+			name:           "no_client_certificate",
+			allowedAgents:  []string{"agent1"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "any_agent_allowed",
+			agent:          "agent2",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "allowed_agent",
+			agent:          "agent1",
+			allowedAgents:  []string{"agent1", "agent3"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "unknown_agent",
+			agent:          "agent2",
+			allowedAgents:  []string{"agent1", "agent3"},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "https://localhost:8080/update/counter/metricName/1", nil)
+			if tt.agent != "" {
+				request.TLS.VerifiedChains = [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tt.agent}}}}
+			}
+			w := httptest.NewRecorder()
+
+			conf := &testConf{}
+			converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+			router := initRouter(memory.NewInMemoryStorage(), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{
+				allowedAgents: tt.allowedAgents,
+			})
+			router.ServeHTTP(w, request)
+
+			actual := w.Result()
+			defer actual.Body.Close()
+			assert.Equal(t, tt.expectedStatus, actual.StatusCode)
+		})
+	}
+}
+
+func Test_ValidateAllowedAgents(t *testing.T) {
+	tests := []struct {
+		name          string
+		conf          *config
+		expectedError error
+	}{
+		{
+			name: "no_allowed_agents",
+			conf: &config{},
+		},
+		{
+			name: "allowed_agents_with_client_ca",
+			conf: &config{AllowedAgents: []string{"agent1"}, TLSClientCA: "ca.crt"},
+		},
+		{
+			name:          "allowed_agents_without_client_ca",
+			conf:          &config{AllowedAgents: []string{"agent1"}},
+			expectedError: errAllowedAgentsNoCA,
+		},
+		{
+			name: "blank_allowed_agents",
+			conf: &config{AllowedAgents: []string{" "}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAllowedAgents(tt.conf)
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_Authorization(t *testing.T) {
+	tokens := &testTokenStore{tokens: map[string]*auth.Token{
+		auth.HashToken("ingest"): {Name: "agent", Scopes: []auth.Scope{auth.ScopeIngest}},
+		auth.HashToken("read"):   {Name: "dashboard", Scopes: []auth.Scope{auth.ScopeRead}},
+		auth.HashToken("admin"):  {Name: "admin", Scopes: []auth.Scope{auth.ScopeAdmin}},
+	}}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{name: "update_no_token", method: http.MethodPost, path: "/update/counter/metricName/1", expectedStatus: http.StatusUnauthorized},
+		{name: "update_read_token", method: http.MethodPost, path: "/update/counter/metricName/1", token: "read", expectedStatus: http.StatusForbidden},
+		{name: "update_ingest_token", method: http.MethodPost, path: "/update/counter/metricName/1", token: "ingest", expectedStatus: http.StatusOK},
+		{name: "value_ingest_token", method: http.MethodGet, path: "/value/counter/metricName", token: "ingest", expectedStatus: http.StatusForbidden},
+		{name: "value_read_token", method: http.MethodGet, path: "/value/counter/metricName", token: "read", expectedStatus: http.StatusOK},
+		{name: "page_no_token", method: http.MethodGet, path: "/", expectedStatus: http.StatusUnauthorized},
+		{name: "page_read_token", method: http.MethodGet, path: "/", token: "read", expectedStatus: http.StatusOK},
+		{name: "debug_read_token", method: http.MethodGet, path: "/debug/pprof/", token: "read", expectedStatus: http.StatusForbidden},
+		{name: "debug_admin_token", method: http.MethodGet, path: "/debug/pprof/", token: "admin", expectedStatus: http.StatusOK},
+		{name: "ping_no_token", method: http.MethodGet, path: "/ping", expectedStatus: http.StatusOK},
+	}
+
+	metricsStorage := memory.NewInMemoryStorage()
+	_, err := metricsStorage.AddMetricValues(context.Background(), []metrics.Metric{createCounterMetric("metricName", 1)})
+	require.NoError(t, err)
+
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(metricsStorage, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{
+		authenticator: auth.NewAuthenticator(tokens),
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, "http://localhost:8080"+tt.path, nil)
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, request)
+
+			actual := w.Result()
+			defer actual.Body.Close()
+			assert.Equal(t, tt.expectedStatus, actual.StatusCode)
+		})
+	}
+}
+
+func Test_AuthorizationBeforeLoadShedding(t *testing.T) {
+	tokens := &testTokenStore{tokens: map[string]*auth.Token{
+		auth.HashToken("ingest"): {Name: "agent", Scopes: []auth.Scope{auth.ScopeIngest}},
+	}}
+
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(memory.NewInMemoryStorage(), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{
+		authenticator: auth.NewAuthenticator(tokens),
+		loadShedder:   limiter.NewLoadShedder(&config{IngestRate: 1, IngestBurstMax: 1}),
+	})
+
+	call := func(token string) int {
+		request := httptest.NewRequest(http.MethodPost, "http://localhost:8080/update/counter/metricName/1", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+		return w.Code
+	}
+
+	// the rejected requests spend no rate tokens
+	assert.Equal(t, http.StatusUnauthorized, call(""))
+	assert.Equal(t, http.StatusUnauthorized, call("unknown"))
+	assert.Equal(t, http.StatusOK, call("ingest"))
+	assert.Equal(t, http.StatusTooManyRequests, call("ingest"))
+}
+
+func Test_Quota(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(memory.NewInMemoryStorage(), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{
+		quotaLimiter: quota.NewQuotaLimiter(&config{QuotaTenantSeries: 1}),
+	})
+
+	call := func(method string, path string) *http.Response {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, nil))
+		return w.Result()
+	}
+
+	// the failed write charges no series
+	response := call(http.MethodPost, "/update/gauge/"+selfmetrics.ReservedPrefix+"first/1")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response = call(http.MethodPost, "/update/counter/first/1")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	response = call(http.MethodPost, "/update/counter/first/1")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	response = call(http.MethodPost, "/update/counter/second/1")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.Equal(t, "60", response.Header.Get("Retry-After"))
+
+	response = call(http.MethodGet, "/value/counter/second")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response = call(http.MethodGet, "/api/admin/quotas")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"usage":[{"tenant":"default","series":1,"seriesLimit":1,"acceptedSamples":3,"rejectedRequests":1}],"rejected":{"tenant_series":1}}`, string(body))
+
+	// the deleted series is released
+	response = call(http.MethodDelete, "/api/admin/metrics/counter/first")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+
+	response = call(http.MethodPost, "/update/counter/second/1")
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func Test_SeedQuota(t *testing.T) {
+	ctx := context.Background()
+	metricsStorage := memory.NewInMemoryStorage()
+	_, err := metricsStorage.AddMetricValues(ctx, []metrics.Metric{createGaugeMetric("first", 1), createGaugeMetric(selfmetrics.ReservedPrefix+"Self", 1)})
+	require.NoError(t, err)
+	_, err = metricsStorage.AddMetricValues(identity.WithTenant(ctx, "teamA"), []metrics.Metric{createGaugeMetric("first", 1), createGaugeMetric("second", 1)})
+	require.NoError(t, err)
+
+	quotaLimiter := quota.NewQuotaLimiter(&config{QuotaTenantSeries: 2})
+	require.NoError(t, seedQuota(ctx, quotaLimiter, metricsStorage))
+
+	assert.Equal(t, []quota.Usage{
+		{Tenant: identity.DefaultTenant, Series: 1, SeriesLimit: 2},
+		{Tenant: "teamA", Series: 2, SeriesLimit: 2},
+	}, quotaLimiter.Usage())
+	assert.Error(t, quotaLimiter.Admit("teamA", "", []quota.Series{{Type: "gauge", Name: "third"}}))
+}
+
+func Test_GracefulShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveResult := make(chan error, 1)
+	go func() {
+		serveResult <- serve(ctx, server, listener, 5*time.Second)
+	}()
+
+	requestResult := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			requestResult <- 0
+			return
+		}
+		defer response.Body.Close()
+		requestResult <- response.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case <-serveResult:
+		assert.Fail(t, "server stopped before in-flight request completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-requestResult)
+	assert.NoError(t, <-serveResult)
+
+	_, err = http.Get("http://" + listener.Addr().String())
+	assert.Error(t, err)
+}
+
+func Test_ShutdownDuringRestore(t *testing.T) {
+	conf := &config{StoreFile: filepath.Join(t.TempDir(), "backup.json"), StoreInterval: 300}
+	backup := file.NewFileStorage(conf)
+	require.NoError(t, backup.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "1.5"}}))
+
+	// the memory is not restored yet
+	storageStrategy := storage.NewStorageStrategy(conf, memory.NewInMemoryStorage(), backup, nil)
+	_, err := storageStrategy.AddMetricValues(context.Background(), []metrics.Metric{createGaugeMetric("Heap", 2)})
+	require.NoError(t, err)
+	restored := health.NewLatch()
+
+	require.NoError(t, afterRestore(restored, storageStrategy.CreateBackup)(context.Background()))
+	closeStorage(storageStrategy, false, restored)
+
+	actual, err := backup.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "1.5"}}, actual)
+
+	restored.Done()
+	closeStorage(storageStrategy, true, restored)
+
+	// in sync mode the writes are already backed up
+	actual, err = backup.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "1.5"}}, actual)
+
+	closeStorage(storageStrategy, false, restored)
+
+	actual, err = backup.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Heap": "2"}}, actual)
+}
+
+func Test_Health(t *testing.T) {
+	restored := health.NewLatch()
+	healthChecker := health.NewChecker(time.Second)
+	healthChecker.Add("restore", restored.Check)
+
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(memory.NewInMemoryStorage(), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{
+		healthChecker: healthChecker,
+		restored:      restored,
+	})
+
+	call := func(method string, path string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, nil))
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		body, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(body)
+	}
+
+	status, body := call(http.MethodGet, "/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"status":"alive"}`, body)
+
+	status, body = call(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.JSONEq(t, `{"status":"not_ready","components":[{"name":"restore","status":"fail","error":"not finished yet"}]}`, body)
+
+	status, _ = call(http.MethodPost, "/update/counter/metricName/1")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	restored.Done()
+
+	status, body = call(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"status":"ready","components":[{"name":"restore","status":"ok"}]}`, body)
+
+	status, _ = call(http.MethodPost, "/update/counter/metricName/1")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func Test_Follower(t *testing.T) {
+	backupPath := filepath.Join(t.TempDir(), "backup.json")
+	err := os.WriteFile(backupPath, []byte(`[{"types":"gauge","name":"temperature","value":"20"}]`), 0o644)
+	require.NoError(t, err)
+
+	metricsStorage := memory.NewInMemoryStorage()
+	primary := follower.NewFollower(&testFollowerConf{path: backupPath}, metricsStorage, nil)
+	healthChecker := health.NewChecker(time.Second)
+	healthChecker.AddWithDetail("follower", primary.Check)
+
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(metricsStorage, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{
+		healthChecker: healthChecker,
+		readOnly:      true,
+	})
+
+	call := func(method string, path string) (int, string, http.Header) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, nil))
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		body, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(body), actual.Header
+	}
+
+	status, _, _ := call(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	require.NoError(t, primary.Sync(context.Background()))
+
+	status, body, _ := call(http.MethodGet, "/value/gauge/temperature")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "20", body)
+
+	status, _, _ = call(http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusOK, status)
+
+	for _, request := range []struct{ method, path string }{
+		{http.MethodPost, "/update/gauge/temperature/25"},
+		{http.MethodPost, "/updates/"},
+		{http.MethodDelete, "/api/admin/metrics/gauge/temperature"},
+		{http.MethodPost, replication.ApplyPath},
+		{http.MethodPost, cluster.MetricsPath},
+		{http.MethodPost, "/api/admin/webhooks"},
+		{http.MethodDelete, "/api/admin/webhooks/id"},
+	} {
+		status, _, header := call(request.method, request.path)
+		assert.Equal(t, http.StatusMethodNotAllowed, status, request.path)
+		assert.Equal(t, "GET, HEAD", header.Get("Allow"), request.path)
+	}
+
+	status, body, _ = call(http.MethodGet, "/value/gauge/temperature")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "20", body)
+}
+
+func Test_SelfMetrics(t *testing.T) {
+	registry := selfmetrics.NewRegistry()
+	metricsStorage := memory.NewInMemoryStorage()
+
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(metricsStorage, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{
+		registry:    registry,
+		selfMetrics: registry,
+	})
+
+	call := func(method string, path string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, nil))
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		body, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(body)
+	}
+
+	status, _ := call(http.MethodPost, "/update/counter/metricName/1")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _ = call(http.MethodPost, "/update/gauge/"+selfmetrics.ReservedPrefix+"metricName/1")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, body := call(http.MethodGet, "/internal/metrics")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "HTTPRequests.update_counter_metricName_metricValue.200 1\n")
+	assert.Contains(t, body, "HTTPRequests.update_gauge_metricName_metricValue.400 1\n")
+	assert.Contains(t, body, "UpdateBatchSize.count 2\n")
+
+	err := exportSelfMetrics(metricsStorage, registry)(context.Background())
+	require.NoError(t, err)
+
+	metric, err := metricsStorage.GetMetric(context.Background(), "gauge", selfmetrics.ReservedPrefix+"UpdateBatchSize.count")
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), metric.GetValue())
+}
+
+func Test_MetricsPageRefresh(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(memory.NewInMemoryStorage(), converter, html.NewDashboardPageBuilder(), &testDBStorage{}, routerOptions{})
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectedPart   string
+	}{
+		{path: "/", expectedStatus: http.StatusOK, expectedPart: "auto-refresh is off"},
+		{path: "/?refresh=10", expectedStatus: http.StatusOK, expectedPart: `<meta http-equiv="refresh" content="10">`},
+		{path: "/?refresh=abc", expectedStatus: http.StatusBadRequest},
+		{path: "/?refresh=-1", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost:8080"+tt.path, nil))
+
+			actual := w.Result()
+			defer actual.Body.Close()
+			body, err := io.ReadAll(actual.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedStatus, actual.StatusCode)
+			assert.Contains(t, string(body), tt.expectedPart)
+		})
+	}
+}
+
+func Test_SplitHistory(t *testing.T) {
+	start := time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC)
+	history := map[string]map[string][]storage.Sample{
+		"gauge": {
+			"Alloc": {{Time: start, Value: 1}, {Time: start.Add(2 * time.Hour), Value: 2}},
+			"Sys":   {{Time: start, Value: 1}},
+			"Heap":  {},
+		},
+	}
+
+	recent, updatedAt := splitHistory(history, start.Add(time.Hour))
+	assert.Equal(t, map[string]map[string][]storage.Sample{
+		"gauge": {
+			"Alloc": {{Time: start.Add(2 * time.Hour), Value: 2}},
+			"Sys":   {},
+		},
+	}, recent)
+	assert.Equal(t, map[string]map[string]time.Time{
+		"gauge": {"Alloc": start.Add(2 * time.Hour), "Sys": start},
+	}, updatedAt)
+}
+
+func Test_Graph(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(memory.NewInMemoryStorageWithHistory(memory.DefaultHistorySize), converter, html.NewDashboardPageBuilder(), &testDBStorage{}, routerOptions{})
+
+	call := func(method string, path string) (int, string, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, nil))
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		body, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, actual.Header.Get("Content-Type"), string(body)
+	}
+
+	for _, value := range []string{"1", "3", "2"} {
+		status, _, _ := call(http.MethodPost, "/update/gauge/Alloc/"+value)
+		require.Equal(t, http.StatusOK, status)
+	}
+
+	status, contentType, body := call(http.MethodGet, "/graph/gauge/Alloc?range=15m")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "image/svg+xml", contentType)
+	assert.Contains(t, body, "<title>Alloc (gauge), last 15m0s</title>")
+	assert.Equal(t, 1, strings.Count(body, "<polyline"))
+
+	status, _, _ = call(http.MethodGet, "/graph/gauge/Unknown")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _, _ = call(http.MethodGet, "/graph/gauge/Alloc?range=yesterday")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _, body = call(http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `<a href="/graph/gauge/Alloc?range=1h"><svg`)
+}
+
+func Test_Stream(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	storageStrategy := storage.NewStorageStrategy(conf, memory.NewInMemoryStorage(), memory.NewInMemoryStorage(), nil)
+	broker := stream.NewBroker(conf, nil)
+	storageStrategy.AddObserver(broker)
+
+	router := initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{
+		broker:    broker,
+		heartbeat: 20 * time.Millisecond,
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	subscribe := func(lastEventID string) (*http.Response, *bufio.Reader) {
+		request, err := http.NewRequest(http.MethodGet, server.URL+"/api/stream?name=Alloc&name=Frees&type=gauge", nil)
+		require.NoError(t, err)
+		if lastEventID != "" {
+			request.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		require.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+		return response, bufio.NewReader(response.Body)
+	}
+
+	// readMessage returns the lines of the next message
+	readMessage := func(reader *bufio.Reader) []string {
+		lines := []string{}
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				return lines
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	readEvent := func(reader *bufio.Reader) []string {
+		for {
+			message := readMessage(reader)
+			if message[0] != ": heartbeat" {
+				return message
+			}
+		}
+	}
+
+	response, reader := subscribe("")
+	assert.Equal(t, []string{": heartbeat"}, readMessage(reader))
+
+	for _, path := range []string{"/update/gauge/Alloc/1", "/update/counter/Alloc/1", "/update/gauge/Other/1", "/update/gauge/Frees/2"} {
+		updateResponse, err := http.Post(server.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		updateResponse.Body.Close()
+		require.Equal(t, http.StatusOK, updateResponse.StatusCode)
+	}
+
+	event := readEvent(reader)
+	require.Len(t, event, 3)
+	assert.Equal(t, []string{"id: 1", "event: metric"}, event[:2])
+	assert.Regexp(t, `^data: \{"id":"Alloc","type":"gauge","value":1,"tenant":"default","timestamp":".+"\}$`, event[2])
+
+	event = readEvent(reader)
+	require.Len(t, event, 3)
+	assert.Equal(t, []string{"id: 4", "event: metric"}, event[:2])
+	assert.Contains(t, event[2], `"id":"Frees","type":"gauge","value":2`)
+	response.Body.Close()
+
+	response, reader = subscribe("1")
+	event = readEvent(reader)
+	assert.Equal(t, "id: 4", event[0])
+	response.Body.Close()
+
+	response, reader = subscribe("100")
+	assert.Equal(t, []string{"event: reset", "data: {}"}, readEvent(reader))
+	response.Body.Close()
+
+	broker.Close()
+	streamResponse, err := http.Get(server.URL + "/api/stream")
+	require.NoError(t, err)
+	streamResponse.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, streamResponse.StatusCode)
+}
+
+func Test_Webhooks(t *testing.T) {
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	storageStrategy := storage.NewStorageStrategy(conf, memory.NewInMemoryStorage(), memory.NewInMemoryStorage(), nil)
+	webhooks := webhook.NewDispatcher(conf, webhook.NewFileSubscriptionStore(""), nil)
+	webhooks.Start(ctx)
+	storageStrategy.AddObserver(webhooks)
+
+	router := initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{webhooks: webhooks})
+
+	call := func(method string, path string, body string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body)))
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		responseBody, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(responseBody)
+	}
+
+	status, _ := call(http.MethodPost, "/api/admin/webhooks", `{"url":"not a url"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, body := call(http.MethodPost, "/api/admin/webhooks", `{"url":"`+receiver.URL+`","selector":{"type":"counter","name":"Deploy*"}}`)
+	require.Equal(t, http.StatusCreated, status)
+
+	created := &webhook.Subscription{}
+	require.NoError(t, json.Unmarshal([]byte(body), created))
+	assert.NotEmpty(t, created.Secret)
+	assert.Equal(t, "default", created.Tenant)
+
+	status, body = call(http.MethodGet, "/api/admin/webhooks", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, body, created.Secret)
+	assert.Contains(t, body, created.ID)
+
+	status, _ = call(http.MethodPost, "/update/gauge/Deployments/1", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = call(http.MethodPost, "/update/counter/Deployments/1", "")
+	require.Equal(t, http.StatusOK, status)
+
+	select {
+	case event := <-received:
+		assert.Contains(t, event, `"type":"counter","name":"Deployments","value":1`)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "webhook is not delivered")
+	}
+
+	status, body = call(http.MethodGet, "/api/admin/webhooks/dead-letters", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "[]", body)
+
+	status, _ = call(http.MethodDelete, "/api/admin/webhooks/"+created.ID, "")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = call(http.MethodDelete, "/api/admin/webhooks/"+created.ID, "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func Test_Federate(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(memory.NewInMemoryStorage(), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{})
+
+	call := func(method string, path string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, nil))
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		body, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(body)
+	}
+
+	for _, path := range []string{"/update/gauge/HeapAlloc/1.5", "/update/gauge/Other/2", "/update/counter/PollCount/3"} {
+		status, _ := call(http.MethodPost, path)
+		require.Equal(t, http.StatusOK, status)
+	}
+
+	status, body := call(http.MethodGet, "/federate?match=Heap*&match=counter:PollCount")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `[{"id":"PollCount","type":"counter","delta":3},{"id":"HeapAlloc","type":"gauge","value":1.5}]`, body)
+
+	status, _ = call(http.MethodGet, "/federate")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func Test_Replication(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+
+	startNode := func(nodeID string, peers ...string) (http.Handler, *replication.Replicator) {
+		local := memory.NewInMemoryStorage()
+		replicator, err := replication.NewReplicator(&config{
+			NodeID:            nodeID,
+			Peers:             peers,
+			ReplicaDir:        t.TempDir(),
+			ReplicaRetention:  100,
+			ReplicaBatch:      100,
+			ReplicaTimeoutSec: 1,
+		}, local, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = replicator.Close() })
+
+		metricsStorage := replication.NewReplicatingStorage(local, replicator)
+		return initRouter(metricsStorage, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{replicator: replicator}), replicator
+	}
+
+	call := func(router http.Handler, method string, path string, body string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body)))
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		content, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(content)
+	}
+
+	routerB, _ := startNode("b")
+	serverB := httptest.NewServer(routerB)
+	defer serverB.Close()
+	routerA, replicatorA := startNode("a", "b="+serverB.URL)
+
+	status, _ := call(routerA, http.MethodPost, "/update/counter/PollCount/3", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = call(routerA, http.MethodPost, "/update/gauge/Alloc/1.5", "")
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, replicatorA.Flush(context.Background()))
+
+	status, body := call(routerB, http.MethodGet, "/value/counter/PollCount", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "3", body)
+
+	status, _ = call(routerA, http.MethodDelete, "/api/admin/metrics/gauge/Alloc", "")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = call(routerA, http.MethodDelete, "/api/admin/metrics/gauge/Alloc", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	require.NoError(t, replicatorA.Flush(context.Background()))
+
+	status, _ = call(routerB, http.MethodGet, "/value/gauge/Alloc", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = call(routerB, http.MethodPost, replication.ApplyPath, `{"origin":"b","mutations":[]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, body = call(routerB, http.MethodPost, replication.ApplyPath, `{"origin":"c","mutations":[{"seq":1,"op":"counter_add","type":"counter","name":"PollCount","value":2}]}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"applied":1}`, body)
+
+	router := initRouter(memory.NewInMemoryStorage(), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{})
+	status, _ = call(router, http.MethodPost, replication.ApplyPath, `{"origin":"c","mutations":[]}`)
+	assert.Equal(t, http.StatusNotImplemented, status)
+}
+
+func Test_Cluster(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+
+	names := []string{"a", "b", "c"}
+	routers := map[string]http.Handler{}
+	locals := map[string]storage.MetricsStorage{}
+	membership := &cluster.Membership{}
+	for _, name := range names {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routers[name].ServeHTTP(w, r)
+		}))
+		defer server.Close()
+		membership.Members = append(membership.Members, cluster.Member{Name: name, URL: server.URL})
+	}
+
+	for _, name := range names {
+		nodes, err := cluster.NewClusterWithMembership(&config{ClusterID: name, ClusterTimeoutSec: 1}, membership, converter, nil)
+		require.NoError(t, err)
+
+		locals[name] = memory.NewInMemoryStorage()
+		routers[name] = initRouter(cluster.NewShardedStorage(locals[name], nodes), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{clusterLocal: locals[name]})
+	}
+
+	call := func(node string, method string, path string) (int, string) {
+		request := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+		request.Header.Set("X-Tenant-ID", "teamA")
+		w := httptest.NewRecorder()
+		routers[node].ServeHTTP(w, request)
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		body, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(body)
+	}
+
+	expected := []string{}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("Metric%02d", i)
+		status, _ := call(names[i%len(names)], http.MethodPost, "/update/counter/"+name+"/2")
+		require.Equal(t, http.StatusOK, status)
+		status, _ = call(names[(i+1)%len(names)], http.MethodPost, "/update/counter/"+name+"/3")
+		require.Equal(t, http.StatusOK, status)
+		expected = append(expected, name+": 5")
+	}
+
+	// every series is stored once on its owner
+	owned := 0
+	for _, name := range names {
+		values, err := locals[name].GetMetricValues(identity.WithTenant(context.Background(), "teamA"))
+		require.NoError(t, err)
+		owned += len(values["counter"])
+	}
+	assert.Equal(t, 20, owned)
+
+	for _, name := range names {
+		status, body := call(name, http.MethodGet, "/value/counter/Metric07")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "5", body)
+
+		status, body = call(name, http.MethodGet, "/metrics")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "<html>"+strings.Join(expected, "<br>")+"<br></html>", body)
+	}
+
+	status, _ := call("a", http.MethodDelete, "/api/admin/metrics/counter/Metric07")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = call("b", http.MethodGet, "/value/counter/Metric07")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	router := initRouter(memory.NewInMemoryStorage(), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost:8080"+cluster.MetricsPath, nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func Test_ClusterFailedWrite(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	membership := &cluster.Membership{Members: []cluster.Member{{Name: "a", URL: "http://localhost:1"}, {Name: "b", URL: unavailable.URL}}}
+	nodes, err := cluster.NewClusterWithMembership(&config{ClusterID: "a", ClusterTimeoutSec: 1}, membership, converter, nil)
+	require.NoError(t, err)
+
+	metricsList := []metrics.Metric{}
+	for i := 0; i < 20; i++ {
+		metricsList = append(metricsList, createCounterMetric(fmt.Sprintf("Metric%02d", i), 1))
+	}
+
+	// the local shard is not written, so a retried request does not add the counters twice
+	local := memory.NewInMemoryStorage()
+	_, err = cluster.NewShardedStorage(local, nodes).AddMetricValues(context.Background(), metricsList)
+	assert.Error(t, err)
+
+	values, err := local.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, values)
+}
+
+func Test_ClusterMetricsList(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	local := memory.NewInMemoryStorage()
+	_, err := local.AddMetricValues(context.Background(), []metrics.Metric{createGaugeMetric("disk/sda", 1.5), createCounterMetric("PollCount", 2)})
+	require.NoError(t, err)
+
+	router := initRouter(local, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{clusterLocal: local})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost:8080"+cluster.MetricsPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	actual := []*model.Metrics{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &actual))
+	require.Len(t, actual, 2)
+	assert.Equal(t, "PollCount", actual[0].ID)
+	assert.Equal(t, "disk/sda", actual[1].ID)
+}
+
+func Test_Snapshots(t *testing.T) {
+	conf := &config{StoreFile: filepath.Join(t.TempDir(), "backup.json"), StoreHourly: 24}
+	storageStrategy := storage.NewStorageStrategy(conf, memory.NewInMemoryStorage(), file.NewFileStorage(conf), nil)
+	converter := model.NewMetricsConverter(&testConf{}, hash.NewSigner(&testConf{}))
+	router := initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{snapshots: storageStrategy})
+
+	call := func(method string, path string, tenant string) (int, string) {
+		request := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+		if tenant != "" {
+			request.Header.Set("X-Tenant-ID", tenant)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		body, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(body)
+	}
+
+	status, _ := call(http.MethodPost, "/update/gauge/Sys/1", "")
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, storageStrategy.CreateBackup(context.Background()))
+
+	status, _ = call(http.MethodPost, "/update/gauge/Sys/2", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = call(http.MethodPost, "/update/gauge/Sys/3", "teamA")
+	require.Equal(t, http.StatusOK, status)
+
+	status, body := call(http.MethodGet, "/api/admin/snapshots", "")
+	require.Equal(t, http.StatusOK, status)
+	snapshots := []storage.Snapshot{}
+	require.NoError(t, json.Unmarshal([]byte(body), &snapshots))
+	require.Len(t, snapshots, 1)
+
+	// the updates after the snapshot are dropped
+	status, _ = call(http.MethodPost, "/api/admin/snapshots/"+snapshots[0].ID+"/restore", "")
+	assert.Equal(t, http.StatusNoContent, status)
+
+	status, body = call(http.MethodGet, "/value/gauge/Sys", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "1", body)
+
+	// the tenant created after the snapshot is emptied
+	status, _ = call(http.MethodGet, "/value/gauge/Sys", "teamA")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = call(http.MethodPost, "/api/admin/snapshots/20000101T000000.000000000Z/restore", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	router = initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{})
+	status, _ = call(http.MethodGet, "/api/admin/snapshots", "")
+	assert.Equal(t, http.StatusNotImplemented, status)
+}
+
+func Test_ImportReplicated(t *testing.T) {
+	conf := &config{StoreFile: filepath.Join(t.TempDir(), "backup.json")}
+	storageStrategy := storage.NewStorageStrategy(conf, memory.NewInMemoryStorage(), file.NewFileStorage(conf), nil)
+	replicator, err := replication.NewReplicator(&config{
+		NodeID:            "a",
+		Peers:             []string{"b=http://127.0.0.1:1"},
+		ReplicaDir:        t.TempDir(),
+		ReplicaRetention:  100,
+		ReplicaBatch:      100,
+		ReplicaTimeoutSec: 1,
+	}, storageStrategy, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = replicator.Close() })
+
+	converter := model.NewMetricsConverter(&testConf{}, hash.NewSigner(&testConf{}))
+	router := initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{state: storageStrategy, replicator: replicator})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost:8080/api/admin/import", strings.NewReader(`{"type":"gauge","name":"Sys","value":1}`)))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	values, err := storageStrategy.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, values)
+}
+
+func Test_ImportSeedsQuota(t *testing.T) {
+	conf := &config{StoreFile: filepath.Join(t.TempDir(), "backup.json"), QuotaTenantSeries: 1}
+	storageStrategy := storage.NewStorageStrategy(conf, memory.NewInMemoryStorage(), file.NewFileStorage(conf), nil)
+	quotaLimiter := quota.NewQuotaLimiter(conf)
+	converter := model.NewMetricsConverter(&testConf{}, hash.NewSigner(&testConf{}))
+	router := initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{state: storageStrategy, quotaLimiter: quotaLimiter})
+
+	call := func(method string, path string, body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, call(http.MethodPost, "/update/gauge/Sys/1", ""))
+	require.Equal(t, http.StatusTooManyRequests, call(http.MethodPost, "/update/gauge/Alloc/1", ""))
+
+	// the replaced series are released and the imported ones are charged
+	require.Equal(t, http.StatusOK, call(http.MethodPost, "/api/admin/import?mode=replace", `{"type":"gauge","name":"Alloc","value":1}`))
+	assert.Equal(t, http.StatusOK, call(http.MethodPost, "/update/gauge/Alloc/2", ""))
+	assert.Equal(t, http.StatusTooManyRequests, call(http.MethodPost, "/update/gauge/Sys/2", ""))
+}
+
+func Test_ExportImport(t *testing.T) {
+	conf := &config{StoreFile: filepath.Join(t.TempDir(), "backup.json")}
+	backup := file.NewFileStorage(conf)
+	storageStrategy := storage.NewStorageStrategy(conf, memory.NewInMemoryStorageWithHistory(memory.DefaultHistorySize), backup, nil)
+	converter := model.NewMetricsConverter(&testConf{}, hash.NewSigner(&testConf{}))
+	router := initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{state: storageStrategy})
+
+	call := func(method string, path string, tenant string, body string) (int, string) {
+		request := httptest.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+		if tenant != "" {
+			request.Header.Set("X-Tenant-ID", tenant)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		content, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(content)
+	}
+
+	status, _ := call(http.MethodPost, "/update/counter/PollCount/5", "", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = call(http.MethodPost, "/update/gauge/Sys/1.5", "teamA", "")
+	require.Equal(t, http.StatusOK, status)
+
+	status, ndjson := call(http.MethodGet, "/api/admin/export", "", "")
+	require.Equal(t, http.StatusOK, status)
+	assert.Contains(t, ndjson, `{"tenant":"default","type":"counter","name":"PollCount","value":5,"updated":`)
+	assert.Contains(t, ndjson, `{"tenant":"teamA","type":"gauge","name":"Sys","value":1.5,"updated":`)
+
+	status, tarDump := call(http.MethodGet, "/api/admin/export?format=tar", "", "")
+	require.Equal(t, http.StatusOK, status)
+
+	// merge keeps the series missed in the dump, counters are set rather than incremented
+	status, body := call(http.MethodPost, "/api/admin/import", "",
+		`{"tenant":"default","type":"counter","name":"PollCount","value":7}`+"\n"+`{"type":"gauge","name":"Heap","value":2}`)
+	require.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"mode":"merge","tenants":1,"series":2}`, body)
+
+	status, body = call(http.MethodGet, "/value/counter/PollCount", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "7", body)
+	status, _ = call(http.MethodGet, "/value/gauge/Sys", "teamA", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	// the backup is updated as well
+	backupValues, err := backup.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"counter": {"PollCount": "7"}, "gauge": {"Heap": "2"}}, backupValues)
+
+	// replace makes the tar dump the whole state
+	request := httptest.NewRequest(http.MethodPost, "http://localhost:8080/api/admin/import?mode=replace", strings.NewReader(tarDump))
+	request.Header.Set("Content-Type", "application/x-tar")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, request)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"mode":"replace","tenants":2,"series":2}`, w.Body.String())
+
+	status, body = call(http.MethodGet, "/value/counter/PollCount", "", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "5", body)
+	status, _ = call(http.MethodGet, "/value/gauge/Heap", "", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	backupValues, err = backup.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"counter": {"PollCount": "5"}}, backupValues)
+
+	status, _ = call(http.MethodPost, "/api/admin/import", "", `{"type":"histogram","name":"Sys","value":1}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = call(http.MethodPost, "/api/admin/import?mode=append", "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = call(http.MethodGet, "/api/admin/export?format=csv", "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	router = initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{state: storageStrategy, readOnly: true})
+	status, _ = call(http.MethodPost, "/api/admin/import", "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+	router = initRouter(storageStrategy, converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{})
+	status, _ = call(http.MethodGet, "/api/admin/export", "", "")
+	assert.Equal(t, http.StatusNotImplemented, status)
+}
+
+func Test_TenantIsolation(t *testing.T) {
+	conf := &testConf{}
+	converter := model.NewMetricsConverter(conf, hash.NewSigner(conf))
+	router := initRouter(memory.NewInMemoryStorage(), converter, html.NewSimplePageBuilder(), &testDBStorage{}, routerOptions{})
+
+	call := func(method string, path string, tenant string) (int, string) {
+		request := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+		if tenant != "" {
+			request.Header.Set("X-Tenant-ID", tenant)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+
+		actual := w.Result()
+		defer actual.Body.Close()
+		body, err := io.ReadAll(actual.Body)
+		require.NoError(t, err)
+		return actual.StatusCode, string(body)
+	}
+
+	status, _ := call(http.MethodPost, "/update/counter/Alloc/100", "teamA")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = call(http.MethodPost, "/update/counter/Alloc/5", "teamB")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, body := call(http.MethodGet, "/value/counter/Alloc", "teamA")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "100", body)
+
+	status, body = call(http.MethodGet, "/value/counter/Alloc", "teamB")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "5", body)
+
+	status, _ = call(http.MethodGet, "/value/counter/Alloc", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = call(http.MethodGet, "/", "teamB")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "<html>Alloc: 5<br></html>", body)
+
+	status, _ = call(http.MethodGet, "/", "bad tenant!")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
 func runJSONTest(t *testing.T, apiRequest jsonAPIRequest) *callResult {
 	t.Helper()
 
@@ -483,7 +1683,7 @@ func runJSONTest(t *testing.T, apiRequest jsonAPIRequest) *callResult {
 	conf := &testConf{}
 	signer := hash.NewSigner(conf)
 	converter := model.NewMetricsConverter(conf, signer)
-	router := initRouter(metricsStorage, converter, htmlPageBuilder, &testDBStorage{})
+	router := initRouter(metricsStorage, converter, htmlPageBuilder, &testDBStorage{}, routerOptions{})
 	router.ServeHTTP(w, request)
 	actual := w.Result()
 	result := &callResult{status: actual.StatusCode}
@@ -611,6 +1811,34 @@ func (t *testConf) GetKey() []byte {
 	return t.key
 }
 
+func (t *testConf) SyncMode() bool {
+	return false
+}
+
+func (t *testConf) StreamReplaySize() int {
+	return 16
+}
+
+func (t *testConf) StreamMaxSubscribers() int {
+	return 0
+}
+
+func (t *testConf) WebhookQueueSize() int {
+	return 10
+}
+
+func (t *testConf) WebhookWorkers() int {
+	return 1
+}
+
+func (t *testConf) WebhookMaxAttempts() int {
+	return 1
+}
+
+func (t *testConf) WebhookTimeout() time.Duration {
+	return time.Second
+}
+
 func (t testDBStorage) Ping(context.Context) error {
 	return nil
 }
@@ -624,12 +1852,48 @@ func (t *testDBStorage) UpdateItems(ctx context.Context, records []*database.DBI
 	panic("not implement")
 }
 
-func (t *testDBStorage) ReadItem(ctx context.Context, metricType string, metricName string) (*database.DBItem, error) {
+func (t *testDBStorage) ReplaceItems(ctx context.Context, tenant string, records []*database.DBItem) error {
 	// TODO: implement
 	panic("not implement")
 }
 
-func (t *testDBStorage) ReadAllItems(ctx context.Context) ([]*database.DBItem, error) {
+func (t *testDBStorage) ReadItem(ctx context.Context, tenant string, metricType string, metricName string) (*database.DBItem, error) {
 	// TODO: implement
 	panic("not implement")
 }
+
+func (t *testDBStorage) ReadAllItems(ctx context.Context, tenant string) ([]*database.DBItem, error) {
+	// TODO: implement
+	panic("not implement")
+}
+
+func (t *testDBStorage) ReadTenants(ctx context.Context) ([]string, error) {
+	// TODO: implement
+	panic("not implement")
+}
+
+func (t *testDBStorage) DeleteItem(ctx context.Context, tenant string, metricType string, metricName string) (bool, error) {
+	// TODO: implement
+	panic("not implement")
+}
+
+func (t *testTokenStore) FindToken(_ context.Context, tokenHash string) (*auth.Token, error) {
+	token, ok := t.tokens[tokenHash]
+	if !ok {
+		return nil, auth.ErrTokenNotFound
+	}
+
+	return token, nil
+}
+
+func (c *testFollowerConf) FollowFile() string {
+	return c.path
+}
+
+func (c *testFollowerConf) FollowMaxLag() time.Duration {
+	return 0
+}
+
+func (c *testFollowerConf) StoreKeyring() *file.Keyring {
+	return nil
+}
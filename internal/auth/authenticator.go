@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type tokenContextKey struct{}
+
+type Authenticator struct {
+	store TokenStore
+}
+
+func NewAuthenticator(store TokenStore) *Authenticator {
+	return &Authenticator{store: store}
+}
+
+// Require returns a middleware that lets through only requests with a bearer token granting the scope.
+// A nil Authenticator allows every request.
+func (a *Authenticator) Require(scope Scope) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil || a.store == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := a.authenticate(r)
+			if err != nil && !errors.Is(err, ErrMissedToken) && !errors.Is(err, ErrTokenNotFound) {
+				writeError(w, http.StatusInternalServerError, "failed to check token")
+				return
+			}
+			if err != nil {
+				logger.SugarLogger.Errorf("Unauthorized request %v %v: %v", r.Method, r.URL.Path, err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="prometheus_wannabe"`)
+				writeError(w, http.StatusUnauthorized, "invalid or missed bearer token")
+				return
+			}
+
+			err = token.CheckScope(scope)
+			if err != nil {
+				logger.SugarLogger.Errorf("Forbidden request %v %v: %v", r.Method, r.URL.Path, err)
+				writeError(w, http.StatusForbidden, "token has no '"+string(scope)+"' scope")
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), tokenContextKey{}, token)
+			if _, ok := identity.Agent(ctx); !ok {
+				ctx = identity.WithAgent(ctx, token.Name)
+			}
+
+			if token.Tenant != "" {
+				requestTenant, ok := identity.ExplicitTenant(ctx)
+				if ok && requestTenant != token.Tenant {
+					logger.SugarLogger.Errorf("Forbidden request %v %v: token %v is not allowed for tenant %v", r.Method, r.URL.Path, token.Name, requestTenant)
+					writeError(w, http.StatusForbidden, "token is not allowed for tenant '"+requestTenant+"'")
+					return
+				}
+
+				ctx = identity.WithTenant(ctx, token.Tenant)
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// TokenFromContext returns the token the request was authenticated with.
+func TokenFromContext(ctx context.Context) (*Token, bool) {
+	token, ok := ctx.Value(tokenContextKey{}).(*Token)
+	return token, ok
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (*Token, error) {
+	header := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return nil, ErrMissedToken
+	}
+
+	token, err := a.store.FindToken(r.Context(), HashToken(strings.TrimSpace(header[len(prefix):])))
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return nil, err
+		}
+
+		return nil, logger.WrapError("find token", err)
+	}
+
+	return token, nil
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(&errorResponse{Error: message})
+	if err != nil {
+		logger.SugarLogger.Errorf("failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tokenStoreMock struct {
+	tokens map[string]*Token
+	err    error
+}
+
+func TestAuthenticator_Require(t *testing.T) {
+	store := &tokenStoreMock{tokens: map[string]*Token{
+		HashToken("ingestToken"): {Name: "agent", Scopes: []Scope{ScopeIngest}},
+		HashToken("adminToken"):  {Name: "admin", Scopes: []Scope{ScopeAdmin}},
+	}}
+
+	tests := []struct {
+		name            string
+		store           *tokenStoreMock
+		header          string
+		scope           Scope
+		expectedStatus  int
+		expectedError   string
+		expectedAgent   string
+		expectedWWWAuth bool
+	}{
+		{
+			name:            "missed_token",
+			store:           store,
+			scope:           ScopeIngest,
+			expectedStatus:  http.StatusUnauthorized,
+			expectedError:   "invalid or missed bearer token",
+			expectedWWWAuth: true,
+		},
+		{
+			name:            "wrong_scheme",
+			store:           store,
+			header:          "Basic ingestToken",
+			scope:           ScopeIngest,
+			expectedStatus:  http.StatusUnauthorized,
+			expectedError:   "invalid or missed bearer token",
+			expectedWWWAuth: true,
+		},
+		{
+			name:            "unknown_token",
+			store:           store,
+			header:          "Bearer unknownToken",
+			scope:           ScopeIngest,
+			expectedStatus:  http.StatusUnauthorized,
+			expectedError:   "invalid or missed bearer token",
+			expectedWWWAuth: true,
+		},
+		{
+			name:           "insufficient_scope",
+			store:          store,
+			header:         "Bearer ingestToken",
+			scope:          ScopeRead,
+			expectedStatus: http.StatusForbidden,
+			expectedError:  "token has no 'read' scope",
+		},
+		{
+			name:           "store_error",
+			store:          &tokenStoreMock{err: test.ErrTest},
+			header:         "Bearer ingestToken",
+			scope:          ScopeRead,
+			expectedStatus: http.StatusInternalServerError,
+			expectedError:  "failed to check token",
+		},
+		{
+			name:           "success",
+			store:          store,
+			header:         "bearer ingestToken",
+			scope:          ScopeIngest,
+			expectedStatus: http.StatusOK,
+			expectedAgent:  "agent",
+		},
+		{
+			name:           "admin_grants_all",
+			store:          store,
+			header:         "Bearer adminToken",
+			scope:          ScopeRead,
+			expectedStatus: http.StatusOK,
+			expectedAgent:  "admin",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actualAgent := ""
+			handler := NewAuthenticator(tt.store).Require(tt.scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actualAgent, _ = identity.Agent(r.Context())
+				_, ok := TokenFromContext(r.Context())
+				assert.True(t, ok)
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				request.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+
+			actual := w.Result()
+			defer actual.Body.Close()
+
+			assert.Equal(t, tt.expectedStatus, actual.StatusCode)
+			assert.Equal(t, tt.expectedAgent, actualAgent)
+			assert.Equal(t, tt.expectedWWWAuth, actual.Header.Get("WWW-Authenticate") != "")
+			if tt.expectedError != "" {
+				assert.Equal(t, "application/json", actual.Header.Get("Content-Type"))
+				body := errorResponse{}
+				require.NoError(t, json.NewDecoder(actual.Body).Decode(&body))
+				assert.Equal(t, tt.expectedError, body.Error)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_TenantToken(t *testing.T) {
+	store := &tokenStoreMock{tokens: map[string]*Token{
+		HashToken("teamToken"): {Name: "agent", Scopes: []Scope{ScopeIngest}, Tenant: "teamA"},
+	}}
+
+	tests := []struct {
+		name           string
+		requestTenant  string
+		expectedStatus int
+		expectedTenant string
+	}{
+		{name: "token_tenant", expectedStatus: http.StatusOK, expectedTenant: "teamA"},
+		{name: "same_tenant", requestTenant: "teamA", expectedStatus: http.StatusOK, expectedTenant: "teamA"},
+		{name: "other_tenant", requestTenant: "teamB", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actualTenant := ""
+			handler := NewAuthenticator(store).Require(ScopeIngest)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actualTenant = identity.Tenant(r.Context())
+			}))
+
+			request := httptest.NewRequest(http.MethodPost, "/", nil)
+			request.Header.Set("Authorization", "Bearer teamToken")
+			if tt.requestTenant != "" {
+				request = request.WithContext(identity.WithTenant(request.Context(), tt.requestTenant))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedTenant, actualTenant)
+		})
+	}
+}
+
+func TestAuthenticator_Disabled(t *testing.T) {
+	for _, authenticator := range []*Authenticator{nil, NewAuthenticator(nil)} {
+		called := false
+		handler := authenticator.Require(ScopeAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.True(t, called)
+	}
+}
+
+func TestToken_CheckScope(t *testing.T) {
+	token := &Token{Name: "agent", Scopes: []Scope{ScopeIngest}}
+	assert.NoError(t, token.CheckScope(ScopeIngest))
+	assert.ErrorIs(t, token.CheckScope(ScopeRead), ErrInsufficientScope)
+
+	admin := &Token{Name: "admin", Scopes: []Scope{ScopeAdmin}}
+	assert.NoError(t, admin.CheckScope(ScopeRead))
+}
+
+func (s *tokenStoreMock) FindToken(_ context.Context, tokenHash string) (*Token, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	token, ok := s.tokens[tokenHash]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	return token, nil
+}
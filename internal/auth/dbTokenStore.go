@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/database"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+type dbTokenStore struct {
+	dataBase database.TokenDataBase
+}
+
+func NewDBTokenStore(dataBase database.TokenDataBase) TokenStore {
+	return &dbTokenStore{dataBase: dataBase}
+}
+
+func (d *dbTokenStore) FindToken(ctx context.Context, tokenHash string) (*Token, error) {
+	record, err := d.dataBase.ReadToken(ctx, tokenHash)
+	if err != nil {
+		return nil, logger.WrapError("read db token", err)
+	}
+
+	if record == nil || !record.Name.Valid {
+		return nil, ErrTokenNotFound
+	}
+
+	scopes, err := ParseScopes(record.Scopes.String)
+	if err != nil {
+		return nil, logger.WrapError("parse token scopes", err)
+	}
+
+	return &Token{
+		Name:   record.Name.String,
+		Hash:   tokenHash,
+		Scopes: scopes,
+		Tenant: record.Tenant.String,
+	}, nil
+}
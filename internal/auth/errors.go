@@ -0,0 +1,10 @@
+package auth
+
+import "errors"
+
+var (
+	ErrMissedToken       = errors.New("missed bearer token")
+	ErrTokenNotFound     = errors.New("token not found")
+	ErrInsufficientScope = errors.New("insufficient token scope")
+	ErrUnknownScope      = errors.New("unknown token scope")
+)
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+type fileTokenStore struct {
+	tokens map[string]*Token
+}
+
+// NewFileTokenStore loads tokens from a JSON array of {"name", "hash", "scopes"} records.
+func NewFileTokenStore(filePath string) (TokenStore, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, logger.WrapError("read tokens file", err)
+	}
+
+	var tokens []*Token
+	err = json.Unmarshal(content, &tokens)
+	if err != nil {
+		return nil, logger.WrapError("decode tokens file", err)
+	}
+
+	result := &fileTokenStore{tokens: map[string]*Token{}}
+	for _, token := range tokens {
+		for _, scope := range token.Scopes {
+			if err = validateScope(scope); err != nil {
+				return nil, logger.WrapError("load token "+token.Name, err)
+			}
+		}
+
+		result.tokens[token.Hash] = token
+	}
+
+	return result, nil
+}
+
+func (f *fileTokenStore) FindToken(_ context.Context, tokenHash string) (*Token, error) {
+	token, ok := f.tokens[tokenHash]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	return token, nil
+}
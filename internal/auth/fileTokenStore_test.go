@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileTokenStore(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		expectedError string
+		expectedToken *Token
+	}{
+		{
+			name:          "invalid_json",
+			content:       "{",
+			expectedError: "failed to decode tokens file",
+		},
+		{
+			name:          "unknown_scope",
+			content:       `[{"name": "agent", "hash": "` + HashToken("secret") + `", "scopes": ["root"]}]`,
+			expectedError: "failed to validate scope 'root': unknown token scope",
+		},
+		{
+			name:          "success",
+			content:       `[{"name": "agent", "hash": "` + HashToken("secret") + `", "scopes": ["ingest", "read"]}]`,
+			expectedToken: &Token{Name: "agent", Hash: HashToken("secret"), Scopes: []Scope{ScopeIngest, ScopeRead}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "tokens.json")
+			require.NoError(t, os.WriteFile(filePath, []byte(tt.content), 0o600))
+
+			store, err := NewFileTokenStore(filePath)
+			if tt.expectedError != "" {
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			actual, err := store.FindToken(context.Background(), HashToken("secret"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedToken, actual)
+
+			_, err = store.FindToken(context.Background(), HashToken("other"))
+			assert.ErrorIs(t, err, ErrTokenNotFound)
+		})
+	}
+}
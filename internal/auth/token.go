@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+type Scope string
+
+const (
+	ScopeIngest Scope = "ingest"
+	ScopeRead   Scope = "read"
+	ScopeAdmin  Scope = "admin"
+)
+
+type Token struct {
+	Name   string  `json:"name"`
+	Hash   string  `json:"hash"` // hex encoded sha256 of the raw token
+	Scopes []Scope `json:"scopes"`
+	Tenant string  `json:"tenant,omitempty"` // binds the token to a tenant, any tenant is allowed when empty
+}
+
+type TokenStore interface {
+	FindToken(ctx context.Context, tokenHash string) (*Token, error)
+}
+
+// HashToken returns the representation under which a raw token is stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasScope reports whether the token grants the scope. Admin grants every scope.
+func (t *Token) HasScope(scope Scope) bool {
+	for _, tokenScope := range t.Scopes {
+		if tokenScope == scope || tokenScope == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckScope returns ErrInsufficientScope unless the token grants the scope.
+func (t *Token) CheckScope(scope Scope) error {
+	if !t.HasScope(scope) {
+		return fmt.Errorf("check token %s scope %s: %w", t.Name, scope, ErrInsufficientScope)
+	}
+
+	return nil
+}
+
+func ParseScopes(value string) ([]Scope, error) {
+	result := []Scope{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		scope := Scope(item)
+		if err := validateScope(scope); err != nil {
+			return nil, err
+		}
+
+		result = append(result, scope)
+	}
+
+	return result, nil
+}
+
+func validateScope(scope Scope) error {
+	switch scope {
+	case ScopeIngest, ScopeRead, ScopeAdmin:
+		return nil
+	default:
+		return logger.WrapError(fmt.Sprintf("validate scope '%s'", scope), ErrUnknownScope)
+	}
+}
@@ -0,0 +1,222 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+// MetricsPath is the node endpoint serving the series the node owns, it never forwards requests further.
+const MetricsPath = "/api/cluster/metrics"
+
+type clusterConfig interface {
+	ClusterConfigFile() string
+	ClusterNodeID() string
+	ClusterToken() string
+	ClusterTimeout() time.Duration
+}
+
+// Cluster knows the series owners and calls the other nodes.
+type Cluster struct {
+	self      string
+	nodes     []string
+	urls      map[string]string
+	ring      *Ring
+	client    *http.Client
+	token     string
+	converter *model.MetricsConverter
+	registry  *selfmetrics.Registry
+}
+
+func NewCluster(config clusterConfig, converter *model.MetricsConverter, registry *selfmetrics.Registry) (*Cluster, error) {
+	membership, err := LoadMembership(config.ClusterConfigFile())
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClusterWithMembership(config, membership, converter, registry)
+}
+
+func NewClusterWithMembership(config clusterConfig, membership *Membership, converter *model.MetricsConverter, registry *selfmetrics.Registry) (*Cluster, error) {
+	err := membership.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]string, 0, len(membership.Members))
+	urls := map[string]string{}
+	for _, member := range membership.Members {
+		nodes = append(nodes, member.Name)
+		urls[member.Name] = strings.TrimSuffix(member.URL, "/") + MetricsPath
+	}
+	sort.Strings(nodes)
+
+	self := config.ClusterNodeID()
+	if _, ok := urls[self]; !ok {
+		return nil, logger.WrapError(fmt.Sprintf("find node '%s' in cluster members", self), ErrInvalidMembership)
+	}
+
+	return &Cluster{
+		self:      self,
+		nodes:     nodes,
+		urls:      urls,
+		ring:      NewRing(nodes, membership.VirtualNodes),
+		client:    &http.Client{Timeout: config.ClusterTimeout()},
+		token:     config.ClusterToken(),
+		converter: converter,
+		registry:  registry,
+	}, nil
+}
+
+// Owner returns the name of the node owning the series.
+func (c *Cluster) Owner(metricType string, metricName string) string {
+	return c.ring.Owner(metricType, metricName)
+}
+
+func (c *Cluster) Self() string {
+	return c.self
+}
+
+// Nodes returns the names of all the nodes including this one.
+func (c *Cluster) Nodes() []string {
+	return append([]string{}, c.nodes...)
+}
+
+func (c *Cluster) write(ctx context.Context, node string, metricsList []metrics.Metric) ([]metrics.Metric, error) {
+	body := make([]*model.Metrics, len(metricsList))
+	for i, metric := range metricsList {
+		modelMetric, err := c.converter.ToModelMetric(metric)
+		if err != nil {
+			return nil, logger.WrapError("convert metric", err)
+		}
+
+		body[i] = modelMetric
+	}
+
+	result := []*model.Metrics{}
+	err := c.call(ctx, node, http.MethodPost, "", body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.fromModel(result)
+}
+
+func (c *Cluster) read(ctx context.Context, node string, metricType string, metricName string) (metrics.Metric, error) {
+	result := &model.Metrics{}
+	err := c.call(ctx, node, http.MethodGet, seriesPath(metricType, metricName), nil, result)
+	if err != nil {
+		return nil, err
+	}
+
+	metric, err := c.converter.FromModelMetric(result)
+	if err != nil {
+		return nil, logger.WrapError("convert node metric", err)
+	}
+
+	return metric, nil
+}
+
+func (c *Cluster) readAll(ctx context.Context, node string) ([]metrics.Metric, error) {
+	result := []*model.Metrics{}
+	err := c.call(ctx, node, http.MethodGet, "", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.fromModel(result)
+}
+
+func (c *Cluster) delete(ctx context.Context, node string, metricType string, metricName string) error {
+	return c.call(ctx, node, http.MethodDelete, seriesPath(metricType, metricName), nil, nil)
+}
+
+// call sends the request in the tenant of ctx, a missed series is reported as metrics.ErrMetricNotFound.
+func (c *Cluster) call(ctx context.Context, node string, method string, path string, body any, result any) error {
+	c.registry.Counter("ClusterRequests." + node).Inc()
+	err := c.doCall(ctx, node, method, path, body, result)
+	if err != nil && !errors.Is(err, metrics.ErrMetricNotFound) {
+		c.registry.Counter("ClusterRequestErrors." + node).Inc()
+		return logger.WrapError("call node "+node, err)
+	}
+
+	return err
+}
+
+func (c *Cluster) doCall(ctx context.Context, node string, method string, path string, body any, result any) error {
+	var content io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return logger.WrapError("marshal request", err)
+		}
+
+		content = bytes.NewReader(payload)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, c.urls[node]+path, content)
+	if err != nil {
+		return logger.WrapError("create request", err)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(identity.TenantHeader, identity.Tenant(ctx))
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return logger.WrapError("send request", err)
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return metrics.ErrMetricNotFound
+	case response.StatusCode >= http.StatusMultipleChoices:
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return logger.WrapError(fmt.Sprintf("node status %v: %s", response.StatusCode, message), ErrUnexpectedStatusCode)
+	case result == nil:
+		return nil
+	}
+
+	err = json.NewDecoder(response.Body).Decode(result)
+	if err != nil {
+		return logger.WrapError("decode response", err)
+	}
+
+	return nil
+}
+
+func (c *Cluster) fromModel(modelMetrics []*model.Metrics) ([]metrics.Metric, error) {
+	result := make([]metrics.Metric, len(modelMetrics))
+	for i, modelMetric := range modelMetrics {
+		metric, err := c.converter.FromModelMetric(modelMetric)
+		if err != nil {
+			return nil, logger.WrapError("convert node metric", err)
+		}
+
+		result[i] = metric
+	}
+
+	return result, nil
+}
+
+func seriesPath(metricType string, metricName string) string {
+	return "/" + url.PathEscape(metricType) + "/" + url.PathEscape(metricName)
+}
@@ -0,0 +1,8 @@
+package cluster
+
+import "errors"
+
+var (
+	ErrInvalidMembership    = errors.New("invalid cluster membership")
+	ErrUnexpectedStatusCode = errors.New("unexpected status code")
+)
@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+type Member struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Membership is the static cluster configuration, every node has to use the same one.
+type Membership struct {
+	VirtualNodes int      `json:"virtualNodes,omitempty"`
+	Members      []Member `json:"members"`
+}
+
+func LoadMembership(path string) (*Membership, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, logger.WrapError("read cluster config", err)
+	}
+
+	membership := &Membership{}
+	err = json.Unmarshal(content, membership)
+	if err != nil {
+		return nil, logger.WrapError("decode cluster config", err)
+	}
+
+	err = membership.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return membership, nil
+}
+
+func (m *Membership) Validate() error {
+	if len(m.Members) == 0 {
+		return logger.WrapError("validate cluster config: no members", ErrInvalidMembership)
+	}
+
+	names := map[string]bool{}
+	for _, member := range m.Members {
+		parsed, err := url.Parse(member.URL)
+		if member.Name == "" || names[member.Name] || err != nil || parsed.Host == "" {
+			return logger.WrapError(fmt.Sprintf("validate cluster member '%s'", member.Name), ErrInvalidMembership)
+		}
+
+		names[member.Name] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes spreads the series evenly enough for a handful of nodes.
+const DefaultVirtualNodes = 128
+
+// Ring assigns series to nodes by consistent hashing, so a membership change moves only the series of the changed node.
+type Ring struct {
+	points []uint64
+	owners []string
+}
+
+func NewRing(nodes []string, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	type point struct {
+		hash  uint64
+		owner string
+	}
+
+	points := make([]point, 0, len(nodes)*virtualNodes)
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{hash: hashKey(node + "#" + strconv.Itoa(i)), owner: node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	ring := &Ring{points: make([]uint64, len(points)), owners: make([]string, len(points))}
+	for i, item := range points {
+		ring.points[i] = item.hash
+		ring.owners[i] = item.owner
+	}
+
+	return ring
+}
+
+// Owner returns the node owning the series, the tenant does not affect the placement.
+func (r *Ring) Owner(metricType string, metricName string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := hashKey(metricType + "/" + metricName)
+	index := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if index == len(r.points) {
+		index = 0
+	}
+
+	return r.owners[index]
+}
+
+func hashKey(key string) uint64 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
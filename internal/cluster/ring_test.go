@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Owner(t *testing.T) {
+	ring := NewRing([]string{"a", "b", "c"}, 0)
+	owners := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		name := "metric" + strconv.Itoa(i)
+		owner := ring.Owner("gauge", name)
+		assert.Equal(t, owner, NewRing([]string{"c", "a", "b"}, 0).Owner("gauge", name))
+		owners[owner]++
+	}
+
+	assert.Len(t, owners, 3)
+	for _, count := range owners {
+		assert.Greater(t, count, 500)
+	}
+
+	assert.Equal(t, "", NewRing(nil, 0).Owner("gauge", "Alloc"))
+}
+
+func TestRing_AddNode(t *testing.T) {
+	before := NewRing([]string{"a", "b", "c"}, 0)
+	after := NewRing([]string{"a", "b", "c", "d"}, 0)
+
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		name := "metric" + strconv.Itoa(i)
+		oldOwner, newOwner := before.Owner("counter", name), after.Owner("counter", name)
+		if oldOwner != newOwner {
+			assert.Equal(t, "d", newOwner)
+			moved++
+		}
+	}
+
+	// about a quarter of the series moves to the new node
+	assert.Greater(t, moved, 400)
+	assert.Less(t, moved, 1200)
+}
+
+func TestMembership_Validate(t *testing.T) {
+	tests := []struct {
+		name          string
+		membership    Membership
+		expectedError bool
+	}{
+		{
+			name:       "success",
+			membership: Membership{Members: []Member{{Name: "a", URL: "http://a:8080"}, {Name: "b", URL: "http://b:8080"}}},
+		},
+		{
+			name:          "no_members",
+			membership:    Membership{},
+			expectedError: true,
+		},
+		{
+			name:          "duplicate_member",
+			membership:    Membership{Members: []Member{{Name: "a", URL: "http://a:8080"}, {Name: "a", URL: "http://b:8080"}}},
+			expectedError: true,
+		},
+		{
+			name:          "invalid_url",
+			membership:    Membership{Members: []Member{{Name: "a", URL: "a:8080/"}}},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.membership.Validate()
+			if tt.expectedError {
+				assert.ErrorIs(t, err, ErrInvalidMembership)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
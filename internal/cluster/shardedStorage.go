@@ -0,0 +1,182 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type shardedStorage struct {
+	local   storage.MetricsStorage
+	cluster *Cluster
+}
+
+// NewShardedStorage keeps the owned series in the local storage and forwards the others to their owners.
+// Listing gathers the series of all nodes, tenants and history are served from the local storage only.
+func NewShardedStorage(local storage.MetricsStorage, cluster *Cluster) storage.MetricsStorage {
+	return &shardedStorage{local: local, cluster: cluster}
+}
+
+// AddMetricValues writes the remote shards in parallel and the local shard only after all of them succeeded,
+// so a failed request retried by the agent does not add the counter deltas to the local series twice.
+func (s *shardedStorage) AddMetricValues(ctx context.Context, metricsList []metrics.Metric) ([]metrics.Metric, error) {
+	indexesByNode := map[string][]int{}
+	for i, metric := range metricsList {
+		owner := s.cluster.Owner(metric.GetType(), metric.GetName())
+		indexesByNode[owner] = append(indexesByNode[owner], i)
+	}
+
+	result := make([]metrics.Metric, len(metricsList))
+	lock := sync.Mutex{}
+	group, groupCtx := errgroup.WithContext(ctx)
+	for node, indexes := range indexesByNode {
+		if node == s.cluster.Self() {
+			continue
+		}
+
+		node, indexes := node, indexes
+		group.Go(func() error {
+			updated, err := s.cluster.write(groupCtx, node, shardMetrics(metricsList, indexes))
+			if err != nil {
+				return err
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			setShardResult(result, indexes, updated)
+			return nil
+		})
+	}
+
+	err := group.Wait()
+	if err != nil {
+		return nil, logger.WrapError("add metric values to cluster", err)
+	}
+
+	if indexes, ok := indexesByNode[s.cluster.Self()]; ok {
+		updated, err := s.local.AddMetricValues(ctx, shardMetrics(metricsList, indexes))
+		if err != nil {
+			return nil, logger.WrapError("add metric values to local shard", err)
+		}
+
+		setShardResult(result, indexes, updated)
+	}
+
+	return result, nil
+}
+
+func (s *shardedStorage) GetMetricValues(ctx context.Context) (map[string]map[string]string, error) {
+	result, err := s.local.GetMetricValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := sync.Mutex{}
+	group, groupCtx := errgroup.WithContext(ctx)
+	for _, node := range s.cluster.Nodes() {
+		if node == s.cluster.Self() {
+			continue
+		}
+
+		node := node
+		group.Go(func() error {
+			nodeMetrics, err := s.cluster.readAll(groupCtx, node)
+			if err != nil {
+				return err
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			for _, metric := range nodeMetrics {
+				values, ok := result[metric.GetType()]
+				if !ok {
+					values = map[string]string{}
+					result[metric.GetType()] = values
+				}
+
+				values[metric.GetName()] = metric.GetStringValue()
+			}
+
+			return nil
+		})
+	}
+
+	err = group.Wait()
+	if err != nil {
+		return nil, logger.WrapError("gather cluster metrics", err)
+	}
+
+	return result, nil
+}
+
+func (s *shardedStorage) GetMetric(ctx context.Context, metricType string, metricName string) (metrics.Metric, error) {
+	owner := s.cluster.Owner(metricType, metricName)
+	if owner == s.cluster.Self() {
+		return s.local.GetMetric(ctx, metricType, metricName)
+	}
+
+	return s.cluster.read(ctx, owner, metricType, metricName)
+}
+
+func (s *shardedStorage) DeleteMetric(ctx context.Context, metricType string, metricName string) error {
+	owner := s.cluster.Owner(metricType, metricName)
+	if owner != s.cluster.Self() {
+		return s.cluster.delete(ctx, owner, metricType, metricName)
+	}
+
+	deleter, ok := s.local.(storage.MetricsDeleter)
+	if !ok {
+		return metrics.ErrDeleteNotSupported
+	}
+
+	return deleter.DeleteMetric(ctx, metricType, metricName)
+}
+
+func (s *shardedStorage) GetTenants(ctx context.Context) ([]string, error) {
+	return s.local.GetTenants(ctx)
+}
+
+func (s *shardedStorage) Restore(ctx context.Context, metricValues map[string]map[string]string) error {
+	return s.local.Restore(ctx, metricValues)
+}
+
+func (s *shardedStorage) GetMetricHistory(ctx context.Context, metricType string, metricName string, since time.Time) ([]storage.Sample, error) {
+	history, ok := s.local.(storage.HistoryStorage)
+	if !ok {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	return history.GetMetricHistory(ctx, metricType, metricName, since)
+}
+
+func (s *shardedStorage) GetHistory(ctx context.Context, since time.Time) (map[string]map[string][]storage.Sample, error) {
+	history, ok := s.local.(storage.HistoryStorage)
+	if !ok {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	return history.GetHistory(ctx, since)
+}
+
+func shardMetrics(metricsList []metrics.Metric, indexes []int) []metrics.Metric {
+	result := make([]metrics.Metric, len(indexes))
+	for i, index := range indexes {
+		result[i] = metricsList[index]
+	}
+
+	return result
+}
+
+func setShardResult(result []metrics.Metric, indexes []int, updated []metrics.Metric) {
+	for i, index := range indexes {
+		if i < len(updated) {
+			result[index] = updated[i]
+		}
+	}
+}
@@ -14,6 +14,12 @@ type Config struct {
 	SendMetricsInterval   int          `env:"REPORT_INTERVAL"`
 	UpdateMetricsInterval int          `env:"POLL_INTERVAL"`
 	LogLevel              logrus.Level `env:"LOG_LEVEL"`
+	TLSCA                 string       `env:"TLS_CA_FILE"`
+	TLSCert               string       `env:"TLS_CERT_FILE"`
+	TLSKey                string       `env:"TLS_KEY_FILE"`
+	Token                 string       `env:"API_TOKEN"`
+	TenantID              string       `env:"TENANT"`
+	ShutdownTimeout       int          `env:"SHUTDOWN_TIMEOUT"`
 	CollectMetricsList    []string
 }
 
@@ -29,6 +35,10 @@ func (c *Config) PushMetricsTimeout() time.Duration {
 	return time.Duration(c.PushTimeout) * time.Second
 }
 
+func (c *Config) FinalPushTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
 func (c *Config) ParallelLimit() int {
 	return c.PushRateLimit
 }
@@ -40,3 +50,23 @@ func (c *Config) GetKey() []byte {
 func (c *Config) SignMetrics() bool {
 	return c.Key != ""
 }
+
+func (c *Config) TLSCAFile() string {
+	return c.TLSCA
+}
+
+func (c *Config) TLSCertFile() string {
+	return c.TLSCert
+}
+
+func (c *Config) TLSKeyFile() string {
+	return c.TLSKey
+}
+
+func (c *Config) APIToken() string {
+	return c.Token
+}
+
+func (c *Config) Tenant() string {
+	return c.TenantID
+}
@@ -0,0 +1,9 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS apiToken (
+                                        hash TEXT PRIMARY KEY,
+                                        name TEXT NOT NULL,
+                                        scopes TEXT NOT NULL DEFAULT ''
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS apiToken;
@@ -0,0 +1,31 @@
+-- +goose Up
+ALTER TABLE metric ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
+DROP INDEX IF EXISTS metric_name_type_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS metric_tenant_name_type_idx ON metric (tenant, name, typeId);
+
+ALTER TABLE apiToken ADD COLUMN IF NOT EXISTS tenant TEXT;
+
+-- +goose StatementBegin
+CREATE OR REPLACE PROCEDURE UpdateOrCreateMetric(metricTenant TEXT, metricType TEXT, metricName TEXT, metricValue DOUBLE PRECISION)
+LANGUAGE plpgsql
+AS $$
+DECLARE
+    metricTypeId SMALLINT;
+BEGIN
+    SELECT id INTO metricTypeId FROM metricType WHERE name = metricType;
+    IF metricTypeId IS NULL THEN
+        INSERT INTO metricType(name) VALUES (metricType) RETURNING id INTO metricTypeId;
+    END IF;
+
+    INSERT INTO metric(tenant, name, typeId, value) VALUES (metricTenant, metricName, metricTypeId, metricValue)
+    ON CONFLICT (tenant, name, typeId) DO UPDATE SET value = EXCLUDED.value;
+END;
+$$;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP PROCEDURE IF EXISTS UpdateOrCreateMetric(TEXT, TEXT, TEXT, DOUBLE PRECISION);
+ALTER TABLE apiToken DROP COLUMN IF EXISTS tenant;
+DROP INDEX IF EXISTS metric_tenant_name_type_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS metric_name_type_idx ON metric (name, typeId);
+ALTER TABLE metric DROP COLUMN IF EXISTS tenant;
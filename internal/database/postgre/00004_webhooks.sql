@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS webhook (
+                                       id TEXT PRIMARY KEY,
+                                       tenant TEXT NOT NULL DEFAULT 'default',
+                                       url TEXT NOT NULL,
+                                       secret TEXT NOT NULL,
+                                       metricType TEXT NOT NULL DEFAULT '',
+                                       metricName TEXT NOT NULL DEFAULT '',
+                                       conditionOp TEXT,
+                                       conditionValue DOUBLE PRECISION
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS webhook;
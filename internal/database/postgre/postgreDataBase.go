@@ -3,11 +3,15 @@ package postgre
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/sirupsen/logrus"
 
 	"github.com/MlDenis/prometheus_wannabe/internal/database"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
 )
 
 type PostgresDataaBaseConfig interface {
@@ -15,48 +19,58 @@ type PostgresDataaBaseConfig interface {
 }
 
 type postgresDataBase struct {
-	conn *sql.DB
+	conn     *sql.DB
+	registry *selfmetrics.Registry
 }
 
-func NewPostgresDataBase(ctx context.Context, conf PostgresDataaBaseConfig) (database.DataBase, error) {
+func NewPostgresDataBase(ctx context.Context, conf PostgresDataaBaseConfig, registry *selfmetrics.Registry) (database.DataBase, error) {
 	conn, err := initDB(ctx, conf.GetConnectionString())
 	if err != nil {
 		return nil, err
 	}
 
-	return &postgresDataBase{conn: conn}, nil
+	return &postgresDataBase{conn: conn, registry: registry}, nil
 }
 
-func (p *postgresDataBase) UpdateItems(ctx context.Context, records []*database.DBItem) error {
+func (p *postgresDataBase) UpdateItems(ctx context.Context, records []*database.DBItem) (err error) {
+	defer p.observe("UpdateItems", time.Now(), &err)
+	p.registry.Histogram("DBUpdateBatchSize", selfmetrics.BatchSizeBuckets).Observe(float64(len(records)))
+
 	return p.callInTransaction(ctx, func(ctx context.Context, tx *sql.Tx) error {
-		for _, record := range records {
-			// statements for stored procedure are stored in a db
-			_, err := tx.ExecContext(ctx, "CALL UpdateOrCreateMetric"+"(@metricType, @metricName, @metricValue)", pgx.NamedArgs{
-				"metricType":  record.MetricType.String,
-				"metricName":  record.Name.String,
-				"metricValue": record.Value.Float64})
-
-			if err != nil {
-				return err
-			}
+		return updateRecords(ctx, tx, records)
+	})
+}
+
+func (p *postgresDataBase) ReplaceItems(ctx context.Context, tenant string, records []*database.DBItem) (err error) {
+	defer p.observe("ReplaceItems", time.Now(), &err)
+
+	// the readers see either the previous or the new tenant records
+	return p.callInTransaction(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM metric WHERE tenant = @metricTenant", pgx.NamedArgs{"metricTenant": tenant})
+		if err != nil {
+			return err
 		}
 
-		return nil
+		return updateRecords(ctx, tx, records)
 	})
 }
 
-func (p *postgresDataBase) ReadItem(ctx context.Context, metricType string, metricName string) (*database.DBItem, error) {
+func (p *postgresDataBase) ReadItem(ctx context.Context, tenant string, metricType string, metricName string) (_ *database.DBItem, err error) {
+	defer p.observe("ReadItem", time.Now(), &err)
+
 	result, err := p.callInTransactionResult(ctx, func(ctx context.Context, tx *sql.Tx) ([]*database.DBItem, error) {
-		const command = "SELECT mt.name, m.name, m.value " +
+		const command = "SELECT m.tenant, mt.name, m.name, m.value " +
 			"FROM metric m " +
 			"JOIN metricType mt ON m.typeId = mt.id " +
 			"WHERE " +
-			"	m.name = @metricName " +
+			"	m.tenant = @metricTenant " +
+			"	and m.name = @metricName " +
 			"	and mt.name = @metricType"
 
 		return p.readRecords(ctx, tx, command, pgx.NamedArgs{
-			"metricType": metricType,
-			"metricName": metricName,
+			"metricTenant": tenant,
+			"metricType":   metricType,
+			"metricName":   metricName,
 		})
 	})
 
@@ -70,23 +84,167 @@ func (p *postgresDataBase) ReadItem(ctx context.Context, metricType string, metr
 	}
 
 	if count > 1 {
-		logrus.Errorf("More than one metric in logical primary key: %v, %v", metricType, metricName)
+		logrus.Errorf("More than one metric in logical primary key: %v, %v, %v", tenant, metricType, metricName)
 	}
 
 	return result[0], nil
 }
 
-func (p *postgresDataBase) ReadAllItems(ctx context.Context) ([]*database.DBItem, error) {
+func (p *postgresDataBase) ReadAllItems(ctx context.Context, tenant string) (_ []*database.DBItem, err error) {
+	defer p.observe("ReadAllItems", time.Now(), &err)
+
 	return p.callInTransactionResult(ctx, func(ctx context.Context, tx *sql.Tx) ([]*database.DBItem, error) {
-		const command = "SELECT mt.name, m.name, m.value " +
+		const command = "SELECT m.tenant, mt.name, m.name, m.value " +
 			"FROM metric m " +
-			"JOIN metricType mt on m.typeId = mt.id"
+			"JOIN metricType mt on m.typeId = mt.id " +
+			"WHERE m.tenant = @metricTenant"
+
+		return p.readRecords(ctx, tx, command, pgx.NamedArgs{"metricTenant": tenant})
+	})
+}
+
+func (p *postgresDataBase) ReadTenants(ctx context.Context) (_ []string, err error) {
+	defer p.observe("ReadTenants", time.Now(), &err)
+
+	rows, err := p.conn.QueryContext(ctx, "SELECT DISTINCT tenant FROM metric ORDER BY tenant")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var tenant string
+		err = rows.Scan(&tenant)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, tenant)
+	}
+
+	return result, rows.Err()
+}
+
+func (p *postgresDataBase) DeleteItem(ctx context.Context, tenant string, metricType string, metricName string) (_ bool, err error) {
+	defer p.observe("DeleteItem", time.Now(), &err)
+
+	const command = "DELETE FROM metric m " +
+		"USING metricType mt " +
+		"WHERE m.typeId = mt.id " +
+		"	and m.tenant = @metricTenant " +
+		"	and m.name = @metricName " +
+		"	and mt.name = @metricType"
+
+	result, err := p.conn.ExecContext(ctx, command, pgx.NamedArgs{
+		"metricTenant": tenant,
+		"metricType":   metricType,
+		"metricName":   metricName,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (p *postgresDataBase) ReadToken(ctx context.Context, tokenHash string) (_ *database.TokenItem, err error) {
+	defer p.observe("ReadToken", time.Now(), &err)
+
+	const command = "SELECT name, hash, scopes, tenant FROM apiToken WHERE hash = $1"
+
+	var record database.TokenItem
+	err = p.conn.QueryRowContext(ctx, command, tokenHash).Scan(&record.Name, &record.Hash, &record.Scopes, &record.Tenant)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func (p *postgresDataBase) ReadWebhooks(ctx context.Context) (_ []*database.WebhookItem, err error) {
+	defer p.observe("ReadWebhooks", time.Now(), &err)
+
+	const command = "SELECT id, tenant, url, secret, metricType, metricName, conditionOp, conditionValue FROM webhook ORDER BY id"
+
+	rows, err := p.conn.QueryContext(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*database.WebhookItem{}
+	for rows.Next() {
+		var record database.WebhookItem
+		err = rows.Scan(&record.ID, &record.Tenant, &record.URL, &record.Secret, &record.MetricType, &record.MetricName, &record.ConditionOp, &record.ConditionValue)
+		if err != nil {
+			return nil, err
+		}
 
-		return p.readRecords(ctx, tx, command)
+		result = append(result, &record)
+	}
+
+	return result, rows.Err()
+}
+
+func (p *postgresDataBase) SaveWebhook(ctx context.Context, record *database.WebhookItem) (err error) {
+	defer p.observe("SaveWebhook", time.Now(), &err)
+
+	const command = "INSERT INTO webhook(id, tenant, url, secret, metricType, metricName, conditionOp, conditionValue) " +
+		"VALUES (@id, @tenant, @url, @secret, @metricType, @metricName, @conditionOp, @conditionValue)"
+
+	_, err = p.conn.ExecContext(ctx, command, pgx.NamedArgs{
+		"id":             record.ID,
+		"tenant":         record.Tenant,
+		"url":            record.URL,
+		"secret":         record.Secret,
+		"metricType":     record.MetricType,
+		"metricName":     record.MetricName,
+		"conditionOp":    record.ConditionOp,
+		"conditionValue": record.ConditionValue,
 	})
+
+	return err
 }
 
-func (p *postgresDataBase) Ping(ctx context.Context) error {
+func (p *postgresDataBase) DeleteWebhook(ctx context.Context, tenant string, id string) (err error) {
+	defer p.observe("DeleteWebhook", time.Now(), &err)
+
+	_, err = p.conn.ExecContext(ctx, "DELETE FROM webhook WHERE tenant = $1 AND id = $2", tenant, id)
+	return err
+}
+
+// AcquireLock takes a session advisory lock on a dedicated connection, so the lock lives as long as the connection.
+func (p *postgresDataBase) AcquireLock(ctx context.Context, key int64) (_ database.Lock, err error) {
+	defer p.observe("AcquireLock", time.Now(), &err)
+
+	conn, err := p.conn.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	acquired := false
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired)
+	if err != nil || !acquired {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &advisoryLock{conn: conn, key: key}, nil
+}
+
+func (p *postgresDataBase) Ping(ctx context.Context) (err error) {
+	defer p.observe("Ping", time.Now(), &err)
+
 	return p.conn.PingContext(ctx)
 }
 
@@ -94,6 +252,15 @@ func (p *postgresDataBase) Close() error {
 	return p.conn.Close()
 }
 
+// observe counts the call and its error and observes the call duration.
+func (p *postgresDataBase) observe(operation string, started time.Time, err *error) {
+	p.registry.Counter("DBQueries." + operation).Inc()
+	p.registry.Histogram("DBQueryDuration."+operation, selfmetrics.DurationBuckets).Observe(time.Since(started).Seconds())
+	if *err != nil {
+		p.registry.Counter("DBErrors." + operation).Inc()
+	}
+}
+
 func (p *postgresDataBase) callInTransaction(ctx context.Context, action func(context.Context, *sql.Tx) error) error {
 	_, err := p.callInTransactionResult(ctx, func(ctx context.Context, tx *sql.Tx) ([]*database.DBItem, error) {
 		return nil, action(ctx, tx)
@@ -127,6 +294,23 @@ func (p *postgresDataBase) callInTransactionResult(ctx context.Context, action f
 	return result, nil
 }
 
+func updateRecords(ctx context.Context, tx *sql.Tx, records []*database.DBItem) error {
+	for _, record := range records {
+		// statements for stored procedure are stored in a db
+		_, err := tx.ExecContext(ctx, "CALL UpdateOrCreateMetric"+"(@metricTenant, @metricType, @metricName, @metricValue)", pgx.NamedArgs{
+			"metricTenant": record.Tenant.String,
+			"metricType":   record.MetricType.String,
+			"metricName":   record.Name.String,
+			"metricValue":  record.Value.Float64})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (p *postgresDataBase) readRecords(ctx context.Context, tx *sql.Tx, command string, args ...any) ([]*database.DBItem, error) {
 	rows, err := tx.QueryContext(ctx, command, args...)
 
@@ -137,7 +321,7 @@ func (p *postgresDataBase) readRecords(ctx context.Context, tx *sql.Tx, command
 	result := []*database.DBItem{}
 	for rows.Next() {
 		var record database.DBItem
-		err = rows.Scan(&record.MetricType, &record.Name, &record.Value)
+		err = rows.Scan(&record.Tenant, &record.MetricType, &record.Name, &record.Value)
 		if err != nil {
 			return nil, err
 		}
@@ -152,3 +336,28 @@ func (p *postgresDataBase) readRecords(ctx context.Context, tx *sql.Tx, command
 
 	return result, nil
 }
+
+type advisoryLock struct {
+	conn *sql.Conn
+	key  int64
+}
+
+// Check verifies the session holding the lock is alive.
+func (l *advisoryLock) Check(ctx context.Context) error {
+	return l.conn.PingContext(ctx)
+}
+
+func (l *advisoryLock) Release(ctx context.Context) error {
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	if err != nil {
+		// a bad connection is not returned to the pool, closing the session releases the lock
+		_ = l.conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+
+	closeErr := l.conn.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
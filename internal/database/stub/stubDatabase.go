@@ -12,14 +12,26 @@ func (s *StubDataBase) UpdateItems(context.Context, []*database.DBItem) error {
 	return nil
 }
 
-func (s *StubDataBase) ReadItem(context.Context, string, string) (*database.DBItem, error) {
+func (s *StubDataBase) ReplaceItems(context.Context, string, []*database.DBItem) error {
+	return nil
+}
+
+func (s *StubDataBase) ReadItem(context.Context, string, string, string) (*database.DBItem, error) {
+	return nil, nil
+}
+
+func (s *StubDataBase) ReadAllItems(context.Context, string) ([]*database.DBItem, error) {
 	return nil, nil
 }
 
-func (s *StubDataBase) ReadAllItems(context.Context) ([]*database.DBItem, error) {
+func (s *StubDataBase) ReadTenants(context.Context) ([]string, error) {
 	return nil, nil
 }
 
+func (s *StubDataBase) DeleteItem(context.Context, string, string, string) (bool, error) {
+	return false, nil
+}
+
 func (s *StubDataBase) Ping(context.Context) error {
 	return nil
 }
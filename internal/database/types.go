@@ -13,12 +13,56 @@ type DataBase interface {
 	io.Closer
 
 	UpdateItems(ctx context.Context, records []*DBItem) error
-	ReadItem(ctx context.Context, metricType string, metricName string) (*DBItem, error)
-	ReadAllItems(ctx context.Context) ([]*DBItem, error)
+	// ReplaceItems sets the tenant records to the given ones, the other records of the tenant are deleted.
+	ReplaceItems(ctx context.Context, tenant string, records []*DBItem) error
+	ReadItem(ctx context.Context, tenant string, metricType string, metricName string) (*DBItem, error)
+	ReadAllItems(ctx context.Context, tenant string) ([]*DBItem, error)
+	ReadTenants(ctx context.Context) ([]string, error)
+	DeleteItem(ctx context.Context, tenant string, metricType string, metricName string) (bool, error)
 }
 
 type DBItem struct {
+	Tenant     sql.NullString
 	MetricType sql.NullString
 	Name       sql.NullString
 	Value      sql.NullFloat64
 }
+
+type LockDataBase interface {
+	// AcquireLock takes the lock without waiting, the result is nil when another session holds it.
+	AcquireLock(ctx context.Context, key int64) (Lock, error)
+}
+
+// Lock is held until it is released or its database session is lost.
+type Lock interface {
+	Check(ctx context.Context) error
+	Release(ctx context.Context) error
+}
+
+type TokenDataBase interface {
+	ReadToken(ctx context.Context, tokenHash string) (*TokenItem, error)
+}
+
+type TokenItem struct {
+	Name   sql.NullString
+	Hash   sql.NullString
+	Scopes sql.NullString // comma separated
+	Tenant sql.NullString // empty when the token is not bound to a tenant
+}
+
+type WebhookDataBase interface {
+	ReadWebhooks(ctx context.Context) ([]*WebhookItem, error)
+	SaveWebhook(ctx context.Context, record *WebhookItem) error
+	DeleteWebhook(ctx context.Context, tenant string, id string) error
+}
+
+type WebhookItem struct {
+	ID             sql.NullString
+	Tenant         sql.NullString
+	URL            sql.NullString
+	Secret         sql.NullString
+	MetricType     sql.NullString // empty matches any type
+	MetricName     sql.NullString // shell pattern, empty matches any name
+	ConditionOp    sql.NullString // null when the webhook has no condition
+	ConditionValue sql.NullFloat64
+}
@@ -0,0 +1,62 @@
+package dump
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+// Format is the layout of a dump, NDJSON holds a series per line, tar holds a JSON array of series per tenant.
+type Format string
+
+const (
+	FormatNDJSON Format = "ndjson"
+	FormatTar    Format = "tar"
+)
+
+// Mode is the way a dump is applied to the current state.
+type Mode string
+
+const (
+	// ModeMerge updates the dumped series and keeps the others.
+	ModeMerge Mode = "merge"
+	// ModeReplace makes the dump the whole state, the series and tenants missed in the dump are removed.
+	ModeReplace Mode = "replace"
+)
+
+// Series is a dump record.
+type Series struct {
+	Tenant string  `json:"tenant"`
+	Type   string  `json:"type"`
+	Name   string  `json:"name"`
+	Value  float64 `json:"value"`
+	// the time of the last sample, set when the storage keeps the history
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+func (f Format) Validate() error {
+	switch f {
+	case FormatNDJSON, FormatTar:
+		return nil
+	default:
+		return logger.WrapError(fmt.Sprintf("validate dump format '%s'", f), ErrUnknownFormat)
+	}
+}
+
+func (f Format) ContentType() string {
+	if f == FormatTar {
+		return "application/x-tar"
+	}
+
+	return "application/x-ndjson"
+}
+
+func (m Mode) Validate() error {
+	switch m {
+	case ModeMerge, ModeReplace:
+		return nil
+	default:
+		return logger.WrapError(fmt.Sprintf("validate import mode '%s'", m), ErrUnknownMode)
+	}
+}
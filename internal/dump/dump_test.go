@@ -0,0 +1,134 @@
+package dump
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport_Read(t *testing.T) {
+	source := memory.NewInMemoryStorageWithHistory(memory.DefaultHistorySize)
+	_, err := source.AddMetricValues(context.Background(), []metrics.Metric{
+		test.CreateCounterMetric("PollCount", 5),
+		test.CreateGaugeMetric("Sys", 1.5),
+	})
+	require.NoError(t, err)
+	_, err = source.AddMetricValues(identity.WithTenant(context.Background(), "teamA"), []metrics.Metric{
+		test.CreateGaugeMetric("Sys", 2.5),
+	})
+	require.NoError(t, err)
+
+	expected := State{
+		"default": {"counter": {"PollCount": "5"}, "gauge": {"Sys": "1.5"}},
+		"teamA":   {"gauge": {"Sys": "2.5"}},
+	}
+
+	for _, format := range []Format{FormatNDJSON, FormatTar} {
+		t.Run(string(format), func(t *testing.T) {
+			content := &bytes.Buffer{}
+			require.NoError(t, Export(context.Background(), source, format, content))
+
+			if format == FormatTar {
+				header, err := tar.NewReader(bytes.NewReader(content.Bytes())).Next()
+				require.NoError(t, err)
+				assert.Equal(t, "tenants/default.json", header.Name)
+			} else {
+				lines := strings.Split(strings.TrimSpace(content.String()), "\n")
+				require.Len(t, lines, 3)
+				assert.Contains(t, lines[0], `{"tenant":"default","type":"counter","name":"PollCount","value":5,"updated":"`)
+			}
+
+			actual, count, err := Read(format, content)
+			require.NoError(t, err)
+			assert.Equal(t, 3, count)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name          string
+		dump          string
+		expectedState State
+		expectedError error
+	}{
+		{
+			name:          "empty",
+			expectedState: State{},
+		},
+		{
+			name:          "default_tenant_last_wins",
+			dump:          `{"type":"gauge","name":"Sys","value":1}` + "\n\n" + `{"tenant":"default","type":"gauge","name":"Sys","value":2}`,
+			expectedState: State{"default": {"gauge": {"Sys": "2"}}},
+		},
+		{
+			name:          "invalid_json",
+			dump:          `{"type":"gauge"`,
+			expectedError: ErrInvalidDump,
+		},
+		{
+			name:          "unknown_type",
+			dump:          `{"type":"histogram","name":"Sys","value":1}`,
+			expectedError: ErrInvalidDump,
+		},
+		{
+			name:          "missed_name",
+			dump:          `{"type":"gauge","value":1}`,
+			expectedError: ErrInvalidDump,
+		},
+		{
+			name:          "invalid_tenant",
+			dump:          `{"tenant":"../etc","type":"gauge","name":"Sys","value":1}`,
+			expectedError: ErrInvalidDump,
+		},
+		{
+			name:          "large_counter",
+			dump:          `{"type":"counter","name":"PollCount","value":9007199254740992}`,
+			expectedState: State{"default": {"counter": {"PollCount": "9007199254740992"}}},
+		},
+		{
+			name:          "fractional_counter",
+			dump:          `{"type":"counter","name":"PollCount","value":1.5}`,
+			expectedError: ErrInvalidDump,
+		},
+		{
+			name:          "out_of_range_counter",
+			dump:          `{"type":"counter","name":"PollCount","value":1e19}`,
+			expectedError: ErrInvalidDump,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, _, err := Read(FormatNDJSON, strings.NewReader(tt.dump))
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedState, actual)
+		})
+	}
+}
+
+func TestFormat_Validate(t *testing.T) {
+	assert.NoError(t, FormatNDJSON.Validate())
+	assert.NoError(t, FormatTar.Validate())
+	assert.ErrorIs(t, Format("csv").Validate(), ErrUnknownFormat)
+
+	assert.NoError(t, ModeMerge.Validate())
+	assert.NoError(t, ModeReplace.Validate())
+	assert.ErrorIs(t, Mode("append").Validate(), ErrUnknownMode)
+}
@@ -0,0 +1,9 @@
+package dump
+
+import "errors"
+
+var (
+	ErrInvalidDump   = errors.New("invalid dump")
+	ErrUnknownFormat = errors.New("unknown dump format")
+	ErrUnknownMode   = errors.New("unknown import mode")
+)
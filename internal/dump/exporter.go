@@ -0,0 +1,144 @@
+package dump
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/converter"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+)
+
+// tarDir keeps the tenant files of a tar dump.
+const tarDir = "tenants/"
+
+// Export writes every series of every tenant of the source, tenant by tenant, so the dump is streamed.
+func Export(ctx context.Context, source storage.MetricsStorage, format Format, w io.Writer) error {
+	err := format.Validate()
+	if err != nil {
+		return err
+	}
+
+	tenants, err := source.GetTenants(ctx)
+	if err != nil {
+		return logger.WrapError("get tenants", err)
+	}
+
+	var archive *tar.Writer
+	var lines *json.Encoder
+	if format == FormatTar {
+		archive = tar.NewWriter(w)
+	} else {
+		lines = json.NewEncoder(w)
+	}
+
+	now := time.Now()
+	for _, tenant := range tenants {
+		series, err := tenantSeries(identity.WithTenant(ctx, tenant), source, tenant)
+		if err != nil {
+			return err
+		}
+
+		if archive != nil {
+			err = writeTarEntry(archive, tarDir+tenant+".json", now, series)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		for i := range series {
+			err = lines.Encode(&series[i])
+			if err != nil {
+				return logger.WrapError("write series", err)
+			}
+		}
+	}
+
+	if archive != nil {
+		err = archive.Close()
+		if err != nil {
+			return logger.WrapError("close tar", err)
+		}
+	}
+
+	return nil
+}
+
+func tenantSeries(ctx context.Context, source storage.MetricsStorage, tenant string) ([]Series, error) {
+	values, err := source.GetMetricValues(ctx)
+	if err != nil {
+		return nil, logger.WrapError(fmt.Sprintf("get tenant %s metrics", tenant), err)
+	}
+
+	var history map[string]map[string][]storage.Sample
+	if historyStorage, ok := source.(storage.HistoryStorage); ok {
+		// the zero time is out of the UnixNano range
+		history, err = historyStorage.GetHistory(ctx, time.Unix(0, 0))
+		if err != nil && !errors.Is(err, metrics.ErrHistoryNotSupported) {
+			logger.SugarLogger.Warnf("Failed to get tenant %v history, the update times are not exported: %v", tenant, err)
+		}
+	}
+
+	result := []Series{}
+	for metricType, metricsByName := range values {
+		for metricName, metricValue := range metricsByName {
+			value, err := converter.ToFloat64(metricValue)
+			if err != nil {
+				return nil, logger.WrapError(fmt.Sprintf("parse metric %s value", metricName), err)
+			}
+
+			series := Series{Tenant: tenant, Type: metricType, Name: metricName, Value: value}
+			if samples := history[metricType][metricName]; len(samples) > 0 {
+				updated := samples[len(samples)-1].Time.UTC()
+				series.Updated = &updated
+			}
+			result = append(result, series)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
+
+func writeTarEntry(archive *tar.Writer, name string, modTime time.Time, series []Series) error {
+	content := &bytes.Buffer{}
+	err := json.NewEncoder(content).Encode(series)
+	if err != nil {
+		return logger.WrapError("encode series", err)
+	}
+
+	err = archive.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(content.Len()),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return logger.WrapError("write tar header", err)
+	}
+
+	_, err = archive.Write(content.Bytes())
+	if err != nil {
+		return logger.WrapError("write tar entry", err)
+	}
+
+	return nil
+}
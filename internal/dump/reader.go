@@ -0,0 +1,146 @@
+package dump
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/converter"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+)
+
+// State is the tenant -> type -> name -> value state read from a dump, see storage.StateStorage.
+type State map[string]map[string]map[string]string
+
+// Read decodes the dump and returns the state with the count of series, the last of the duplicated series wins.
+// A series without the tenant belongs to identity.DefaultTenant.
+func Read(format Format, r io.Reader) (State, int, error) {
+	err := format.Validate()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	state := State{}
+	count := 0
+	add := func(series *Series) error {
+		err := state.add(series)
+		if err != nil {
+			return err
+		}
+
+		count++
+		return nil
+	}
+
+	if format == FormatTar {
+		err = readTar(r, add)
+	} else {
+		err = readLines(r, add)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return state, count, nil
+}
+
+func readLines(r io.Reader, add func(series *Series) error) error {
+	decoder := json.NewDecoder(r)
+	for {
+		series := &Series{}
+		err := decoder.Decode(series)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("decode series: %v", err), ErrInvalidDump)
+		}
+
+		err = add(series)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readTar reads the JSON entries, the tenant is taken from the series rather than from the entry name.
+func readTar(r io.Reader, add func(series *Series) error) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("read tar: %v", err), ErrInvalidDump)
+		}
+
+		if header.Typeflag != tar.TypeReg || path.Ext(header.Name) != ".json" {
+			continue
+		}
+
+		series := []Series{}
+		err = json.NewDecoder(archive).Decode(&series)
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("decode tar entry %s: %v", header.Name, err), ErrInvalidDump)
+		}
+
+		for i := range series {
+			err = add(&series[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s State) add(series *Series) error {
+	tenant := series.Tenant
+	if tenant == "" {
+		tenant = identity.DefaultTenant
+	}
+
+	err := identity.ValidateTenant(tenant)
+	if err != nil {
+		return logger.WrapError(err.Error(), ErrInvalidDump)
+	}
+
+	var value string
+	switch series.Type {
+	case "gauge":
+		value = converter.FloatToString(series.Value)
+	case "counter":
+		// 2^63 is exact in float64 unlike math.MaxInt64
+		if series.Value != math.Trunc(series.Value) || series.Value < math.MinInt64 || series.Value >= math.MaxInt64 {
+			return logger.WrapError(fmt.Sprintf("read counter %s with value %v: %v", series.Name, series.Value, metrics.ErrInvalidRecordMetricValue), ErrInvalidDump)
+		}
+		value = converter.IntToString(int64(series.Value))
+	default:
+		return logger.WrapError(fmt.Sprintf("read series with type '%s': %v", series.Type, metrics.ErrUnknownMetricType), ErrInvalidDump)
+	}
+
+	if series.Name == "" {
+		return logger.WrapError(fmt.Sprintf("read series: %v", metrics.ErrInvalidRecordMetricName), ErrInvalidDump)
+	}
+
+	tenantValues, ok := s[tenant]
+	if !ok {
+		tenantValues = map[string]map[string]string{}
+		s[tenant] = tenantValues
+	}
+
+	typedValues, ok := tenantValues[series.Type]
+	if !ok {
+		typedValues = map[string]string{}
+		tenantValues[series.Type] = typedValues
+	}
+
+	typedValues[series.Name] = value
+	return nil
+}
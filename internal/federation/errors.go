@@ -0,0 +1,10 @@
+package federation
+
+import "errors"
+
+var (
+	ErrMissedMatch          = errors.New("at least one match pattern is required")
+	ErrInvalidMatch         = errors.New("invalid match pattern")
+	ErrInvalidUpstream      = errors.New("invalid upstream, expected name=url")
+	ErrUnexpectedStatusCode = errors.New("unexpected upstream status code")
+)
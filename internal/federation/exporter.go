@@ -0,0 +1,101 @@
+package federation
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/converter"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+)
+
+// Matcher selects series by shell patterns of the metric name, a pattern may be prefixed with the type, e.g. counter:Poll*.
+type Matcher struct {
+	patterns []matchPattern
+}
+
+type matchPattern struct {
+	metricType string
+	name       string
+}
+
+func NewMatcher(patterns []string) (*Matcher, error) {
+	if len(patterns) == 0 {
+		return nil, ErrMissedMatch
+	}
+
+	result := &Matcher{}
+	for _, pattern := range patterns {
+		item := matchPattern{name: pattern}
+		if metricType, name, ok := strings.Cut(pattern, ":"); ok && (metricType == "counter" || metricType == "gauge") {
+			item = matchPattern{metricType: metricType, name: name}
+		}
+
+		if _, err := path.Match(item.name, ""); err != nil || item.name == "" {
+			return nil, logger.WrapError(fmt.Sprintf("parse match '%s'", pattern), ErrInvalidMatch)
+		}
+
+		result.patterns = append(result.patterns, item)
+	}
+
+	return result, nil
+}
+
+func (m *Matcher) Match(metricType string, name string) bool {
+	for _, pattern := range m.patterns {
+		if pattern.metricType != "" && pattern.metricType != metricType {
+			continue
+		}
+
+		if ok, _ := path.Match(pattern.name, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Export returns the current values of the matched series of the context tenant sorted by type and name.
+func Export(ctx context.Context, metricsStorage storage.MetricsStorage, matcher *Matcher) ([]metrics.Metric, error) {
+	values, err := metricsStorage.GetMetricValues(ctx)
+	if err != nil {
+		return nil, logger.WrapError("get metric values", err)
+	}
+
+	result := []metrics.Metric{}
+	for metricType, metricValues := range values {
+		metricFactory := types.NewGaugeMetric
+		if metricType == "counter" {
+			metricFactory = types.NewCounterMetric
+		}
+
+		for name, value := range metricValues {
+			if !matcher.Match(metricType, name) {
+				continue
+			}
+
+			floatValue, err := converter.ToFloat64(value)
+			if err != nil {
+				return nil, logger.WrapError("parse metric value", err)
+			}
+
+			metric := metricFactory(name)
+			metric.SetValue(floatValue)
+			result = append(result, metric)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].GetType() != result[j].GetType() {
+			return result[i].GetType() < result[j].GetType()
+		}
+		return result[i].GetName() < result[j].GetName()
+	})
+
+	return result, nil
+}
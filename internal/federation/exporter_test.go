@@ -0,0 +1,76 @@
+package federation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		name          string
+		match         []string
+		expectedError error
+		expected      []string
+	}{
+		{
+			name:          "missed_match",
+			expectedError: ErrMissedMatch,
+		},
+		{
+			name:          "invalid_match",
+			match:         []string{"Heap["},
+			expectedError: ErrInvalidMatch,
+		},
+		{
+			name:     "all",
+			match:    []string{"*"},
+			expected: []string{"counter:PollCount", "gauge:HeapAlloc", "gauge:HeapInuse", "gauge:PollCount"},
+		},
+		{
+			name:     "patterns",
+			match:    []string{"Heap*", "Unknown"},
+			expected: []string{"gauge:HeapAlloc", "gauge:HeapInuse"},
+		},
+		{
+			name:     "typed_pattern",
+			match:    []string{"counter:Poll*", "gauge:HeapAlloc"},
+			expected: []string{"counter:PollCount", "gauge:HeapAlloc"},
+		},
+	}
+
+	ctx := context.Background()
+	metricsStorage := memory.NewInMemoryStorage()
+	_, err := metricsStorage.AddMetricValues(ctx, []metrics.Metric{
+		test.CreateGaugeMetric("HeapAlloc", 1),
+		test.CreateGaugeMetric("HeapInuse", 2),
+		test.CreateGaugeMetric("PollCount", 3),
+		test.CreateCounterMetric("PollCount", 4),
+	})
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher, err := NewMatcher(tt.match)
+			assert.ErrorIs(t, err, tt.expectedError)
+			if tt.expectedError != nil {
+				return
+			}
+
+			metricsList, err := Export(ctx, metricsStorage, matcher)
+			require.NoError(t, err)
+
+			actual := []string{}
+			for _, metric := range metricsList {
+				actual = append(actual, metric.GetType()+":"+metric.GetName())
+			}
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+// SourceSeparator joins the upstream name and the upstream metric name.
+const SourceSeparator = "."
+
+type pullerConfig interface {
+	FederationUpstreams() []string
+	FederationMatch() []string
+	FederationToken() string
+	FederationTimeout() time.Duration
+}
+
+type upstream struct {
+	name string
+	url  string
+}
+
+// Puller copies series from upstream servers into the local storage under the "<upstream>.<name>" names.
+type Puller struct {
+	upstreams []upstream
+	match     []string
+	token     string
+	client    *http.Client
+	storage   storage.MetricsStorage
+	converter *model.MetricsConverter
+	registry  *selfmetrics.Registry
+}
+
+func NewPuller(config pullerConfig, metricsStorage storage.MetricsStorage, converter *model.MetricsConverter, registry *selfmetrics.Registry) (*Puller, error) {
+	upstreams := []upstream{}
+	for _, item := range config.FederationUpstreams() {
+		name, upstreamURL, ok := strings.Cut(item, "=")
+		if !ok || name == "" || strings.Contains(name, SourceSeparator) {
+			return nil, logger.WrapError(fmt.Sprintf("parse upstream '%s'", item), ErrInvalidUpstream)
+		}
+
+		parsed, err := url.Parse(upstreamURL)
+		if err != nil || parsed.Host == "" {
+			return nil, logger.WrapError(fmt.Sprintf("parse upstream '%s'", item), ErrInvalidUpstream)
+		}
+
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/federate"
+		upstreams = append(upstreams, upstream{name: name, url: parsed.String()})
+	}
+
+	_, err := NewMatcher(config.FederationMatch())
+	if err != nil {
+		return nil, logger.WrapError("parse federation match", err)
+	}
+
+	return &Puller{
+		upstreams: upstreams,
+		match:     config.FederationMatch(),
+		token:     config.FederationToken(),
+		client:    &http.Client{Timeout: config.FederationTimeout()},
+		storage:   metricsStorage,
+		converter: converter,
+		registry:  registry,
+	}, nil
+}
+
+// Pull copies series from every upstream, an unavailable upstream does not stop the others.
+func (p *Puller) Pull(ctx context.Context) error {
+	var result error
+	for _, source := range p.upstreams {
+		p.registry.Counter("FederationPulls." + source.name).Inc()
+
+		count, err := p.pullUpstream(ctx, source)
+		if err != nil {
+			p.registry.Counter("FederationPullErrors." + source.name).Inc()
+			logger.SugarLogger.Errorf("Failed to pull upstream %v: %v", source.name, err)
+			result = logger.WrapError("pull upstream "+source.name, err)
+			continue
+		}
+
+		p.registry.Gauge("FederationSeries." + source.name).Set(float64(count))
+	}
+
+	return result
+}
+
+func (p *Puller) pullUpstream(ctx context.Context, source upstream) (int, error) {
+	modelMetrics, err := p.fetch(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+
+	metricsList := make([]metrics.Metric, 0, len(modelMetrics))
+	for _, modelMetric := range modelMetrics {
+		metric, err := p.converter.FromModelMetric(modelMetric)
+		if err != nil {
+			return 0, logger.WrapError("convert upstream metric", err)
+		}
+
+		merged, err := p.toLocal(ctx, source.name, metric)
+		if err != nil {
+			return 0, err
+		}
+
+		metricsList = append(metricsList, merged)
+	}
+
+	if len(metricsList) == 0 {
+		return 0, nil
+	}
+
+	_, err = p.storage.AddMetricValues(ctx, metricsList)
+	if err != nil {
+		return 0, logger.WrapError("store upstream metrics", err)
+	}
+
+	return len(metricsList), nil
+}
+
+// toLocal renames the metric under the source prefix. Upstream counters hold totals and local counters add deltas,
+// so a counter is converted to the delta from the local value which makes the local value equal to the upstream one.
+func (p *Puller) toLocal(ctx context.Context, source string, metric metrics.Metric) (metrics.Metric, error) {
+	name := source + SourceSeparator + metric.GetName()
+	if metric.GetType() != "counter" {
+		result := types.NewGaugeMetric(name)
+		result.SetValue(metric.GetValue())
+		return result, nil
+	}
+
+	current := float64(0)
+	local, err := p.storage.GetMetric(ctx, "counter", name)
+	if err == nil {
+		current = local.GetValue()
+	} else if !errors.Is(err, metrics.ErrMetricNotFound) {
+		return nil, logger.WrapError("get local counter", err)
+	}
+
+	result := types.NewCounterMetric(name)
+	result.SetValue(metric.GetValue() - current)
+	return result, nil
+}
+
+func (p *Puller) fetch(ctx context.Context, source upstream) ([]*model.Metrics, error) {
+	query := url.Values{"match": p.match}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, source.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, logger.WrapError("create federate request", err)
+	}
+
+	request.Header.Set("Accept", "application/json")
+	if p.token != "" {
+		request.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, logger.WrapError("send federate request", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		content, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, logger.WrapError(fmt.Sprintf("federate status %v: %s", response.StatusCode, content), ErrUnexpectedStatusCode)
+	}
+
+	result := []*model.Metrics{}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return nil, logger.WrapError("decode federate response", err)
+	}
+
+	return result, nil
+}
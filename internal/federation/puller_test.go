@@ -0,0 +1,172 @@
+package federation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/hash"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pullerConf struct {
+	upstreams []string
+}
+
+type converterConf struct{}
+
+type upstreamServer struct {
+	server   *httptest.Server
+	response string
+	status   int
+	query    string
+	token    string
+	lock     sync.Mutex
+}
+
+func TestNewPuller(t *testing.T) {
+	tests := []struct {
+		name          string
+		upstreams     []string
+		expectedError error
+	}{
+		{
+			name:      "valid",
+			upstreams: []string{"dc1=http://dc1:8080", "dc2=https://dc2/prefix/"},
+		},
+		{
+			name:          "missed_name",
+			upstreams:     []string{"http://dc1:8080"},
+			expectedError: ErrInvalidUpstream,
+		},
+		{
+			name:          "name_with_separator",
+			upstreams:     []string{"dc.1=http://dc1:8080"},
+			expectedError: ErrInvalidUpstream,
+		},
+		{
+			name:          "relative_url",
+			upstreams:     []string{"dc1=/federate"},
+			expectedError: ErrInvalidUpstream,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPuller(&pullerConf{upstreams: tt.upstreams}, memory.NewInMemoryStorage(), createConverter(), nil)
+			assert.ErrorIs(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestPuller_Pull(t *testing.T) {
+	ctx := context.Background()
+	dc1 := newUpstreamServer(t, `[{"id":"PollCount","type":"counter","delta":10},{"id":"Alloc","type":"gauge","value":1.5}]`)
+	dc2 := newUpstreamServer(t, `[{"id":"PollCount","type":"counter","delta":7}]`)
+	broken := newUpstreamServer(t, `[]`)
+	broken.status = http.StatusInternalServerError
+
+	localStorage := memory.NewInMemoryStorage()
+	puller, err := NewPuller(&pullerConf{upstreams: []string{
+		"dc1=" + dc1.server.URL,
+		"broken=" + broken.server.URL,
+		"dc2=" + dc2.server.URL + "/",
+	}}, localStorage, createConverter(), nil)
+	require.NoError(t, err)
+
+	assertLocal := func(expected map[string]map[string]string) {
+		values, err := localStorage.GetMetricValues(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, expected, values)
+	}
+
+	// an unavailable upstream does not stop others
+	assert.ErrorIs(t, puller.Pull(ctx), ErrUnexpectedStatusCode)
+	assertLocal(map[string]map[string]string{
+		"counter": {"dc1.PollCount": "10", "dc2.PollCount": "7"},
+		"gauge":   {"dc1.Alloc": "1.5"},
+	})
+	assert.Equal(t, "match=%2A", dc1.query)
+	assert.Equal(t, "Bearer secret", dc1.token)
+
+	// counter totals are not summed on each pull
+	dc1.setResponse(`[{"id":"PollCount","type":"counter","delta":15},{"id":"Alloc","type":"gauge","value":0.5}]`)
+	assert.Error(t, puller.Pull(ctx))
+	assert.Error(t, puller.Pull(ctx))
+	assertLocal(map[string]map[string]string{
+		"counter": {"dc1.PollCount": "15", "dc2.PollCount": "7"},
+		"gauge":   {"dc1.Alloc": "0.5"},
+	})
+
+	// the upstream is restarted and its counter is reset
+	dc1.setResponse(`[{"id":"PollCount","type":"counter","delta":3}]`)
+	assert.Error(t, puller.Pull(ctx))
+	assertLocal(map[string]map[string]string{
+		"counter": {"dc1.PollCount": "3", "dc2.PollCount": "7"},
+		"gauge":   {"dc1.Alloc": "0.5"},
+	})
+}
+
+func newUpstreamServer(t *testing.T, response string) *upstreamServer {
+	result := &upstreamServer{response: response, status: http.StatusOK}
+	result.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result.lock.Lock()
+		defer result.lock.Unlock()
+
+		if r.URL.Path != "/federate" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		result.query = r.URL.RawQuery
+		result.token = r.Header.Get("Authorization")
+		w.WriteHeader(result.status)
+		_, _ = w.Write([]byte(result.response))
+	}))
+	t.Cleanup(result.server.Close)
+
+	return result
+}
+
+func (u *upstreamServer) setResponse(response string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.response = response
+}
+
+func createConverter() *model.MetricsConverter {
+	conf := &converterConf{}
+	return model.NewMetricsConverter(conf, hash.NewSigner(conf))
+}
+
+func (c *pullerConf) FederationUpstreams() []string {
+	return c.upstreams
+}
+
+func (c *pullerConf) FederationMatch() []string {
+	return []string{"*"}
+}
+
+func (c *pullerConf) FederationToken() string {
+	return "secret"
+}
+
+func (c *pullerConf) FederationTimeout() time.Duration {
+	return time.Second
+}
+
+func (c *converterConf) SignMetrics() bool {
+	return false
+}
+
+func (c *converterConf) GetKey() []byte {
+	return nil
+}
@@ -0,0 +1,8 @@
+package follower
+
+import "errors"
+
+var (
+	ErrNotSynced  = errors.New("follower is not synced yet")
+	ErrLagTooHigh = errors.New("follower lag is too high")
+)
@@ -0,0 +1,305 @@
+package follower
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/converter"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/file"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+type followerConfig interface {
+	FollowFile() string
+	FollowMaxLag() time.Duration
+	StoreKeyring() *file.Keyring
+}
+
+// sourceConfig opens the backup of the primary with the file storage.
+type sourceConfig struct {
+	path    string
+	keyring *file.Keyring
+}
+
+type sourceVersion struct {
+	modTime    time.Time
+	size       int64
+	walModTime time.Time
+	walSize    int64
+}
+
+type seriesKey struct {
+	metricType string
+	name       string
+}
+
+// Follower keeps the target storage equal to the backup file of the primary server.
+// Only the series taken from the backup are updated and removed, so the own series of the follower (e.g. self metrics) are kept.
+type Follower struct {
+	path   string
+	source storage.MetricsStorage
+	target storage.MetricsStorage
+	maxLag time.Duration
+	now    func() time.Time
+
+	synced  map[string]map[seriesKey]bool
+	version sourceVersion
+	// the start of the last sync which saw the latest primary change
+	syncedAt time.Time
+	lock     sync.Mutex
+
+	lag *selfmetrics.Gauge
+}
+
+func NewFollower(config followerConfig, target storage.MetricsStorage, registry *selfmetrics.Registry) *Follower {
+	return &Follower{
+		path:   config.FollowFile(),
+		source: file.NewReadOnlyFileStorage(&sourceConfig{path: config.FollowFile(), keyring: config.StoreKeyring()}),
+		target: target,
+		maxLag: config.FollowMaxLag(),
+		now:    time.Now,
+		lag:    registry.Gauge("FollowerLagSeconds"),
+	}
+}
+
+// Sync applies the changes of the backup and its write-ahead log since the last sync, an unchanged backup is not read.
+// The primary may write the files during the read, such a read is dropped and repeated on the next sync.
+func (f *Follower) Sync(ctx context.Context) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	defer f.lag.Set(f.lagLocked().Seconds())
+
+	// the changes written after the version is taken are seen by the next sync only
+	startedAt := f.now()
+	version, err := f.sourceVersion()
+	if err != nil {
+		return err
+	}
+
+	if f.synced != nil && version == f.version {
+		f.syncedAt = startedAt
+		return nil
+	}
+
+	sourceValues, err := f.readSource(ctx)
+	if err != nil {
+		return err
+	}
+
+	readVersion, err := f.sourceVersion()
+	if err != nil {
+		return err
+	}
+	if readVersion != version {
+		return nil
+	}
+
+	synced := map[string]map[seriesKey]bool{}
+	for tenant, values := range sourceValues {
+		tenantCtx := identity.WithTenant(ctx, tenant)
+		synced[tenant], err = f.syncTenant(tenantCtx, values)
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("sync tenant %s", tenant), err)
+		}
+	}
+
+	// the series removed from the primary are removed here too
+	for tenant, series := range f.synced {
+		for key := range series {
+			if synced[tenant][key] {
+				continue
+			}
+
+			err = f.deleteMetric(identity.WithTenant(ctx, tenant), key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	f.synced = synced
+	f.version = version
+	f.syncedAt = startedAt
+	return nil
+}
+
+// Lag returns the time since the last sync which saw the latest primary change,
+// it grows while the syncs fail or drop the reads of the concurrently written backup.
+func (f *Follower) Lag() time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.lagLocked()
+}
+
+// Check reports the lag, it fails before the first sync and when the lag exceeds the maximum one.
+func (f *Follower) Check(context.Context) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.synced == nil {
+		return "", ErrNotSynced
+	}
+
+	lag := f.lagLocked()
+	detail := "lag " + lag.Round(time.Second).String()
+	if f.maxLag > 0 && lag > f.maxLag {
+		return detail, logger.WrapError(fmt.Sprintf("check lag %v", lag), ErrLagTooHigh)
+	}
+
+	return detail, nil
+}
+
+func (f *Follower) lagLocked() time.Duration {
+	if f.synced == nil {
+		return 0
+	}
+
+	return f.now().Sub(f.syncedAt)
+}
+
+func (f *Follower) readSource(ctx context.Context) (map[string]map[string]map[string]string, error) {
+	tenants, err := f.source.GetTenants(ctx)
+	if err != nil {
+		return nil, logger.WrapError("read primary tenants", err)
+	}
+
+	result := map[string]map[string]map[string]string{}
+	for _, tenant := range tenants {
+		result[tenant], err = f.source.GetMetricValues(identity.WithTenant(ctx, tenant))
+		if err != nil {
+			return nil, logger.WrapError(fmt.Sprintf("read primary metrics of tenant %s", tenant), err)
+		}
+	}
+
+	return result, nil
+}
+
+func (f *Follower) sourceVersion() (sourceVersion, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return sourceVersion{}, logger.WrapError("stat primary backup", err)
+	}
+
+	result := sourceVersion{modTime: info.ModTime(), size: info.Size()}
+	walInfo, err := os.Stat(file.WALPath(f.path))
+	if errors.Is(err, os.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return sourceVersion{}, logger.WrapError("stat primary write-ahead log", err)
+	}
+
+	result.walModTime = walInfo.ModTime()
+	result.walSize = walInfo.Size()
+	return result, nil
+}
+
+// syncTenant updates the changed series, counters are updated with the delta to the primary value.
+func (f *Follower) syncTenant(ctx context.Context, sourceValues map[string]map[string]string) (map[seriesKey]bool, error) {
+	targetValues, err := f.target.GetMetricValues(ctx)
+	if err != nil {
+		return nil, logger.WrapError("read local metrics", err)
+	}
+
+	series := map[seriesKey]bool{}
+	changed := []metrics.Metric{}
+	for metricType, values := range sourceValues {
+		metricFactory := types.NewGaugeMetric
+		if metricType == "counter" {
+			metricFactory = types.NewCounterMetric
+		}
+
+		for name, value := range values {
+			series[seriesKey{metricType: metricType, name: name}] = true
+
+			current, ok := targetValues[metricType][name]
+			if ok && current == value {
+				continue
+			}
+
+			sourceValue, err := converter.ToFloat64(value)
+			if err != nil {
+				return nil, logger.WrapError("parse primary value", err)
+			}
+
+			if metricType == "counter" && ok {
+				currentValue, err := converter.ToFloat64(current)
+				if err != nil {
+					return nil, logger.WrapError("parse local value", err)
+				}
+
+				sourceValue -= currentValue
+			}
+
+			metric := metricFactory(name)
+			metric.SetValue(sourceValue)
+			changed = append(changed, metric)
+		}
+	}
+
+	if len(changed) > 0 {
+		_, err = f.target.AddMetricValues(ctx, changed)
+		if err != nil {
+			return nil, logger.WrapError("update local metrics", err)
+		}
+	}
+
+	return series, nil
+}
+
+func (f *Follower) deleteMetric(ctx context.Context, key seriesKey) error {
+	deleter, ok := f.target.(storage.MetricsDeleter)
+	if !ok {
+		return metrics.ErrDeleteNotSupported
+	}
+
+	err := deleter.DeleteMetric(ctx, key.metricType, key.name)
+	if err != nil && !errors.Is(err, metrics.ErrMetricNotFound) {
+		return logger.WrapError("delete local metric", err)
+	}
+
+	return nil
+}
+
+func (c *sourceConfig) StoreFilePath() string {
+	return c.path
+}
+
+// StoreEncoding is not used for reading, the encoding of a snapshot is detected.
+func (c *sourceConfig) StoreEncoding() file.Encoding {
+	return file.EncodingJSON
+}
+
+func (c *sourceConfig) StoreKeyring() *file.Keyring {
+	return c.keyring
+}
+
+func (c *sourceConfig) StoreFsyncPolicy() file.FsyncPolicy {
+	return file.FsyncNever
+}
+
+func (c *sourceConfig) StoreFsyncInterval() time.Duration {
+	return 0
+}
+
+func (c *sourceConfig) StoreSnapshotThreshold() int {
+	return 0
+}
+
+func (c *sourceConfig) StoreKeepHourly() int {
+	return 0
+}
+
+func (c *sourceConfig) StoreKeepDaily() int {
+	return 0
+}
@@ -0,0 +1,176 @@
+package follower
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/file"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	path   string
+	maxLag time.Duration
+}
+
+func TestFollower_Sync(t *testing.T) {
+	ctx := context.Background()
+	conf := &testConfig{path: filepath.Join(t.TempDir(), "backup.json")}
+	primary := file.NewFileStorage(conf)
+	local := memory.NewInMemoryStorage()
+	follower := NewFollower(conf, local, nil)
+
+	_, err := local.AddMetricValues(ctx, []metrics.Metric{newMetric(types.NewGaugeMetric, "_internal.Uptime", 1)})
+	require.NoError(t, err)
+
+	_, err = primary.AddMetricValues(ctx, []metrics.Metric{
+		newMetric(types.NewCounterMetric, "requests", 5),
+		newMetric(types.NewGaugeMetric, "temperature", 20),
+	})
+	require.NoError(t, err)
+	_, err = primary.AddMetricValues(identity.WithTenant(ctx, "team"), []metrics.Metric{newMetric(types.NewGaugeMetric, "load", 0.5)})
+	require.NoError(t, err)
+
+	require.NoError(t, follower.Sync(ctx))
+	assertValues(t, ctx, local, map[string]map[string]string{
+		"counter": {"requests": "5"},
+		"gauge":   {"temperature": "20", "_internal.Uptime": "1"},
+	})
+	assertValues(t, identity.WithTenant(ctx, "team"), local, map[string]map[string]string{
+		"gauge": {"load": "0.5"},
+	})
+
+	// the primary backs up the accumulated counter value
+	_, err = primary.AddMetricValues(ctx, []metrics.Metric{newMetric(types.NewCounterMetric, "requests", 8)})
+	require.NoError(t, err)
+	deleter, ok := primary.(storage.MetricsDeleter)
+	require.True(t, ok)
+	require.NoError(t, deleter.DeleteMetric(ctx, "gauge", "temperature"))
+
+	require.NoError(t, follower.Sync(ctx))
+	assertValues(t, ctx, local, map[string]map[string]string{
+		"counter": {"requests": "8"},
+		"gauge":   {"_internal.Uptime": "1"},
+	})
+
+	// an unchanged backup keeps the local state
+	require.NoError(t, follower.Sync(ctx))
+	assertValues(t, ctx, local, map[string]map[string]string{
+		"counter": {"requests": "8"},
+		"gauge":   {"_internal.Uptime": "1"},
+	})
+}
+
+func TestFollower_Check(t *testing.T) {
+	ctx := context.Background()
+	conf := &testConfig{path: filepath.Join(t.TempDir(), "backup.json"), maxLag: time.Minute}
+	primary := file.NewFileStorage(conf)
+	follower := NewFollower(conf, memory.NewInMemoryStorage(), nil)
+
+	_, err := follower.Check(ctx)
+	assert.ErrorIs(t, err, ErrNotSynced)
+	assert.Equal(t, time.Duration(0), follower.Lag())
+
+	_, err = primary.AddMetricValues(ctx, []metrics.Metric{newMetric(types.NewGaugeMetric, "temperature", 20)})
+	require.NoError(t, err)
+
+	// the backup age is not the lag, an idle primary is followed without a lag
+	now := time.Now().Add(time.Hour)
+	follower.now = func() time.Time { return now }
+	require.NoError(t, follower.Sync(ctx))
+
+	now = now.Add(10 * time.Second)
+	detail, err := follower.Check(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "lag 10s", detail)
+	assert.Equal(t, 10*time.Second, follower.Lag())
+
+	require.NoError(t, follower.Sync(ctx))
+	assert.Equal(t, time.Duration(0), follower.Lag())
+
+	// the failed syncs do not reset the lag
+	require.NoError(t, os.Remove(conf.path))
+	now = now.Add(time.Hour)
+	assert.Error(t, follower.Sync(ctx))
+	detail, err = follower.Check(ctx)
+	assert.ErrorIs(t, err, ErrLagTooHigh)
+	assert.Equal(t, "lag 1h0m0s", detail)
+}
+
+func TestFollower_ReadOnlySource(t *testing.T) {
+	ctx := context.Background()
+	conf := &testConfig{path: filepath.Join(t.TempDir(), "backup.json")}
+	follower := NewFollower(conf, memory.NewInMemoryStorage(), nil)
+
+	// the missed backup of the primary is not created by the follower
+	assert.Error(t, follower.Sync(ctx))
+	_, err := os.Stat(conf.path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = follower.source.AddMetricValues(ctx, []metrics.Metric{newMetric(types.NewGaugeMetric, "temperature", 20)})
+	assert.ErrorIs(t, err, file.ErrReadOnly)
+	_, err = os.Stat(file.WALPath(conf.path))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func assertValues(t *testing.T, ctx context.Context, target storage.MetricsStorage, expected map[string]map[string]string) {
+	actual, err := target.GetMetricValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func newMetric(factory func(string) metrics.Metric, name string, value float64) metrics.Metric {
+	metric := factory(name)
+	metric.SetValue(value)
+	return metric
+}
+
+func (c *testConfig) StoreFilePath() string {
+	return c.path
+}
+
+func (c *testConfig) StoreEncoding() file.Encoding {
+	return file.EncodingJSON
+}
+
+func (c *testConfig) StoreKeyring() *file.Keyring {
+	return nil
+}
+
+func (c *testConfig) StoreFsyncPolicy() file.FsyncPolicy {
+	return file.FsyncNever
+}
+
+func (c *testConfig) StoreFsyncInterval() time.Duration {
+	return 0
+}
+
+func (c *testConfig) StoreSnapshotThreshold() int {
+	return 0
+}
+
+func (c *testConfig) StoreKeepHourly() int {
+	return 0
+}
+
+func (c *testConfig) StoreKeepDaily() int {
+	return 0
+}
+
+func (c *testConfig) FollowFile() string {
+	return c.path
+}
+
+func (c *testConfig) FollowMaxLag() time.Duration {
+	return c.maxLag
+}
@@ -0,0 +1,104 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusFail     = "fail"
+	StatusReady    = "ready"
+	StatusNotReady = "not_ready"
+)
+
+type CheckFunc func(ctx context.Context) error
+
+// DetailCheckFunc also describes the component state, e.g. its role.
+type DetailCheckFunc func(ctx context.Context) (string, error)
+
+type ComponentStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status     string            `json:"status"`
+	Components []ComponentStatus `json:"components"`
+}
+
+type component struct {
+	name  string
+	check DetailCheckFunc
+}
+
+// Checker aggregates component checks into a readiness report.
+type Checker struct {
+	components []component
+	timeout    time.Duration
+	lock       sync.RWMutex
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+func (c *Checker) Add(name string, check CheckFunc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.components = append(c.components, component{name: name, check: func(ctx context.Context) (string, error) {
+		return "", check(ctx)
+	}})
+}
+
+func (c *Checker) AddWithDetail(name string, check DetailCheckFunc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.components = append(c.components, component{name: name, check: check})
+}
+
+// Check runs every component check, the server is ready only when all of them pass.
+// A nil Checker is always ready.
+func (c *Checker) Check(ctx context.Context) *Report {
+	result := &Report{Status: StatusReady, Components: []ComponentStatus{}}
+	if c == nil {
+		return result
+	}
+
+	c.lock.RLock()
+	components := c.components
+	c.lock.RUnlock()
+
+	for _, item := range components {
+		detail, err := c.runCheck(ctx, item.check)
+		status := ComponentStatus{Name: item.name, Status: StatusOK, Detail: detail}
+		if err != nil {
+			status.Status = StatusFail
+			status.Error = err.Error()
+			result.Status = StatusNotReady
+		}
+
+		result.Components = append(result.Components, status)
+	}
+
+	return result
+}
+
+func (r *Report) Ready() bool {
+	return r.Status == StatusReady
+}
+
+func (c *Checker) runCheck(ctx context.Context, check DetailCheckFunc) (string, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	return check(ctx)
+}
@@ -0,0 +1,125 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecker_Check(t *testing.T) {
+	errTest := errors.New("test error")
+
+	tests := []struct {
+		name           string
+		checks         map[string]CheckFunc
+		expectedReport *Report
+	}{
+		{
+			name:           "no_checks",
+			expectedReport: &Report{Status: StatusReady, Components: []ComponentStatus{}},
+		},
+		{
+			name: "all_passed",
+			checks: map[string]CheckFunc{
+				"first": func(context.Context) error { return nil },
+			},
+			expectedReport: &Report{Status: StatusReady, Components: []ComponentStatus{
+				{Name: "first", Status: StatusOK},
+			}},
+		},
+		{
+			name: "one_failed",
+			checks: map[string]CheckFunc{
+				"first": func(context.Context) error { return errTest },
+			},
+			expectedReport: &Report{Status: StatusNotReady, Components: []ComponentStatus{
+				{Name: "first", Status: StatusFail, Error: "test error"},
+			}},
+		},
+		{
+			name: "timeout",
+			checks: map[string]CheckFunc{
+				"first": func(ctx context.Context) error {
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			},
+			expectedReport: &Report{Status: StatusNotReady, Components: []ComponentStatus{
+				{Name: "first", Status: StatusFail, Error: context.DeadlineExceeded.Error()},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(10 * time.Millisecond)
+			for name, check := range tt.checks {
+				checker.Add(name, check)
+			}
+
+			assert.Equal(t, tt.expectedReport, checker.Check(context.Background()))
+		})
+	}
+}
+
+func TestChecker_AddWithDetail(t *testing.T) {
+	checker := NewChecker(0)
+	checker.AddWithDetail("leader", func(context.Context) (string, error) { return "follower", nil })
+
+	assert.Equal(t, &Report{Status: StatusReady, Components: []ComponentStatus{
+		{Name: "leader", Status: StatusOK, Detail: "follower"},
+	}}, checker.Check(context.Background()))
+}
+
+func TestChecker_Nil(t *testing.T) {
+	var checker *Checker
+	assert.True(t, checker.Check(context.Background()).Ready())
+}
+
+func TestLatch(t *testing.T) {
+	latch := NewLatch()
+	assert.ErrorIs(t, latch.Check(context.Background()), ErrNotFinished)
+
+	latch.Done()
+	assert.NoError(t, latch.Check(context.Background()))
+
+	var nilLatch *Latch
+	assert.True(t, nilLatch.IsDone())
+}
+
+func TestFreshness(t *testing.T) {
+	last := time.Time{}
+	check := Freshness(func() time.Time { return last }, time.Minute)
+	assert.NoError(t, check(context.Background()))
+
+	last = time.Now().Add(-time.Hour)
+	assert.ErrorIs(t, check(context.Background()), ErrOutdated)
+
+	last = time.Now()
+	assert.NoError(t, check(context.Background()))
+}
+
+func TestFileWritable(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "backup.json")
+
+	// the missed file is not created
+	assert.NoError(t, FileWritable(filePath)(context.Background()))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	require.NoError(t, os.WriteFile(filePath, []byte("{}"), 0o644))
+	assert.NoError(t, FileWritable(filePath)(context.Background()))
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(content))
+
+	assert.Error(t, FileWritable(filepath.Join(dir, "missed", "backup.json"))(context.Background()))
+}
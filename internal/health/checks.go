@@ -0,0 +1,88 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+// Latch is a one-way flag for startup steps, e.g. restore from backup.
+type Latch struct {
+	done atomic.Bool
+}
+
+func NewLatch() *Latch {
+	return &Latch{}
+}
+
+func (l *Latch) Done() {
+	l.done.Store(true)
+}
+
+// IsDone reports whether the step is finished, a nil Latch is always done.
+func (l *Latch) IsDone() bool {
+	return l == nil || l.done.Load()
+}
+
+func (l *Latch) Check(context.Context) error {
+	if !l.IsDone() {
+		return ErrNotFinished
+	}
+
+	return nil
+}
+
+// FileWritable checks the file can be opened for writing, the check never creates the file.
+// A missed file is checked by creating and removing a temporary file in its directory.
+func FileWritable(filePath string) CheckFunc {
+	return func(context.Context) error {
+		file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0)
+		if err == nil {
+			return file.Close()
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return logger.WrapError("open file for write", err)
+		}
+
+		probe, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".probe-*")
+		if err != nil {
+			return logger.WrapError("create file in directory", err)
+		}
+
+		err = probe.Close()
+		removeErr := os.Remove(probe.Name())
+		if err != nil {
+			return logger.WrapError("close probe file", err)
+		}
+		if removeErr != nil {
+			return logger.WrapError("remove probe file", removeErr)
+		}
+
+		return nil
+	}
+}
+
+// Freshness checks the last event happened not earlier than maxAge ago.
+// Before the first event the age is counted from the check creation.
+func Freshness(last func() time.Time, maxAge time.Duration) CheckFunc {
+	started := time.Now()
+	return func(context.Context) error {
+		lastTime := last()
+		if lastTime.IsZero() {
+			lastTime = started
+		}
+
+		age := time.Since(lastTime)
+		if age > maxAge {
+			return fmt.Errorf("last time %v ago, max age %v: %w", age.Round(time.Second), maxAge, ErrOutdated)
+		}
+
+		return nil
+	}
+}
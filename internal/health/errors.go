@@ -0,0 +1,8 @@
+package health
+
+import "errors"
+
+var (
+	ErrNotFinished = errors.New("not finished yet")
+	ErrOutdated    = errors.New("outdated")
+)
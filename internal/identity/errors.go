@@ -0,0 +1,5 @@
+package identity
+
+import "errors"
+
+var ErrInvalidTenant = errors.New("invalid tenant name")
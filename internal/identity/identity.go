@@ -0,0 +1,16 @@
+package identity
+
+import "context"
+
+type agentContextKey struct{}
+
+// WithAgent returns a copy of ctx that carries the identity of the calling agent.
+func WithAgent(ctx context.Context, agent string) context.Context {
+	return context.WithValue(ctx, agentContextKey{}, agent)
+}
+
+// Agent returns the identity of the calling agent, if it was established.
+func Agent(ctx context.Context) (string, bool) {
+	agent, ok := ctx.Value(agentContextKey{}).(string)
+	return agent, ok && agent != ""
+}
@@ -0,0 +1,47 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+// DefaultTenant owns every request that is not mapped to a tenant explicitly.
+const DefaultTenant = "default"
+
+const TenantHeader = "X-Tenant-ID"
+
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+type tenantContextKey struct{}
+
+// WithTenant returns a copy of ctx scoped to the tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// Tenant returns the tenant of ctx or DefaultTenant.
+func Tenant(ctx context.Context) string {
+	tenant, ok := ExplicitTenant(ctx)
+	if !ok {
+		return DefaultTenant
+	}
+
+	return tenant
+}
+
+// ExplicitTenant returns the tenant of ctx only if it was set.
+func ExplicitTenant(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+func ValidateTenant(tenant string) error {
+	if !tenantPattern.MatchString(tenant) {
+		return logger.WrapError(fmt.Sprintf("validate tenant '%s'", tenant), ErrInvalidTenant)
+	}
+
+	return nil
+}
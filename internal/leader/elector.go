@@ -0,0 +1,200 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/database"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+type electorConfig interface {
+	LeaderLockKey() int64
+	LeaderLease() time.Duration
+}
+
+// Elector elects one leader among the servers sharing a database.
+// The leader renews its lease three times per lease period and steps down when the renewal fails,
+// then the lock is released by the database with the lost session and another server takes it over.
+type Elector struct {
+	locker database.LockDataBase
+	key    int64
+	lease  time.Duration
+	now    func() time.Time
+
+	// serializes the database calls, the state is guarded by mutex so the role is read without waiting for them
+	campaign sync.Mutex
+	lock     database.Lock
+	renewed  time.Time
+	since    time.Time
+	mutex    sync.RWMutex
+
+	leaderGauge *selfmetrics.Gauge
+	transitions *selfmetrics.Counter
+}
+
+func NewElector(config electorConfig, locker database.LockDataBase, registry *selfmetrics.Registry) *Elector {
+	return &Elector{
+		locker:      locker,
+		key:         config.LeaderLockKey(),
+		lease:       config.LeaderLease(),
+		now:         time.Now,
+		leaderGauge: registry.Gauge("LeaderElected"),
+		transitions: registry.Counter("LeaderTransitions"),
+	}
+}
+
+// Run campaigns and renews the lease until ctx is done, the leadership is kept until Release,
+// so the leader can finish its shutdown jobs.
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		e.Renew(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Renew takes the lock if it is free or checks the held one, each attempt is limited by a third of the lease.
+func (e *Elector) Renew(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.lease/3)
+	defer cancel()
+
+	e.campaign.Lock()
+	defer e.campaign.Unlock()
+
+	if e.heldLock() == nil {
+		lock, err := e.locker.AcquireLock(ctx, e.key)
+		if err != nil {
+			logger.SugarLogger.Errorf("Failed to campaign for leadership: %v", err)
+			return
+		}
+		if lock == nil {
+			return
+		}
+
+		e.mutex.Lock()
+		e.lock = lock
+		e.since = e.now()
+		e.renewed = e.since
+		e.mutex.Unlock()
+
+		e.transitions.Inc()
+		e.leaderGauge.Set(1)
+		logger.SugarLogger.Info("Became the leader")
+		return
+	}
+
+	err := e.heldLock().Check(ctx)
+	if err != nil {
+		logger.SugarLogger.Errorf("Lost leadership: %v", err)
+		e.stepDown(ctx)
+		return
+	}
+
+	e.mutex.Lock()
+	e.renewed = e.now()
+	e.mutex.Unlock()
+}
+
+// Release hands the leadership over to another server.
+func (e *Elector) Release(ctx context.Context) {
+	if e == nil {
+		return
+	}
+
+	e.campaign.Lock()
+	defer e.campaign.Unlock()
+
+	if e.heldLock() != nil {
+		logger.SugarLogger.Info("Release leadership")
+		e.stepDown(ctx)
+	}
+}
+
+// IsLeader reports whether the lease is held and not expired. A nil Elector is always the leader.
+func (e *Elector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.lock != nil && e.now().Sub(e.renewed) < e.lease
+}
+
+// LeaderSince returns the time the leadership was taken, zero for a follower and a nil Elector.
+func (e *Elector) LeaderSince() time.Time {
+	if !e.IsLeader() || e == nil {
+		return time.Time{}
+	}
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.since
+}
+
+// Singleton wraps a background job to run only on the leader.
+func (e *Elector) Singleton(job func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if !e.IsLeader() {
+			return nil
+		}
+
+		return job(ctx)
+	}
+}
+
+// Check reports the role of the server, a follower is healthy too.
+func (e *Elector) Check(context.Context) (string, error) {
+	if !e.IsLeader() {
+		return RoleFollower, nil
+	}
+
+	if e == nil {
+		return RoleLeader, nil
+	}
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return RoleLeader + " since " + e.since.UTC().Format(time.RFC3339), nil
+}
+
+func (e *Elector) heldLock() database.Lock {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.lock
+}
+
+// stepDown stops the leader jobs first and then releases the lock.
+func (e *Elector) stepDown(ctx context.Context) {
+	e.mutex.Lock()
+	lock := e.lock
+	e.lock = nil
+	e.mutex.Unlock()
+
+	err := lock.Release(ctx)
+	if err != nil {
+		logger.SugarLogger.Errorf("Failed to release leader lock: %v", err)
+	}
+
+	e.transitions.Inc()
+	e.leaderGauge.Set(0)
+}
@@ -0,0 +1,136 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/database"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type electorConf struct{}
+
+type lockerMock struct {
+	holders map[int64]*lockMock
+	lock    sync.Mutex
+}
+
+type lockMock struct {
+	locker *lockerMock
+	key    int64
+	lost   bool
+}
+
+func TestElector(t *testing.T) {
+	ctx := context.Background()
+	locker := &lockerMock{holders: map[int64]*lockMock{}}
+	first := NewElector(&electorConf{}, locker, nil)
+	second := NewElector(&electorConf{}, locker, nil)
+
+	first.Renew(ctx)
+	second.Renew(ctx)
+	assert.True(t, first.IsLeader())
+	assert.False(t, second.IsLeader())
+
+	role, err := second.Check(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleFollower, role)
+	assert.True(t, second.LeaderSince().IsZero())
+	assert.False(t, first.LeaderSince().IsZero())
+
+	runs := 0
+	job := func(context.Context) error {
+		runs++
+		return nil
+	}
+	assert.NoError(t, first.Singleton(job)(ctx))
+	assert.NoError(t, second.Singleton(job)(ctx))
+	assert.Equal(t, 1, runs)
+
+	// the session of the leader is lost, the database releases the lock
+	locker.loseSession(first.key)
+	second.Renew(ctx)
+	assert.True(t, second.IsLeader())
+	first.Renew(ctx)
+	assert.False(t, first.IsLeader())
+
+	// the leadership is handed over on release
+	second.Release(ctx)
+	assert.False(t, second.IsLeader())
+	first.Renew(ctx)
+	assert.True(t, first.IsLeader())
+
+	// the lease expires without renewals
+	now := time.Now()
+	first.now = func() time.Time { return now.Add(time.Minute) }
+	assert.False(t, first.IsLeader())
+	first.Renew(ctx)
+	assert.True(t, first.IsLeader())
+}
+
+func TestElector_Nil(t *testing.T) {
+	var elector *Elector
+	assert.True(t, elector.IsLeader())
+	assert.True(t, elector.LeaderSince().IsZero())
+	elector.Release(context.Background())
+
+	role, err := elector.Check(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, RoleLeader, role)
+	assert.ErrorIs(t, elector.Singleton(func(context.Context) error { return test.ErrTest })(context.Background()), test.ErrTest)
+}
+
+func (l *lockerMock) AcquireLock(_ context.Context, key int64) (database.Lock, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.holders[key]; ok {
+		return nil, nil
+	}
+
+	result := &lockMock{locker: l, key: key}
+	l.holders[key] = result
+	return result, nil
+}
+
+func (l *lockerMock) loseSession(key int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.holders[key].lost = true
+	delete(l.holders, key)
+}
+
+func (l *lockMock) Check(context.Context) error {
+	l.locker.lock.Lock()
+	defer l.locker.lock.Unlock()
+
+	if l.lost {
+		return test.ErrTest
+	}
+
+	return nil
+}
+
+func (l *lockMock) Release(context.Context) error {
+	l.locker.lock.Lock()
+	defer l.locker.lock.Unlock()
+
+	if l.locker.holders[l.key] == l {
+		delete(l.locker.holders, l.key)
+	}
+
+	return nil
+}
+
+func (c *electorConf) LeaderLockKey() int64 {
+	return 42
+}
+
+func (c *electorConf) LeaderLease() time.Duration {
+	return 15 * time.Second
+}
@@ -0,0 +1,32 @@
+package limiter
+
+// ConcurrencyLimiter bounds the number of operations in flight without waiting for a free slot.
+type ConcurrencyLimiter struct {
+	slots chan struct{}
+}
+
+func NewConcurrencyLimiter(capacity int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{slots: make(chan struct{}, capacity)}
+}
+
+// TryAcquire takes a slot if one is free.
+func (l *ConcurrencyLimiter) TryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *ConcurrencyLimiter) Release() {
+	<-l.slots
+}
+
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.slots)
+}
+
+func (l *ConcurrencyLimiter) Capacity() int {
+	return cap(l.slots)
+}
@@ -0,0 +1,178 @@
+package limiter
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+)
+
+type Class string
+
+const (
+	ClassIngest Class = "ingest"
+	ClassRead   Class = "read"
+
+	ReasonConcurrency = "concurrency"
+	ReasonRate        = "rate"
+
+	concurrencyRetryAfter = time.Second
+)
+
+type loadShedderConfig interface {
+	MaxIngestInFlight() int
+	IngestRequestsPerSecond() int
+	IngestBurst() int
+	MaxReadInFlight() int
+}
+
+type ClassStats struct {
+	Class             Class `json:"class"`
+	InFlight          int64 `json:"inFlight"`
+	MaxInFlight       int   `json:"maxInFlight,omitempty"`
+	RatePerSecond     int   `json:"ratePerSecond,omitempty"`
+	Accepted          int64 `json:"accepted"`
+	ShedByConcurrency int64 `json:"shedByConcurrency"`
+	ShedByRate        int64 `json:"shedByRate"`
+}
+
+type classLimiter struct {
+	concurrency *ConcurrencyLimiter
+	rate        *TokenBucket
+	ratePerSec  int
+
+	inFlight          atomic.Int64
+	accepted          atomic.Int64
+	shedByConcurrency atomic.Int64
+	shedByRate        atomic.Int64
+}
+
+// LoadShedder rejects requests over the configured limits instead of queueing them.
+// Ingest and read requests use separate limits, so an ingest storm never takes the read capacity.
+type LoadShedder struct {
+	classes map[Class]*classLimiter
+}
+
+func NewLoadShedder(config loadShedderConfig) *LoadShedder {
+	ingest := &classLimiter{ratePerSec: config.IngestRequestsPerSecond()}
+	if maxInFlight := config.MaxIngestInFlight(); maxInFlight > 0 {
+		ingest.concurrency = NewConcurrencyLimiter(maxInFlight)
+	}
+	if ingest.ratePerSec > 0 {
+		burst := config.IngestBurst()
+		if burst <= 0 {
+			burst = ingest.ratePerSec
+		}
+		ingest.rate = NewTokenBucket(float64(ingest.ratePerSec), float64(burst))
+	}
+
+	read := &classLimiter{}
+	if maxInFlight := config.MaxReadInFlight(); maxInFlight > 0 {
+		read.concurrency = NewConcurrencyLimiter(maxInFlight)
+	}
+
+	return &LoadShedder{classes: map[Class]*classLimiter{
+		ClassIngest: ingest,
+		ClassRead:   read,
+	}}
+}
+
+// Limit returns a middleware that sheds requests of the class over its limits:
+// 503 when all slots are busy and 429 when the rate is exceeded, both with Retry-After.
+// A nil LoadShedder allows every request.
+func (s *LoadShedder) Limit(class Class) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if s == nil {
+			return next
+		}
+
+		limiter := s.classes[class]
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the slot is taken first, so a request shed by concurrency does not spend a rate token
+			if limiter.concurrency != nil {
+				if !limiter.concurrency.TryAcquire() {
+					limiter.shedByConcurrency.Add(1)
+					shed(w, r, class, ReasonConcurrency, concurrencyRetryAfter, http.StatusServiceUnavailable)
+					return
+				}
+				defer limiter.concurrency.Release()
+			}
+
+			if limiter.rate != nil {
+				if ok, delay := limiter.rate.Allow(1); !ok {
+					limiter.shedByRate.Add(1)
+					shed(w, r, class, ReasonRate, delay, http.StatusTooManyRequests)
+					return
+				}
+			}
+
+			limiter.accepted.Add(1)
+			limiter.inFlight.Add(1)
+			defer limiter.inFlight.Add(-1)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Stats returns the current state of every request class.
+func (s *LoadShedder) Stats() []ClassStats {
+	result := []ClassStats{}
+	if s == nil {
+		return result
+	}
+
+	for _, class := range []Class{ClassIngest, ClassRead} {
+		limiter := s.classes[class]
+		stats := ClassStats{
+			Class:             class,
+			InFlight:          limiter.inFlight.Load(),
+			RatePerSecond:     limiter.ratePerSec,
+			Accepted:          limiter.accepted.Load(),
+			ShedByConcurrency: limiter.shedByConcurrency.Load(),
+			ShedByRate:        limiter.shedByRate.Load(),
+		}
+		if limiter.concurrency != nil {
+			stats.MaxInFlight = limiter.concurrency.Capacity()
+		}
+
+		result = append(result, stats)
+	}
+
+	return result
+}
+
+// GetMetrics exports the stats as gauges, so the shedder can be used as a self-metrics provider.
+func (s *LoadShedder) GetMetrics() <-chan metrics.Metric {
+	stats := s.Stats()
+
+	result := make(chan metrics.Metric)
+	go func() {
+		defer close(result)
+		for _, item := range stats {
+			suffix := "." + string(item.Class)
+			result <- types.NewGaugeMetricValue("LimiterInFlight"+suffix, float64(item.InFlight))
+			result <- types.NewGaugeMetricValue("LimiterAccepted"+suffix, float64(item.Accepted))
+			result <- types.NewGaugeMetricValue("LimiterShed."+ReasonConcurrency+suffix, float64(item.ShedByConcurrency))
+			result <- types.NewGaugeMetricValue("LimiterShed."+ReasonRate+suffix, float64(item.ShedByRate))
+		}
+	}()
+
+	return result
+}
+
+func (s *LoadShedder) Update(context.Context) error {
+	return nil
+}
+
+func shed(w http.ResponseWriter, r *http.Request, class Class, reason string, retryAfter time.Duration, status int) {
+	logger.SugarLogger.Debugf("Shed %v request %v %v: %v limit exceeded", class, r.Method, r.URL.Path, reason)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, string(class)+" "+reason+" limit exceeded", status)
+}
@@ -0,0 +1,142 @@
+package limiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConf struct {
+	maxIngestInFlight int
+	ingestRate        int
+	ingestBurst       int
+	maxReadInFlight   int
+}
+
+func TestLoadShedder_Concurrency(t *testing.T) {
+	shedder := NewLoadShedder(&testConf{maxIngestInFlight: 1})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := shedder.Limit(ClassIngest)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	ingest := shedder.Limit(ClassIngest)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	read := shedder.Limit(ClassRead)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		blocking.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	ingest.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	read.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	close(release)
+	wg.Wait()
+
+	w = httptest.NewRecorder()
+	ingest.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, []ClassStats{
+		{Class: ClassIngest, MaxInFlight: 1, Accepted: 2, ShedByConcurrency: 1},
+		{Class: ClassRead, Accepted: 1},
+	}, shedder.Stats())
+}
+
+func TestLoadShedder_Rate(t *testing.T) {
+	shedder := NewLoadShedder(&testConf{ingestRate: 1, ingestBurst: 2})
+	handler := shedder.Limit(ClassIngest)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+		statuses = append(statuses, w.Code)
+		if w.Code == http.StatusTooManyRequests {
+			require.Equal(t, "1", w.Header().Get("Retry-After"))
+		}
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, statuses)
+	assert.Equal(t, int64(1), shedder.Stats()[0].ShedByRate)
+}
+
+func TestLoadShedder_ConcurrencyKeepsRate(t *testing.T) {
+	shedder := NewLoadShedder(&testConf{maxIngestInFlight: 1, ingestRate: 1, ingestBurst: 2})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := shedder.Limit(ClassIngest)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	ingest := shedder.Limit(ClassIngest)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		blocking.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	}()
+	<-started
+
+	// the requests shed by concurrency leave the last token
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		ingest.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	}
+
+	close(release)
+	wg.Wait()
+
+	w := httptest.NewRecorder()
+	ingest.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats := shedder.Stats()[0]
+	assert.Equal(t, int64(2), stats.ShedByConcurrency)
+	assert.Equal(t, int64(0), stats.ShedByRate)
+}
+
+func TestLoadShedder_Nil(t *testing.T) {
+	var shedder *LoadShedder
+	handler := shedder.Limit(ClassIngest)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, shedder.Stats())
+}
+
+func (c *testConf) MaxIngestInFlight() int {
+	return c.maxIngestInFlight
+}
+
+func (c *testConf) IngestRequestsPerSecond() int {
+	return c.ingestRate
+}
+
+func (c *testConf) IngestBurst() int {
+	return c.ingestBurst
+}
+
+func (c *testConf) MaxReadInFlight() int {
+	return c.maxReadInFlight
+}
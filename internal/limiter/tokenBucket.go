@@ -0,0 +1,95 @@
+package limiter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket refills rate tokens per second up to capacity.
+// A request larger than capacity is admitted on a full bucket and leaves it in debt,
+// so oversized requests are slowed down instead of being rejected forever.
+type TokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	updated  time.Time
+	now      func() time.Time
+	lock     sync.Mutex
+}
+
+func NewTokenBucket(rate float64, capacity float64) *TokenBucket {
+	return newTokenBucket(rate, capacity, time.Now)
+}
+
+func newTokenBucket(rate float64, capacity float64, now func() time.Time) *TokenBucket {
+	return &TokenBucket{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		updated:  now(),
+		now:      now,
+	}
+}
+
+// Allow takes n tokens if they are available, otherwise returns how long to wait for them.
+func (b *TokenBucket) Allow(n float64) (bool, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delay := b.delay(n)
+	if delay > 0 {
+		return false, delay
+	}
+
+	b.tokens -= n
+	return true, 0
+}
+
+// Delay returns how long to wait until n tokens are available, without taking them.
+func (b *TokenBucket) Delay(n float64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.delay(n)
+}
+
+// Take unconditionally takes n tokens.
+func (b *TokenBucket) Take(n float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	b.tokens -= n
+}
+
+func (b *TokenBucket) Tokens() float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+	return b.tokens
+}
+
+func (b *TokenBucket) delay(n float64) time.Duration {
+	b.refill()
+
+	required := math.Min(n, b.capacity)
+	if b.tokens >= required {
+		return 0
+	}
+
+	seconds := (required - b.tokens) / b.rate
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+func (b *TokenBucket) refill() {
+	now := b.now()
+	elapsed := now.Sub(b.updated).Seconds()
+	b.updated = now
+	if elapsed <= 0 {
+		return
+	}
+
+	b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.rate)
+}
@@ -0,0 +1,44 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket_Allow(t *testing.T) {
+	now := time.Unix(0, 0)
+	bucket := newTokenBucket(10, 10, func() time.Time { return now })
+
+	ok, _ := bucket.Allow(6)
+	assert.True(t, ok)
+
+	ok, delay := bucket.Allow(6)
+	assert.False(t, ok)
+	assert.Equal(t, 200*time.Millisecond, delay)
+
+	now = now.Add(200 * time.Millisecond)
+	ok, _ = bucket.Allow(6)
+	assert.True(t, ok)
+	assert.Equal(t, float64(0), bucket.Tokens())
+
+	// refill is capped by capacity
+	now = now.Add(time.Hour)
+	assert.Equal(t, float64(10), bucket.Tokens())
+}
+
+func TestTokenBucket_Oversized(t *testing.T) {
+	now := time.Unix(0, 0)
+	bucket := newTokenBucket(10, 10, func() time.Time { return now })
+
+	ok, _ := bucket.Allow(30)
+	assert.True(t, ok)
+	assert.Equal(t, float64(-20), bucket.Tokens())
+
+	ok, delay := bucket.Allow(1)
+	assert.False(t, ok)
+	assert.Equal(t, 2100*time.Millisecond, delay)
+
+	assert.Equal(t, time.Duration(0), newTokenBucket(10, 10, func() time.Time { return now }).Delay(100))
+}
@@ -12,9 +12,9 @@ const (
 	LogInfo  = "info"
 )
 
-// Global logger
+// Global logger, no-op until InitLogger is called
 var log *zap.Logger
-var SugarLogger *zap.SugaredLogger
+var SugarLogger = zap.NewNop().Sugar()
 
 // Initializing the logger with a given debug level
 func InitLogger(debugLevel string) {
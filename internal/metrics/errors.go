@@ -3,14 +3,18 @@ package metrics
 import "errors"
 
 var (
+	ErrDeleteNotSupported       = errors.New("metrics deletion is not supported")
 	ErrEmptyURL                 = errors.New("empty url string")
 	ErrFieldNameNotFound        = errors.New("field name was not found")
+	ErrHistoryNotSupported      = errors.New("metrics history is not supported")
 	ErrInvalidRecordMetricType  = errors.New("invalid record metric type")
 	ErrInvalidRecordMetricName  = errors.New("invalid record metric name")
 	ErrInvalidRecordMetricValue = errors.New("invalid record metric value")
 	ErrInvalidSignature         = errors.New("invalid signature")
 	ErrMetricNotFound           = errors.New("metric not found")
 	ErrMetricValueMissed        = errors.New("metric value is missed")
+	ErrSnapshotNotFound         = errors.New("snapshot not found")
+	ErrSnapshotsNotSupported    = errors.New("snapshots are not supported")
 	ErrUnexpectedStatusCode     = errors.New("unexpected status code")
 	ErrUnknownMetricType        = errors.New("unknown metric type")
 )
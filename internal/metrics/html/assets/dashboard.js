@@ -0,0 +1,25 @@
+(function () {
+  var filter = document.getElementById("filter");
+  var storageKey = "metricsFilter";
+
+  function apply() {
+    var query = filter.value.trim().toLowerCase();
+    sessionStorage.setItem(storageKey, filter.value);
+    document.querySelectorAll("section.group").forEach(function (group) {
+      var visible = 0;
+      group.querySelectorAll("tbody tr").forEach(function (row) {
+        var matched = row.dataset.name.toLowerCase().indexOf(query) >= 0;
+        row.classList.toggle("hidden", !matched);
+        if (matched) {
+          visible++;
+        }
+      });
+      group.classList.toggle("hidden", visible === 0);
+    });
+  }
+
+  // keep the filter through auto-refresh reloads
+  filter.value = sessionStorage.getItem(storageKey) || "";
+  filter.addEventListener("input", apply);
+  apply();
+})();
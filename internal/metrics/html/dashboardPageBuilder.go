@@ -0,0 +1,185 @@
+package html
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	timeLayout      = "2006-01-02 15:04:05 MST"
+	sparklineWidth  = 100
+	sparklineHeight = 20
+)
+
+//go:embed assets
+var assets embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(assets, "assets/dashboard.html"))
+
+type dashboardPage struct {
+	Tenant         string
+	GeneratedAt    string
+	RefreshSeconds int
+	ShowTrends     bool
+	Groups         []dashboardGroup
+	Style          template.CSS
+	Script         template.JS
+}
+
+type dashboardGroup struct {
+	Type    string
+	Metrics []dashboardMetric
+}
+
+type dashboardMetric struct {
+	Name      string
+	Value     string
+	Unit      string
+	UpdatedAt string
+	GraphURL  string
+	Sparkline template.HTML
+}
+
+// dashboardPageBuilder renders metrics as a table grouped by type.
+type dashboardPageBuilder struct {
+	style  template.CSS
+	script template.JS
+}
+
+func NewDashboardPageBuilder() HTMLPageBuilder {
+	return &dashboardPageBuilder{
+		// assets are embedded into the binary and trusted
+		style:  template.CSS(mustReadAsset("assets/dashboard.css")),
+		script: template.JS(mustReadAsset("assets/dashboard.js")),
+	}
+}
+
+func (d *dashboardPageBuilder) BuildMetricsPage(metricsByType map[string]map[string]string, options PageOptions) string {
+	generatedAt := options.GeneratedAt
+	if generatedAt.IsZero() {
+		generatedAt = time.Now()
+	}
+
+	page := dashboardPage{
+		Tenant:         options.Tenant,
+		GeneratedAt:    generatedAt.Format(timeLayout),
+		RefreshSeconds: int(options.RefreshInterval.Seconds()),
+		ShowTrends:     options.History != nil,
+		Groups:         []dashboardGroup{},
+		Style:          d.style,
+		Script:         d.script,
+	}
+
+	for _, metricType := range sortedKeys(metricsByType) {
+		metricValues := metricsByType[metricType]
+		if len(metricValues) == 0 {
+			continue
+		}
+
+		group := dashboardGroup{Type: metricType}
+		for _, metricName := range sortedKeys(metricValues) {
+			value := metricValues[metricName]
+			metric := dashboardMetric{
+				Name:  metricName,
+				Value: value,
+				Unit:  metricUnit(metricName),
+			}
+			if updatedAt, ok := options.UpdatedAt[metricType][metricName]; ok {
+				metric.UpdatedAt = updatedAt.Format(timeLayout)
+			}
+
+			if page.ShowTrends {
+				metric.GraphURL = "/graph/" + url.PathEscape(metricType) + "/" + url.PathEscape(metricName)
+				// the chart is rendered by us from numbers only, the title is escaped
+				metric.Sparkline = template.HTML(RenderLineChart(options.History[metricType][metricName], ChartOptions{
+					Title:     metricName,
+					Width:     sparklineWidth,
+					Height:    sparklineHeight,
+					Sparkline: true,
+				}))
+			}
+
+			group.Metrics = append(group.Metrics, metric)
+		}
+
+		page.Groups = append(page.Groups, group)
+	}
+
+	buf := bytes.Buffer{}
+	err := dashboardTemplate.Execute(&buf, page)
+	if err != nil {
+		logrus.Errorf("failed to build dashboard page: %v", err)
+		return "<html>" + template.HTMLEscapeString(err.Error()) + "</html>"
+	}
+
+	return buf.String()
+}
+
+var exactUnits = map[string]string{
+	"GCCPUFraction": "ratio",
+	"LastGC":        "ns",
+	"PauseTotalNs":  "ns",
+	"RandomValue":   "",
+}
+
+var countMetrics = map[string]bool{
+	"Frees":       true,
+	"HeapObjects": true,
+	"Lookups":     true,
+	"Mallocs":     true,
+	"NumForcedGC": true,
+	"NumGC":       true,
+	"PollCount":   true,
+}
+
+// metricUnit guesses the unit by the well known metric names.
+func metricUnit(metricName string) string {
+	if unit, ok := exactUnits[metricName]; ok {
+		return unit
+	}
+
+	switch {
+	case countMetrics[metricName]:
+		return "count"
+	case strings.HasPrefix(metricName, "CPUutilization"):
+		return "%"
+	case strings.Contains(metricName, "Duration"):
+		return "s"
+	case strings.HasSuffix(metricName, "Memory"),
+		strings.HasSuffix(metricName, "Sys"),
+		strings.HasSuffix(metricName, "Inuse"),
+		strings.HasSuffix(metricName, "Alloc"),
+		strings.HasSuffix(metricName, "Idle"),
+		strings.HasSuffix(metricName, "Released"),
+		metricName == "NextGC":
+		return "bytes"
+	default:
+		return ""
+	}
+}
+
+func sortedKeys[T any](values map[string]T) []string {
+	result := make([]string, 0, len(values))
+	for key := range values {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+func mustReadAsset(name string) string {
+	content, err := assets.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(content)
+}
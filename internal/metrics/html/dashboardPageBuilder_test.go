@@ -0,0 +1,105 @@
+package html
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboardPageBuilder_BuildMetricsPage(t *testing.T) {
+	generatedAt := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		metricsByType    map[string]map[string]string
+		options          PageOptions
+		expectedParts    []string
+		notExpectedParts []string
+	}{
+		{
+			name:          "no_metrics",
+			metricsByType: map[string]map[string]string{"counter": {}},
+			options:       PageOptions{Tenant: "default", GeneratedAt: generatedAt},
+			expectedParts: []string{
+				"No metrics yet",
+				"Updated at <time>2023-01-02 03:04:05 UTC</time>, auto-refresh is off",
+			},
+			notExpectedParts: []string{"http-equiv=\"refresh\"", "<table>", "<th>Trend</th>"},
+		},
+		{
+			name: "grouped_by_type",
+			metricsByType: map[string]map[string]string{
+				"gauge":   {"Alloc": "100", "CPUutilization1": "12.5"},
+				"counter": {"PollCount": "5"},
+			},
+			options: PageOptions{Tenant: "teamA", GeneratedAt: generatedAt, RefreshInterval: 5 * time.Second},
+			expectedParts: []string{
+				`<meta http-equiv="refresh" content="5">`,
+				`<section class="group" data-type="counter">`,
+				`<td class="name">PollCount</td><td class="value">5</td><td class="unit">count</td>`,
+				`<td class="name">Alloc</td><td class="value">100</td><td class="unit">bytes</td>`,
+				`<td class="name">CPUutilization1</td><td class="value">12.5</td><td class="unit">%</td>`,
+				"<title>Metrics - teamA</title>",
+			},
+		},
+		{
+			name: "sparklines",
+			metricsByType: map[string]map[string]string{
+				"gauge": {"Alloc": "100", "my metric": "1"},
+			},
+			options: PageOptions{GeneratedAt: generatedAt, History: map[string]map[string][]storage.Sample{
+				"gauge": {"Alloc": {{Time: generatedAt, Value: 100}}},
+			}},
+			expectedParts: []string{
+				"<th>Trend</th>",
+				`<a href="/graph/gauge/Alloc?range=1h"><svg`,
+				`<a href="/graph/gauge/my%20metric?range=1h"><svg`,
+				`<circle cx="99.0" cy="10.0" r="2"`,
+			},
+		},
+		{
+			name: "escaped_name",
+			metricsByType: map[string]map[string]string{
+				"gauge": {"<script>alert(1)</script>": "1"},
+			},
+			options:          PageOptions{GeneratedAt: generatedAt},
+			expectedParts:    []string{"&lt;script&gt;alert(1)&lt;/script&gt;"},
+			notExpectedParts: []string{"<script>alert(1)</script>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := NewDashboardPageBuilder().BuildMetricsPage(tt.metricsByType, tt.options)
+
+			for _, part := range tt.expectedParts {
+				assert.Contains(t, actual, part)
+			}
+			for _, part := range tt.notExpectedParts {
+				assert.NotContains(t, actual, part)
+			}
+		})
+	}
+}
+
+func TestDashboardPageBuilder_UpdatedAt(t *testing.T) {
+	updatedAt := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	metricsByType := map[string]map[string]string{"gauge": {"Alloc": "2", "Sys": "1"}}
+	options := PageOptions{
+		GeneratedAt: updatedAt.Add(time.Hour),
+		UpdatedAt:   map[string]map[string]time.Time{"gauge": {"Alloc": updatedAt}},
+	}
+
+	// the page views do not change the update times
+	builder := NewDashboardPageBuilder()
+	builder.BuildMetricsPage(metricsByType, PageOptions{GeneratedAt: updatedAt.Add(-time.Hour)})
+	actual := builder.BuildMetricsPage(metricsByType, options)
+
+	assert.Contains(t, actual, `<td class="name">Alloc</td><td class="value">2</td><td class="unit">bytes</td><td class="updated-at"><time>2023-01-02 03:04:05 UTC</time>`)
+	assert.Contains(t, actual, `<td class="name">Sys</td><td class="value">1</td><td class="unit">bytes</td><td class="updated-at">unknown</td>`)
+	assert.Equal(t, 1, strings.Count(actual, "<table>"))
+}
@@ -1,5 +1,21 @@
 package html
 
+import (
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+)
+
+type PageOptions struct {
+	Tenant          string
+	GeneratedAt     time.Time
+	RefreshInterval time.Duration
+	// History of the metrics by type and name for sparklines, nil disables them.
+	History map[string]map[string][]storage.Sample
+	// UpdatedAt is the last update time of the metrics by type and name kept by the storage, nil if unknown.
+	UpdatedAt map[string]map[string]time.Time
+}
+
 type HTMLPageBuilder interface {
-	BuildMetricsPage(metricsByType map[string]map[string]string) string
+	BuildMetricsPage(metricsByType map[string]map[string]string, options PageOptions) string
 }
@@ -13,7 +13,7 @@ func NewSimplePageBuilder() HTMLPageBuilder {
 	return &simplePageBuilder{}
 }
 
-func (s simplePageBuilder) BuildMetricsPage(metricsByType map[string]map[string]string) string {
+func (s simplePageBuilder) BuildMetricsPage(metricsByType map[string]map[string]string, _ PageOptions) string {
 	sb := strings.Builder{}
 	sb.WriteString("<html>")
 
@@ -47,7 +47,7 @@ func TestSimplePageBuilder_BuildMetricsPage(t *testing.T) {
 				"gauge":   tt.gaugeMetrics,
 			}
 
-			actual := builder.BuildMetricsPage(metricsByType)
+			actual := builder.BuildMetricsPage(metricsByType, PageOptions{})
 			assert.Equal(t, tt.expected, actual)
 		})
 	}
@@ -0,0 +1,101 @@
+package html
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+)
+
+const chartPadding = 40
+
+type ChartOptions struct {
+	Title  string
+	Width  int
+	Height int
+	// Sparkline renders only the line without axes and labels.
+	Sparkline bool
+}
+
+// RenderLineChart renders the samples as an SVG line chart.
+func RenderLineChart(samples []storage.Sample, options ChartOptions) string {
+	padding := chartPadding
+	if options.Sparkline {
+		padding = 1
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" class="chart">`,
+		options.Width, options.Height, options.Width, options.Height))
+	if options.Title != "" {
+		sb.WriteString("<title>" + html.EscapeString(options.Title) + "</title>")
+	}
+
+	if len(samples) == 0 {
+		if !options.Sparkline {
+			sb.WriteString(fmt.Sprintf(`<text x="%d" y="%d" text-anchor="middle" fill="#777">no samples</text>`, options.Width/2, options.Height/2))
+		}
+		sb.WriteString("</svg>")
+		return sb.String()
+	}
+
+	minTime, maxTime := samples[0].Time, samples[len(samples)-1].Time
+	minValue, maxValue := samples[0].Value, samples[0].Value
+	for _, sample := range samples {
+		minValue = math.Min(minValue, sample.Value)
+		maxValue = math.Max(maxValue, sample.Value)
+	}
+
+	plotWidth := float64(options.Width - 2*padding)
+	plotHeight := float64(options.Height - 2*padding)
+	x := func(at time.Time) float64 {
+		timeRange := maxTime.Sub(minTime)
+		if timeRange <= 0 {
+			return float64(padding) + plotWidth
+		}
+		return float64(padding) + plotWidth*float64(at.Sub(minTime))/float64(timeRange)
+	}
+	y := func(value float64) float64 {
+		valueRange := maxValue - minValue
+		if valueRange == 0 {
+			return float64(padding) + plotHeight/2
+		}
+		return float64(padding) + plotHeight*(1-(value-minValue)/valueRange)
+	}
+
+	if !options.Sparkline {
+		bottom := options.Height - padding
+		right := options.Width - padding
+		sb.WriteString(fmt.Sprintf(`<g stroke="#ccc"><line x1="%d" y1="%d" x2="%d" y2="%d"/><line x1="%d" y1="%d" x2="%d" y2="%d"/></g>`,
+			padding, padding, padding, bottom, padding, bottom, right, bottom))
+		sb.WriteString(fmt.Sprintf(`<g font-size="11" fill="#555">`+
+			`<text x="%d" y="%d" text-anchor="end">%s</text>`+
+			`<text x="%d" y="%d" text-anchor="end">%s</text>`+
+			`<text x="%d" y="%d">%s</text>`+
+			`<text x="%d" y="%d" text-anchor="end">%s</text></g>`,
+			padding-4, padding+4, formatChartValue(maxValue),
+			padding-4, bottom, formatChartValue(minValue),
+			padding, bottom+16, minTime.Format(time.TimeOnly),
+			right, bottom+16, maxTime.Format(time.TimeOnly)))
+	}
+
+	points := make([]string, len(samples))
+	for i, sample := range samples {
+		points[i] = fmt.Sprintf("%.1f,%.1f", x(sample.Time), y(sample.Value))
+	}
+
+	sb.WriteString(`<polyline fill="none" stroke="#2a6fdb" stroke-width="1.5" points="` + strings.Join(points, " ") + `"/>`)
+	if len(samples) == 1 {
+		sb.WriteString(fmt.Sprintf(`<circle cx="%.1f" cy="%.1f" r="2" fill="#2a6fdb"/>`, x(samples[0].Time), y(samples[0].Value)))
+	}
+	sb.WriteString("</svg>")
+	return sb.String()
+}
+
+func formatChartValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', 6, 64)
+}
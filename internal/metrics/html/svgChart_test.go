@@ -0,0 +1,73 @@
+package html
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderLineChart(t *testing.T) {
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	samples := []storage.Sample{
+		{Time: start, Value: 10},
+		{Time: start.Add(time.Minute), Value: 30},
+		{Time: start.Add(2 * time.Minute), Value: 20},
+	}
+
+	tests := []struct {
+		name             string
+		samples          []storage.Sample
+		options          ChartOptions
+		expectedParts    []string
+		notExpectedParts []string
+	}{
+		{
+			name:    "chart",
+			samples: samples,
+			options: ChartOptions{Title: "<Alloc>", Width: 140, Height: 100},
+			expectedParts: []string{
+				`<svg xmlns="http://www.w3.org/2000/svg" width="140" height="100" viewBox="0 0 140 100" class="chart">`,
+				"<title>&lt;Alloc&gt;</title>",
+				`points="40.0,60.0 70.0,40.0 100.0,50.0"`,
+				`<text x="36" y="44" text-anchor="end">30</text>`,
+				`<text x="36" y="60" text-anchor="end">10</text>`,
+				">03:04:05</text>",
+				">03:06:05</text>",
+			},
+		},
+		{
+			name:             "sparkline",
+			samples:          samples,
+			options:          ChartOptions{Width: 102, Height: 22, Sparkline: true},
+			expectedParts:    []string{`points="1.0,21.0 51.0,1.0 101.0,11.0"`},
+			notExpectedParts: []string{"<text", "<line"},
+		},
+		{
+			name:          "no_samples",
+			options:       ChartOptions{Width: 100, Height: 50},
+			expectedParts: []string{"no samples</text></svg>"},
+		},
+		{
+			name:          "single_sample",
+			samples:       samples[:1],
+			options:       ChartOptions{Width: 102, Height: 22, Sparkline: true},
+			expectedParts: []string{`<circle cx="101.0" cy="11.0" r="2"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := RenderLineChart(tt.samples, tt.options)
+
+			for _, part := range tt.expectedParts {
+				assert.Contains(t, actual, part)
+			}
+			for _, part := range tt.notExpectedParts {
+				assert.NotContains(t, actual, part)
+			}
+		})
+	}
+}
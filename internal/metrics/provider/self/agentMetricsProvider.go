@@ -0,0 +1,69 @@
+package self
+
+import (
+	"context"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+// AgentMetricsProvider reports the agent collection and push health as ordinary gauges.
+type AgentMetricsProvider struct {
+	registry *selfmetrics.Registry
+}
+
+type trackedMetricsProvider struct {
+	name     string
+	provider metrics.MetricsProvider
+	registry *selfmetrics.Registry
+}
+
+func NewAgentMetricsProvider() *AgentMetricsProvider {
+	return &AgentMetricsProvider{registry: selfmetrics.NewRegistry()}
+}
+
+func (a *AgentMetricsProvider) GetMetrics() <-chan metrics.Metric {
+	return a.registry.GetMetrics()
+}
+
+func (a *AgentMetricsProvider) Update(context.Context) error {
+	return nil
+}
+
+func (a *AgentMetricsProvider) ObservePush(metricsCount int, duration time.Duration, failureReason string) {
+	a.registry.Counter("AgentPushAttempts").Inc()
+	a.registry.Histogram("AgentPushDuration", selfmetrics.DurationBuckets).Observe(duration.Seconds())
+	a.registry.Histogram("AgentPushBatchSize", selfmetrics.BatchSizeBuckets).Observe(float64(metricsCount))
+	if failureReason != "" {
+		a.registry.Counter("AgentPushFailures." + failureReason).Inc()
+	}
+}
+
+func (a *AgentMetricsProvider) ObserveDropped(metricsCount int) {
+	a.registry.Counter("AgentDroppedMetrics").Add(int64(metricsCount))
+}
+
+// Track wraps the provider to observe its update durations and failures.
+func (a *AgentMetricsProvider) Track(name string, provider metrics.MetricsProvider) metrics.MetricsProvider {
+	return &trackedMetricsProvider{
+		name:     name,
+		provider: provider,
+		registry: a.registry,
+	}
+}
+
+func (t *trackedMetricsProvider) GetMetrics() <-chan metrics.Metric {
+	return t.provider.GetMetrics()
+}
+
+func (t *trackedMetricsProvider) Update(ctx context.Context) error {
+	started := time.Now()
+	err := t.provider.Update(ctx)
+	t.registry.Histogram("AgentProviderUpdateDuration."+t.name, selfmetrics.DurationBuckets).Observe(time.Since(started).Seconds())
+	if err != nil {
+		t.registry.Counter("AgentProviderUpdateFailures." + t.name).Inc()
+	}
+
+	return err
+}
@@ -0,0 +1,67 @@
+package self
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type metricsProviderMock struct {
+	mock.Mock
+}
+
+func TestAgentMetricsProvider_Observe(t *testing.T) {
+	provider := NewAgentMetricsProvider()
+
+	provider.ObservePush(10, 20*time.Millisecond, "")
+	provider.ObservePush(5, time.Second, "timeout")
+	provider.ObserveDropped(5)
+
+	actual := collect(provider)
+	assert.Equal(t, float64(2), actual["AgentPushAttempts"])
+	assert.Equal(t, float64(1), actual["AgentPushFailures.timeout"])
+	assert.Equal(t, float64(5), actual["AgentDroppedMetrics"])
+	assert.Equal(t, float64(2), actual["AgentPushBatchSize.count"])
+	assert.Equal(t, float64(15), actual["AgentPushBatchSize.sum"])
+	assert.Equal(t, float64(1), actual["AgentPushDuration.le_0.05"])
+}
+
+func TestAgentMetricsProvider_Track(t *testing.T) {
+	ctx := context.Background()
+	provider := NewAgentMetricsProvider()
+
+	trackedProvider := new(metricsProviderMock)
+	trackedProvider.On("Update", ctx).Return(test.ErrTest)
+
+	err := provider.Track("runtime", trackedProvider).Update(ctx)
+	assert.ErrorIs(t, err, test.ErrTest)
+
+	actual := collect(provider)
+	assert.Equal(t, float64(1), actual["AgentProviderUpdateDuration.runtime.count"])
+	assert.Equal(t, float64(1), actual["AgentProviderUpdateFailures.runtime"])
+}
+
+func collect(provider metrics.MetricsProvider) map[string]float64 {
+	result := map[string]float64{}
+	for metric := range provider.GetMetrics() {
+		result[metric.GetName()] = metric.GetValue()
+	}
+
+	return result
+}
+
+func (m *metricsProviderMock) GetMetrics() <-chan metrics.Metric {
+	args := m.Called()
+	return args.Get(0).(<-chan metrics.Metric)
+}
+
+func (m *metricsProviderMock) Update(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,19 +12,25 @@ import (
 	"sync"
 	"time"
 
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
 	"github.com/MlDenis/prometheus_wannabe/internal/logger"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/sendler"
+	"github.com/MlDenis/prometheus_wannabe/internal/transport"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
 type metricsPusherConfig interface {
+	transport.ClientTLSConfig
+
 	ParallelLimit() int
 	MetricsServerURL() string
 	PushMetricsTimeout() time.Duration
+	APIToken() string
+	Tenant() string
 }
 
 type httpMetricsPusher struct {
@@ -31,27 +38,63 @@ type httpMetricsPusher struct {
 	client           *http.Client
 	metricsServerURL string
 	pushTimeout      time.Duration
+	apiToken         string
+	tenant           string
 	converter        *model.MetricsConverter
+	observer         sendler.PushObserver
+}
+
+type unexpectedStatusError struct {
+	statusCode int
+	content    string
 }
 
+type nopPushObserver struct{}
+
 var bufPool = sync.Pool{
 	New: func() interface{} {
 		return new(bytes.Buffer)
 	},
 }
 
-func NewMetricsPusher(config metricsPusherConfig, converter *model.MetricsConverter) (sendler.MetricsPusher, error) {
+// NewMetricsPusher creates the pusher, the observer may be nil.
+func NewMetricsPusher(config metricsPusherConfig, converter *model.MetricsConverter, observer sendler.PushObserver) (sendler.MetricsPusher, error) {
 	serverURL, err := normalizeURL(config.MetricsServerURL())
 	if err != nil {
 		return nil, logger.WrapError("normalize url", err)
 	}
 
+	tlsConfig, err := transport.NewClientTLSConfig(config)
+	if err != nil {
+		return nil, logger.WrapError("create tls config", err)
+	}
+
+	if observer == nil {
+		observer = nopPushObserver{}
+	}
+
+	client := &http.Client{}
+	if tlsConfig != nil {
+		if serverURL.Scheme != "https" {
+			logrus.Infof("TLS is configured, switch metrics server scheme from %s to https", serverURL.Scheme)
+			serverURL.Scheme = "https"
+		}
+
+		// keeps the proxy, timeouts and connection limits of the default transport
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+	}
+
 	return &httpMetricsPusher{
 		parallelLimit:    config.ParallelLimit(),
-		client:           &http.Client{},
+		client:           client,
 		metricsServerURL: serverURL.String(),
 		pushTimeout:      config.PushMetricsTimeout(),
+		apiToken:         config.APIToken(),
+		tenant:           config.Tenant(),
 		converter:        converter,
+		observer:         observer,
 	}, nil
 }
 
@@ -67,8 +110,9 @@ func (p *httpMetricsPusher) Push(ctx context.Context, metricsChan <-chan metrics
 						return nil
 					}
 
-					err := p.pushMetrics(ctx, []metrics.Metric{metric})
+					err := p.observedPushMetrics(ctx, []metrics.Metric{metric})
 					if err != nil {
+						p.observer.ObserveDropped(1)
 						return err
 					}
 				case <-ctx.Done():
@@ -78,7 +122,25 @@ func (p *httpMetricsPusher) Push(ctx context.Context, metricsChan <-chan metrics
 		})
 	}
 
-	return eg.Wait()
+	err := eg.Wait()
+	if err != nil {
+		// the rest of the metrics is not delivered, drain them so the providers are not blocked
+		dropped := 0
+		for range metricsChan {
+			dropped++
+		}
+		p.observer.ObserveDropped(dropped)
+	}
+
+	return err
+}
+
+func (p *httpMetricsPusher) observedPushMetrics(ctx context.Context, metricsList []metrics.Metric) error {
+	started := time.Now()
+	err := p.pushMetrics(ctx, metricsList)
+	p.observer.ObservePush(len(metricsList), time.Since(started), failureReason(err))
+
+	return err
 }
 
 func (p *httpMetricsPusher) pushMetrics(ctx context.Context, metricsList []metrics.Metric) error {
@@ -115,6 +177,12 @@ func (p *httpMetricsPusher) pushMetrics(ctx context.Context, metricsList []metri
 		return logger.WrapError("create push request", err)
 	}
 	request.Header.Add("Content-Type", "application/json")
+	if p.apiToken != "" {
+		request.Header.Add("Authorization", "Bearer "+p.apiToken)
+	}
+	if p.tenant != "" {
+		request.Header.Add(identity.TenantHeader, p.tenant)
+	}
 
 	response, err := p.client.Do(request)
 	if err != nil {
@@ -131,7 +199,7 @@ func (p *httpMetricsPusher) pushMetrics(ctx context.Context, metricsList []metri
 	stringContent := string(content)
 	if response.StatusCode != http.StatusOK {
 		logrus.Errorf("Unexpected response status code: %v %v", response.Status, stringContent)
-		return logger.WrapError(fmt.Sprintf("push metric: %s", stringContent), metrics.ErrUnexpectedStatusCode)
+		return logger.WrapError("push metric", &unexpectedStatusError{statusCode: response.StatusCode, content: stringContent})
 	}
 
 	for _, metric := range metricsList {
@@ -146,6 +214,39 @@ func (p *httpMetricsPusher) pushMetrics(ctx context.Context, metricsList []metri
 	return nil
 }
 
+// failureReason classifies the push error for the self metrics, so the reasons count is bounded.
+func failureReason(err error) string {
+	var errStatus *unexpectedStatusError
+	var errURL *url.Error
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &errStatus):
+		return fmt.Sprintf("status_%d", errStatus.statusCode)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &errURL):
+		return "connection"
+	default:
+		return "other"
+	}
+}
+
+func (e *unexpectedStatusError) Error() string {
+	return fmt.Sprintf("%v: %d %s", metrics.ErrUnexpectedStatusCode, e.statusCode, e.content)
+}
+
+func (e *unexpectedStatusError) Unwrap() error {
+	return metrics.ErrUnexpectedStatusCode
+}
+
+func (nopPushObserver) ObservePush(int, time.Duration, string) {}
+
+func (nopPushObserver) ObserveDropped(int) {}
+
 func normalizeURL(urlStr string) (*url.URL, error) {
 	if urlStr == "" {
 		return nil, logger.WrapError("normalize url", metrics.ErrEmptyURL)
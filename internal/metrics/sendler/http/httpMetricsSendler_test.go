@@ -14,8 +14,10 @@ import (
 	internalHash "github.com/MlDenis/prometheus_wannabe/internal/hash"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/provider/self"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
 	"github.com/MlDenis/prometheus_wannabe/internal/test"
+	"github.com/MlDenis/prometheus_wannabe/internal/transport"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -26,6 +28,17 @@ type testConf struct {
 	signEnabled      bool
 	key              []byte
 	parallelLimit    int
+	caFile           string
+	certFile         string
+	keyFile          string
+	apiToken         string
+	tenant           string
+}
+
+type serverTLSConf struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
 }
 
 type testMetric struct {
@@ -103,6 +116,8 @@ func TestHttpMetricsPusher_Push(t *testing.T) {
 
 			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				assert.Equal(t, "Bearer agentToken", r.Header.Get("Authorization"))
+				assert.Equal(t, "teamA", r.Header.Get("X-Tenant-ID"))
 
 				defer r.Body.Close()
 				modelRequest := []*model.Metrics{}
@@ -125,10 +140,12 @@ func TestHttpMetricsPusher_Push(t *testing.T) {
 				signEnabled:      false,
 				key:              nil,
 				parallelLimit:    10,
+				apiToken:         "agentToken",
+				tenant:           "teamA",
 			}
 			signer := internalHash.NewSigner(conf)
 			converter := model.NewMetricsConverter(conf, signer)
-			pusher, err := NewMetricsPusher(conf, converter)
+			pusher, err := NewMetricsPusher(conf, converter, nil)
 			assert.NoError(t, err)
 
 			err = pusher.Push(ctx, test.ArrayToChan(tt.metricsToPush))
@@ -144,6 +161,84 @@ func TestHttpMetricsPusher_Push(t *testing.T) {
 	}
 }
 
+func TestHttpMetricsPusher_PushTLS(t *testing.T) {
+	serverCA := test.CreateCertificateAuthority(t, "serverCA")
+	clientCA := test.CreateCertificateAuthority(t, "clientCA")
+	serverCert := serverCA.IssueCertificate(t, "server")
+	agentCert := clientCA.IssueCertificate(t, "agent")
+
+	serverTLS, err := transport.NewServerTLSConfig(&serverTLSConf{
+		certFile:     serverCert.CertFile,
+		keyFile:      serverCert.KeyFile,
+		clientCAFile: clientCA.CertFile,
+	})
+	assert.NoError(t, err)
+
+	pushedBy := ""
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushedBy, _ = transport.PeerCommonName(r.TLS)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = serverTLS
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &testConf{
+		connectionString: server.Listener.Addr().String(),
+		timeout:          10 * time.Second,
+		parallelLimit:    1,
+		caFile:           serverCA.CertFile,
+		certFile:         agentCert.CertFile,
+		keyFile:          agentCert.KeyFile,
+	}
+	converter := model.NewMetricsConverter(conf, internalHash.NewSigner(conf))
+	pusher, err := NewMetricsPusher(conf, converter, nil)
+	assert.NoError(t, err)
+
+	// the TLS transport keeps the defaults
+	clientTransport := pusher.(*httpMetricsPusher).client.Transport.(*http.Transport)
+	assert.NotNil(t, clientTransport.Proxy)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout, clientTransport.TLSHandshakeTimeout)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).MaxIdleConns, clientTransport.MaxIdleConns)
+
+	err = pusher.Push(context.Background(), test.ArrayToChan([]metrics.Metric{createCounterMetric("counterMetric", 1)}))
+	assert.NoError(t, err)
+	assert.Equal(t, "agent", pushedBy)
+}
+
+func TestHttpMetricsPusher_PushObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	conf := &testConf{
+		connectionString: server.URL,
+		timeout:          10 * time.Second,
+		parallelLimit:    1,
+	}
+	observer := self.NewAgentMetricsProvider()
+	converter := model.NewMetricsConverter(conf, internalHash.NewSigner(conf))
+	pusher, err := NewMetricsPusher(conf, converter, observer)
+	assert.NoError(t, err)
+
+	err = pusher.Push(context.Background(), test.ArrayToChan([]metrics.Metric{
+		createCounterMetric("first", 1),
+		createCounterMetric("second", 1),
+		createCounterMetric("third", 1),
+	}))
+	assert.ErrorIs(t, err, metrics.ErrUnexpectedStatusCode)
+
+	actual := map[string]float64{}
+	for metric := range observer.GetMetrics() {
+		actual[metric.GetName()] = metric.GetValue()
+	}
+
+	assert.Equal(t, float64(1), actual["AgentPushAttempts"])
+	assert.Equal(t, float64(1), actual["AgentPushFailures.status_429"])
+	assert.Equal(t, float64(3), actual["AgentDroppedMetrics"])
+}
+
 func Test_URLNormalization(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -256,3 +351,35 @@ func (c *testConf) GetKey() []byte {
 func (c *testConf) ParallelLimit() int {
 	return c.parallelLimit
 }
+
+func (c *testConf) TLSCAFile() string {
+	return c.caFile
+}
+
+func (c *testConf) TLSCertFile() string {
+	return c.certFile
+}
+
+func (c *testConf) TLSKeyFile() string {
+	return c.keyFile
+}
+
+func (c *serverTLSConf) TLSCertFile() string {
+	return c.certFile
+}
+
+func (c *serverTLSConf) TLSKeyFile() string {
+	return c.keyFile
+}
+
+func (c *serverTLSConf) TLSClientCAFile() string {
+	return c.clientCAFile
+}
+
+func (c *testConf) APIToken() string {
+	return c.apiToken
+}
+
+func (c *testConf) Tenant() string {
+	return c.tenant
+}
@@ -2,6 +2,7 @@ package sendler
 
 import (
 	"context"
+	"time"
 
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 )
@@ -9,3 +10,10 @@ import (
 type MetricsPusher interface {
 	Push(ctx context.Context, metrics <-chan metrics.Metric) error
 }
+
+// PushObserver is notified about every push request and metrics that were not delivered.
+// The failure reason is empty for a successful push.
+type PushObserver interface {
+	ObservePush(metricsCount int, duration time.Duration, failureReason string)
+	ObserveDropped(metricsCount int)
+}
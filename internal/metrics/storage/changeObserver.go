@@ -0,0 +1,17 @@
+package storage
+
+import "time"
+
+// MetricChange is a snapshot of a series value after an update.
+type MetricChange struct {
+	Tenant string
+	Type   string
+	Name   string
+	Value  float64
+	Time   time.Time
+}
+
+// ChangeObserver is notified about every successful update, it is called under the storage lock and must not block.
+type ChangeObserver interface {
+	ObserveChanges(changes []MetricChange)
+}
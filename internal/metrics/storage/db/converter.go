@@ -10,8 +10,9 @@ import (
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
 )
 
-func toDBRecord(metric metrics.Metric) *database.DBItem {
+func toDBRecord(tenant string, metric metrics.Metric) *database.DBItem {
 	return &database.DBItem{
+		Tenant:     sql.NullString{String: tenant, Valid: true},
 		MetricType: sql.NullString{String: metric.GetType(), Valid: true},
 		Name:       sql.NullString{String: metric.GetName(), Valid: true},
 		Value:      sql.NullFloat64{Float64: metric.GetValue(), Valid: true},
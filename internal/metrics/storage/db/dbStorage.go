@@ -3,9 +3,11 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/MlDenis/prometheus_wannabe/internal/converter"
 	"github.com/MlDenis/prometheus_wannabe/internal/database"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
 	"github.com/MlDenis/prometheus_wannabe/internal/logger"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
@@ -20,9 +22,10 @@ func NewDBStorage(dataBase database.DataBase) storage.MetricsStorage {
 }
 
 func (d *dbStorage) AddMetricValues(ctx context.Context, metricsList []metrics.Metric) ([]metrics.Metric, error) {
+	tenant := identity.Tenant(ctx)
 	dbRecords := make([]*database.DBItem, len(metricsList))
 	for i, metric := range metricsList {
-		dbRecords[i] = toDBRecord(metric)
+		dbRecords[i] = toDBRecord(tenant, metric)
 	}
 
 	err := d.dataBase.UpdateItems(ctx, dbRecords)
@@ -34,7 +37,7 @@ func (d *dbStorage) AddMetricValues(ctx context.Context, metricsList []metrics.M
 }
 
 func (d *dbStorage) GetMetricValues(ctx context.Context) (map[string]map[string]string, error) {
-	records, err := d.dataBase.ReadAllItems(ctx)
+	records, err := d.dataBase.ReadAllItems(ctx, identity.Tenant(ctx))
 	if err != nil {
 		return nil, logger.WrapError("read all db records", err)
 	}
@@ -68,15 +71,43 @@ func (d *dbStorage) GetMetricValues(ctx context.Context) (map[string]map[string]
 }
 
 func (d *dbStorage) GetMetric(ctx context.Context, metricType string, metricName string) (metrics.Metric, error) {
-	result, err := d.dataBase.ReadItem(ctx, metricType, metricName)
+	result, err := d.dataBase.ReadItem(ctx, identity.Tenant(ctx), metricType, metricName)
 	if err != nil {
 		return nil, logger.WrapError("read db record", err)
 	}
 
+	if result == nil {
+		return nil, logger.WrapError(fmt.Sprintf("get metric with name '%s' and type '%s'", metricName, metricType), metrics.ErrMetricNotFound)
+	}
+
 	return fromDBRecord(result)
 }
 
+func (d *dbStorage) DeleteMetric(ctx context.Context, metricType string, metricName string) error {
+	deleted, err := d.dataBase.DeleteItem(ctx, identity.Tenant(ctx), metricType, metricName)
+	if err != nil {
+		return logger.WrapError("delete db record", err)
+	}
+
+	if !deleted {
+		return logger.WrapError(fmt.Sprintf("delete metric with name '%s' and type '%s'", metricName, metricType), metrics.ErrMetricNotFound)
+	}
+
+	return nil
+}
+
+func (d *dbStorage) GetTenants(ctx context.Context) ([]string, error) {
+	tenants, err := d.dataBase.ReadTenants(ctx)
+	if err != nil {
+		return nil, logger.WrapError("read db tenants", err)
+	}
+
+	return tenants, nil
+}
+
+// Restore replaces the tenant records in one transaction, the series missed in the values are deleted.
 func (d *dbStorage) Restore(ctx context.Context, metricValues map[string]map[string]string) error {
+	tenant := sql.NullString{String: identity.Tenant(ctx), Valid: true}
 	records := []*database.DBItem{}
 	for metricType, metricsByType := range metricValues {
 		for metricName, metricValue := range metricsByType {
@@ -86,6 +117,7 @@ func (d *dbStorage) Restore(ctx context.Context, metricValues map[string]map[str
 			}
 
 			records = append(records, &database.DBItem{
+				Tenant:     tenant,
 				MetricType: sql.NullString{String: metricType, Valid: true},
 				Name:       sql.NullString{String: metricName, Valid: true},
 				Value:      sql.NullFloat64{Float64: value, Valid: true},
@@ -93,9 +125,9 @@ func (d *dbStorage) Restore(ctx context.Context, metricValues map[string]map[str
 		}
 	}
 
-	err := d.dataBase.UpdateItems(ctx, records)
+	err := d.dataBase.ReplaceItems(ctx, tenant.String, records)
 	if err != nil {
-		return logger.WrapError("update records", err)
+		return logger.WrapError("replace records", err)
 	}
 
 	return nil
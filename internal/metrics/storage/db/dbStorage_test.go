@@ -1 +1,225 @@
 package db
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/converter"
+	"github.com/MlDenis/prometheus_wannabe/internal/database"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConf struct{}
+
+// testDataBase keeps the records by tenant, type and name
+type testDataBase struct {
+	records map[string]map[string]map[string]*database.DBItem
+	err     error
+	lock    sync.Mutex
+}
+
+func TestDBStorage_Restore(t *testing.T) {
+	tests := []struct {
+		name          string
+		current       map[string]map[string]map[string]string
+		values        map[string]map[string]string
+		dbError       error
+		expected      map[string]map[string]map[string]string
+		expectedError error
+	}{
+		{
+			name: "replace_tenant",
+			current: map[string]map[string]map[string]string{
+				"teamA": {"gauge": {"Sys": "1", "Alloc": "2"}, "counter": {"PollCount": "3"}},
+				"teamB": {"gauge": {"Sys": "4"}},
+			},
+			values: map[string]map[string]string{"gauge": {"Sys": "5"}},
+			expected: map[string]map[string]map[string]string{
+				"teamA": {"gauge": {"Sys": "5"}},
+				"teamB": {"gauge": {"Sys": "4"}},
+			},
+		},
+		{
+			name: "empty_tenant",
+			current: map[string]map[string]map[string]string{
+				"teamA": {"gauge": {"Sys": "1"}},
+			},
+			values:   map[string]map[string]string{},
+			expected: map[string]map[string]map[string]string{},
+		},
+		{
+			name: "db_error",
+			current: map[string]map[string]map[string]string{
+				"teamA": {"gauge": {"Sys": "1"}},
+			},
+			values:        map[string]map[string]string{"gauge": {"Sys": "5"}},
+			dbError:       test.ErrTest,
+			expected:      map[string]map[string]map[string]string{"teamA": {"gauge": {"Sys": "1"}}},
+			expectedError: test.ErrTest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := identity.WithTenant(context.Background(), "teamA")
+			dataBase := newTestDataBase(t, tt.current)
+			dataBase.err = tt.dbError
+
+			actualError := NewDBStorage(dataBase).Restore(ctx, tt.values)
+
+			assert.ErrorIs(t, actualError, tt.expectedError)
+			assert.Equal(t, tt.expected, dataBase.state())
+		})
+	}
+}
+
+func TestDBStorage_ReplaceImport(t *testing.T) {
+	ctx := context.Background()
+	dataBase := newTestDataBase(t, map[string]map[string]map[string]string{
+		"teamA": {"gauge": {"Sys": "1", "Alloc": "2"}},
+		"teamB": {"gauge": {"Sys": "3"}},
+	})
+	strategy := storage.NewStorageStrategy(&testConf{}, memory.NewInMemoryStorage(), NewDBStorage(dataBase), nil)
+
+	// the memory misses teamB, it is removed from the database anyway
+	require.NoError(t, strategy.ImportMetricValues(ctx, map[string]map[string]map[string]string{
+		"teamA": {"gauge": {"Sys": "5"}},
+	}, true))
+
+	assert.Equal(t, map[string]map[string]map[string]string{"teamA": {"gauge": {"Sys": "5"}}}, dataBase.state())
+}
+
+func (c *testConf) SyncMode() bool {
+	return true
+}
+
+func newTestDataBase(t *testing.T, state map[string]map[string]map[string]string) *testDataBase {
+	dataBase := &testDataBase{records: map[string]map[string]map[string]*database.DBItem{}}
+	for tenant, values := range state {
+		ctx := identity.WithTenant(context.Background(), tenant)
+		require.NoError(t, NewDBStorage(dataBase).Restore(ctx, values))
+	}
+
+	return dataBase
+}
+
+func (d *testDataBase) state() map[string]map[string]map[string]string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	result := map[string]map[string]map[string]string{}
+	for tenant, recordsByType := range d.records {
+		for metricType, recordsByName := range recordsByType {
+			for metricName, record := range recordsByName {
+				if result[tenant] == nil {
+					result[tenant] = map[string]map[string]string{}
+				}
+				if result[tenant][metricType] == nil {
+					result[tenant][metricType] = map[string]string{}
+				}
+				result[tenant][metricType][metricName] = converter.FloatToString(record.Value.Float64)
+			}
+		}
+	}
+
+	return result
+}
+
+func (d *testDataBase) Ping(context.Context) error {
+	return nil
+}
+
+func (d *testDataBase) Close() error {
+	return nil
+}
+
+func (d *testDataBase) UpdateItems(_ context.Context, records []*database.DBItem) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	d.update(records)
+	return nil
+}
+
+func (d *testDataBase) ReplaceItems(_ context.Context, tenant string, records []*database.DBItem) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	delete(d.records, tenant)
+	d.update(records)
+	return nil
+}
+
+func (d *testDataBase) ReadItem(_ context.Context, tenant string, metricType string, metricName string) (*database.DBItem, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.records[tenant][metricType][metricName], d.err
+}
+
+func (d *testDataBase) ReadAllItems(_ context.Context, tenant string) ([]*database.DBItem, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	result := []*database.DBItem{}
+	for _, recordsByName := range d.records[tenant] {
+		for _, record := range recordsByName {
+			result = append(result, record)
+		}
+	}
+
+	return result, d.err
+}
+
+func (d *testDataBase) ReadTenants(context.Context) ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	result := []string{}
+	for tenant := range d.records {
+		result = append(result, tenant)
+	}
+
+	return result, d.err
+}
+
+func (d *testDataBase) DeleteItem(_ context.Context, tenant string, metricType string, metricName string) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, ok := d.records[tenant][metricType][metricName]
+	delete(d.records[tenant][metricType], metricName)
+	return ok, d.err
+}
+
+func (d *testDataBase) update(records []*database.DBItem) {
+	for _, record := range records {
+		recordsByType, ok := d.records[record.Tenant.String]
+		if !ok {
+			recordsByType = map[string]map[string]*database.DBItem{}
+			d.records[record.Tenant.String] = recordsByType
+		}
+
+		recordsByName, ok := recordsByType[record.MetricType.String]
+		if !ok {
+			recordsByName = map[string]*database.DBItem{}
+			recordsByType[record.MetricType.String] = recordsByName
+		}
+
+		recordsByName[record.Name.String] = record
+	}
+}
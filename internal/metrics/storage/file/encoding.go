@@ -0,0 +1,126 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+// Encoding is the format of the snapshot body, the write-ahead log is always JSON lines.
+type Encoding string
+
+const (
+	EncodingJSON Encoding = "json"
+	EncodingGzip Encoding = "gzip"
+	EncodingGob  Encoding = "gob"
+	// the snapshots written before the header was added
+	encodingLegacy Encoding = ""
+)
+
+type codec struct {
+	encode func(records storageRecords) ([]byte, error)
+	decode func(data []byte) (storageRecords, error)
+}
+
+var codecs = map[Encoding]codec{
+	EncodingJSON: {encode: encodeJSON, decode: decodeJSON},
+	EncodingGzip: {encode: encodeGzip, decode: decodeGzip},
+	EncodingGob:  {encode: encodeGob, decode: decodeGob},
+}
+
+func (e Encoding) Validate() error {
+	if _, ok := codecs[e]; !ok {
+		return logger.WrapError(fmt.Sprintf("check encoding '%s'", e), ErrUnknownEncoding)
+	}
+
+	return nil
+}
+
+func encodeJSON(records storageRecords) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetIndent("", " ")
+	err := encoder.Encode(records)
+	if err != nil {
+		return nil, logger.WrapError("encode json", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decodeJSON(data []byte) (storageRecords, error) {
+	records := storageRecords{}
+	err := json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, logger.WrapError("decode json", err)
+	}
+
+	return records, nil
+}
+
+func encodeGzip(records storageRecords) ([]byte, error) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, logger.WrapError("encode json", err)
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, logger.WrapError("compress json", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decodeGzip(data []byte) (storageRecords, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, logger.WrapError("open gzip", err)
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, logger.WrapError("decompress json", err)
+	}
+
+	return decodeJSON(decompressed)
+}
+
+func encodeGob(records storageRecords) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(records)
+	if err != nil {
+		return nil, logger.WrapError("encode gob", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decodeGob(data []byte) (storageRecords, error) {
+	records := storageRecords{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&records)
+	if err != nil {
+		return nil, logger.WrapError("decode gob", err)
+	}
+
+	return records, nil
+}
+
+// detectLegacyEncoding tells the encoding of a snapshot without the header by its first bytes.
+func detectLegacyEncoding(data []byte) Encoding {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		return EncodingGzip
+	}
+
+	return EncodingJSON
+}
@@ -0,0 +1,84 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage_Encoding(t *testing.T) {
+	for _, encoding := range []Encoding{EncodingJSON, EncodingGzip, EncodingGob} {
+		t.Run(string(encoding), func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "backup")
+			storage := NewFileStorage(&config{filePath: filePath, encoding: encoding})
+
+			values := map[string]map[string]string{"counter": {"PollCount": "5"}, "gauge": {"Sys": "1.5"}}
+			require.NoError(t, storage.Restore(context.Background(), values))
+
+			content, err := os.ReadFile(filePath)
+			require.NoError(t, err)
+			assert.Contains(t, string(content), `"encoding":"`+string(encoding)+`"`)
+
+			// the encoding is detected on read
+			for _, other := range []Encoding{EncodingJSON, EncodingGzip, EncodingGob} {
+				actual, err := NewFileStorage(&config{filePath: filePath, encoding: other}).GetMetricValues(context.Background())
+				require.NoError(t, err)
+				assert.Equal(t, values, actual)
+			}
+		})
+	}
+}
+
+func TestFileStorage_ConvertEncoding(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup.json")
+	writeRecords(t, filePath, storageRecords{{Type: "gauge", Name: "Sys", Value: "1.5"}})
+
+	storage := NewFileStorage(&config{filePath: filePath, encoding: EncodingGob})
+	actual, err := storage.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "1.5"}}, actual)
+
+	// the legacy JSON snapshot is converted on the first write
+	_, err = storage.AddMetricValues(context.Background(), []metrics.Metric{test.CreateGaugeMetric("Heap", 2.5)})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	header, _, _ := strings.Cut(string(content), "\n")
+	assert.Contains(t, header, `"encoding":"gob"`)
+	assert.Equal(t, storageRecords{{Type: "gauge", Name: "Sys", Value: "1.5"}}, readSnapshot(t, filePath))
+	assert.Equal(t, storageRecords{
+		{Type: "gauge", Name: "Sys", Value: "1.5"},
+		{Type: "gauge", Name: "Heap", Value: "2.5"},
+	}, readRecords(t, filePath))
+}
+
+func TestDecodeSnapshot_Version1(t *testing.T) {
+	body := `[{"types":"gauge","name":"Sys","value":"1.5"}]` + "\n"
+	header := `{"format":"metrics-snapshot","version":1,"size":` + strconv.Itoa(len(body)) + `,"checksum":"` + checksum([]byte(body)) + `"}`
+
+	records, actualHeader, err := decodeSnapshot([]byte(header+"\n"+body), nil)
+	require.NoError(t, err)
+	assert.Equal(t, EncodingJSON, actualHeader.Encoding)
+	assert.Equal(t, storageRecords{{Type: "gauge", Name: "Sys", Value: "1.5"}}, records)
+
+	_, _, err = decodeSnapshot([]byte(`{"format":"metrics-snapshot","version":4,"size":0,"checksum":""}`+"\n"), nil)
+	assert.ErrorIs(t, err, ErrUnsupportedSnapshot)
+}
+
+func TestEncoding_Validate(t *testing.T) {
+	for _, encoding := range []Encoding{EncodingJSON, EncodingGzip, EncodingGob} {
+		assert.NoError(t, encoding.Validate())
+	}
+
+	assert.ErrorIs(t, Encoding("xml").Validate(), ErrUnknownEncoding)
+}
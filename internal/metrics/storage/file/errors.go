@@ -0,0 +1,15 @@
+package file
+
+import "errors"
+
+var (
+	ErrCorruptedLog        = errors.New("write-ahead log is corrupted")
+	ErrCorruptedSnapshot   = errors.New("snapshot is corrupted")
+	ErrInvalidKey          = errors.New("invalid encryption key")
+	ErrMissedKey           = errors.New("snapshot encryption key is missed")
+	ErrReadOnly            = errors.New("storage is read-only")
+	ErrUnknownEncoding     = errors.New("unknown snapshot encoding")
+	ErrUnknownFsyncPolicy  = errors.New("unknown fsync policy")
+	ErrUnsupportedSnapshot = errors.New("unsupported snapshot version")
+	ErrWrongKey            = errors.New("wrong snapshot encryption key")
+)
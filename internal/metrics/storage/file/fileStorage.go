@@ -2,14 +2,15 @@ package file
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/MlDenis/prometheus_wannabe/internal/converter"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
 	"github.com/MlDenis/prometheus_wannabe/internal/logger"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
@@ -21,30 +22,51 @@ import (
 const fileMode os.FileMode = 0o644
 
 type storageRecord struct {
-	Type  string `json:"types"`
-	Name  string `json:"name"`
-	Value string `json:"value"`
+	Tenant string `json:"tenant,omitempty"` // empty for the default tenant
+	Type   string `json:"types"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
 }
 
 type storageRecords []*storageRecord
 
 type fileStorageConfig interface {
 	StoreFilePath() string
+	StoreEncoding() Encoding
+	StoreKeyring() *Keyring
+	StoreFsyncPolicy() FsyncPolicy
+	StoreFsyncInterval() time.Duration
+	StoreSnapshotThreshold() int
+	StoreKeepHourly() int
+	StoreKeepDaily() int
 }
 
+// fileStorage keeps a snapshot of the records and appends the later mutations to the write-ahead log.
+// The state is the snapshot with the log replayed over it, the log is written to a new snapshot
+// on Restore and when it grows over the snapshot threshold (0 - only on Restore).
+// Every snapshot is kept as a generation until the retention removes it.
 type fileStorage struct {
-	filePath string
-	lock     sync.Mutex
+	filePath          string
+	encoding          Encoding
+	keyring           *Keyring
+	wal               *writeAheadLog
+	generations       *generations
+	snapshotThreshold int
+	now               func() time.Time
+	// the snapshot is corrupted and the state is read from the previous one
+	corrupted bool
+	// the header of the last read or written snapshot
+	lastHeader snapshotHeader
+	converted  bool
+	readOnly   bool
+	lock       sync.Mutex
 }
 
 func NewFileStorage(config fileStorageConfig) storage.MetricsStorage {
-	result := &fileStorage{
-		filePath: config.StoreFilePath(),
-	}
-
+	result := newFileStorage(config)
 	if _, err := os.Stat(result.filePath); err != nil && result.filePath != "" && errors.Is(err, os.ErrNotExist) {
 		logrus.Infof("Init storage file in %v", result.filePath)
-		err = result.writeRecordsToFile(storageRecords{})
+		err = writeSnapshotFile(result.filePath, storageRecords{}, result.encoding, result.keyring, result.wal.policy != FsyncNever, false)
 		if err != nil {
 			logrus.Errorf("failed to init storage file: %v", err)
 		}
@@ -53,13 +75,82 @@ func NewFileStorage(config fileStorageConfig) storage.MetricsStorage {
 	return result
 }
 
+// NewReadOnlyFileStorage opens the backup of another server, e.g. the primary one, without writing to it:
+// the missed file is not created and the writes fail with ErrReadOnly.
+func NewReadOnlyFileStorage(config fileStorageConfig) storage.MetricsStorage {
+	result := newFileStorage(config)
+	result.readOnly = true
+	return result
+}
+
+func newFileStorage(config fileStorageConfig) *fileStorage {
+	encoding := config.StoreEncoding()
+	if encoding == "" {
+		encoding = EncodingJSON
+	}
+
+	return &fileStorage{
+		filePath:          config.StoreFilePath(),
+		encoding:          encoding,
+		keyring:           config.StoreKeyring(),
+		wal:               newWriteAheadLog(WALPath(config.StoreFilePath()), config.StoreFsyncPolicy(), config.StoreFsyncInterval(), config.StoreKeyring()),
+		generations:       newGenerations(config.StoreFilePath(), config.StoreKeepHourly(), config.StoreKeepDaily()),
+		snapshotThreshold: config.StoreSnapshotThreshold(),
+		now:               time.Now,
+	}
+}
+
 func (f *fileStorage) AddMetricValues(ctx context.Context, metricsList []metrics.Metric) ([]metrics.Metric, error) {
-	return metricsList, f.updateMetrics(metricsList)
+	if f.filePath == "" {
+		return metricsList, nil
+	}
+	if f.readOnly {
+		return nil, logger.WrapError("add metrics", ErrReadOnly)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	tenant := toRecordTenant(identity.Tenant(ctx))
+	records := make(storageRecords, len(metricsList))
+	for i, metric := range metricsList {
+		records[i] = &storageRecord{
+			Tenant: tenant,
+			Type:   metric.GetType(),
+			Name:   metric.GetName(),
+			Value:  metric.GetStringValue(),
+		}
+	}
+
+	err := f.convertSnapshot()
+	if err != nil {
+		return nil, logger.WrapError("convert snapshot", err)
+	}
+
+	err = f.wal.append(&walEntry{Op: walOpSet, Records: records})
+	if err != nil {
+		return nil, logger.WrapError("append metrics to log", err)
+	}
+
+	if f.snapshotThreshold > 0 && f.wal.len() >= f.snapshotThreshold {
+		state, err := f.loadRecords()
+		if err != nil {
+			return nil, logger.WrapError("load records", err)
+		}
+
+		err = f.createSnapshot(state)
+		if err != nil {
+			return nil, logger.WrapError("create snapshot", err)
+		}
+	}
+
+	return metricsList, nil
 }
 
 func (f *fileStorage) GetMetric(ctx context.Context, metricType string, metricName string) (metrics.Metric, error) {
+	tenant := toRecordTenant(identity.Tenant(ctx))
 	records, err := f.readRecordsFromFile(func(record *storageRecord) bool {
-		return record.Type == metricType && record.Name == metricName
+		return record.Tenant == tenant && record.Type == metricType && record.Name == metricName
 	})
 	if err != nil {
 		return nil, logger.WrapError("read records from file", err)
@@ -71,8 +162,9 @@ func (f *fileStorage) GetMetric(ctx context.Context, metricType string, metricNa
 	return f.toMetric(*records[0])
 }
 
-func (f *fileStorage) GetMetricValues(context.Context) (map[string]map[string]string, error) {
-	records, err := f.readRecordsFromFile(func(record *storageRecord) bool { return true })
+func (f *fileStorage) GetMetricValues(ctx context.Context) (map[string]map[string]string, error) {
+	tenant := toRecordTenant(identity.Tenant(ctx))
+	records, err := f.readRecordsFromFile(func(record *storageRecord) bool { return record.Tenant == tenant })
 	if err != nil {
 		return nil, logger.WrapError("read records from file", err)
 	}
@@ -91,111 +183,265 @@ func (f *fileStorage) GetMetricValues(context.Context) (map[string]map[string]st
 	return result, nil
 }
 
+func (f *fileStorage) GetTenants(context.Context) ([]string, error) {
+	records, err := f.readRecordsFromFile(func(record *storageRecord) bool { return true })
+	if err != nil {
+		return nil, logger.WrapError("read records from file", err)
+	}
+
+	tenants := map[string]bool{}
+	for _, record := range records {
+		tenants[fromRecordTenant(record.Tenant)] = true
+	}
+
+	result := make([]string, 0, len(tenants))
+	for tenant := range tenants {
+		result = append(result, tenant)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// Restore replaces the tenant records and writes the whole state to a new snapshot.
 func (f *fileStorage) Restore(ctx context.Context, metricValues map[string]map[string]string) error {
+	if f.filePath == "" {
+		return nil
+	}
+	if f.readOnly {
+		return logger.WrapError("restore metrics", ErrReadOnly)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	tenant := toRecordTenant(identity.Tenant(ctx))
 	var records storageRecords
 	for metricType, metricsByType := range metricValues {
 		for metricName, metricValue := range metricsByType {
 			records = append(records, &storageRecord{
-				Type:  metricType,
-				Name:  metricName,
-				Value: metricValue,
+				Tenant: tenant,
+				Type:   metricType,
+				Name:   metricName,
+				Value:  metricValue,
 			})
 		}
 	}
 
-	return f.writeRecordsToFile(records)
+	state, err := f.loadRecords()
+	if err != nil {
+		return logger.WrapError("load records", err)
+	}
+
+	// Replace the tenant records, keep the others
+	state.replaceTenant(tenant, records)
+	return f.createSnapshot(state)
 }
 
-func (f *fileStorage) updateMetrics(metricsList []metrics.Metric) error {
-	// Read and write
-	return f.workWithFile(os.O_CREATE|os.O_RDWR, func(fileStream *os.File) error {
-		f.lock.Lock()
-		defer f.lock.Unlock()
+// RestoreState replaces the records of all tenants with a single snapshot, so a backup is one consistent generation.
+func (f *fileStorage) RestoreState(_ context.Context, state map[string]map[string]map[string]string) error {
+	if f.filePath == "" {
+		return nil
+	}
+	if f.readOnly {
+		return logger.WrapError("restore state", ErrReadOnly)
+	}
 
-		metricsMap := map[string]metrics.Metric{} // contains?
-		for _, metric := range metricsList {
-			metricsMap[metric.GetType()+metric.GetName()] = metric
-		}
+	f.lock.Lock()
+	defer f.lock.Unlock()
 
-		records, err := f.readRecords(fileStream, func(record *storageRecord) bool {
-			_, found := metricsMap[record.Type+record.Name]
-			return !found
-		})
-		if err != nil {
-			return logger.WrapError("read records", err)
+	tenants := make([]string, 0, len(state))
+	for tenant := range state {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	records := storageRecords{}
+	for _, tenant := range tenants {
+		recordTenant := toRecordTenant(tenant)
+		for metricType, metricsByType := range state[tenant] {
+			for metricName, metricValue := range metricsByType {
+				records = append(records, &storageRecord{
+					Tenant: recordTenant,
+					Type:   metricType,
+					Name:   metricName,
+					Value:  metricValue,
+				})
+			}
 		}
+	}
 
-		_, err = fileStream.Seek(0, io.SeekStart)
-		if err != nil {
-			return logger.WrapError("seek pointer", err)
-		}
-		err = fileStream.Truncate(0)
-		if err != nil {
-			return logger.WrapError("truncate file stream", err)
-		}
+	return f.createSnapshot(newRecordSet(records))
+}
 
-		for _, metric := range metricsList {
-			records = append(records, &storageRecord{
-				Type:  metric.GetType(),
-				Name:  metric.GetName(),
-				Value: metric.GetStringValue(),
-			})
-		}
+func (f *fileStorage) DeleteMetric(ctx context.Context, metricType string, metricName string) error {
+	if f.filePath == "" {
+		return nil
+	}
+	if f.readOnly {
+		return logger.WrapError("delete metric", ErrReadOnly)
+	}
 
-		return f.writeRecords(fileStream, records)
-	})
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	err := f.convertSnapshot()
+	if err != nil {
+		return logger.WrapError("convert snapshot", err)
+	}
+
+	record := &storageRecord{Tenant: toRecordTenant(identity.Tenant(ctx)), Type: metricType, Name: metricName}
+	state, err := f.loadRecords()
+	if err != nil {
+		return logger.WrapError("load records", err)
+	}
+
+	if !state.contains(record) {
+		return logger.WrapError(fmt.Sprintf("delete metric with name '%s' and type '%s'", metricName, metricType), metrics.ErrMetricNotFound)
+	}
+
+	err = f.wal.append(&walEntry{Op: walOpDelete, Records: storageRecords{record}})
+	if err != nil {
+		return logger.WrapError("append deletion to log", err)
+	}
+
+	return nil
 }
 
-func (f *fileStorage) readRecordsFromFile(isValid func(*storageRecord) bool) (storageRecords, error) {
-	// ReadOnly
-	return f.workWithFileResult(os.O_CREATE|os.O_RDONLY, func(fileStream *os.File) (storageRecords, error) {
-		return f.readRecords(fileStream, isValid)
-	})
+func (f *fileStorage) ListSnapshots(context.Context) ([]storage.Snapshot, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.generations.list()
 }
 
-func (f *fileStorage) readRecords(fileStream *os.File, isValid func(*storageRecord) bool) (storageRecords, error) {
-	var records storageRecords
-	err := json.NewDecoder(fileStream).Decode(&records)
+// RestoreSnapshot writes the generation as a new snapshot, the later mutations are dropped.
+func (f *fileStorage) RestoreSnapshot(_ context.Context, id string) error {
+	if f.readOnly {
+		return logger.WrapError("restore snapshot", ErrReadOnly)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path, ok := f.generations.find(id)
+	if !ok {
+		return logger.WrapError(fmt.Sprintf("find snapshot '%s'", id), metrics.ErrSnapshotNotFound)
+	}
+
+	records, _, err := readSnapshotFile(path, f.keyring)
 	if err != nil {
-		return nil, logger.WrapError("decode storage", err)
+		return logger.WrapError(fmt.Sprintf("read snapshot '%s'", id), err)
 	}
 
-	result := storageRecords{}
-	for _, record := range records {
-		if isValid(record) {
-			result = append(result, record)
+	return f.createSnapshot(newRecordSet(records))
+}
+
+// Close flushes the write-ahead log.
+func (f *fileStorage) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.wal.close()
+}
+
+// loadRecords replays the log over the snapshot.
+func (f *fileStorage) loadRecords() (*recordSet, error) {
+	snapshot, err := f.readSnapshot()
+	if err != nil {
+		return nil, logger.WrapError("read snapshot", err)
+	}
+
+	state := newRecordSet(snapshot)
+	_, _, err = readLog(f.wal.path, f.keyring, func(entry *walEntry) {
+		for _, record := range entry.Records {
+			if entry.Op == walOpDelete {
+				state.delete(record)
+			} else {
+				state.set(record)
+			}
 		}
+	})
+	if err != nil {
+		return nil, logger.WrapError("replay log", err)
 	}
 
-	return result, nil
+	return state, nil
 }
 
-func (f *fileStorage) writeRecordsToFile(records storageRecords) error {
-	// WriteOnly
-	return f.workWithFile(os.O_CREATE|os.O_WRONLY, func(fileStream *os.File) error {
-		return f.writeRecords(fileStream, records)
-	})
+// createSnapshot writes the state and empties the log, the log replay over the new snapshot
+// after a crash between both steps changes nothing.
+func (f *fileStorage) createSnapshot(state *recordSet) error {
+	err := writeSnapshotFile(f.filePath, state.records, f.encoding, f.keyring, f.wal.policy != FsyncNever, f.corrupted)
+	if err != nil {
+		return logger.WrapError("write snapshot", err)
+	}
+	f.corrupted = false
+	f.lastHeader = snapshotHeader{Encoding: f.encoding, KeyID: f.keyring.ActiveKeyID()}
+
+	err = f.wal.reset()
+	if err != nil {
+		return err
+	}
+
+	err = f.generations.add(f.filePath, f.now())
+	if err != nil {
+		// the snapshot is written, only its copy is missed
+		logrus.Errorf("failed to keep snapshot generation: %v", err)
+	}
+
+	return nil
 }
 
-func (f *fileStorage) writeRecords(fileStream *os.File, records storageRecords) error {
-	encoder := json.NewEncoder(fileStream)
-	encoder.SetIndent("", " ")
-	err := encoder.Encode(records)
+// convertSnapshot rewrites a snapshot of another encoding or key, e.g. the legacy JSON one, before the first write.
+func (f *fileStorage) convertSnapshot() error {
+	if f.converted {
+		return nil
+	}
+
+	state, err := f.loadRecords()
 	if err != nil {
-		return logger.WrapError("write records", err)
+		return logger.WrapError("load records", err)
+	}
+
+	if f.lastHeader.Encoding != f.encoding || f.lastHeader.KeyID != f.keyring.ActiveKeyID() {
+		logrus.Infof("Convert snapshot %v to %v encoding with key '%v'", f.filePath, f.encoding, f.keyring.ActiveKeyID())
+		err = f.createSnapshot(state)
+		if err != nil {
+			return logger.WrapError("write snapshot", err)
+		}
 	}
 
+	f.converted = true
 	return nil
 }
 
-func (f *fileStorage) workWithFile(flag int, work func(file *os.File) error) error {
-	_, err := f.workWithFileResult(flag, func(fileStream *os.File) (storageRecords, error) {
-		return nil, work(fileStream)
-	})
-	return err
+// readSnapshot falls back to the previous snapshot when the current one is corrupted, a missed snapshot is empty.
+func (f *fileStorage) readSnapshot() (storageRecords, error) {
+	records, header, err := readSnapshotFile(f.filePath, f.keyring)
+	if errors.Is(err, os.ErrNotExist) {
+		f.lastHeader = snapshotHeader{Encoding: f.encoding, KeyID: f.keyring.ActiveKeyID()}
+		return storageRecords{}, nil
+	}
+
+	f.corrupted = errors.Is(err, ErrCorruptedSnapshot)
+	if !f.corrupted {
+		f.lastHeader = header
+		return records, err
+	}
+
+	logrus.Errorf("Snapshot %v is corrupted, fall back to the previous one: %v", f.filePath, err)
+	records, header, previousErr := readSnapshotFile(PreviousSnapshotPath(f.filePath), f.keyring)
+	if previousErr != nil {
+		logrus.Errorf("failed to read previous snapshot: %v", previousErr)
+		return nil, err
+	}
+
+	f.lastHeader = header
+	return records, nil
 }
 
-func (f *fileStorage) workWithFileResult(flag int, work func(file *os.File) (storageRecords, error)) (storageRecords, error) {
+func (f *fileStorage) readRecordsFromFile(isValid func(*storageRecord) bool) (storageRecords, error) {
 	if f.filePath == "" {
 		return nil, nil
 	}
@@ -203,18 +449,28 @@ func (f *fileStorage) workWithFileResult(flag int, work func(file *os.File) (sto
 	f.lock.Lock()
 	defer f.lock.Unlock()
 
-	fileStream, err := os.OpenFile(f.filePath, flag, fileMode)
+	state, err := f.loadRecords()
 	if err != nil {
-		return nil, logger.WrapError("open file", err)
+		return nil, err
+	}
+
+	return state.filter(isValid), nil
+}
+
+func toRecordTenant(tenant string) string {
+	if tenant == identity.DefaultTenant {
+		return ""
+	}
+
+	return tenant
+}
+
+func fromRecordTenant(tenant string) string {
+	if tenant == "" {
+		return identity.DefaultTenant
 	}
-	defer func(fileStream *os.File) {
-		err = fileStream.Close()
-		if err != nil {
-			logrus.Errorf("failed to close file: %v", err)
-		}
-	}(fileStream)
 
-	return work(fileStream)
+	return tenant
 }
 
 func (f *fileStorage) toMetric(record storageRecord) (metrics.Metric, error) {
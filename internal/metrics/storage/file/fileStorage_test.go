@@ -4,16 +4,27 @@ import (
 	"context"
 	"encoding/json"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/test"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type config struct {
-	filePath string
+	filePath          string
+	encoding          Encoding
+	keyring           *Keyring
+	fsyncPolicy       FsyncPolicy
+	snapshotThreshold int
+	keepHourly        int
+	keepDaily         int
 }
 
 func TestFileStorage_New(t *testing.T) {
@@ -38,6 +49,7 @@ func TestFileStorage_New(t *testing.T) {
 			if tt.filePath != "" {
 				defer func(name string) {
 					_ = os.Remove(name)
+					_ = os.Remove(WALPath(name))
 				}(tt.filePath)
 
 				actualRecords := readRecords(t, tt.filePath)
@@ -82,6 +94,7 @@ func TestFileStorage_AddGaugeMetricValue(t *testing.T) {
 			filePath := os.TempDir() + "TestFileStorage_AddGaugeMetricValue"
 			defer func(name string) {
 				_ = os.Remove(name)
+				_ = os.Remove(WALPath(name))
 			}(filePath)
 
 			storage := NewFileStorage(&config{filePath: filePath})
@@ -135,6 +148,7 @@ func TestFileStorage_AddCounterMetricValue(t *testing.T) {
 			filePath := os.TempDir() + "TestFileStorage_AddCounterMetricValue"
 			defer func(name string) {
 				assert.NoError(t, os.Remove(name))
+				_ = os.Remove(WALPath(name))
 			}(filePath)
 
 			storage := NewFileStorage(&config{filePath: filePath})
@@ -189,6 +203,7 @@ func TestFileStorage_GetMetric(t *testing.T) {
 			filePath := os.TempDir() + "TestFileStorage_GetMetricValue"
 			defer func(name string) {
 				_ = os.Remove(name)
+				_ = os.Remove(WALPath(name))
 			}(filePath)
 			writeRecords(t, filePath, tt.stored)
 
@@ -204,21 +219,265 @@ func TestFileStorage_GetMetric(t *testing.T) {
 	}
 }
 
+func TestFileStorage_Tenants(t *testing.T) {
+	filePath := os.TempDir() + "TestFileStorage_Tenants"
+	defer func(name string) {
+		_ = os.Remove(name)
+		_ = os.Remove(WALPath(name))
+	}(filePath)
+	writeRecords(t, filePath, storageRecords{
+		{Type: "counter", Name: "Alloc", Value: "100"},
+		{Tenant: "teamA", Type: "counter", Name: "Alloc", Value: "200"},
+	})
+
+	storage := NewFileStorage(&config{filePath: filePath})
+	teamA := identity.WithTenant(context.Background(), "teamA")
+
+	tenants, err := storage.GetTenants(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{identity.DefaultTenant, "teamA"}, tenants)
+
+	_, err = storage.AddMetricValues(teamA, []metrics.Metric{test.CreateGaugeMetric("Sys", 1.5)})
+	assert.NoError(t, err)
+
+	err = storage.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "2.5"}})
+	assert.NoError(t, err)
+
+	assert.ElementsMatch(t, storageRecords{
+		{Tenant: "teamA", Type: "counter", Name: "Alloc", Value: "200"},
+		{Tenant: "teamA", Type: "gauge", Name: "Sys", Value: "1.5"},
+		{Type: "gauge", Name: "Sys", Value: "2.5"},
+	}, readRecords(t, filePath))
+
+	actual, err := storage.GetMetricValues(teamA)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"counter": {"Alloc": "200"}, "gauge": {"Sys": "1.5"}}, actual)
+}
+
+func TestFileStorage_DeleteMetric(t *testing.T) {
+	filePath := os.TempDir() + "TestFileStorage_DeleteMetric"
+	defer func(name string) {
+		_ = os.Remove(name)
+		_ = os.Remove(WALPath(name))
+	}(filePath)
+	writeRecords(t, filePath, storageRecords{
+		{Type: "counter", Name: "Alloc", Value: "100"},
+		{Type: "gauge", Name: "Sys", Value: "1.5"},
+		{Tenant: "teamA", Type: "counter", Name: "Alloc", Value: "200"},
+	})
+
+	storage := NewFileStorage(&config{filePath: filePath}).(*fileStorage)
+
+	err := storage.DeleteMetric(context.Background(), "counter", "Alloc")
+	assert.NoError(t, err)
+
+	err = storage.DeleteMetric(context.Background(), "counter", "Alloc")
+	assert.ErrorIs(t, err, metrics.ErrMetricNotFound)
+
+	assert.ElementsMatch(t, storageRecords{
+		{Type: "gauge", Name: "Sys", Value: "1.5"},
+		{Tenant: "teamA", Type: "counter", Name: "Alloc", Value: "200"},
+	}, readRecords(t, filePath))
+}
+
+func TestFileStorage_WriteAheadLog(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup.json")
+	conf := &config{filePath: filePath, fsyncPolicy: FsyncAlways}
+	storage := NewFileStorage(conf).(*fileStorage)
+
+	_, err := storage.AddMetricValues(context.Background(), []metrics.Metric{
+		test.CreateCounterMetric("Alloc", 100),
+		test.CreateGaugeMetric("Sys", 1.5),
+	})
+	require.NoError(t, err)
+	_, err = storage.AddMetricValues(context.Background(), []metrics.Metric{test.CreateCounterMetric("Alloc", 200)})
+	require.NoError(t, err)
+	require.NoError(t, storage.DeleteMetric(context.Background(), "gauge", "Sys"))
+
+	// the mutations go to the log, the snapshot is not rewritten
+	assert.Empty(t, readSnapshot(t, filePath))
+	content, err := os.ReadFile(WALPath(filePath))
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(content), "\n"))
+
+	// recovery replays the log over the snapshot
+	require.NoError(t, storage.Close())
+	recovered := NewFileStorage(conf)
+	actual, err := recovered.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"counter": {"Alloc": "200"}}, actual)
+
+	// restore writes a snapshot and empties the log
+	err = recovered.Restore(context.Background(), map[string]map[string]string{"counter": {"Alloc": "300"}})
+	require.NoError(t, err)
+	assert.Equal(t, storageRecords{{Type: "counter", Name: "Alloc", Value: "300"}}, readSnapshot(t, filePath))
+	content, err = os.ReadFile(WALPath(filePath))
+	require.NoError(t, err)
+	assert.Empty(t, content)
+}
+
+func TestFileStorage_SnapshotThreshold(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup.json")
+	storage := NewFileStorage(&config{filePath: filePath, fsyncPolicy: FsyncNever, snapshotThreshold: 2})
+
+	_, err := storage.AddMetricValues(context.Background(), []metrics.Metric{test.CreateGaugeMetric("Sys", 1.5)})
+	require.NoError(t, err)
+	assert.Empty(t, readSnapshot(t, filePath))
+
+	_, err = storage.AddMetricValues(context.Background(), []metrics.Metric{test.CreateGaugeMetric("Heap", 2.5)})
+	require.NoError(t, err)
+	assert.Equal(t, storageRecords{
+		{Type: "gauge", Name: "Sys", Value: "1.5"},
+		{Type: "gauge", Name: "Heap", Value: "2.5"},
+	}, readSnapshot(t, filePath))
+
+	info, err := os.Stat(WALPath(filePath))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestFileStorage_TornLog(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup.json")
+	writeRecords(t, filePath, storageRecords{{Type: "gauge", Name: "Sys", Value: "1.5"}})
+	err := os.WriteFile(WALPath(filePath), []byte(`{"op":"set","records":[{"types":"gauge","name":"Sys","value":"2.5"}]}`+"\n"+`{"op":"set","rec`), 0o644)
+	require.NoError(t, err)
+
+	storage := NewFileStorage(&config{filePath: filePath})
+	actual, err := storage.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "2.5"}}, actual)
+
+	// the torn tail is cut before the next append
+	_, err = storage.AddMetricValues(context.Background(), []metrics.Metric{test.CreateGaugeMetric("Heap", 3.5)})
+	require.NoError(t, err)
+	assert.Equal(t, storageRecords{
+		{Type: "gauge", Name: "Sys", Value: "2.5"},
+		{Type: "gauge", Name: "Heap", Value: "3.5"},
+	}, readRecords(t, filePath))
+
+	err = os.WriteFile(WALPath(filePath), []byte("garbage\n"), 0o644)
+	require.NoError(t, err)
+	_, err = NewFileStorage(&config{filePath: filePath}).GetMetricValues(context.Background())
+	assert.ErrorIs(t, err, ErrCorruptedLog)
+}
+
+func TestFileStorage_AtomicSnapshot(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup.json")
+	storage := NewFileStorage(&config{filePath: filePath})
+
+	require.NoError(t, storage.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "1.5"}}))
+	require.NoError(t, storage.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "2.5"}}))
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	header, _, _ := strings.Cut(string(content), "\n")
+	assert.Contains(t, header, `"format":"metrics-snapshot","version":3,"encoding":"json"`)
+	assert.Contains(t, header, `"checksum":"sha256:`)
+
+	_, err = os.Stat(filePath + tempSuffix)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.Equal(t, storageRecords{{Type: "gauge", Name: "Sys", Value: "2.5"}}, readSnapshot(t, filePath))
+	assert.Equal(t, storageRecords{{Type: "gauge", Name: "Sys", Value: "1.5"}}, readSnapshot(t, PreviousSnapshotPath(filePath)))
+}
+
+func TestFileStorage_CorruptedSnapshot(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup.json")
+	conf := &config{filePath: filePath}
+	storage := NewFileStorage(conf)
+
+	require.NoError(t, storage.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "1.5"}}))
+	require.NoError(t, storage.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "2.5"}}))
+	corrupt(t, filePath)
+
+	// the previous good snapshot is restored
+	recovered := NewFileStorage(conf)
+	actual, err := recovered.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "1.5"}}, actual)
+
+	// the next snapshot replaces the corrupted one and keeps the good previous one
+	require.NoError(t, recovered.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "3.5"}}))
+	assert.Equal(t, storageRecords{{Type: "gauge", Name: "Sys", Value: "3.5"}}, readSnapshot(t, filePath))
+	assert.Equal(t, storageRecords{{Type: "gauge", Name: "Sys", Value: "1.5"}}, readSnapshot(t, PreviousSnapshotPath(filePath)))
+
+	corrupt(t, filePath)
+	corrupt(t, PreviousSnapshotPath(filePath))
+	_, err = NewFileStorage(conf).GetMetricValues(context.Background())
+	assert.ErrorIs(t, err, ErrCorruptedSnapshot)
+}
+
+func TestWriteAheadLog_IntervalSync(t *testing.T) {
+	entry := &walEntry{Op: walOpSet, Records: storageRecords{{Type: "gauge", Name: "Sys", Value: "1.5"}}}
+	dirty := func(log *writeAheadLog) func() bool {
+		return func() bool {
+			log.lock.Lock()
+			defer log.lock.Unlock()
+			return log.dirty
+		}
+	}
+
+	// the last entry is synced without a later append
+	log := newWriteAheadLog(filepath.Join(t.TempDir(), "backup.wal"), FsyncInterval, 10*time.Millisecond, nil)
+	require.NoError(t, log.append(entry))
+	assert.Eventually(t, func() bool { return !dirty(log)() }, time.Second, 5*time.Millisecond)
+	require.NoError(t, log.close())
+	assert.Nil(t, log.stop)
+
+	// the entries wait for the tick and are synced on close
+	log = newWriteAheadLog(filepath.Join(t.TempDir(), "backup.wal"), FsyncInterval, time.Hour, nil)
+	require.NoError(t, log.append(entry))
+	assert.True(t, dirty(log)())
+	require.NoError(t, log.close())
+	assert.False(t, dirty(log)())
+
+	log = newWriteAheadLog(filepath.Join(t.TempDir(), "backup.wal"), FsyncAlways, time.Hour, nil)
+	require.NoError(t, log.append(entry))
+	assert.False(t, dirty(log)())
+	assert.Nil(t, log.stop)
+	require.NoError(t, log.close())
+}
+
+func TestFsyncPolicy_Validate(t *testing.T) {
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncInterval, FsyncNever} {
+		assert.NoError(t, policy.Validate())
+	}
+
+	assert.ErrorIs(t, FsyncPolicy("sometimes").Validate(), ErrUnknownFsyncPolicy)
+}
+
 func readRecords(t *testing.T, filePath string) storageRecords {
 	t.Helper()
 	_, err := os.Stat(filePath)
 	assert.NoError(t, err)
 
-	content, err := os.ReadFile(filePath)
+	storage := &fileStorage{filePath: filePath, wal: newWriteAheadLog(WALPath(filePath), FsyncNever, 0, nil)}
+	state, err := storage.loadRecords()
 	assert.NoError(t, err)
 
-	records := storageRecords{}
-	err = json.Unmarshal(content, &records)
-	assert.NoError(t, err)
+	return state.records
+}
+
+func readSnapshot(t *testing.T, filePath string) storageRecords {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+
+	records, _, err := decodeSnapshot(content, nil)
+	require.NoError(t, err)
 
 	return records
 }
 
+func corrupt(t *testing.T, filePath string) {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+
+	content[len(content)-3] ^= 0xff
+	require.NoError(t, os.WriteFile(filePath, content, 0o644))
+}
+
 func writeRecords(t *testing.T, filePath string, records storageRecords) {
 	t.Helper()
 	fileStream, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0o644)
@@ -234,3 +493,31 @@ func writeRecords(t *testing.T, filePath string, records storageRecords) {
 func (c *config) StoreFilePath() string {
 	return c.filePath
 }
+
+func (c *config) StoreEncoding() Encoding {
+	return c.encoding
+}
+
+func (c *config) StoreKeyring() *Keyring {
+	return c.keyring
+}
+
+func (c *config) StoreFsyncPolicy() FsyncPolicy {
+	return c.fsyncPolicy
+}
+
+func (c *config) StoreFsyncInterval() time.Duration {
+	return time.Second
+}
+
+func (c *config) StoreSnapshotThreshold() int {
+	return c.snapshotThreshold
+}
+
+func (c *config) StoreKeepHourly() int {
+	return c.keepHourly
+}
+
+func (c *config) StoreKeepDaily() int {
+	return c.keepDaily
+}
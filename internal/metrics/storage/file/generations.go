@@ -0,0 +1,170 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	generationsSuffix   = ".snapshots"
+	generationExtension = ".snapshot"
+	// the fixed width keeps the ids sorted by time
+	generationIDLayout = "20060102T150405.000000000Z"
+)
+
+// generations keeps every snapshot as a timestamped file linked to it and prunes them by the retention:
+// the newest one of each hour for keepHourly hours and of each day for keepDaily days, the latest one is always kept.
+type generations struct {
+	dir        string
+	keepHourly int
+	keepDaily  int
+}
+
+// GenerationsDir returns the directory of the snapshot generations of the backup file.
+func GenerationsDir(filePath string) string {
+	return filePath + generationsSuffix
+}
+
+func newGenerations(filePath string, keepHourly int, keepDaily int) *generations {
+	return &generations{
+		dir:        GenerationsDir(filePath),
+		keepHourly: keepHourly,
+		keepDaily:  keepDaily,
+	}
+}
+
+func (g *generations) enabled() bool {
+	return g.keepHourly > 0 || g.keepDaily > 0
+}
+
+// add links the snapshot as a new generation and removes the generations out of the retention.
+func (g *generations) add(snapshotPath string, created time.Time) error {
+	if !g.enabled() {
+		return nil
+	}
+
+	err := os.MkdirAll(g.dir, 0o755)
+	if err != nil {
+		return logger.WrapError("create generations directory", err)
+	}
+
+	// snapshots are never written in place, so the link keeps the content
+	err = os.Link(snapshotPath, g.path(created.UTC().Format(generationIDLayout)))
+	if err != nil {
+		return logger.WrapError("link snapshot generation", err)
+	}
+
+	return g.prune(created)
+}
+
+func (g *generations) list() ([]storage.Snapshot, error) {
+	entries, err := os.ReadDir(g.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []storage.Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, logger.WrapError("read generations directory", err)
+	}
+
+	result := []storage.Snapshot{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), generationExtension)
+		if !ok {
+			continue
+		}
+
+		created, err := time.Parse(generationIDLayout, id)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, logger.WrapError("stat snapshot generation", err)
+		}
+
+		result = append(result, storage.Snapshot{ID: id, Created: created, Size: info.Size()})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].ID > result[j].ID })
+	return result, nil
+}
+
+func (g *generations) find(id string) (string, bool) {
+	if _, err := time.Parse(generationIDLayout, id); err != nil {
+		return "", false
+	}
+
+	path := g.path(id)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+
+	return path, true
+}
+
+func (g *generations) prune(now time.Time) error {
+	snapshots, err := g.list()
+	if err != nil {
+		return err
+	}
+
+	kept := retain(snapshots, now, g.keepHourly, g.keepDaily)
+	for _, snapshot := range snapshots {
+		if kept[snapshot.ID] {
+			continue
+		}
+
+		err = os.Remove(g.path(snapshot.ID))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("failed to remove snapshot generation %v: %v", snapshot.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (g *generations) path(id string) string {
+	return filepath.Join(g.dir, id+generationExtension)
+}
+
+// retain returns the ids of the snapshots to keep, the snapshots are sorted the newest first.
+func retain(snapshots []storage.Snapshot, now time.Time, keepHourly int, keepDaily int) map[string]bool {
+	kept := map[string]bool{}
+	if len(snapshots) > 0 {
+		kept[snapshots[0].ID] = true
+	}
+
+	keepNewest := func(bucket func(time.Time) time.Time, period time.Duration, count int) {
+		since := now.Add(-time.Duration(count) * period)
+		buckets := map[time.Time]bool{}
+		for _, snapshot := range snapshots {
+			if !snapshot.Created.After(since) {
+				break
+			}
+
+			key := bucket(snapshot.Created)
+			if !buckets[key] {
+				buckets[key] = true
+				kept[snapshot.ID] = true
+			}
+		}
+	}
+
+	keepNewest(func(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) }, time.Hour, keepHourly)
+	keepNewest(func(t time.Time) time.Time {
+		year, month, day := t.UTC().Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}, 24*time.Hour, keepDaily)
+
+	return kept
+}
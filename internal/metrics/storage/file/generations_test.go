@@ -0,0 +1,143 @@
+package file
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetain(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC)
+	snapshot := func(ago time.Duration) storage.Snapshot {
+		created := now.Add(-ago)
+		return storage.Snapshot{ID: created.Format(generationIDLayout), Created: created}
+	}
+
+	snapshots := []storage.Snapshot{
+		snapshot(time.Minute),         // latest, hour 12
+		snapshot(20 * time.Minute),    // hour 12
+		snapshot(50 * time.Minute),    // hour 11
+		snapshot(55 * time.Minute),    // hour 11
+		snapshot(3 * time.Hour),       // hour 9, out of hourly
+		snapshot(26 * time.Hour),      // day 9
+		snapshot(30 * time.Hour),      // day 9
+		snapshot(3 * 24 * time.Hour),  // day 7, out of daily
+		snapshot(10 * 24 * time.Hour), // out of both
+	}
+
+	tests := []struct {
+		name       string
+		keepHourly int
+		keepDaily  int
+		expected   []int
+	}{
+		{
+			name:     "latest_only",
+			expected: []int{0},
+		},
+		{
+			name:       "hourly",
+			keepHourly: 2,
+			expected:   []int{0, 2},
+		},
+		{
+			name:      "daily",
+			keepDaily: 2,
+			expected:  []int{0, 5},
+		},
+		{
+			name:       "hourly_and_daily",
+			keepHourly: 24,
+			keepDaily:  7,
+			expected:   []int{0, 2, 4, 5, 7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := map[string]bool{}
+			for _, i := range tt.expected {
+				expected[snapshots[i].ID] = true
+			}
+
+			assert.Equal(t, expected, retain(snapshots, now, tt.keepHourly, tt.keepDaily))
+		})
+	}
+}
+
+func TestFileStorage_Snapshots(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "backup.json")
+	fileStorage := NewFileStorage(&config{filePath: filePath, keepHourly: 3}).(*fileStorage)
+
+	now := time.Date(2024, 5, 10, 10, 0, 0, 0, time.UTC)
+	fileStorage.now = func() time.Time { return now }
+
+	for i, value := range []string{"1", "2", "3", "4"} {
+		now = now.Add(time.Duration(i) * 40 * time.Minute)
+		require.NoError(t, fileStorage.Restore(ctx, map[string]map[string]string{"gauge": {"Sys": value}}))
+	}
+
+	// 10:00, 10:40, 12:00 and 14:00, the ones out of the last three hours are removed
+	snapshots, err := fileStorage.ListSnapshots(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, "20240510T140000.000000000Z", snapshots[0].ID)
+	assert.Equal(t, now, snapshots[0].Created)
+	assert.Equal(t, "20240510T120000.000000000Z", snapshots[1].ID)
+	assert.Positive(t, snapshots[1].Size)
+
+	_, err = fileStorage.AddMetricValues(ctx, []metrics.Metric{test.CreateGaugeMetric("Heap", 5)})
+	require.NoError(t, err)
+
+	now = now.Add(time.Minute)
+
+	require.NoError(t, fileStorage.RestoreSnapshot(ctx, snapshots[1].ID))
+	actual, err := fileStorage.GetMetricValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "3"}}, actual)
+
+	for _, id := range []string{"20240510T100000.000000000Z", "../backup.json", "latest"} {
+		err = fileStorage.RestoreSnapshot(ctx, id)
+		assert.ErrorIs(t, err, metrics.ErrSnapshotNotFound, id)
+	}
+}
+
+func TestFileStorage_RestoreState(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "backup.json")
+	fileStorage := NewFileStorage(&config{filePath: filePath, keepHourly: 3}).(*fileStorage)
+	fileStorage.now = func() time.Time { return time.Date(2024, 5, 10, 10, 0, 0, 0, time.UTC) }
+	require.NoError(t, fileStorage.Restore(identity.WithTenant(ctx, "teamC"), map[string]map[string]string{"gauge": {"Sys": "1"}}))
+
+	fileStorage.now = func() time.Time { return time.Date(2024, 5, 10, 11, 0, 0, 0, time.UTC) }
+	require.NoError(t, fileStorage.RestoreState(ctx, map[string]map[string]map[string]string{
+		identity.DefaultTenant: {"counter": {"PollCount": "5"}},
+		"teamA":                {"gauge": {"Sys": "1.5"}},
+		"teamB":                {"gauge": {"Sys": "2.5"}},
+	}))
+
+	// all tenants are written to a single generation, the missed tenant is removed
+	snapshots, err := fileStorage.ListSnapshots(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, "20240510T110000.000000000Z", snapshots[0].ID)
+	assert.Equal(t, "20240510T100000.000000000Z", snapshots[1].ID)
+
+	tenants, err := fileStorage.GetTenants(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{identity.DefaultTenant, "teamA", "teamB"}, tenants)
+
+	actual, err := fileStorage.GetMetricValues(identity.WithTenant(ctx, "teamB"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "2.5"}}, actual)
+}
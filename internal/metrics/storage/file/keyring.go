@@ -0,0 +1,128 @@
+package file
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+// Keyring keeps the AES-GCM backup keys by id, the active key encrypts new snapshots and log entries, every key decrypts.
+// A rotated key stays in the keyring until the snapshots and the log entries encrypted with it are rewritten.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// ParseKeyring reads comma or newline separated id=base64 AES-128, AES-192 or AES-256 keys, the first key is active.
+func ParseKeyring(spec string) (*Keyring, error) {
+	result := &Keyring{keys: map[string]cipher.AEAD{}}
+	entries := strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' })
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encodedKey, ok := strings.Cut(entry, "=")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, logger.WrapError("parse key entry, id=base64 is expected", ErrInvalidKey)
+		}
+		if _, ok := result.keys[id]; ok {
+			return nil, logger.WrapError(fmt.Sprintf("add key '%s' twice", id), ErrInvalidKey)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, logger.WrapError(fmt.Sprintf("decode key '%s': %v", id, err), ErrInvalidKey)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, logger.WrapError(fmt.Sprintf("create cipher of key '%s': %v", id, err), ErrInvalidKey)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, logger.WrapError(fmt.Sprintf("create gcm of key '%s': %v", id, err), ErrInvalidKey)
+		}
+
+		if result.active == "" {
+			result.active = id
+		}
+		result.keys[id] = aead
+	}
+
+	if result.active == "" {
+		return nil, logger.WrapError("parse keyring", ErrInvalidKey)
+	}
+
+	return result, nil
+}
+
+// LoadKeyring reads the keyring from the key file or, without the file, from the spec, nil is returned when neither is set.
+func LoadKeyring(keyFile string, spec string) (*Keyring, error) {
+	if keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, logger.WrapError("read key file", err)
+		}
+
+		spec = string(content)
+	}
+
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	return ParseKeyring(spec)
+}
+
+// ActiveKeyID returns the id of the key encrypting new snapshots, empty for a nil keyring.
+func (k *Keyring) ActiveKeyID() string {
+	if k == nil {
+		return ""
+	}
+
+	return k.active
+}
+
+// encrypt seals the data with the active key, the nonce is prepended.
+func (k *Keyring) encrypt(data []byte, additionalData []byte) ([]byte, error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, logger.WrapError("generate nonce", err)
+	}
+
+	return aead.Seal(nonce, nonce, data, additionalData), nil
+}
+
+func (k *Keyring) decrypt(keyID string, data []byte, additionalData []byte) ([]byte, error) {
+	if k == nil {
+		return nil, logger.WrapError(fmt.Sprintf("decrypt data encrypted with key '%s', no keys are set", keyID), ErrMissedKey)
+	}
+
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, logger.WrapError(fmt.Sprintf("decrypt data encrypted with key '%s'", keyID), ErrMissedKey)
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, logger.WrapError(fmt.Sprintf("decrypt data with key '%s'", keyID), ErrWrongKey)
+	}
+
+	result, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, logger.WrapError(fmt.Sprintf("decrypt data with key '%s'", keyID), ErrWrongKey)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,248 @@
+package file
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyring(t *testing.T) {
+	key := testKey(1)
+
+	tests := []struct {
+		name           string
+		spec           string
+		expectedActive string
+		expectedError  error
+	}{
+		{
+			name:           "single_key",
+			spec:           "k1=" + key,
+			expectedActive: "k1",
+		},
+		{
+			name:           "first_key_is_active",
+			spec:           "# rotated on monday\nk2=" + testKey(2) + "\nk1=" + key + "\n",
+			expectedActive: "k2",
+		},
+		{
+			name:           "comma_separated",
+			spec:           "k2=" + testKey(2) + ", k1=" + key,
+			expectedActive: "k2",
+		},
+		{
+			name:          "empty",
+			spec:          " \n# comment",
+			expectedError: ErrInvalidKey,
+		},
+		{
+			name:          "missed_id",
+			spec:          key,
+			expectedError: ErrInvalidKey,
+		},
+		{
+			name:          "duplicated_id",
+			spec:          "k1=" + key + ",k1=" + testKey(2),
+			expectedError: ErrInvalidKey,
+		},
+		{
+			name:          "invalid_base64",
+			spec:          "k1=not base64",
+			expectedError: ErrInvalidKey,
+		},
+		{
+			name:          "invalid_key_size",
+			spec:          "k1=" + base64.StdEncoding.EncodeToString([]byte("short")),
+			expectedError: ErrInvalidKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := ParseKeyring(tt.spec)
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedActive, keyring.ActiveKeyID())
+		})
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	keyring, err := LoadKeyring("", "")
+	require.NoError(t, err)
+	assert.Nil(t, keyring)
+	assert.Equal(t, "", keyring.ActiveKeyID())
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(keyFile, []byte("file="+testKey(1)+"\n"), 0o600))
+
+	// the key file wins over the keys
+	keyring, err = LoadKeyring(keyFile, "env="+testKey(2))
+	require.NoError(t, err)
+	assert.Equal(t, "file", keyring.ActiveKeyID())
+
+	_, err = LoadKeyring(filepath.Join(t.TempDir(), "missed"), "")
+	assert.Error(t, err)
+}
+
+func TestFileStorage_Encryption(t *testing.T) {
+	values := map[string]map[string]string{"counter": {"PollCount": "5"}, "gauge": {"Sys": "1.5"}}
+
+	for _, encoding := range []Encoding{EncodingJSON, EncodingGzip, EncodingGob} {
+		t.Run(string(encoding), func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "backup")
+			keyring := testKeyring(t, "k1="+testKey(1))
+			storage := NewFileStorage(&config{filePath: filePath, encoding: encoding, keyring: keyring})
+			require.NoError(t, storage.Restore(context.Background(), values))
+
+			content, err := os.ReadFile(filePath)
+			require.NoError(t, err)
+			header, body, _ := strings.Cut(string(content), "\n")
+			assert.Contains(t, header, `"keyId":"k1"`)
+			assert.NotContains(t, body, "PollCount")
+
+			actual, err := NewFileStorage(&config{filePath: filePath, keyring: keyring}).GetMetricValues(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, values, actual)
+		})
+	}
+}
+
+func TestFileStorage_WrongKey(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup")
+	storage := NewFileStorage(&config{filePath: filePath, keyring: testKeyring(t, "k1="+testKey(1))})
+	require.NoError(t, storage.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "1.5"}}))
+	require.NoError(t, storage.Restore(context.Background(), map[string]map[string]string{"gauge": {"Sys": "2.5"}}))
+
+	tests := []struct {
+		name          string
+		keyring       *Keyring
+		expectedError error
+	}{
+		{
+			name:          "same_id_other_key",
+			keyring:       testKeyring(t, "k1="+testKey(2)),
+			expectedError: ErrWrongKey,
+		},
+		{
+			name:          "unknown_id",
+			keyring:       testKeyring(t, "k2="+testKey(1)),
+			expectedError: ErrMissedKey,
+		},
+		{
+			name:          "no_keys",
+			expectedError: ErrMissedKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the previous snapshot is not used as a fallback
+			_, err := NewFileStorage(&config{filePath: filePath, keyring: tt.keyring}).GetMetricValues(context.Background())
+			assert.ErrorIs(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestFileStorage_KeyRotation(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup")
+	writeRecords(t, filePath, storageRecords{{Type: "gauge", Name: "Sys", Value: "1.5"}})
+
+	// unencrypted snapshots still load and are encrypted on the first write
+	storage := NewFileStorage(&config{filePath: filePath, keyring: testKeyring(t, "k1="+testKey(1))})
+	_, err := storage.AddMetricValues(context.Background(), []metrics.Metric{test.CreateGaugeMetric("Heap", 2.5)})
+	require.NoError(t, err)
+	assert.Contains(t, readHeader(t, filePath), `"keyId":"k1"`)
+
+	// the rotated key decrypts the snapshot until it is rewritten with the new active key
+	rotated := testKeyring(t, "k2="+testKey(2)+"\nk1="+testKey(1))
+	storage = NewFileStorage(&config{filePath: filePath, keyring: rotated})
+	actual, err := storage.GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "1.5", "Heap": "2.5"}}, actual)
+
+	_, err = storage.AddMetricValues(context.Background(), []metrics.Metric{test.CreateGaugeMetric("Heap", 3.5)})
+	require.NoError(t, err)
+	assert.Contains(t, readHeader(t, filePath), `"keyId":"k2"`)
+
+	actual, err = NewFileStorage(&config{filePath: filePath, keyring: testKeyring(t, "k2="+testKey(2))}).GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "1.5", "Heap": "3.5"}}, actual)
+}
+
+func TestFileStorage_NoPlaintextOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "backup")
+	keyring := testKeyring(t, "k1="+testKey(1))
+	conf := &config{filePath: filePath, keyring: keyring, fsyncPolicy: FsyncAlways, snapshotThreshold: 10000, keepHourly: 24}
+	storage := NewFileStorage(conf)
+
+	// the mutations stay in the log below the snapshot threshold
+	_, err := storage.AddMetricValues(context.Background(), []metrics.Metric{
+		test.CreateGaugeMetric("SecretGauge", 1.5),
+		test.CreateCounterMetric("SecretCounter", 10),
+	})
+	require.NoError(t, err)
+	require.NoError(t, storage.(*fileStorage).DeleteMetric(context.Background(), "counter", "SecretCounter"))
+	require.NoError(t, storage.Restore(context.Background(), map[string]map[string]string{"gauge": {"SecretGauge": "2.5"}}))
+	_, err = storage.AddMetricValues(context.Background(), []metrics.Metric{test.CreateGaugeMetric("SecretHeap", 3.5)})
+	require.NoError(t, err)
+
+	require.NoError(t, filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		require.NoError(t, err)
+		if entry.IsDir() {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "Secret", path)
+		return nil
+	}))
+
+	actual, err := NewFileStorage(&config{filePath: filePath, keyring: keyring}).GetMetricValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"SecretGauge": "2.5", "SecretHeap": "3.5"}}, actual)
+
+	_, err = NewFileStorage(&config{filePath: filePath, keyring: testKeyring(t, "k1="+testKey(2))}).GetMetricValues(context.Background())
+	assert.ErrorIs(t, err, ErrWrongKey)
+}
+
+func testKey(seed byte) string {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = seed
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func testKeyring(t *testing.T, spec string) *Keyring {
+	t.Helper()
+	keyring, err := ParseKeyring(spec)
+	require.NoError(t, err)
+
+	return keyring
+}
+
+func readHeader(t *testing.T, filePath string) string {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+
+	header, _, _ := strings.Cut(string(content), "\n")
+	return header
+}
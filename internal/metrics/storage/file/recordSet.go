@@ -0,0 +1,77 @@
+package file
+
+type recordKey struct {
+	tenant     string
+	metricType string
+	name       string
+}
+
+// recordSet is the storage state, the records are kept in the order they were added.
+type recordSet struct {
+	records storageRecords
+	index   map[recordKey]int
+}
+
+func newRecordSet(records storageRecords) *recordSet {
+	result := &recordSet{index: map[recordKey]int{}}
+	for _, record := range records {
+		result.set(record)
+	}
+
+	return result
+}
+
+func (s *recordSet) set(record *storageRecord) {
+	key := toRecordKey(record)
+	if i, ok := s.index[key]; ok {
+		s.records[i] = record
+		return
+	}
+
+	s.index[key] = len(s.records)
+	s.records = append(s.records, record)
+}
+
+func (s *recordSet) contains(record *storageRecord) bool {
+	_, ok := s.index[toRecordKey(record)]
+	return ok
+}
+
+func (s *recordSet) delete(record *storageRecord) {
+	key := toRecordKey(record)
+	if _, ok := s.index[key]; ok {
+		s.rebuild(func(current *storageRecord) bool { return toRecordKey(current) != key })
+	}
+}
+
+// replaceTenant drops the tenant records and adds the new ones.
+func (s *recordSet) replaceTenant(tenant string, records storageRecords) {
+	s.rebuild(func(record *storageRecord) bool { return record.Tenant != tenant })
+	for _, record := range records {
+		s.set(record)
+	}
+}
+
+func (s *recordSet) filter(keep func(*storageRecord) bool) storageRecords {
+	result := storageRecords{}
+	for _, record := range s.records {
+		if keep(record) {
+			result = append(result, record)
+		}
+	}
+
+	return result
+}
+
+func (s *recordSet) rebuild(keep func(*storageRecord) bool) {
+	records := s.filter(keep)
+	s.records = nil
+	s.index = map[recordKey]int{}
+	for _, record := range records {
+		s.set(record)
+	}
+}
+
+func toRecordKey(record *storageRecord) recordKey {
+	return recordKey{tenant: record.Tenant, metricType: record.Type, name: record.Name}
+}
@@ -0,0 +1,221 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotFormat = "metrics-snapshot"
+	// the version 1 snapshots have no encoding, their body is JSON, the version 2 ones are not encrypted
+	snapshotVersion = 3
+	tempSuffix      = ".tmp"
+	previousSuffix  = ".prev"
+)
+
+// snapshotHeader is the first line of a snapshot, the body follows it.
+type snapshotHeader struct {
+	Format   string   `json:"format"`
+	Version  int      `json:"version"`
+	Encoding Encoding `json:"encoding,omitempty"`
+	KeyID    string   `json:"keyId,omitempty"`
+	Size     int      `json:"size"`
+	Checksum string   `json:"checksum"`
+}
+
+// PreviousSnapshotPath returns the path of the snapshot replaced by the last one.
+func PreviousSnapshotPath(filePath string) string {
+	return filePath + previousSuffix
+}
+
+// encodeSnapshot encodes the records and encrypts them with the active key of a non-nil keyring.
+func encodeSnapshot(records storageRecords, encoding Encoding, keyring *Keyring) ([]byte, error) {
+	codec, ok := codecs[encoding]
+	if !ok {
+		return nil, logger.WrapError(fmt.Sprintf("encode snapshot with '%s'", encoding), ErrUnknownEncoding)
+	}
+
+	body, err := codec.encode(records)
+	if err != nil {
+		return nil, logger.WrapError("encode records", err)
+	}
+
+	if keyring != nil {
+		// the checksum covers the encrypted body, so the corruption is told from a wrong key
+		body, err = keyring.encrypt(body, []byte(encoding))
+		if err != nil {
+			return nil, logger.WrapError("encrypt records", err)
+		}
+	}
+
+	header, err := json.Marshal(&snapshotHeader{
+		Format:   snapshotFormat,
+		Version:  snapshotVersion,
+		Encoding: encoding,
+		KeyID:    keyring.ActiveKeyID(),
+		Size:     len(body),
+		Checksum: checksum(body),
+	})
+	if err != nil {
+		return nil, logger.WrapError("encode snapshot header", err)
+	}
+
+	return append(append(header, '\n'), body...), nil
+}
+
+// decodeSnapshot checks the header, decrypts the body and decodes it with the encoding from the header.
+// A snapshot without the header is the legacy JSON, its header has encodingLegacy.
+func decodeSnapshot(data []byte, keyring *Keyring) (storageRecords, snapshotHeader, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return storageRecords{}, snapshotHeader{}, nil
+	}
+
+	if data[0] != '{' {
+		records, err := codecs[detectLegacyEncoding(data)].decode(data)
+		if err != nil {
+			return nil, snapshotHeader{}, logger.WrapError(fmt.Sprintf("decode snapshot records: %v", err), ErrCorruptedSnapshot)
+		}
+
+		return records, snapshotHeader{}, nil
+	}
+
+	headerLine, body, _ := bytes.Cut(data, []byte("\n"))
+	header := snapshotHeader{}
+	err := json.Unmarshal(headerLine, &header)
+	if err != nil || header.Format != snapshotFormat {
+		return nil, snapshotHeader{}, logger.WrapError("decode snapshot header", ErrCorruptedSnapshot)
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		return nil, snapshotHeader{}, logger.WrapError(fmt.Sprintf("read snapshot version %d", header.Version), ErrUnsupportedSnapshot)
+	}
+	if len(body) != header.Size || checksum(body) != header.Checksum {
+		return nil, snapshotHeader{}, logger.WrapError("verify snapshot checksum", ErrCorruptedSnapshot)
+	}
+
+	if header.Encoding == "" {
+		header.Encoding = EncodingJSON
+	}
+
+	codec, ok := codecs[header.Encoding]
+	if !ok {
+		return nil, snapshotHeader{}, logger.WrapError(fmt.Sprintf("decode snapshot with '%s'", header.Encoding), ErrUnsupportedSnapshot)
+	}
+
+	if header.KeyID != "" {
+		body, err = keyring.decrypt(header.KeyID, body, []byte(header.Encoding))
+		if err != nil {
+			return nil, snapshotHeader{}, err
+		}
+	}
+
+	records, err := codec.decode(body)
+	if err != nil {
+		return nil, snapshotHeader{}, logger.WrapError(fmt.Sprintf("decode snapshot records: %v", err), ErrCorruptedSnapshot)
+	}
+
+	return records, header, nil
+}
+
+func readSnapshotFile(path string, keyring *Keyring) (storageRecords, snapshotHeader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, snapshotHeader{}, logger.WrapError("read snapshot", err)
+	}
+
+	return decodeSnapshot(data, keyring)
+}
+
+// writeSnapshotFile replaces the snapshot atomically: the data goes to a temp file renamed over the snapshot.
+// The replaced snapshot is kept as the previous one unless keepPrevious is set, e.g. when the current one is corrupted.
+func writeSnapshotFile(path string, records storageRecords, encoding Encoding, keyring *Keyring, sync bool, keepPrevious bool) error {
+	data, err := encodeSnapshot(records, encoding, keyring)
+	if err != nil {
+		return err
+	}
+
+	tempPath := path + tempSuffix
+	err = writeFile(tempPath, data, sync)
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+
+	if !keepPrevious {
+		previousPath := PreviousSnapshotPath(path)
+		err = os.Remove(previousPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return logger.WrapError("remove previous snapshot", err)
+		}
+
+		// the link keeps the current snapshot in place until the rename
+		err = os.Link(path, previousPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("failed to keep previous snapshot: %v", err)
+		}
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return logger.WrapError("rename snapshot", err)
+	}
+
+	if !sync {
+		return nil
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+func writeFile(path string, data []byte, sync bool) error {
+	fileStream, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fileMode)
+	if err != nil {
+		return logger.WrapError("open file", err)
+	}
+
+	_, err = fileStream.Write(data)
+	if err == nil && sync {
+		err = fileStream.Sync()
+	}
+	closeErr := fileStream.Close()
+	if err != nil {
+		return logger.WrapError("write file", err)
+	}
+	if closeErr != nil {
+		return logger.WrapError("close file", closeErr)
+	}
+
+	return nil
+}
+
+// syncDir persists the rename.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return logger.WrapError("open directory", err)
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+
+	err = dir.Sync()
+	if err != nil {
+		return logger.WrapError("sync directory", err)
+	}
+
+	return nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
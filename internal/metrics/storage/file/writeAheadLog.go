@@ -0,0 +1,342 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	walSuffix   = ".wal"
+	walOpSet    = "set"
+	walOpDelete = "delete"
+)
+
+// walAdditionalData binds a sealed entry to the log, so it is never taken for a snapshot body.
+var walAdditionalData = []byte("wal")
+
+// FsyncPolicy sets when the appended mutations are flushed to the disk.
+type FsyncPolicy string
+
+const (
+	FsyncAlways   FsyncPolicy = "always"
+	FsyncInterval FsyncPolicy = "interval"
+	FsyncNever    FsyncPolicy = "never"
+)
+
+// walEntry is a batch of mutations, the records keep absolute values, so a replay is idempotent.
+type walEntry struct {
+	Op      string         `json:"op"`
+	Records storageRecords `json:"records"`
+}
+
+// sealedEntry is a walEntry encrypted with the key of KeyID.
+type sealedEntry struct {
+	KeyID  string `json:"keyId"`
+	Sealed []byte `json:"sealed"`
+}
+
+// writeAheadLog appends the mutations since the last snapshot as JSON lines,
+// with a keyring every line is sealed with the active key.
+// With the interval policy the open log is synced in the background every interval if it has unsynced entries.
+type writeAheadLog struct {
+	path     string
+	policy   FsyncPolicy
+	interval time.Duration
+	keyring  *Keyring
+	file     *os.File
+	entries  int
+	dirty    bool
+	stop     chan struct{}
+	stopped  chan struct{}
+	lock     sync.Mutex
+}
+
+// WALPath returns the path of the write-ahead log of the backup file.
+func WALPath(filePath string) string {
+	return filePath + walSuffix
+}
+
+func (p FsyncPolicy) Validate() error {
+	switch p {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+		return nil
+	default:
+		return logger.WrapError(fmt.Sprintf("check fsync policy '%s'", p), ErrUnknownFsyncPolicy)
+	}
+}
+
+func newWriteAheadLog(path string, policy FsyncPolicy, interval time.Duration, keyring *Keyring) *writeAheadLog {
+	if policy == "" {
+		policy = FsyncAlways
+	}
+
+	return &writeAheadLog{
+		path:     path,
+		policy:   policy,
+		interval: interval,
+		keyring:  keyring,
+	}
+}
+
+func (l *writeAheadLog) append(entry *walEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.open()
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeLogEntry(entry, l.keyring)
+	if err != nil {
+		return err
+	}
+
+	// the entry is written at once, so a crash may tear only the last line
+	_, err = l.file.Write(append(data, '\n'))
+	if err != nil {
+		return logger.WrapError("write log entry", err)
+	}
+	l.entries++
+	l.dirty = true
+
+	if l.periodic() {
+		return nil
+	}
+
+	return l.sync()
+}
+
+// reset empties the log after its entries are written to a snapshot.
+func (l *writeAheadLog) reset() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.open()
+	if err != nil {
+		return err
+	}
+
+	err = l.file.Truncate(0)
+	if err != nil {
+		return logger.WrapError("truncate log", err)
+	}
+	l.entries = 0
+	l.dirty = true
+
+	return l.sync()
+}
+
+// len returns the count of entries since the last snapshot.
+func (l *writeAheadLog) len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.entries
+}
+
+func (l *writeAheadLog) open() error {
+	if l.file != nil {
+		return nil
+	}
+
+	entries, size, err := readLog(l.path, l.keyring, func(*walEntry) {})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, fileMode)
+	if err != nil {
+		return logger.WrapError("open log", err)
+	}
+
+	// a torn tail of a crashed write is cut, so the next entries are not glued to it
+	err = file.Truncate(size)
+	if err != nil {
+		_ = file.Close()
+		return logger.WrapError("truncate torn log tail", err)
+	}
+
+	l.file = file
+	l.entries = entries
+	if l.periodic() {
+		l.stop = make(chan struct{})
+		l.stopped = make(chan struct{})
+		go l.syncWorker(l.stop, l.stopped)
+	}
+
+	return nil
+}
+
+// periodic reports whether the appended entries are synced by the background worker.
+func (l *writeAheadLog) periodic() bool {
+	return l.policy == FsyncInterval && l.interval > 0
+}
+
+func (l *writeAheadLog) syncWorker(stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.lock.Lock()
+			err := l.sync()
+			l.lock.Unlock()
+			if err != nil {
+				logrus.Errorf("failed to sync log: %v", err)
+			}
+		}
+	}
+}
+
+// sync flushes the unsynced entries of the open log.
+func (l *writeAheadLog) sync() error {
+	if l.policy == FsyncNever || l.file == nil || !l.dirty {
+		return nil
+	}
+
+	err := l.file.Sync()
+	if err != nil {
+		return logger.WrapError("sync log", err)
+	}
+
+	l.dirty = false
+	return nil
+}
+
+func (l *writeAheadLog) close() error {
+	l.lock.Lock()
+	stop, stopped := l.stop, l.stopped
+	l.stop, l.stopped = nil, nil
+	l.lock.Unlock()
+
+	// the worker takes the lock to sync, so it is stopped before the lock is held
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.sync()
+	if err != nil {
+		return err
+	}
+
+	err = l.file.Close()
+	l.file = nil
+	if err != nil {
+		return logger.WrapError("close log", err)
+	}
+
+	return nil
+}
+
+// readLog replays the complete entries of the log and returns their count and size, a missed log is empty.
+// Unsealed entries of a log written without a keyring are read as is.
+func readLog(path string, keyring *Keyring, apply func(*walEntry)) (int, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, logger.WrapError("open log", err)
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			logrus.Errorf("failed to close log: %v", err)
+		}
+	}()
+
+	entries := 0
+	size := int64(0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				logrus.Warnf("Skip torn entry at the end of %v", path)
+			}
+			return entries, size, nil
+		}
+		if err != nil {
+			return 0, 0, logger.WrapError("read log", err)
+		}
+
+		entry, err := decodeLogEntry(line, keyring)
+		if err != nil {
+			return 0, 0, logger.WrapError(fmt.Sprintf("decode log entry at offset %d", size), err)
+		}
+
+		apply(entry)
+		entries++
+		size += int64(len(line))
+	}
+}
+
+func encodeLogEntry(entry *walEntry, keyring *Keyring) ([]byte, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, logger.WrapError("encode log entry", err)
+	}
+
+	if keyring == nil {
+		return data, nil
+	}
+
+	sealed, err := keyring.encrypt(data, walAdditionalData)
+	if err != nil {
+		return nil, logger.WrapError("encrypt log entry", err)
+	}
+
+	data, err = json.Marshal(&sealedEntry{KeyID: keyring.ActiveKeyID(), Sealed: sealed})
+	if err != nil {
+		return nil, logger.WrapError("encode sealed log entry", err)
+	}
+
+	return data, nil
+}
+
+func decodeLogEntry(line []byte, keyring *Keyring) (*walEntry, error) {
+	sealed := &sealedEntry{}
+	err := json.Unmarshal(line, sealed)
+	if err != nil {
+		return nil, logger.WrapError(err.Error(), ErrCorruptedLog)
+	}
+
+	if sealed.KeyID != "" {
+		line, err = keyring.decrypt(sealed.KeyID, sealed.Sealed, walAdditionalData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entry := &walEntry{}
+	err = json.Unmarshal(line, entry)
+	if err != nil {
+		return nil, logger.WrapError(err.Error(), ErrCorruptedLog)
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// HistoryStorage keeps recent samples of every series, the tenant is taken from the context.
+type HistoryStorage interface {
+	GetMetricHistory(ctx context.Context, metricType string, metricName string, since time.Time) ([]Sample, error)
+	GetHistory(ctx context.Context, since time.Time) (map[string]map[string][]Sample, error)
+}
@@ -3,23 +3,47 @@ package memory
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/MlDenis/prometheus_wannabe/internal/converter"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
 )
 
+// DefaultHistorySize keeps an hour of samples for the default agent report interval.
+const DefaultHistorySize = 360
+
+type metricsByType map[string]map[string]metrics.Metric
+
+type historyByType map[string]map[string]*sampleRing
+
 type inMemoryStorage struct {
-	metricsByType map[string]map[string]metrics.Metric
-	lock          sync.RWMutex
+	metricsByTenant map[string]metricsByType
+	historyByTenant map[string]historyByType
+	historySize     int
+	now             func() time.Time
+	lock            sync.RWMutex
 }
 
+// NewInMemoryStorage creates the storage without history.
 func NewInMemoryStorage() storage.MetricsStorage {
+	return NewInMemoryStorageWithHistory(0)
+}
+
+// NewInMemoryStorageWithHistory creates the storage keeping the last historySize samples per series,
+// the storage implements storage.HistoryStorage, with zero historySize it returns metrics.ErrHistoryNotSupported.
+func NewInMemoryStorageWithHistory(historySize int) storage.MetricsStorage {
 	return &inMemoryStorage{
-		metricsByType: map[string]map[string]metrics.Metric{},
-		lock:          sync.RWMutex{},
+		metricsByTenant: map[string]metricsByType{},
+		historyByTenant: map[string]historyByType{},
+		historySize:     historySize,
+		now:             time.Now,
+		lock:            sync.RWMutex{},
 	}
 }
 
@@ -27,14 +51,17 @@ func (s *inMemoryStorage) AddMetricValues(ctx context.Context, metricList []metr
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	tenant := identity.Tenant(ctx)
+	tenantMetrics := s.ensureTenant(tenant)
+	now := s.now()
 	result := make([]metrics.Metric, len(metricList))
 
 	for i, metric := range metricList {
 		metricType := metric.GetType()
-		typedMetrics, ok := s.metricsByType[metricType]
+		typedMetrics, ok := tenantMetrics[metricType]
 		if !ok {
 			typedMetrics = map[string]metrics.Metric{}
-			s.metricsByType[metricType] = typedMetrics
+			tenantMetrics[metricType] = typedMetrics
 		}
 
 		metricName := metric.GetName()
@@ -46,17 +73,18 @@ func (s *inMemoryStorage) AddMetricValues(ctx context.Context, metricList []metr
 			typedMetrics[metricName] = currentMetric
 		}
 		result[i] = currentMetric
+		s.addSample(tenant, metricType, metricName, now, currentMetric.GetValue())
 	}
 
 	return result, nil
 }
 
-func (s *inMemoryStorage) GetMetricValues(context.Context) (map[string]map[string]string, error) {
+func (s *inMemoryStorage) GetMetricValues(ctx context.Context) (map[string]map[string]string, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
 	metricValues := map[string]map[string]string{}
-	for metricsType, metricsList := range s.metricsByType {
+	for metricsType, metricsList := range s.metricsByTenant[identity.Tenant(ctx)] {
 		values := map[string]string{}
 		metricValues[metricsType] = values
 
@@ -71,7 +99,7 @@ func (s *inMemoryStorage) GetMetricValues(context.Context) (map[string]map[strin
 func (s *inMemoryStorage) GetMetric(ctx context.Context, metricType string, metricName string) (metrics.Metric, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	metricsByName, ok := s.metricsByType[metricType]
+	metricsByName, ok := s.metricsByTenant[identity.Tenant(ctx)][metricType]
 	if !ok {
 		return nil, fmt.Errorf("get metric with type %s: %w", metricType, metrics.ErrMetricNotFound)
 	}
@@ -84,18 +112,47 @@ func (s *inMemoryStorage) GetMetric(ctx context.Context, metricType string, metr
 	return metric, nil
 }
 
+// DeleteMetric removes the series with its history.
+func (s *inMemoryStorage) DeleteMetric(ctx context.Context, metricType string, metricName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tenant := identity.Tenant(ctx)
+	metricsByName := s.metricsByTenant[tenant][metricType]
+	if _, ok := metricsByName[metricName]; !ok {
+		return fmt.Errorf("metrics with name %v and types %v not found: %w", metricName, metricType, metrics.ErrMetricNotFound)
+	}
+
+	delete(metricsByName, metricName)
+	delete(s.historyByTenant[tenant][metricType], metricName)
+	return nil
+}
+
+func (s *inMemoryStorage) GetTenants(context.Context) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := make([]string, 0, len(s.metricsByTenant))
+	for tenant := range s.metricsByTenant {
+		result = append(result, tenant)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
 func (s *inMemoryStorage) Restore(ctx context.Context, metricValues map[string]map[string]string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.metricsByType = map[string]map[string]metrics.Metric{}
+	restored := metricsByType{}
 
 	for metricType, metricsByType := range metricValues {
 		metricFactory := types.NewGaugeMetric
 		if metricType == "counter" {
 			metricFactory = types.NewCounterMetric
 		} else if metricType != "gauge" {
-			return fmt.Errorf("handle backup metric with type '%s': %w", metricType, metrics.ErrUnknownMetricType)
+			return logger.WrapError(fmt.Sprintf("handle backup metric with type '%s'", metricType), metrics.ErrUnknownMetricType)
 		}
 
 		for metricName, metricValue := range metricsByType {
@@ -104,10 +161,10 @@ func (s *inMemoryStorage) Restore(ctx context.Context, metricValues map[string]m
 				return fmt.Errorf("parse float metric value: %w", err)
 			}
 
-			metricsList, ok := s.metricsByType[metricType]
+			metricsList, ok := restored[metricType]
 			if !ok {
 				metricsList = map[string]metrics.Metric{}
-				s.metricsByType[metricType] = metricsList
+				restored[metricType] = metricsList
 			}
 
 			currentMetric, ok := metricsList[metricName]
@@ -120,5 +177,89 @@ func (s *inMemoryStorage) Restore(ctx context.Context, metricValues map[string]m
 		}
 	}
 
+	tenant := identity.Tenant(ctx)
+	s.metricsByTenant[tenant] = restored
+
+	delete(s.historyByTenant, tenant)
+	now := s.now()
+	for metricType, metricsList := range restored {
+		for metricName, metric := range metricsList {
+			s.addSample(tenant, metricType, metricName, now, metric.GetValue())
+		}
+	}
+
 	return nil
 }
+
+func (s *inMemoryStorage) GetMetricHistory(ctx context.Context, metricType string, metricName string, since time.Time) ([]storage.Sample, error) {
+	if s.historySize <= 0 {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ring, ok := s.historyByTenant[identity.Tenant(ctx)][metricType][metricName]
+	if !ok {
+		return nil, fmt.Errorf("history of metric with name %v and type %v not found: %w", metricName, metricType, metrics.ErrMetricNotFound)
+	}
+
+	return ring.samples(since), nil
+}
+
+func (s *inMemoryStorage) GetHistory(ctx context.Context, since time.Time) (map[string]map[string][]storage.Sample, error) {
+	if s.historySize <= 0 {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	result := map[string]map[string][]storage.Sample{}
+	for metricType, rings := range s.historyByTenant[identity.Tenant(ctx)] {
+		samples := map[string][]storage.Sample{}
+		result[metricType] = samples
+
+		for metricName, ring := range rings {
+			samples[metricName] = ring.samples(since)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *inMemoryStorage) addSample(tenant string, metricType string, metricName string, at time.Time, value float64) {
+	if s.historySize <= 0 {
+		return
+	}
+
+	tenantHistory, ok := s.historyByTenant[tenant]
+	if !ok {
+		tenantHistory = historyByType{}
+		s.historyByTenant[tenant] = tenantHistory
+	}
+
+	typedHistory, ok := tenantHistory[metricType]
+	if !ok {
+		typedHistory = map[string]*sampleRing{}
+		tenantHistory[metricType] = typedHistory
+	}
+
+	ring, ok := typedHistory[metricName]
+	if !ok {
+		ring = newSampleRing(s.historySize)
+		typedHistory[metricName] = ring
+	}
+
+	ring.add(at, value)
+}
+
+func (s *inMemoryStorage) ensureTenant(tenant string) metricsByType {
+	tenantMetrics, ok := s.metricsByTenant[tenant]
+	if !ok {
+		tenantMetrics = metricsByType{}
+		s.metricsByTenant[tenant] = tenantMetrics
+	}
+
+	return tenantMetrics
+}
@@ -3,8 +3,11 @@ package memory
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
 	"github.com/MlDenis/prometheus_wannabe/internal/test"
 
 	"github.com/stretchr/testify/assert"
@@ -345,3 +348,118 @@ func TestInMemoryStorage_GetMetricValue(t *testing.T) {
 		})
 	}
 }
+
+func TestInMemoryStorage_Tenants(t *testing.T) {
+	storage := NewInMemoryStorage()
+	teamA := identity.WithTenant(context.Background(), "teamA")
+	teamB := identity.WithTenant(context.Background(), "teamB")
+
+	_, err := storage.AddMetricValues(teamA, []metrics.Metric{test.CreateCounterMetric("Alloc", 100)})
+	assert.NoError(t, err)
+	_, err = storage.AddMetricValues(teamB, []metrics.Metric{test.CreateCounterMetric("Alloc", 200)})
+	assert.NoError(t, err)
+
+	actualA, err := storage.GetMetricValues(teamA)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"counter": {"Alloc": "100"}}, actualA)
+
+	actualB, err := storage.GetMetric(teamB, "counter", "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(200), actualB.GetValue())
+
+	_, err = storage.GetMetric(context.Background(), "counter", "Alloc")
+	assert.ErrorIs(t, err, metrics.ErrMetricNotFound)
+
+	err = storage.Restore(teamA, map[string]map[string]string{"gauge": {"Sys": "1.5"}})
+	assert.NoError(t, err)
+
+	actualA, err = storage.GetMetricValues(teamA)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"gauge": {"Sys": "1.5"}}, actualA)
+
+	actualB, err = storage.GetMetric(teamB, "counter", "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(200), actualB.GetValue())
+
+	tenants, err := storage.GetTenants(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"teamA", "teamB"}, tenants)
+}
+
+func TestInMemoryStorage_DeleteMetric(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryStorageWithHistory(DefaultHistorySize)
+
+	_, err := s.AddMetricValues(ctx, []metrics.Metric{test.CreateCounterMetric("Alloc", 100), test.CreateGaugeMetric("Sys", 1.5)})
+	assert.NoError(t, err)
+
+	deleter := s.(storage.MetricsDeleter)
+	err = deleter.DeleteMetric(ctx, "counter", "Alloc")
+	assert.NoError(t, err)
+
+	err = deleter.DeleteMetric(ctx, "counter", "Alloc")
+	assert.ErrorIs(t, err, metrics.ErrMetricNotFound)
+
+	err = deleter.DeleteMetric(identity.WithTenant(ctx, "teamA"), "gauge", "Sys")
+	assert.ErrorIs(t, err, metrics.ErrMetricNotFound)
+
+	actual, err := s.GetMetricValues(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"counter": {}, "gauge": {"Sys": "1.5"}}, actual)
+
+	_, err = s.(storage.HistoryStorage).GetMetricHistory(ctx, "counter", "Alloc", time.Time{})
+	assert.ErrorIs(t, err, metrics.ErrMetricNotFound)
+}
+
+func TestInMemoryStorage_History(t *testing.T) {
+	ctx := context.Background()
+	start := time.Unix(1000, 0)
+	now := start
+
+	s := NewInMemoryStorageWithHistory(3).(*inMemoryStorage)
+	s.now = func() time.Time { return now }
+
+	for i := 1; i <= 4; i++ {
+		_, err := s.AddMetricValues(ctx, []metrics.Metric{test.CreateCounterMetric("counterMetric", 10)})
+		assert.NoError(t, err)
+		now = now.Add(time.Minute)
+	}
+
+	actual, err := s.GetMetricHistory(ctx, "counter", "counterMetric", time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Sample{
+		{Time: start.Add(time.Minute), Value: 20},
+		{Time: start.Add(2 * time.Minute), Value: 30},
+		{Time: start.Add(3 * time.Minute), Value: 40},
+	}, actual)
+
+	actual, err = s.GetMetricHistory(ctx, "counter", "counterMetric", start.Add(3*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.Sample{{Time: start.Add(3 * time.Minute), Value: 40}}, actual)
+
+	_, err = s.GetMetricHistory(identity.WithTenant(ctx, "teamA"), "counter", "counterMetric", time.Time{})
+	assert.ErrorIs(t, err, metrics.ErrMetricNotFound)
+
+	err = s.Restore(ctx, map[string]map[string]string{"gauge": {"gaugeMetric": "1.5"}})
+	assert.NoError(t, err)
+
+	history, err := s.GetHistory(ctx, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string][]storage.Sample{
+		"gauge": {"gaugeMetric": {{Time: now, Value: 1.5}}},
+	}, history)
+}
+
+func TestInMemoryStorage_NoHistory(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryStorage()
+	_, err := s.AddMetricValues(ctx, []metrics.Metric{test.CreateCounterMetric("counterMetric", 10)})
+	assert.NoError(t, err)
+
+	history := s.(storage.HistoryStorage)
+	_, err = history.GetMetricHistory(ctx, "counter", "counterMetric", time.Time{})
+	assert.ErrorIs(t, err, metrics.ErrHistoryNotSupported)
+
+	_, err = history.GetHistory(ctx, time.Time{})
+	assert.ErrorIs(t, err, metrics.ErrHistoryNotSupported)
+}
@@ -0,0 +1,52 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+)
+
+// sampleRing keeps the last samples of a series, the oldest sample is overwritten when it is full.
+type sampleRing struct {
+	times  []int64
+	values []float64
+	next   int
+	full   bool
+}
+
+func newSampleRing(capacity int) *sampleRing {
+	return &sampleRing{
+		times:  make([]int64, capacity),
+		values: make([]float64, capacity),
+	}
+}
+
+func (r *sampleRing) add(at time.Time, value float64) {
+	r.times[r.next] = at.UnixNano()
+	r.values[r.next] = value
+	r.next = (r.next + 1) % len(r.times)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// samples returns samples not older than since, from the oldest to the newest.
+func (r *sampleRing) samples(since time.Time) []storage.Sample {
+	start, count := 0, r.next
+	if r.full {
+		start, count = r.next, len(r.times)
+	}
+
+	sinceNano := since.UnixNano()
+	result := []storage.Sample{}
+	for i := 0; i < count; i++ {
+		index := (start + i) % len(r.times)
+		if r.times[index] < sinceNano {
+			continue
+		}
+
+		result = append(result, storage.Sample{Time: time.Unix(0, r.times[index]), Value: r.values[index]})
+	}
+
+	return result
+}
@@ -6,9 +6,16 @@ import (
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 )
 
+// MetricsStorage keeps a separate metric set per tenant, the tenant is taken from the context (see identity.Tenant).
 type MetricsStorage interface {
 	AddMetricValues(ctx context.Context, metric []metrics.Metric) ([]metrics.Metric, error)
 	GetMetricValues(ctx context.Context) (map[string]map[string]string, error)
 	GetMetric(ctx context.Context, metricType string, metricName string) (metrics.Metric, error)
+	GetTenants(ctx context.Context) ([]string, error)
 	Restore(ctx context.Context, metricValues map[string]map[string]string) error
 }
+
+// MetricsDeleter is implemented by storages which can remove a series, metrics.ErrMetricNotFound is returned for an unknown one.
+type MetricsDeleter interface {
+	DeleteMetric(ctx context.Context, metricType string, metricName string) error
+}
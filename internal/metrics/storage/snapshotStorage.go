@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// SnapshotStorage keeps timestamped snapshots of all tenants, metrics.ErrSnapshotNotFound is returned for an unknown one.
+type SnapshotStorage interface {
+	// ListSnapshots returns the kept snapshots, the newest first.
+	ListSnapshots(ctx context.Context) ([]Snapshot, error)
+	// RestoreSnapshot makes the snapshot the current state of the storage.
+	RestoreSnapshot(ctx context.Context, id string) error
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "context"
+
+// StateStorage is a storage whose state of all tenants can be exported and imported at once.
+type StateStorage interface {
+	MetricsStorage
+	// ImportMetricValues sets the tenant -> type -> name -> value state,
+	// with replace the series and the tenants missed in the state are removed, otherwise they are kept.
+	ImportMetricValues(ctx context.Context, state map[string]map[string]map[string]string, replace bool) error
+}
+
+// StateRestorer is implemented by storages which replace the state of all tenants at once,
+// e.g. with a single snapshot, the tenants missed in the tenant -> type -> name -> value state are removed.
+type StateRestorer interface {
+	RestoreState(ctx context.Context, state map[string]map[string]map[string]string) error
+}
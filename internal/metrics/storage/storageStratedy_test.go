@@ -3,7 +3,9 @@ package storage
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
 	"github.com/MlDenis/prometheus_wannabe/internal/test"
 
@@ -19,6 +21,14 @@ type metricStorageMock struct {
 	mock.Mock
 }
 
+type stateRestorerMock struct {
+	metricStorageMock
+}
+
+type changeObserverMock struct {
+	changes []MetricChange
+}
+
 const (
 	metricType          = "metricType"
 	metricName          = "metricName"
@@ -84,7 +94,7 @@ func TestStorageStrategy_AddGaugeMetricValue(t *testing.T) {
 			inMemoryStorageMock.On("AddMetricValues", ctx, metricsList).Return(tt.expectedResult, tt.inMemoryStorageError)
 			backupStorageMock.On("AddMetricValues", ctx, tt.expectedResult).Return(tt.expectedResult, tt.backupStorageErrorError)
 
-			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock)
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
 			actualResult, actualError := strategy.AddMetricValues(ctx, metricsList)
 
 			assert.Equal(t, tt.expectedResult, actualResult)
@@ -164,7 +174,7 @@ func TestStorageStrategy_AddCounterMetricValue(t *testing.T) {
 			inMemoryStorageMock.On("AddMetricValues", ctx, metricsList).Return(tt.expectedResult, tt.inMemoryStorageError)
 			backupStorageMock.On("AddMetricValues", ctx, tt.expectedResult).Return(tt.expectedResult, tt.backupStorageErrorError)
 
-			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock)
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
 			actualResult, actualError := strategy.AddMetricValues(ctx, metricsList)
 
 			assert.Equal(t, tt.expectedResult, actualResult)
@@ -234,7 +244,7 @@ func TestStorageStrategy_GetMetricValues(t *testing.T) {
 			inMemoryStorageMock.On("GetMetricValues", ctx).Return(tt.storageResult, tt.storageError)
 			backupStorageMock.On("GetMetricValues", ctx).Return(tt.storageResult, tt.storageError)
 
-			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock)
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
 			actualResult, actualError := strategy.GetMetricValues(ctx)
 
 			assert.Equal(t, tt.expectedResult, actualResult)
@@ -294,7 +304,7 @@ func TestStorageStrategy_GetMetric(t *testing.T) {
 			inMemoryStorageMock.On("GetMetric", ctx, metricType, metricName).Return(tt.storageResult, tt.storageError)
 			backupStorageMock.On("GetMetric", ctx, metricType, metricName).Return(tt.storageResult, tt.storageError)
 
-			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock)
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
 			actualResult, actualError := strategy.GetMetric(ctx, metricType, metricName)
 
 			assert.Equal(t, tt.expectedResult, actualResult)
@@ -349,7 +359,7 @@ func TestStorageStrategy_Restore(t *testing.T) {
 			inMemoryStorageMock.On("Restore", ctx, values).Return(tt.storageError)
 			backupStorageMock.On("Restore", ctx, values).Return(tt.storageError)
 
-			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock)
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
 			actualError := strategy.Restore(ctx, values)
 
 			assert.Equal(t, tt.expectedError, actualError)
@@ -412,24 +422,26 @@ func TestStorageStrategy_CreateBackup(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx := context.Background()
+			tenantCtx := identity.WithTenant(ctx, identity.DefaultTenant)
 
 			confMock := new(configMock)
 			inMemoryStorageMock := new(metricStorageMock)
 			backupStorageMock := new(metricStorageMock)
 
 			confMock.On("SyncMode").Return(tt.syncMode)
-			inMemoryStorageMock.On("GetMetricValues", ctx).Return(tt.currentStateValues, tt.currentStateError)
-			backupStorageMock.On("Restore", ctx, tt.currentStateValues).Return(tt.restoreError)
+			inMemoryStorageMock.On("GetTenants", ctx).Return([]string{identity.DefaultTenant}, nil)
+			inMemoryStorageMock.On("GetMetricValues", tenantCtx).Return(tt.currentStateValues, tt.currentStateError)
+			backupStorageMock.On("Restore", tenantCtx, tt.currentStateValues).Return(tt.restoreError)
 
-			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock)
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
 			actualError := strategy.CreateBackup(ctx)
 
 			assert.ErrorIs(t, actualError, tt.expectedError)
 
-			inMemoryStorageMock.AssertCalled(t, "GetMetricValues", ctx)
+			inMemoryStorageMock.AssertCalled(t, "GetMetricValues", tenantCtx)
 
 			if tt.currentStateError == nil {
-				backupStorageMock.AssertCalled(t, "Restore", ctx, tt.currentStateValues)
+				backupStorageMock.AssertCalled(t, "Restore", tenantCtx, tt.currentStateValues)
 			} else {
 				backupStorageMock.AssertNotCalled(t, "Restore", mock.Anything, mock.Anything)
 			}
@@ -489,24 +501,26 @@ func TestStorageStrategy_RestoreFromBackup(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx := context.Background()
+			tenantCtx := identity.WithTenant(ctx, identity.DefaultTenant)
 
 			confMock := new(configMock)
 			inMemoryStorageMock := new(metricStorageMock)
 			backupStorageMock := new(metricStorageMock)
 
 			confMock.On("SyncMode").Return(tt.syncMode)
-			backupStorageMock.On("GetMetricValues", ctx).Return(tt.currentStateValues, tt.currentStateError)
-			inMemoryStorageMock.On("Restore", ctx, tt.currentStateValues).Return(tt.restoreError)
+			backupStorageMock.On("GetTenants", ctx).Return([]string{identity.DefaultTenant}, nil)
+			backupStorageMock.On("GetMetricValues", tenantCtx).Return(tt.currentStateValues, tt.currentStateError)
+			inMemoryStorageMock.On("Restore", tenantCtx, tt.currentStateValues).Return(tt.restoreError)
 
-			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock)
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
 			actualError := strategy.RestoreFromBackup(ctx)
 
 			assert.ErrorIs(t, actualError, tt.expectedError)
 
-			backupStorageMock.AssertCalled(t, "GetMetricValues", ctx)
+			backupStorageMock.AssertCalled(t, "GetMetricValues", tenantCtx)
 
 			if tt.currentStateError == nil {
-				inMemoryStorageMock.AssertCalled(t, "Restore", ctx, tt.currentStateValues)
+				inMemoryStorageMock.AssertCalled(t, "Restore", tenantCtx, tt.currentStateValues)
 			} else {
 				inMemoryStorageMock.AssertNotCalled(t, "Restore", mock.Anything, mock.Anything)
 			}
@@ -566,24 +580,26 @@ func TestStorageStrategy_Close(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx := context.Background()
+			tenantCtx := identity.WithTenant(ctx, identity.DefaultTenant)
 
 			confMock := new(configMock)
 			inMemoryStorageMock := new(metricStorageMock)
 			backupStorageMock := new(metricStorageMock)
 
 			confMock.On("SyncMode").Return(tt.syncMode)
-			inMemoryStorageMock.On("GetMetricValues", ctx).Return(tt.currentStateValues, tt.currentStateError)
-			backupStorageMock.On("Restore", ctx, tt.currentStateValues).Return(tt.restoreError)
+			inMemoryStorageMock.On("GetTenants", ctx).Return([]string{identity.DefaultTenant}, nil)
+			inMemoryStorageMock.On("GetMetricValues", tenantCtx).Return(tt.currentStateValues, tt.currentStateError)
+			backupStorageMock.On("Restore", tenantCtx, tt.currentStateValues).Return(tt.restoreError)
 
-			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock)
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
 			actualError := strategy.Close()
 
 			assert.ErrorIs(t, actualError, tt.expectedError)
 
-			inMemoryStorageMock.AssertCalled(t, "GetMetricValues", ctx)
+			inMemoryStorageMock.AssertCalled(t, "GetMetricValues", tenantCtx)
 
 			if tt.currentStateError == nil {
-				backupStorageMock.AssertCalled(t, "Restore", ctx, tt.currentStateValues)
+				backupStorageMock.AssertCalled(t, "Restore", tenantCtx, tt.currentStateValues)
 			} else {
 				backupStorageMock.AssertNotCalled(t, "Restore", mock.Anything, mock.Anything)
 			}
@@ -591,6 +607,180 @@ func TestStorageStrategy_Close(t *testing.T) {
 	}
 }
 
+func TestStorageStrategy_AddObserver(t *testing.T) {
+	tests := []struct {
+		name                 string
+		inMemoryStorageError error
+		expectedChanges      []MetricChange
+	}{
+		{
+			name:                 "inMemoryStorage_error",
+			inMemoryStorageError: test.ErrTest,
+		},
+		{
+			name: "success",
+			expectedChanges: []MetricChange{
+				{Tenant: "team-a", Type: "gauge", Name: "resultMetric", Value: 100},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := identity.WithTenant(context.Background(), "team-a")
+
+			confMock := new(configMock)
+			inMemoryStorageMock := new(metricStorageMock)
+			observer := &changeObserverMock{}
+
+			metricsList := []metrics.Metric{test.CreateGaugeMetric(metricName, metricValue)}
+			result := []metrics.Metric{test.CreateGaugeMetric("resultMetric", 100)}
+
+			confMock.On("SyncMode").Return(false)
+			inMemoryStorageMock.On("AddMetricValues", ctx, metricsList).Return(result, tt.inMemoryStorageError)
+
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, new(metricStorageMock), nil)
+			strategy.AddObserver(observer)
+			_, actualError := strategy.AddMetricValues(ctx, metricsList)
+
+			assert.ErrorIs(t, actualError, tt.inMemoryStorageError)
+			for i := range observer.changes {
+				assert.False(t, observer.changes[i].Time.IsZero())
+				observer.changes[i].Time = time.Time{}
+			}
+			assert.Equal(t, tt.expectedChanges, observer.changes)
+		})
+	}
+}
+
+func TestStorageStrategy_ImportMetricValues(t *testing.T) {
+	ctx := context.Background()
+	defaultCtx := identity.WithTenant(ctx, identity.DefaultTenant)
+	teamCtx := identity.WithTenant(ctx, "teamA")
+	backupTeamCtx := identity.WithTenant(ctx, "teamB")
+	state := map[string]map[string]map[string]string{
+		identity.DefaultTenant: {"counter": {metricName: "7"}},
+	}
+
+	tests := []struct {
+		name          string
+		replace       bool
+		state         map[string]map[string]map[string]string
+		backupError   error
+		expectedError error
+	}{
+		{
+			name:  "merge_success",
+			state: state,
+		},
+		{
+			name:          "merge_backup_error",
+			state:         state,
+			backupError:   test.ErrTest,
+			expectedError: test.ErrTest,
+		},
+		{
+			name:    "replace_success",
+			replace: true,
+			state:   state,
+		},
+		{
+			name:          "replace_backup_error",
+			replace:       true,
+			state:         state,
+			backupError:   test.ErrTest,
+			expectedError: test.ErrTest,
+		},
+		{
+			name:          "unknown_type",
+			state:         map[string]map[string]map[string]string{identity.DefaultTenant: {metricType: {metricName: "1"}}},
+			expectedError: metrics.ErrUnknownMetricType,
+		},
+		{
+			name:          "invalid_tenant",
+			replace:       true,
+			state:         map[string]map[string]map[string]string{"../etc": {}},
+			expectedError: identity.ErrInvalidTenant,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confMock := new(configMock)
+			inMemoryStorageMock := new(metricStorageMock)
+			backupStorageMock := new(metricStorageMock)
+
+			// the counter is set from 5 to 7
+			delta := []metrics.Metric{test.CreateCounterMetric(metricName, 2)}
+			result := []metrics.Metric{test.CreateCounterMetric(metricName, 7)}
+			confMock.On("SyncMode").Return(false)
+			inMemoryStorageMock.On("GetMetric", defaultCtx, "counter", metricName).Return(test.CreateCounterMetric(metricName, 5), nil)
+			inMemoryStorageMock.On("AddMetricValues", defaultCtx, delta).Return(result, nil)
+			inMemoryStorageMock.On("GetTenants", ctx).Return([]string{identity.DefaultTenant, "teamA"}, nil)
+			inMemoryStorageMock.On("Restore", mock.Anything, mock.Anything).Return(nil)
+			backupStorageMock.On("AddMetricValues", defaultCtx, result).Return(result, tt.backupError)
+			backupStorageMock.On("GetTenants", ctx).Return([]string{"teamA", "teamB"}, nil)
+			backupStorageMock.On("Restore", mock.Anything, mock.Anything).Return(tt.backupError)
+
+			strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
+			actualError := strategy.ImportMetricValues(ctx, tt.state, tt.replace)
+
+			assert.ErrorIs(t, actualError, tt.expectedError)
+			assert.Equal(t, tt.expectedError == nil, !strategy.LastBackup().IsZero())
+
+			switch {
+			case tt.state[identity.DefaultTenant]["counter"] == nil:
+				inMemoryStorageMock.AssertNotCalled(t, "AddMetricValues", mock.Anything, mock.Anything)
+				inMemoryStorageMock.AssertNotCalled(t, "Restore", mock.Anything, mock.Anything)
+			case !tt.replace:
+				backupStorageMock.AssertCalled(t, "AddMetricValues", defaultCtx, result)
+				inMemoryStorageMock.AssertNotCalled(t, "Restore", mock.Anything, mock.Anything)
+			case tt.backupError == nil:
+				// the tenant missed in the state is emptied
+				inMemoryStorageMock.AssertCalled(t, "Restore", defaultCtx, state[identity.DefaultTenant])
+				inMemoryStorageMock.AssertCalled(t, "Restore", teamCtx, map[string]map[string]string{})
+				backupStorageMock.AssertCalled(t, "Restore", teamCtx, map[string]map[string]string{})
+				// the tenant kept only in the backup is emptied too
+				backupStorageMock.AssertCalled(t, "Restore", backupTeamCtx, map[string]map[string]string{})
+				inMemoryStorageMock.AssertNotCalled(t, "AddMetricValues", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestStorageStrategy_CreateBackup_WholeState(t *testing.T) {
+	ctx := context.Background()
+	defaultCtx := identity.WithTenant(ctx, identity.DefaultTenant)
+	teamCtx := identity.WithTenant(ctx, "teamA")
+	defaultValues := map[string]map[string]string{"counter": {metricName: "5"}}
+	teamValues := map[string]map[string]string{"gauge": {metricName: "1.5"}}
+
+	confMock := new(configMock)
+	inMemoryStorageMock := new(metricStorageMock)
+	backupStorageMock := new(stateRestorerMock)
+
+	confMock.On("SyncMode").Return(false)
+	inMemoryStorageMock.On("GetTenants", ctx).Return([]string{identity.DefaultTenant, "teamA"}, nil)
+	inMemoryStorageMock.On("GetMetricValues", defaultCtx).Return(defaultValues, nil)
+	inMemoryStorageMock.On("GetMetricValues", teamCtx).Return(teamValues, nil)
+	backupStorageMock.On("RestoreState", ctx, mock.Anything).Return(nil)
+
+	strategy := NewStorageStrategy(confMock, inMemoryStorageMock, backupStorageMock, nil)
+	assert.NoError(t, strategy.CreateBackup(ctx))
+
+	// the backup is written at once rather than tenant by tenant
+	backupStorageMock.AssertNumberOfCalls(t, "RestoreState", 1)
+	backupStorageMock.AssertCalled(t, "RestoreState", ctx, map[string]map[string]map[string]string{
+		identity.DefaultTenant: defaultValues,
+		"teamA":                teamValues,
+	})
+	backupStorageMock.AssertNotCalled(t, "Restore", mock.Anything, mock.Anything)
+}
+
+func (o *changeObserverMock) ObserveChanges(changes []MetricChange) {
+	o.changes = append(o.changes, changes...)
+}
+
 func (c *configMock) SyncMode() bool {
 	args := c.Called()
 	return args.Bool(0)
@@ -629,3 +819,13 @@ func (s *metricStorageMock) Restore(ctx context.Context, metricValues map[string
 	args := s.Called(ctx, metricValues)
 	return args.Error(0)
 }
+
+func (s *metricStorageMock) GetTenants(ctx context.Context) ([]string, error) {
+	args := s.Called(ctx)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (s *stateRestorerMock) RestoreState(ctx context.Context, state map[string]map[string]map[string]string) error {
+	args := s.Called(ctx, state)
+	return args.Error(0)
+}
@@ -2,10 +2,19 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/MlDenis/prometheus_wannabe/internal/converter"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
 	"github.com/MlDenis/prometheus_wannabe/internal/logger"
 	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
 )
 
 type storageStrategyConfig interface {
@@ -16,14 +25,21 @@ type StorageStrategy struct {
 	backupStorage   MetricsStorage
 	inMemoryStorage MetricsStorage
 	syncMode        bool
+	lastBackup      atomic.Int64
+	observers       []ChangeObserver
 	lock            sync.RWMutex
+
+	backupDuration *selfmetrics.Histogram
+	backupErrors   *selfmetrics.Counter
 }
 
-func NewStorageStrategy(config storageStrategyConfig, inMemoryStorage MetricsStorage, fileStorage MetricsStorage) *StorageStrategy {
+func NewStorageStrategy(config storageStrategyConfig, inMemoryStorage MetricsStorage, fileStorage MetricsStorage, registry *selfmetrics.Registry) *StorageStrategy {
 	return &StorageStrategy{
 		backupStorage:   fileStorage,
 		inMemoryStorage: inMemoryStorage,
 		syncMode:        config.SyncMode(),
+		backupDuration:  registry.Histogram("BackupDuration", selfmetrics.DurationBuckets),
+		backupErrors:    registry.Counter("BackupErrors"),
 	}
 }
 
@@ -36,16 +52,51 @@ func (s *StorageStrategy) AddMetricValues(ctx context.Context, metric []metrics.
 		return result, logger.WrapError("add metric values to memory storage", err)
 	}
 
+	s.notifyObservers(identity.Tenant(ctx), result)
+
 	if s.syncMode {
 		_, err = s.backupStorage.AddMetricValues(ctx, result)
 		if err != nil {
+			s.backupErrors.Inc()
 			return nil, logger.WrapError("add metric values to backup storage", err)
 		}
+
+		s.lastBackup.Store(time.Now().UnixNano())
 	}
 
 	return result, nil
 }
 
+// AddObserver subscribes the observer to the memory storage changes.
+func (s *StorageStrategy) AddObserver(observer ChangeObserver) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.observers = append(s.observers, observer)
+}
+
+func (s *StorageStrategy) notifyObservers(tenant string, result []metrics.Metric) {
+	if len(s.observers) == 0 {
+		return
+	}
+
+	now := time.Now()
+	changes := make([]MetricChange, len(result))
+	for i, metric := range result {
+		changes[i] = MetricChange{
+			Tenant: tenant,
+			Type:   metric.GetType(),
+			Name:   metric.GetName(),
+			Value:  metric.GetValue(),
+			Time:   now,
+		}
+	}
+
+	for _, observer := range s.observers {
+		observer.ObserveChanges(changes)
+	}
+}
+
 func (s *StorageStrategy) GetMetricValues(ctx context.Context) (map[string]map[string]string, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
@@ -60,6 +111,66 @@ func (s *StorageStrategy) GetMetric(ctx context.Context, metricType string, metr
 	return s.inMemoryStorage.GetMetric(ctx, metricType, metricName)
 }
 
+func (s *StorageStrategy) GetTenants(ctx context.Context) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.inMemoryStorage.GetTenants(ctx)
+}
+
+// DeleteMetric removes the series from memory and from the backup, the backup may not have the series yet.
+func (s *StorageStrategy) DeleteMetric(ctx context.Context, metricType string, metricName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	memory, ok := s.inMemoryStorage.(MetricsDeleter)
+	if !ok {
+		return metrics.ErrDeleteNotSupported
+	}
+
+	err := memory.DeleteMetric(ctx, metricType, metricName)
+	if err != nil {
+		return err
+	}
+
+	backup, ok := s.backupStorage.(MetricsDeleter)
+	if !ok {
+		return nil
+	}
+
+	err = backup.DeleteMetric(ctx, metricType, metricName)
+	if err != nil && !errors.Is(err, metrics.ErrMetricNotFound) {
+		s.backupErrors.Inc()
+		return logger.WrapError("delete metric from backup storage", err)
+	}
+
+	return nil
+}
+
+func (s *StorageStrategy) GetMetricHistory(ctx context.Context, metricType string, metricName string, since time.Time) ([]Sample, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	history, ok := s.inMemoryStorage.(HistoryStorage)
+	if !ok {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	return history.GetMetricHistory(ctx, metricType, metricName, since)
+}
+
+func (s *StorageStrategy) GetHistory(ctx context.Context, since time.Time) (map[string]map[string][]Sample, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	history, ok := s.inMemoryStorage.(HistoryStorage)
+	if !ok {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	return history.GetHistory(ctx, since)
+}
+
 func (s *StorageStrategy) Restore(ctx context.Context, metricValues map[string]map[string]string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -68,21 +179,306 @@ func (s *StorageStrategy) Restore(ctx context.Context, metricValues map[string]m
 }
 
 func (s *StorageStrategy) CreateBackup(ctx context.Context) error {
-	currentState, err := s.inMemoryStorage.GetMetricValues(ctx)
+	started := time.Now()
+	err := s.createBackup(ctx)
+	s.backupDuration.Observe(time.Since(started).Seconds())
 	if err != nil {
-		return logger.WrapError("get metrics from memory storage", err)
+		s.backupErrors.Inc()
+		return err
+	}
+
+	s.lastBackup.Store(time.Now().UnixNano())
+	return nil
+}
+
+// createBackup writes the state of all tenants at once if the backup supports it, otherwise tenant by tenant.
+func (s *StorageStrategy) createBackup(ctx context.Context) error {
+	tenants, err := s.inMemoryStorage.GetTenants(ctx)
+	if err != nil {
+		return logger.WrapError("get tenants from memory storage", err)
+	}
+
+	restorer, wholeState := s.backupStorage.(StateRestorer)
+	state := map[string]map[string]map[string]string{}
+	for _, tenant := range tenants {
+		tenantCtx := identity.WithTenant(ctx, tenant)
+		currentState, err := s.inMemoryStorage.GetMetricValues(tenantCtx)
+		if err != nil {
+			return logger.WrapError("get metrics from memory storage", err)
+		}
+
+		if wholeState {
+			state[tenant] = currentState
+			continue
+		}
+
+		err = s.backupStorage.Restore(tenantCtx, currentState)
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("backup tenant %s", tenant), err)
+		}
+	}
+
+	if wholeState {
+		err = restorer.RestoreState(ctx, state)
+		if err != nil {
+			return logger.WrapError("backup state", err)
+		}
+	}
+
+	return nil
+}
+
+// LastBackup returns the time of the last successful backup, zero if there was none.
+func (s *StorageStrategy) LastBackup() time.Time {
+	lastBackup := s.lastBackup.Load()
+	if lastBackup == 0 {
+		return time.Time{}
 	}
 
-	return s.backupStorage.Restore(ctx, currentState)
+	return time.Unix(0, lastBackup)
 }
 
 func (s *StorageStrategy) RestoreFromBackup(ctx context.Context) error {
-	restoredState, err := s.backupStorage.GetMetricValues(ctx)
+	tenants, err := s.backupStorage.GetTenants(ctx)
+	if err != nil {
+		return logger.WrapError("get tenants from backup storage", err)
+	}
+
+	for _, tenant := range tenants {
+		tenantCtx := identity.WithTenant(ctx, tenant)
+		restoredState, err := s.backupStorage.GetMetricValues(tenantCtx)
+		if err != nil {
+			return logger.WrapError("get metrics from backup storage", err)
+		}
+
+		err = s.inMemoryStorage.Restore(tenantCtx, restoredState)
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("restore tenant %s", tenant), err)
+		}
+	}
+
+	return nil
+}
+
+func (s *StorageStrategy) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	snapshots, ok := s.backupStorage.(SnapshotStorage)
+	if !ok {
+		return nil, metrics.ErrSnapshotsNotSupported
+	}
+
+	return snapshots.ListSnapshots(ctx)
+}
+
+// RestoreSnapshot makes the backup snapshot the current state of the backup and of the memory,
+// the tenants missed in the snapshot are emptied.
+func (s *StorageStrategy) RestoreSnapshot(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snapshots, ok := s.backupStorage.(SnapshotStorage)
+	if !ok {
+		return metrics.ErrSnapshotsNotSupported
+	}
+
+	err := snapshots.RestoreSnapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	currentTenants, err := s.inMemoryStorage.GetTenants(ctx)
+	if err != nil {
+		return logger.WrapError("get tenants from memory storage", err)
+	}
+
+	restoredTenants, err := s.backupStorage.GetTenants(ctx)
+	if err != nil {
+		return logger.WrapError("get tenants from backup storage", err)
+	}
+
+	restored := map[string]bool{}
+	for _, tenant := range restoredTenants {
+		restored[tenant] = true
+	}
+
+	for _, tenant := range currentTenants {
+		if restored[tenant] {
+			continue
+		}
+
+		err = s.inMemoryStorage.Restore(identity.WithTenant(ctx, tenant), map[string]map[string]string{})
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("empty tenant %s", tenant), err)
+		}
+	}
+
+	err = s.RestoreFromBackup(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.lastBackup.Store(time.Now().UnixNano())
+	return nil
+}
+
+// ImportMetricValues writes the state to memory and to the backup regardless of the sync mode.
+// Merged series are added as updates, so their history is kept and the observers are notified,
+// replaced tenants are restored as a whole without notifying the observers,
+// so the stream and webhook subscribers do not see the replaced values.
+func (s *StorageStrategy) ImportMetricValues(ctx context.Context, state map[string]map[string]map[string]string, replace bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// nothing is changed on an invalid state
+	err := validateState(state)
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		err = s.replaceState(ctx, state)
+	} else {
+		err = s.mergeState(ctx, state)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.lastBackup.Store(time.Now().UnixNano())
+	return nil
+}
+
+func (s *StorageStrategy) mergeState(ctx context.Context, state map[string]map[string]map[string]string) error {
+	for _, tenant := range sortedTenants(state) {
+		tenantCtx := identity.WithTenant(ctx, tenant)
+		metricsList, err := s.importedMetrics(tenantCtx, state[tenant])
+		if err != nil {
+			return err
+		}
+
+		result, err := s.inMemoryStorage.AddMetricValues(tenantCtx, metricsList)
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("add tenant %s metric values to memory storage", tenant), err)
+		}
+
+		s.notifyObservers(tenant, result)
+
+		_, err = s.backupStorage.AddMetricValues(tenantCtx, result)
+		if err != nil {
+			s.backupErrors.Inc()
+			return logger.WrapError(fmt.Sprintf("add tenant %s metric values to backup storage", tenant), err)
+		}
+	}
+
+	return nil
+}
+
+func (s *StorageStrategy) replaceState(ctx context.Context, state map[string]map[string]map[string]string) error {
+	currentTenants, err := s.inMemoryStorage.GetTenants(ctx)
 	if err != nil {
-		return logger.WrapError("get metrics from backup storage", err)
+		return logger.WrapError("get tenants from memory storage", err)
+	}
+
+	backupTenants, err := s.backupStorage.GetTenants(ctx)
+	if err != nil {
+		return logger.WrapError("get tenants from backup storage", err)
+	}
+
+	// the backup may keep the tenants which are not restored to memory
+	tenants := sortedTenants(state)
+	known := map[string]bool{}
+	for _, tenant := range append(currentTenants, backupTenants...) {
+		if _, ok := state[tenant]; !ok && !known[tenant] {
+			known[tenant] = true
+			tenants = append(tenants, tenant)
+		}
+	}
+
+	for _, tenant := range tenants {
+		tenantCtx := identity.WithTenant(ctx, tenant)
+		values := state[tenant]
+		if values == nil {
+			values = map[string]map[string]string{}
+		}
+
+		err = s.inMemoryStorage.Restore(tenantCtx, values)
+		if err != nil {
+			return logger.WrapError(fmt.Sprintf("restore tenant %s", tenant), err)
+		}
+
+		err = s.backupStorage.Restore(tenantCtx, values)
+		if err != nil {
+			s.backupErrors.Inc()
+			return logger.WrapError(fmt.Sprintf("backup tenant %s", tenant), err)
+		}
+	}
+
+	return nil
+}
+
+// importedMetrics converts the values to updates, a counter update is the difference with the current value.
+func (s *StorageStrategy) importedMetrics(ctx context.Context, values map[string]map[string]string) ([]metrics.Metric, error) {
+	result := []metrics.Metric{}
+	for metricType, metricsByName := range values {
+		for metricName, metricValue := range metricsByName {
+			value, err := converter.ToFloat64(metricValue)
+			if err != nil {
+				return nil, logger.WrapError(fmt.Sprintf("parse metric %s value", metricName), err)
+			}
+
+			var metric metrics.Metric
+			if metricType == "counter" {
+				current, err := s.inMemoryStorage.GetMetric(ctx, metricType, metricName)
+				if err == nil {
+					value -= current.GetValue()
+				} else if !errors.Is(err, metrics.ErrMetricNotFound) {
+					return nil, logger.WrapError("get current counter value", err)
+				}
+
+				metric = types.NewCounterMetric(metricName)
+			} else {
+				metric = types.NewGaugeMetric(metricName)
+			}
+
+			metric.SetValue(value)
+			result = append(result, metric)
+		}
+	}
+
+	return result, nil
+}
+
+func validateState(state map[string]map[string]map[string]string) error {
+	for tenant, values := range state {
+		err := identity.ValidateTenant(tenant)
+		if err != nil {
+			return err
+		}
+
+		for metricType, metricsByName := range values {
+			if metricType != "gauge" && metricType != "counter" {
+				return logger.WrapError(fmt.Sprintf("import metric with type '%s'", metricType), metrics.ErrUnknownMetricType)
+			}
+
+			for metricName, metricValue := range metricsByName {
+				_, err = converter.ToFloat64(metricValue)
+				if err != nil {
+					return logger.WrapError(fmt.Sprintf("parse metric %s value", metricName), err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func sortedTenants(state map[string]map[string]map[string]string) []string {
+	result := make([]string, 0, len(state))
+	for tenant := range state {
+		result = append(result, tenant)
 	}
+	sort.Strings(result)
 
-	return s.inMemoryStorage.Restore(ctx, restoredState)
+	return result
 }
 
 func (s *StorageStrategy) Close() error {
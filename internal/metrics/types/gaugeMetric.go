@@ -19,6 +19,14 @@ func NewGaugeMetric(name string) metrics.Metric {
 	}
 }
 
+// NewGaugeMetricValue creates the gauge with the value, e.g. for the exported stats.
+func NewGaugeMetricValue(name string, value float64) metrics.Metric {
+	return &gaugeMetric{
+		name:  name,
+		value: value,
+	}
+}
+
 func (m *gaugeMetric) GetType() string {
 	return "gauge"
 }
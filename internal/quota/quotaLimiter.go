@@ -0,0 +1,338 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/limiter"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+)
+
+const (
+	ReasonBatchSize     = "batch_size"
+	ReasonTenantSeries  = "tenant_series"
+	ReasonAgentSeries   = "agent_series"
+	ReasonTenantSamples = "tenant_samples"
+	ReasonAgentSamples  = "agent_samples"
+
+	// series are released only on delete, so a client should not retry soon
+	seriesRetryAfter    = time.Minute
+	batchSizeRetryAfter = time.Second
+)
+
+type quotaLimiterConfig interface {
+	MaxSeriesPerTenant() int
+	MaxSeriesPerAgent() int
+	MaxSamplesPerTenant() int
+	MaxSamplesPerAgent() int
+	MaxBatchSize() int
+}
+
+type Series struct {
+	Type string
+	Name string
+}
+
+type ExceededError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+type Usage struct {
+	Tenant           string  `json:"tenant"`
+	Agent            string  `json:"agent,omitempty"`
+	Series           int     `json:"series"`
+	SeriesLimit      int     `json:"seriesLimit,omitempty"`
+	AcceptedSamples  int64   `json:"acceptedSamples"`
+	AvailableSamples float64 `json:"availableSamples,omitempty"`
+	SamplesPerSecond int     `json:"samplesPerSecondLimit,omitempty"`
+	RejectedRequests int64   `json:"rejectedRequests"`
+}
+
+type usage struct {
+	series   map[Series]struct{}
+	samples  *limiter.TokenBucket
+	accepted int64
+	rejected int64
+}
+
+// QuotaLimiter enforces ingestion limits per tenant and per agent, zero limits are not enforced.
+// Series are counted from the stored ones seeded at the start and the successful writes since then,
+// the concurrently admitted writes may exceed the series limits by their new series.
+type QuotaLimiter struct {
+	maxSeriesPerTenant  int
+	maxSeriesPerAgent   int
+	maxSamplesPerTenant int
+	maxSamplesPerAgent  int
+	maxBatchSize        int
+
+	tenants  map[string]*usage
+	agents   map[string]*usage
+	rejected map[string]int64
+	lock     sync.Mutex
+}
+
+func NewQuotaLimiter(config quotaLimiterConfig) *QuotaLimiter {
+	return &QuotaLimiter{
+		maxSeriesPerTenant:  config.MaxSeriesPerTenant(),
+		maxSeriesPerAgent:   config.MaxSeriesPerAgent(),
+		maxSamplesPerTenant: config.MaxSamplesPerTenant(),
+		maxSamplesPerAgent:  config.MaxSamplesPerAgent(),
+		maxBatchSize:        config.MaxBatchSize(),
+		tenants:             map[string]*usage{},
+		agents:              map[string]*usage{},
+		rejected:            map[string]int64{},
+	}
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s, retry after %v", e.Reason, e.RetryAfter)
+}
+
+// Admit checks the batch against the tenant and agent quotas and takes its samples,
+// its series are charged by Charge once the batch is written.
+// Either the whole batch is admitted or an *ExceededError is returned and nothing is accounted.
+func (q *QuotaLimiter) Admit(tenant string, agent string, batch []Series) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	tenantUsage := q.ensureUsage(q.tenants, tenant, q.maxSamplesPerTenant)
+	var agentUsage *usage
+	if agent != "" {
+		agentUsage = q.ensureUsage(q.agents, agentKey(tenant, agent), q.maxSamplesPerAgent)
+	}
+
+	err := q.check(tenantUsage, agentUsage, batch)
+	if err != nil {
+		q.rejected[err.Reason]++
+		tenantUsage.rejected++
+		if agentUsage != nil {
+			agentUsage.rejected++
+		}
+
+		return err
+	}
+
+	q.accept(tenantUsage, batch)
+	if agentUsage != nil {
+		q.accept(agentUsage, batch)
+	}
+
+	return nil
+}
+
+// Charge counts the series of the written batch against the tenant and agent quotas.
+func (q *QuotaLimiter) Charge(tenant string, agent string, batch []Series) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	addSeries(q.ensureUsage(q.tenants, tenant, q.maxSamplesPerTenant), batch)
+	if agent != "" {
+		addSeries(q.ensureUsage(q.agents, agentKey(tenant, agent), q.maxSamplesPerAgent), batch)
+	}
+}
+
+// Seed sets the tenant series to the stored ones, the agents which wrote them are unknown,
+// so the agents keep only their series which are still stored.
+func (q *QuotaLimiter) Seed(tenant string, batch []Series) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	tenantUsage := q.ensureUsage(q.tenants, tenant, q.maxSamplesPerTenant)
+	tenantUsage.series = map[Series]struct{}{}
+	addSeries(tenantUsage, batch)
+
+	for key, agentUsage := range q.agents {
+		if agentTenant, _ := splitAgentKey(key); agentTenant == tenant {
+			for series := range agentUsage.series {
+				if _, ok := tenantUsage.series[series]; !ok {
+					delete(agentUsage.series, series)
+				}
+			}
+		}
+	}
+}
+
+// Release frees the deleted series of the tenant and of all its agents.
+func (q *QuotaLimiter) Release(tenant string, series Series) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if tenantUsage, ok := q.tenants[tenant]; ok {
+		delete(tenantUsage.series, series)
+	}
+
+	for key, agentUsage := range q.agents {
+		if agentTenant, _ := splitAgentKey(key); agentTenant == tenant {
+			delete(agentUsage.series, series)
+		}
+	}
+}
+
+// Usage returns the current usage of every known tenant and agent.
+func (q *QuotaLimiter) Usage() []Usage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	result := []Usage{}
+	for tenant, tenantUsage := range q.tenants {
+		result = append(result, q.toUsage(tenant, "", tenantUsage, q.maxSeriesPerTenant, q.maxSamplesPerTenant))
+	}
+	for key, agentUsage := range q.agents {
+		tenant, agent := splitAgentKey(key)
+		result = append(result, q.toUsage(tenant, agent, agentUsage, q.maxSeriesPerAgent, q.maxSamplesPerAgent))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Tenant != result[j].Tenant {
+			return result[i].Tenant < result[j].Tenant
+		}
+		return result[i].Agent < result[j].Agent
+	})
+
+	return result
+}
+
+// Rejected returns the count of rejected requests by reason.
+func (q *QuotaLimiter) Rejected() map[string]int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	result := make(map[string]int64, len(q.rejected))
+	for reason, count := range q.rejected {
+		result[reason] = count
+	}
+
+	return result
+}
+
+// GetMetrics exports the usage as gauges, so the limiter can be used as a self-metrics provider.
+func (q *QuotaLimiter) GetMetrics() <-chan metrics.Metric {
+	usages := q.Usage()
+	rejected := q.Rejected()
+
+	result := make(chan metrics.Metric)
+	go func() {
+		defer close(result)
+		for _, item := range usages {
+			suffix := item.Tenant
+			prefix := "QuotaTenant"
+			if item.Agent != "" {
+				suffix = item.Tenant + "." + item.Agent
+				prefix = "QuotaAgent"
+			}
+
+			result <- types.NewGaugeMetricValue(prefix+"Series."+suffix, float64(item.Series))
+			result <- types.NewGaugeMetricValue(prefix+"AcceptedSamples."+suffix, float64(item.AcceptedSamples))
+			result <- types.NewGaugeMetricValue(prefix+"RejectedRequests."+suffix, float64(item.RejectedRequests))
+		}
+
+		for reason, count := range rejected {
+			result <- types.NewGaugeMetricValue("QuotaRejected."+reason, float64(count))
+		}
+	}()
+
+	return result
+}
+
+func (q *QuotaLimiter) Update(context.Context) error {
+	return nil
+}
+
+func (q *QuotaLimiter) check(tenantUsage *usage, agentUsage *usage, batch []Series) *ExceededError {
+	if q.maxBatchSize > 0 && len(batch) > q.maxBatchSize {
+		return &ExceededError{Reason: ReasonBatchSize, RetryAfter: batchSizeRetryAfter}
+	}
+
+	if q.maxSeriesPerTenant > 0 && len(tenantUsage.series)+newSeriesCount(tenantUsage, batch) > q.maxSeriesPerTenant {
+		return &ExceededError{Reason: ReasonTenantSeries, RetryAfter: seriesRetryAfter}
+	}
+
+	if agentUsage != nil && q.maxSeriesPerAgent > 0 && len(agentUsage.series)+newSeriesCount(agentUsage, batch) > q.maxSeriesPerAgent {
+		return &ExceededError{Reason: ReasonAgentSeries, RetryAfter: seriesRetryAfter}
+	}
+
+	samples := float64(len(batch))
+	if tenantUsage.samples != nil {
+		if delay := tenantUsage.samples.Delay(samples); delay > 0 {
+			return &ExceededError{Reason: ReasonTenantSamples, RetryAfter: delay}
+		}
+	}
+
+	if agentUsage != nil && agentUsage.samples != nil {
+		if delay := agentUsage.samples.Delay(samples); delay > 0 {
+			return &ExceededError{Reason: ReasonAgentSamples, RetryAfter: delay}
+		}
+	}
+
+	return nil
+}
+
+func (q *QuotaLimiter) accept(target *usage, batch []Series) {
+	target.accepted += int64(len(batch))
+	if target.samples != nil {
+		target.samples.Take(float64(len(batch)))
+	}
+}
+
+func (q *QuotaLimiter) ensureUsage(usages map[string]*usage, key string, samplesPerSecond int) *usage {
+	result, ok := usages[key]
+	if !ok {
+		result = &usage{series: map[Series]struct{}{}}
+		if samplesPerSecond > 0 {
+			result.samples = limiter.NewTokenBucket(float64(samplesPerSecond), float64(samplesPerSecond))
+		}
+		usages[key] = result
+	}
+
+	return result
+}
+
+func (q *QuotaLimiter) toUsage(tenant string, agent string, source *usage, seriesLimit int, samplesLimit int) Usage {
+	result := Usage{
+		Tenant:           tenant,
+		Agent:            agent,
+		Series:           len(source.series),
+		SeriesLimit:      seriesLimit,
+		AcceptedSamples:  source.accepted,
+		SamplesPerSecond: samplesLimit,
+		RejectedRequests: source.rejected,
+	}
+
+	if source.samples != nil {
+		result.AvailableSamples = source.samples.Tokens()
+	}
+
+	return result
+}
+
+func newSeriesCount(target *usage, batch []Series) int {
+	unique := map[Series]struct{}{}
+	for _, series := range batch {
+		if _, ok := target.series[series]; !ok {
+			unique[series] = struct{}{}
+		}
+	}
+
+	return len(unique)
+}
+
+func addSeries(target *usage, batch []Series) {
+	for _, series := range batch {
+		target.series[series] = struct{}{}
+	}
+}
+
+func agentKey(tenant string, agent string) string {
+	return tenant + "\x00" + agent
+}
+
+func splitAgentKey(key string) (string, string) {
+	tenant, agent, _ := strings.Cut(key, "\x00")
+	return tenant, agent
+}
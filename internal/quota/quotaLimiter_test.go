@@ -0,0 +1,188 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testConf struct {
+	maxSeriesPerTenant  int
+	maxSeriesPerAgent   int
+	maxSamplesPerTenant int
+	maxSamplesPerAgent  int
+	maxBatchSize        int
+}
+
+func TestQuotaLimiter_Admit(t *testing.T) {
+	series := func(names ...string) []Series {
+		result := make([]Series, len(names))
+		for i, name := range names {
+			result[i] = Series{Type: "gauge", Name: name}
+		}
+		return result
+	}
+
+	tests := []struct {
+		name           string
+		conf           testConf
+		admitted       []Series
+		batch          []Series
+		agent          string
+		expectedReason string
+	}{
+		{
+			name:  "unlimited",
+			conf:  testConf{},
+			batch: series("a", "b", "c"),
+		},
+		{
+			name:           "batch_size",
+			conf:           testConf{maxBatchSize: 2},
+			batch:          series("a", "b", "c"),
+			expectedReason: ReasonBatchSize,
+		},
+		{
+			name:     "tenant_series_known",
+			conf:     testConf{maxSeriesPerTenant: 2},
+			admitted: series("a", "b"),
+			batch:    series("a", "b", "a"),
+		},
+		{
+			name:           "tenant_series_new",
+			conf:           testConf{maxSeriesPerTenant: 2},
+			admitted:       series("a", "b"),
+			batch:          series("c"),
+			expectedReason: ReasonTenantSeries,
+		},
+		{
+			name:           "agent_series_new",
+			conf:           testConf{maxSeriesPerAgent: 2},
+			admitted:       series("a", "b"),
+			batch:          series("c"),
+			agent:          "agent",
+			expectedReason: ReasonAgentSeries,
+		},
+		{
+			name:     "agent_series_other_agent",
+			conf:     testConf{maxSeriesPerAgent: 2},
+			admitted: series("a", "b"),
+			batch:    series("c"),
+			agent:    "other",
+		},
+		{
+			name:           "tenant_samples",
+			conf:           testConf{maxSamplesPerTenant: 3},
+			admitted:       series("a", "b", "c"),
+			batch:          series("a"),
+			expectedReason: ReasonTenantSamples,
+		},
+		{
+			name:           "agent_samples",
+			conf:           testConf{maxSamplesPerAgent: 3},
+			admitted:       series("a", "b", "c"),
+			batch:          series("a"),
+			agent:          "agent",
+			expectedReason: ReasonAgentSamples,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewQuotaLimiter(&tt.conf)
+			if tt.admitted != nil {
+				require.NoError(t, limiter.Admit("tenant", "agent", tt.admitted))
+				limiter.Charge("tenant", "agent", tt.admitted)
+			}
+
+			err := limiter.Admit("tenant", tt.agent, tt.batch)
+			if tt.expectedReason == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var exceeded *ExceededError
+			require.True(t, errors.As(err, &exceeded))
+			assert.Equal(t, tt.expectedReason, exceeded.Reason)
+			assert.Greater(t, exceeded.RetryAfter.Nanoseconds(), int64(0))
+			assert.Equal(t, map[string]int64{tt.expectedReason: 1}, limiter.Rejected())
+		})
+	}
+}
+
+func TestQuotaLimiter_RejectedNotAccounted(t *testing.T) {
+	limiter := NewQuotaLimiter(&testConf{maxSeriesPerTenant: 2})
+
+	require.NoError(t, limiter.Admit("tenant", "agent", []Series{{Type: "gauge", Name: "a"}}))
+	limiter.Charge("tenant", "agent", []Series{{Type: "gauge", Name: "a"}})
+	assert.Error(t, limiter.Admit("tenant", "agent", []Series{{Type: "gauge", Name: "b"}, {Type: "gauge", Name: "c"}}))
+	assert.NoError(t, limiter.Admit("tenant", "agent", []Series{{Type: "gauge", Name: "b"}}))
+	limiter.Charge("tenant", "agent", []Series{{Type: "gauge", Name: "b"}})
+
+	assert.Equal(t, []Usage{
+		{Tenant: "tenant", Series: 2, SeriesLimit: 2, AcceptedSamples: 2, RejectedRequests: 1},
+		{Tenant: "tenant", Agent: "agent", Series: 2, AcceptedSamples: 2, RejectedRequests: 1},
+	}, limiter.Usage())
+
+	metricsCount := 0
+	for range limiter.GetMetrics() {
+		metricsCount++
+	}
+	assert.Equal(t, 7, metricsCount)
+}
+
+func TestQuotaLimiter_Charge(t *testing.T) {
+	limiter := NewQuotaLimiter(&testConf{maxSeriesPerTenant: 2, maxSeriesPerAgent: 1})
+	first := []Series{{Type: "gauge", Name: "a"}}
+	second := []Series{{Type: "gauge", Name: "b"}}
+
+	// the admitted series are not charged until the batch is written
+	require.NoError(t, limiter.Admit("tenant", "agent", first))
+	require.NoError(t, limiter.Admit("tenant", "agent", second))
+	limiter.Charge("tenant", "agent", first)
+	assert.Error(t, limiter.Admit("tenant", "agent", second))
+
+	// the stored series count only against the tenant
+	limiter.Seed("tenant", append(first, second...))
+	assert.Error(t, limiter.Admit("tenant", "other", []Series{{Type: "gauge", Name: "c"}}))
+
+	limiter.Release("tenant", first[0])
+	limiter.Release("tenant", Series{Type: "gauge", Name: "unknown"})
+	assert.NoError(t, limiter.Admit("tenant", "agent", []Series{{Type: "gauge", Name: "c"}}))
+
+	usages := limiter.Usage()
+	require.Len(t, usages, 3)
+	assert.Equal(t, 1, usages[0].Series)
+	assert.Equal(t, 0, usages[1].Series)
+
+	// the series which are not stored anymore are dropped
+	limiter.Charge("tenant", "agent", first)
+	limiter.Seed("tenant", nil)
+	for _, usage := range limiter.Usage() {
+		if usage.Tenant == "tenant" {
+			assert.Equal(t, 0, usage.Series)
+		}
+	}
+}
+
+func (c *testConf) MaxSeriesPerTenant() int {
+	return c.maxSeriesPerTenant
+}
+
+func (c *testConf) MaxSeriesPerAgent() int {
+	return c.maxSeriesPerAgent
+}
+
+func (c *testConf) MaxSamplesPerTenant() int {
+	return c.maxSamplesPerTenant
+}
+
+func (c *testConf) MaxSamplesPerAgent() int {
+	return c.maxSamplesPerAgent
+}
+
+func (c *testConf) MaxBatchSize() int {
+	return c.maxBatchSize
+}
@@ -0,0 +1,256 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+const (
+	batchFileSuffix   = ".batch"
+	corruptFileSuffix = ".corrupt"
+	queueFileMode     = 0o644
+	queueDirMode      = 0o755
+)
+
+// Record is a received metric, the counter value is the received delta.
+type Record struct {
+	Tenant string  `json:"tenant"`
+	Type   string  `json:"type"`
+	Name   string  `json:"name"`
+	Value  float64 `json:"value"`
+}
+
+// Batch is a queued file of records.
+type Batch struct {
+	sequence uint64
+	Records  []Record
+}
+
+// DiskQueue keeps batches as files named by a sequence number, so the queue survives restarts.
+type DiskQueue struct {
+	dir          string
+	maxBatches   int
+	nextSequence uint64
+	sequences    []uint64
+	lock         sync.Mutex
+}
+
+// NewDiskQueue opens the queue in the directory, a non-positive maxBatches means unlimited.
+func NewDiskQueue(dir string, maxBatches int) (*DiskQueue, error) {
+	err := os.MkdirAll(dir, queueDirMode)
+	if err != nil {
+		return nil, logger.WrapError("create queue dir", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, logger.WrapError("read queue dir", err)
+	}
+
+	queue := &DiskQueue{dir: dir, maxBatches: maxBatches, nextSequence: 1}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, batchFileSuffix) {
+			continue
+		}
+
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, batchFileSuffix), 10, 64)
+		if err != nil {
+			logger.SugarLogger.Errorf("Skip unexpected relay queue file %v", name)
+			continue
+		}
+
+		queue.sequences = append(queue.sequences, sequence)
+		if sequence >= queue.nextSequence {
+			queue.nextSequence = sequence + 1
+		}
+	}
+
+	sort.Slice(queue.sequences, func(i, j int) bool { return queue.sequences[i] < queue.sequences[j] })
+	return queue, nil
+}
+
+func (q *DiskQueue) Append(records []Record) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.maxBatches > 0 && len(q.sequences) >= q.maxBatches {
+		return ErrQueueFull
+	}
+
+	sequence := q.nextSequence
+	err := q.write(sequence, records)
+	if err != nil {
+		return err
+	}
+
+	q.nextSequence++
+	q.sequences = append(q.sequences, sequence)
+	return nil
+}
+
+// Peek returns the oldest batches holding up to maxRecords records, at least one batch is returned from a non-empty queue.
+func (q *DiskQueue) Peek(maxRecords int) ([]*Batch, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	result := []*Batch{}
+	count := 0
+	for _, sequence := range q.sequences {
+		records, err := q.read(sequence)
+		if err != nil {
+			// an unreadable batch would stop the queue, so it is moved aside for the manual recovery
+			logger.SugarLogger.Errorf("Move aside unreadable relay queue batch %v: %v", sequence, err)
+			err = os.Rename(q.path(sequence), q.path(sequence)+corruptFileSuffix)
+			if err != nil {
+				return nil, logger.WrapError("move aside queue batch", err)
+			}
+
+			q.sequences = q.withoutSequence(sequence)
+			return result, nil
+		}
+
+		if len(result) > 0 && count+len(records) > maxRecords {
+			break
+		}
+
+		result = append(result, &Batch{sequence: sequence, Records: records})
+		count += len(records)
+	}
+
+	return result, nil
+}
+
+// Remove deletes the delivered batches.
+func (q *DiskQueue) Remove(batches []*Batch) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.remove(batches)
+}
+
+// Replace keeps the undelivered records of the batches in place of the first batch and removes the others.
+func (q *DiskQueue) Replace(batches []*Batch, records []Record) error {
+	if len(batches) == 0 {
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(records) == 0 {
+		return q.remove(batches)
+	}
+
+	err := q.write(batches[0].sequence, records)
+	if err != nil {
+		return err
+	}
+
+	return q.remove(batches[1:])
+}
+
+// Len returns the count of queued batches.
+func (q *DiskQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.sequences)
+}
+
+func (q *DiskQueue) remove(batches []*Batch) error {
+	removed := map[uint64]bool{}
+	for _, batch := range batches {
+		err := os.Remove(q.path(batch.sequence))
+		if err != nil && !os.IsNotExist(err) {
+			return logger.WrapError("remove queue batch", err)
+		}
+		removed[batch.sequence] = true
+	}
+
+	sequences := []uint64{}
+	for _, sequence := range q.sequences {
+		if !removed[sequence] {
+			sequences = append(sequences, sequence)
+		}
+	}
+	q.sequences = sequences
+
+	return nil
+}
+
+func (q *DiskQueue) withoutSequence(removed uint64) []uint64 {
+	sequences := []uint64{}
+	for _, sequence := range q.sequences {
+		if sequence != removed {
+			sequences = append(sequences, sequence)
+		}
+	}
+
+	return sequences
+}
+
+// write replaces the batch file at once, so a crash never leaves a partially written batch.
+func (q *DiskQueue) write(sequence uint64, records []Record) error {
+	content, err := json.Marshal(records)
+	if err != nil {
+		return logger.WrapError("encode queue batch", err)
+	}
+
+	tempFile, err := os.CreateTemp(q.dir, "batch-*.tmp")
+	if err != nil {
+		return logger.WrapError("create queue temp file", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(content)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return logger.WrapError("write queue temp file", err)
+	}
+
+	err = os.Chmod(tempFile.Name(), queueFileMode)
+	if err != nil {
+		return logger.WrapError("chmod queue temp file", err)
+	}
+
+	err = os.Rename(tempFile.Name(), q.path(sequence))
+	if err != nil {
+		return logger.WrapError("rename queue batch", err)
+	}
+
+	return nil
+}
+
+func (q *DiskQueue) read(sequence uint64) ([]Record, error) {
+	content, err := os.ReadFile(q.path(sequence))
+	if err != nil {
+		return nil, logger.WrapError("read queue batch", err)
+	}
+
+	records := []Record{}
+	err = json.Unmarshal(content, &records)
+	if err != nil {
+		return nil, logger.WrapError(fmt.Sprintf("decode queue batch %d", sequence), err)
+	}
+
+	return records, nil
+}
+
+func (q *DiskQueue) path(sequence uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", sequence, batchFileSuffix))
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := NewDiskQueue(dir, 3)
+	require.NoError(t, err)
+
+	first := []Record{{Type: "counter", Name: "PollCount", Value: 1}, {Type: "gauge", Name: "Alloc", Value: 2}}
+	second := []Record{{Tenant: "team-a", Type: "counter", Name: "PollCount", Value: 3}}
+	third := []Record{{Type: "gauge", Name: "Alloc", Value: 4}}
+	require.NoError(t, queue.Append(first))
+	require.NoError(t, queue.Append(second))
+	require.NoError(t, queue.Append(third))
+	assert.ErrorIs(t, queue.Append(third), ErrQueueFull)
+
+	batches, err := queue.Peek(3)
+	require.NoError(t, err)
+	require.Len(t, batches, 2)
+	assert.Equal(t, first, batches[0].Records)
+	assert.Equal(t, second, batches[1].Records)
+
+	// the first batch is returned even if it is larger than the limit
+	batches, err = queue.Peek(1)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+
+	// the queue survives the restart
+	queue, err = NewDiskQueue(dir, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, queue.Len())
+
+	batches, err = queue.Peek(10)
+	require.NoError(t, err)
+	require.Len(t, batches, 3)
+
+	remaining := []Record{{Type: "counter", Name: "PollCount", Value: 1}}
+	require.NoError(t, queue.Replace(batches[:2], remaining))
+	assert.Equal(t, 2, queue.Len())
+
+	batches, err = queue.Peek(10)
+	require.NoError(t, err)
+	require.Len(t, batches, 2)
+	assert.Equal(t, remaining, batches[0].Records)
+	assert.Equal(t, third, batches[1].Records)
+
+	require.NoError(t, queue.Remove(batches))
+	assert.Equal(t, 0, queue.Len())
+
+	// sequence numbers keep growing after the queue is drained
+	require.NoError(t, queue.Append(first))
+	queue, err = NewDiskQueue(dir, 3)
+	require.NoError(t, err)
+	batches, err = queue.Peek(10)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	assert.Equal(t, uint64(4), batches[0].sequence)
+}
+
+func TestDiskQueue_CorruptBatch(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := NewDiskQueue(dir, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Append([]Record{{Type: "gauge", Name: "Alloc", Value: 1}}))
+	require.NoError(t, queue.Append([]Record{{Type: "gauge", Name: "Alloc", Value: 2}}))
+	require.NoError(t, os.WriteFile(queue.path(1), []byte("{broken"), queueFileMode))
+
+	batches, err := queue.Peek(10)
+	require.NoError(t, err)
+	assert.Empty(t, batches)
+	assert.FileExists(t, filepath.Join(dir, "00000000000000000001.batch.corrupt"))
+
+	batches, err = queue.Peek(10)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	assert.Equal(t, float64(2), batches[0].Records[0].Value)
+}
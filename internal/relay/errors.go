@@ -0,0 +1,8 @@
+package relay
+
+import "errors"
+
+var (
+	ErrQueueFull          = errors.New("relay queue is full")
+	ErrLocalWriteDisabled = errors.New("relay does not keep metrics locally")
+)
@@ -0,0 +1,307 @@
+package relay
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/sendler"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/sendler/http"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+const (
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = time.Minute
+	pollInterval      = 5 * time.Second
+	pushParallelLimit = 4
+)
+
+type forwarderConfig interface {
+	RelayUpstreamURL() string
+	RelayAPIToken() string
+	RelayPushTimeout() time.Duration
+	RelayTLSCAFile() string
+	RelayTLSCertFile() string
+	RelayTLSKeyFile() string
+	RelayBatchSize() int
+}
+
+// pusherConfig adapts the relay configuration to the agent pusher one for a tenant.
+type pusherConfig struct {
+	config forwarderConfig
+	tenant string
+}
+
+type seriesKey struct {
+	metricType string
+	name       string
+}
+
+// Forwarder pushes the queued metrics upstream with the agent protocol and retries until they are delivered.
+type Forwarder struct {
+	config     forwarderConfig
+	queue      *DiskQueue
+	converter  *model.MetricsConverter
+	pushers    map[string]sendler.MetricsPusher
+	notify     chan struct{}
+	retryDelay time.Duration
+
+	forwarded   *selfmetrics.Counter
+	failures    *selfmetrics.Counter
+	queueLength *selfmetrics.Gauge
+}
+
+func NewForwarder(config forwarderConfig, queue *DiskQueue, converter *model.MetricsConverter, registry *selfmetrics.Registry) (*Forwarder, error) {
+	forwarder := &Forwarder{
+		config:      config,
+		queue:       queue,
+		converter:   converter,
+		pushers:     map[string]sendler.MetricsPusher{},
+		notify:      make(chan struct{}, 1),
+		retryDelay:  defaultRetryDelay,
+		forwarded:   registry.Counter("RelayForwardedMetrics"),
+		failures:    registry.Counter("RelayForwardFailures"),
+		queueLength: registry.Gauge("RelayQueueBatches"),
+	}
+
+	// validates the upstream configuration on start
+	_, err := forwarder.pusher(identity.DefaultTenant)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarder.queueLength.Set(float64(queue.Len()))
+	return forwarder, nil
+}
+
+// Notify wakes the forwarder up after new metrics are queued.
+func (f *Forwarder) Notify() {
+	if f == nil {
+		return
+	}
+
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run forwards the queue until ctx is done, the delay between failed attempts grows up to a minute.
+func (f *Forwarder) Run(ctx context.Context) {
+	delay := f.retryDelay
+	for {
+		wait := pollInterval
+		empty, err := f.Forward(ctx)
+		switch {
+		case err != nil:
+			logger.SugarLogger.Errorf("Failed to forward metrics upstream, retry in %v: %v", delay, err)
+			wait = delay
+			delay = min(delay*2, maxRetryDelay)
+		case !empty:
+			delay = f.retryDelay
+			continue
+		default:
+			delay = f.retryDelay
+		}
+
+		if !f.wait(ctx, wait, err == nil) {
+			return
+		}
+	}
+}
+
+// wait sleeps the delay, new metrics interrupt the sleep unless the upstream is failing. It returns false when ctx is done.
+func (f *Forwarder) wait(ctx context.Context, delay time.Duration, wakeOnNotify bool) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case <-f.notify:
+			if wakeOnNotify {
+				return true
+			}
+		}
+	}
+}
+
+// Forward pushes the oldest batches and reports whether the queue was empty.
+// The undelivered metrics are kept at the head of the queue.
+func (f *Forwarder) Forward(ctx context.Context) (bool, error) {
+	batches, err := f.queue.Peek(f.config.RelayBatchSize())
+	if err != nil {
+		return false, logger.WrapError("peek relay queue", err)
+	}
+	if len(batches) == 0 {
+		return true, nil
+	}
+
+	metricsByTenant := coalesce(batches)
+	tenants := make([]string, 0, len(metricsByTenant))
+	for tenant := range metricsByTenant {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+
+	var pushErr error
+	for _, tenant := range tenants {
+		if pushErr == nil {
+			pushErr = f.push(ctx, tenant, metricsByTenant[tenant])
+		}
+	}
+
+	if pushErr == nil {
+		f.forwarded.Add(int64(countRecords(batches)))
+		err = f.queue.Remove(batches)
+		f.queueLength.Set(float64(f.queue.Len()))
+		if err != nil {
+			return false, logger.WrapError("remove forwarded batches", err)
+		}
+
+		return false, nil
+	}
+
+	f.failures.Inc()
+	err = f.queue.Replace(batches, undelivered(tenants, metricsByTenant))
+	f.queueLength.Set(float64(f.queue.Len()))
+	if err != nil {
+		logger.SugarLogger.Errorf("Failed to keep undelivered metrics: %v", err)
+	}
+
+	return false, logger.WrapError("forward metrics", pushErr)
+}
+
+func (f *Forwarder) push(ctx context.Context, tenant string, metricsList []metrics.Metric) error {
+	pusher, err := f.pusher(tenant)
+	if err != nil {
+		return err
+	}
+
+	metricsChan := make(chan metrics.Metric, len(metricsList))
+	for _, metric := range metricsList {
+		metricsChan <- metric
+	}
+	close(metricsChan)
+
+	return pusher.Push(ctx, metricsChan)
+}
+
+func (f *Forwarder) pusher(tenant string) (sendler.MetricsPusher, error) {
+	pusher, ok := f.pushers[tenant]
+	if ok {
+		return pusher, nil
+	}
+
+	upstreamTenant := tenant
+	if tenant == identity.DefaultTenant {
+		upstreamTenant = ""
+	}
+
+	pusher, err := http.NewMetricsPusher(&pusherConfig{config: f.config, tenant: upstreamTenant}, f.converter, nil)
+	if err != nil {
+		return nil, logger.WrapError("create upstream pusher", err)
+	}
+
+	f.pushers[tenant] = pusher
+	return pusher, nil
+}
+
+// coalesce merges the batches per tenant: counter deltas are summed and the last gauge value wins.
+func coalesce(batches []*Batch) map[string][]metrics.Metric {
+	result := map[string][]metrics.Metric{}
+	index := map[string]map[seriesKey]metrics.Metric{}
+	for _, batch := range batches {
+		for _, record := range batch.Records {
+			tenantIndex, ok := index[record.Tenant]
+			if !ok {
+				tenantIndex = map[seriesKey]metrics.Metric{}
+				index[record.Tenant] = tenantIndex
+			}
+
+			key := seriesKey{metricType: record.Type, name: record.Name}
+			metric, ok := tenantIndex[key]
+			if !ok {
+				metricFactory := types.NewGaugeMetric
+				if record.Type == "counter" {
+					metricFactory = types.NewCounterMetric
+				}
+
+				metric = metricFactory(record.Name)
+				tenantIndex[key] = metric
+				result[record.Tenant] = append(result[record.Tenant], metric)
+			}
+
+			metric.SetValue(record.Value)
+		}
+	}
+
+	return result
+}
+
+// undelivered returns the records to retry, the pusher resets delivered counters to zero.
+// A gauge is sent again since its delivery is not known and repeated gauge updates are harmless.
+func undelivered(tenants []string, metricsByTenant map[string][]metrics.Metric) []Record {
+	result := []Record{}
+	for _, tenant := range tenants {
+		for _, metric := range metricsByTenant[tenant] {
+			if metric.GetType() == "counter" && metric.GetValue() == 0 {
+				continue
+			}
+
+			result = append(result, Record{Tenant: tenant, Type: metric.GetType(), Name: metric.GetName(), Value: metric.GetValue()})
+		}
+	}
+
+	return result
+}
+
+func countRecords(batches []*Batch) int {
+	count := 0
+	for _, batch := range batches {
+		count += len(batch.Records)
+	}
+
+	return count
+}
+
+func (c *pusherConfig) TLSCAFile() string {
+	return c.config.RelayTLSCAFile()
+}
+
+func (c *pusherConfig) TLSCertFile() string {
+	return c.config.RelayTLSCertFile()
+}
+
+func (c *pusherConfig) TLSKeyFile() string {
+	return c.config.RelayTLSKeyFile()
+}
+
+func (c *pusherConfig) ParallelLimit() int {
+	return pushParallelLimit
+}
+
+func (c *pusherConfig) MetricsServerURL() string {
+	return c.config.RelayUpstreamURL()
+}
+
+func (c *pusherConfig) PushMetricsTimeout() time.Duration {
+	return c.config.RelayPushTimeout()
+}
+
+func (c *pusherConfig) APIToken() string {
+	return c.config.RelayAPIToken()
+}
+
+func (c *pusherConfig) Tenant() string {
+	return c.tenant
+}
@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/hash"
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/model"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type forwarderConf struct {
+	upstreamURL string
+	batchSize   int
+}
+
+type converterConf struct{}
+
+// upstream sums the received counters and keeps the last gauges per tenant like a real server.
+type upstream struct {
+	server  *httptest.Server
+	failing bool
+	values  map[string]map[string]float64
+	lock    sync.Mutex
+}
+
+func TestForwarder_Forward(t *testing.T) {
+	ctx := context.Background()
+	upstream := newUpstream(t)
+	queue, err := NewDiskQueue(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	forwarder, err := NewForwarder(&forwarderConf{upstreamURL: upstream.server.URL, batchSize: 100}, queue, createConverter(), nil)
+	require.NoError(t, err)
+
+	relayStorage := NewRelayStorage(queue, nil, forwarder)
+	add := func(tenant string, metricsList ...metrics.Metric) {
+		_, err := relayStorage.AddMetricValues(identity.WithTenant(ctx, tenant), metricsList)
+		require.NoError(t, err)
+	}
+
+	add(identity.DefaultTenant, test.CreateCounterMetric("PollCount", 2), test.CreateGaugeMetric("Alloc", 1))
+	add("team-a", test.CreateCounterMetric("PollCount", 5))
+
+	// the upstream outage does not lose metrics
+	upstream.setFailing(true)
+	empty, err := forwarder.Forward(ctx)
+	assert.False(t, empty)
+	assert.Error(t, err)
+	add(identity.DefaultTenant, test.CreateCounterMetric("PollCount", 3), test.CreateGaugeMetric("Alloc", 4))
+	assert.Equal(t, 2, queue.Len())
+
+	upstream.setFailing(false)
+	empty, err = forwarder.Forward(ctx)
+	assert.False(t, empty)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, queue.Len())
+
+	empty, err = forwarder.Forward(ctx)
+	assert.True(t, empty)
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]map[string]float64{
+		"":       {"counter:PollCount": 5, "gauge:Alloc": 4},
+		"team-a": {"counter:PollCount": 5},
+	}, upstream.snapshot())
+
+	values, err := relayStorage.GetMetricValues(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, values)
+}
+
+func TestForwarder_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := newUpstream(t)
+	queue, err := NewDiskQueue(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	forwarder, err := NewForwarder(&forwarderConf{upstreamURL: upstream.server.URL, batchSize: 1}, queue, createConverter(), nil)
+	require.NoError(t, err)
+	forwarder.retryDelay = time.Millisecond
+
+	localStorage := memory.NewInMemoryStorage()
+	relayStorage := NewRelayStorage(queue, localStorage, forwarder)
+
+	upstream.setFailing(true)
+	go forwarder.Run(ctx)
+
+	for i := 0; i < 3; i++ {
+		_, err = relayStorage.AddMetricValues(ctx, []metrics.Metric{test.CreateCounterMetric("PollCount", 1)})
+		require.NoError(t, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	upstream.setFailing(false)
+
+	assert.Eventually(t, func() bool {
+		return queue.Len() == 0 && upstream.snapshot()[""]["counter:PollCount"] == 3
+	}, 5*time.Second, time.Millisecond)
+
+	local, err := localStorage.GetMetric(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, float64(3), local.GetValue())
+}
+
+func newUpstream(t *testing.T) *upstream {
+	result := &upstream{values: map[string]map[string]float64{}}
+	result.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result.lock.Lock()
+		defer result.lock.Unlock()
+
+		if result.failing || r.URL.Path != "/updates" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		modelMetrics := []*model.Metrics{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&modelMetrics))
+
+		tenant := r.Header.Get(identity.TenantHeader)
+		tenantValues, ok := result.values[tenant]
+		if !ok {
+			tenantValues = map[string]float64{}
+			result.values[tenant] = tenantValues
+		}
+
+		for _, modelMetric := range modelMetrics {
+			if modelMetric.Delta != nil {
+				tenantValues["counter:"+modelMetric.ID] += float64(*modelMetric.Delta)
+			} else {
+				tenantValues["gauge:"+modelMetric.ID] = *modelMetric.Value
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(result.server.Close)
+
+	return result
+}
+
+func (u *upstream) setFailing(failing bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.failing = failing
+}
+
+func (u *upstream) snapshot() map[string]map[string]float64 {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	result := map[string]map[string]float64{}
+	for tenant, values := range u.values {
+		result[tenant] = map[string]float64{}
+		for key, value := range values {
+			result[tenant][key] = value
+		}
+	}
+
+	return result
+}
+
+func createConverter() *model.MetricsConverter {
+	conf := &converterConf{}
+	return model.NewMetricsConverter(conf, hash.NewSigner(conf))
+}
+
+func (c *forwarderConf) RelayUpstreamURL() string {
+	return c.upstreamURL
+}
+
+func (c *forwarderConf) RelayAPIToken() string {
+	return ""
+}
+
+func (c *forwarderConf) RelayPushTimeout() time.Duration {
+	return time.Second
+}
+
+func (c *forwarderConf) RelayTLSCAFile() string {
+	return ""
+}
+
+func (c *forwarderConf) RelayTLSCertFile() string {
+	return ""
+}
+
+func (c *forwarderConf) RelayTLSKeyFile() string {
+	return ""
+}
+
+func (c *forwarderConf) RelayBatchSize() int {
+	return c.batchSize
+}
+
+func (c *converterConf) SignMetrics() bool {
+	return false
+}
+
+func (c *converterConf) GetKey() []byte {
+	return nil
+}
@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+)
+
+type relayStorage struct {
+	queue     *DiskQueue
+	local     storage.MetricsStorage
+	forwarder *Forwarder
+}
+
+// NewRelayStorage queues the received metrics for forwarding and writes them to the local storage if it is not nil.
+func NewRelayStorage(queue *DiskQueue, local storage.MetricsStorage, forwarder *Forwarder) storage.MetricsStorage {
+	return &relayStorage{queue: queue, local: local, forwarder: forwarder}
+}
+
+func (r *relayStorage) AddMetricValues(ctx context.Context, metricsList []metrics.Metric) ([]metrics.Metric, error) {
+	// the local storage may keep the metric objects and change their values, so the records are taken before
+	tenant := identity.Tenant(ctx)
+	records := make([]Record, len(metricsList))
+	for i, metric := range metricsList {
+		records[i] = Record{Tenant: tenant, Type: metric.GetType(), Name: metric.GetName(), Value: metric.GetValue()}
+	}
+
+	err := r.queue.Append(records)
+	if err != nil {
+		return nil, logger.WrapError("queue metrics", err)
+	}
+	r.forwarder.Notify()
+
+	if r.local == nil {
+		return metricsList, nil
+	}
+
+	return r.local.AddMetricValues(ctx, metricsList)
+}
+
+func (r *relayStorage) GetMetricValues(ctx context.Context) (map[string]map[string]string, error) {
+	if r.local == nil {
+		return map[string]map[string]string{}, nil
+	}
+
+	return r.local.GetMetricValues(ctx)
+}
+
+func (r *relayStorage) GetMetric(ctx context.Context, metricType string, metricName string) (metrics.Metric, error) {
+	if r.local == nil {
+		return nil, logger.WrapError(fmt.Sprintf("get metric with name '%s' and type '%s'", metricName, metricType), metrics.ErrMetricNotFound)
+	}
+
+	return r.local.GetMetric(ctx, metricType, metricName)
+}
+
+func (r *relayStorage) GetTenants(ctx context.Context) ([]string, error) {
+	if r.local == nil {
+		return []string{}, nil
+	}
+
+	return r.local.GetTenants(ctx)
+}
+
+func (r *relayStorage) Restore(ctx context.Context, metricValues map[string]map[string]string) error {
+	if r.local == nil {
+		return logger.WrapError("restore relay storage", ErrLocalWriteDisabled)
+	}
+
+	return r.local.Restore(ctx, metricValues)
+}
+
+func (r *relayStorage) GetMetricHistory(ctx context.Context, metricType string, metricName string, since time.Time) ([]storage.Sample, error) {
+	history, ok := r.local.(storage.HistoryStorage)
+	if !ok {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	return history.GetMetricHistory(ctx, metricType, metricName, since)
+}
+
+func (r *relayStorage) GetHistory(ctx context.Context, since time.Time) (map[string]map[string][]storage.Sample, error) {
+	history, ok := r.local.(storage.HistoryStorage)
+	if !ok {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	return history.GetHistory(ctx, since)
+}
@@ -0,0 +1,12 @@
+package replication
+
+import "errors"
+
+var (
+	ErrInvalidNodeID        = errors.New("invalid replication node id")
+	ErrInvalidPeer          = errors.New("invalid replication peer")
+	ErrMissedDir            = errors.New("replication directory is missed")
+	ErrOwnMutations         = errors.New("mutations originated on this node")
+	ErrUnknownOperation     = errors.New("unknown replication operation")
+	ErrUnexpectedStatusCode = errors.New("unexpected status code")
+)
@@ -0,0 +1,285 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+const (
+	OpCounterAdd = "counter_add"
+	OpGaugeSet   = "gauge_set"
+	OpDelete     = "delete"
+
+	logFileName   = "replication.log"
+	epochFileName = "epoch"
+)
+
+// Mutation is a change applied by a node, Seq is assigned by the node log the mutation originated in.
+type Mutation struct {
+	Seq    uint64  `json:"seq"`
+	Tenant string  `json:"tenant"`
+	Op     string  `json:"op"`
+	Type   string  `json:"type"`
+	Name   string  `json:"name"`
+	Value  float64 `json:"value,omitempty"`
+}
+
+// Log keeps the last mutations of the node in a JSON lines file, so peers can catch up after an outage.
+// The file is compacted to the retained mutations once it holds twice as many.
+// The epoch is created with the log, so peers notice the sequence numbers restarted when the log directory is lost.
+type Log struct {
+	path        string
+	epoch       string
+	retention   int
+	entries     []Mutation
+	lastSeq     uint64
+	fileEntries int
+	file        *os.File
+	lock        sync.Mutex
+}
+
+func OpenLog(dir string, retention int) (*Log, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, logger.WrapError("create replication directory", err)
+	}
+
+	log := &Log{path: filepath.Join(dir, logFileName), retention: max(retention, 1)}
+	err = log.load()
+	if err != nil {
+		return nil, err
+	}
+
+	log.epoch, err = loadEpoch(filepath.Join(dir, epochFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	// rewriting drops a line left incomplete by a crash
+	err = log.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	return log, nil
+}
+
+// Append assigns the sequence numbers to the mutations and writes them to the log.
+func (l *Log) Append(mutations []Mutation) error {
+	if len(mutations) == 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return logger.WrapError("append mutations", os.ErrClosed)
+	}
+
+	content := []byte{}
+	seq := l.lastSeq
+	for i := range mutations {
+		seq++
+		mutations[i].Seq = seq
+		line, err := json.Marshal(&mutations[i])
+		if err != nil {
+			return logger.WrapError("marshal mutation", err)
+		}
+
+		content = append(append(content, line...), '\n')
+	}
+
+	_, err := l.file.Write(content)
+	if err != nil {
+		return logger.WrapError("write replication log", err)
+	}
+
+	l.lastSeq = seq
+	l.fileEntries += len(mutations)
+	l.entries = append(l.entries, mutations...)
+	if len(l.entries) > l.retention {
+		l.entries = append([]Mutation{}, l.entries[len(l.entries)-l.retention:]...)
+	}
+
+	if l.fileEntries >= 2*l.retention {
+		return l.compact()
+	}
+
+	return nil
+}
+
+// After returns up to limit mutations following seq.
+func (l *Log) After(seq uint64, limit int) []Mutation {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	start := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Seq > seq })
+	end := len(l.entries)
+	if limit > 0 {
+		end = min(end, start+limit)
+	}
+
+	return append([]Mutation{}, l.entries[start:end]...)
+}
+
+// FirstSeq returns the oldest retained sequence number, zero if the log is empty.
+func (l *Log) FirstSeq() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.entries) == 0 {
+		return 0
+	}
+
+	return l.entries[0].Seq
+}
+
+// Epoch identifies the sequence numbers of the log.
+func (l *Log) Epoch() string {
+	return l.epoch
+}
+
+func (l *Log) LastSeq() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.lastSeq
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *Log) load() error {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return logger.WrapError("open replication log", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		mutation := Mutation{}
+		err = json.Unmarshal(scanner.Bytes(), &mutation)
+		if err != nil || mutation.Seq <= l.lastSeq {
+			logger.SugarLogger.Errorf("Skip invalid replication log entry: %s", scanner.Text())
+			continue
+		}
+
+		l.lastSeq = mutation.Seq
+		l.entries = append(l.entries, mutation)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return logger.WrapError("read replication log", err)
+	}
+
+	if len(l.entries) > l.retention {
+		l.entries = l.entries[len(l.entries)-l.retention:]
+	}
+
+	return nil
+}
+
+// compact rewrites the file with the retained mutations and reopens it for appending.
+func (l *Log) compact() error {
+	temp, err := os.CreateTemp(filepath.Dir(l.path), logFileName+".*.tmp")
+	if err != nil {
+		return logger.WrapError("create replication log", err)
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	encoder := json.NewEncoder(writer)
+	for i := range l.entries {
+		err = encoder.Encode(&l.entries[i])
+		if err != nil {
+			_ = temp.Close()
+			return logger.WrapError("write replication log", err)
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return logger.WrapError("write replication log", err)
+	}
+
+	if l.file != nil {
+		_ = l.file.Close()
+		l.file = nil
+	}
+
+	// the previous file is reopened if it could not be replaced
+	renameErr := os.Rename(temp.Name(), l.path)
+	l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return logger.WrapError(fmt.Sprintf("open replication log %s", l.path), err)
+	}
+	if renameErr != nil {
+		return logger.WrapError("replace replication log", renameErr)
+	}
+
+	l.fileEntries = len(l.entries)
+	return nil
+}
+
+// loadEpoch reads the epoch of the log or creates a new one.
+func loadEpoch(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err == nil && len(content) > 0 {
+		return string(content), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", logger.WrapError("read replication log epoch", err)
+	}
+
+	random := make([]byte, 8)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", logger.WrapError("generate replication log epoch", err)
+	}
+
+	epoch := hex.EncodeToString(random)
+	temp := path + ".tmp"
+	err = os.WriteFile(temp, []byte(epoch), 0o644)
+	if err != nil {
+		return "", logger.WrapError("write replication log epoch", err)
+	}
+
+	err = os.Rename(temp, path)
+	if err != nil {
+		return "", logger.WrapError("replace replication log epoch", err)
+	}
+
+	return epoch, nil
+}
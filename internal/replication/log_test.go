@@ -0,0 +1,56 @@
+package replication
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	log, err := OpenLog(dir, 3)
+	require.NoError(t, err)
+
+	first := []Mutation{{Op: OpCounterAdd, Type: "counter", Name: "PollCount", Value: 1}, {Op: OpGaugeSet, Type: "gauge", Name: "Alloc", Value: 2}}
+	require.NoError(t, log.Append(first))
+	assert.Equal(t, uint64(1), first[0].Seq)
+	assert.Equal(t, uint64(2), first[1].Seq)
+	assert.Equal(t, first[1:], log.After(1, 10))
+	assert.Equal(t, first[:1], log.After(0, 1))
+
+	// the log survives the restart, an incomplete line is dropped
+	require.NoError(t, log.Close())
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"seq":3,"te`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	epoch := log.Epoch()
+	assert.NotEmpty(t, epoch)
+
+	log, err = OpenLog(dir, 3)
+	require.NoError(t, err)
+	assert.Equal(t, epoch, log.Epoch())
+	assert.Equal(t, uint64(2), log.LastSeq())
+	assert.Equal(t, first, log.After(0, 0))
+
+	// only the last mutations are retained
+	second := []Mutation{{Tenant: "teamA", Op: OpDelete, Type: "gauge", Name: "Alloc"}, {Op: OpCounterAdd, Type: "counter", Name: "PollCount", Value: 3}}
+	require.NoError(t, log.Append(second))
+	assert.Equal(t, uint64(2), log.FirstSeq())
+	assert.Equal(t, uint64(4), log.LastSeq())
+	assert.Equal(t, append(first[1:], second...), log.After(0, 0))
+
+	require.NoError(t, log.Append([]Mutation{{Op: OpGaugeSet, Type: "gauge", Name: "Alloc", Value: 5}}))
+	require.NoError(t, log.Close())
+
+	log, err = OpenLog(dir, 3)
+	require.NoError(t, err)
+	defer log.Close()
+	assert.Equal(t, uint64(3), log.FirstSeq())
+	assert.Equal(t, uint64(5), log.LastSeq())
+}
@@ -0,0 +1,101 @@
+package replication
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+)
+
+type replicatingStorage struct {
+	local      storage.MetricsStorage
+	replicator *Replicator
+	// keeps the log order equal to the order the mutations are applied in
+	lock sync.Mutex
+}
+
+// NewReplicatingStorage applies the received metrics to the local storage and records them for the peers.
+// The mutations received from the peers must be applied to the local storage directly, so they are not reflected back.
+func NewReplicatingStorage(local storage.MetricsStorage, replicator *Replicator) storage.MetricsStorage {
+	return &replicatingStorage{local: local, replicator: replicator}
+}
+
+func (r *replicatingStorage) AddMetricValues(ctx context.Context, metricsList []metrics.Metric) ([]metrics.Metric, error) {
+	// the local storage may keep the metric objects and change their values, so the mutations are taken before
+	tenant := identity.Tenant(ctx)
+	mutations := make([]Mutation, len(metricsList))
+	for i, metric := range metricsList {
+		op := OpGaugeSet
+		if metric.GetType() == "counter" {
+			op = OpCounterAdd
+		}
+
+		mutations[i] = Mutation{Tenant: tenant, Op: op, Type: metric.GetType(), Name: metric.GetName(), Value: metric.GetValue()}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result, err := r.local.AddMetricValues(ctx, metricsList)
+	if err != nil {
+		return nil, err
+	}
+
+	r.replicator.Record(mutations)
+	return result, nil
+}
+
+func (r *replicatingStorage) DeleteMetric(ctx context.Context, metricType string, metricName string) error {
+	deleter, ok := r.local.(storage.MetricsDeleter)
+	if !ok {
+		return metrics.ErrDeleteNotSupported
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := deleter.DeleteMetric(ctx, metricType, metricName)
+	if err != nil {
+		return err
+	}
+
+	r.replicator.Record([]Mutation{{Tenant: identity.Tenant(ctx), Op: OpDelete, Type: metricType, Name: metricName}})
+	return nil
+}
+
+func (r *replicatingStorage) GetMetricValues(ctx context.Context) (map[string]map[string]string, error) {
+	return r.local.GetMetricValues(ctx)
+}
+
+func (r *replicatingStorage) GetMetric(ctx context.Context, metricType string, metricName string) (metrics.Metric, error) {
+	return r.local.GetMetric(ctx, metricType, metricName)
+}
+
+func (r *replicatingStorage) GetTenants(ctx context.Context) ([]string, error) {
+	return r.local.GetTenants(ctx)
+}
+
+func (r *replicatingStorage) Restore(ctx context.Context, metricValues map[string]map[string]string) error {
+	return r.local.Restore(ctx, metricValues)
+}
+
+func (r *replicatingStorage) GetMetricHistory(ctx context.Context, metricType string, metricName string, since time.Time) ([]storage.Sample, error) {
+	history, ok := r.local.(storage.HistoryStorage)
+	if !ok {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	return history.GetMetricHistory(ctx, metricType, metricName, since)
+}
+
+func (r *replicatingStorage) GetHistory(ctx context.Context, since time.Time) (map[string]map[string][]storage.Sample, error) {
+	history, ok := r.local.(storage.HistoryStorage)
+	if !ok {
+		return nil, metrics.ErrHistoryNotSupported
+	}
+
+	return history.GetHistory(ctx, since)
+}
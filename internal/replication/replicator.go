@@ -0,0 +1,527 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/identity"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+// ApplyPath is the peer endpoint receiving the mutations.
+const ApplyPath = "/api/replication/apply"
+
+const (
+	stateFileName     = "state.json"
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = time.Minute
+	pollInterval      = 5 * time.Second
+)
+
+type replicatorConfig interface {
+	ReplicationNodeID() string
+	ReplicationPeers() []string
+	ReplicationDir() string
+	ReplicationRetention() int
+	ReplicationBatchSize() int
+	ReplicationToken() string
+	ReplicationTimeout() time.Duration
+}
+
+// ApplyRequest carries the mutations of the origin node in the sequence order.
+// The sequence numbers restart with a new epoch of the origin log.
+type ApplyRequest struct {
+	Origin    string     `json:"origin"`
+	Epoch     string     `json:"epoch,omitempty"`
+	Mutations []Mutation `json:"mutations"`
+}
+
+type ApplyResponse struct {
+	Applied int `json:"applied"`
+}
+
+type peer struct {
+	name   string
+	url    string
+	notify chan struct{}
+}
+
+// state is persisted, so a restarted node neither resends acknowledged mutations nor applies them twice.
+type state struct {
+	Sent    map[string]uint64 `json:"sent"`    // by peer
+	Applied map[string]uint64 `json:"applied"` // by origin
+	Epochs  map[string]string `json:"epochs"`  // of the applied origin logs
+}
+
+// Replicator streams the local mutations to the peers and applies the mutations of the peers.
+// Every node has to list all the others as peers, since the applied mutations are not forwarded further.
+type Replicator struct {
+	nodeID     string
+	peers      []*peer
+	log        *Log
+	local      storage.MetricsStorage
+	client     *http.Client
+	token      string
+	batchSize  int
+	statePath  string
+	state      state
+	stateLock  sync.Mutex
+	applyLock  sync.Mutex
+	retryDelay time.Duration
+
+	registry  *selfmetrics.Registry
+	logSeq    *selfmetrics.Gauge
+	logErrors *selfmetrics.Counter
+}
+
+// NewReplicator opens the replication log, local is the storage the peer mutations are applied to.
+func NewReplicator(config replicatorConfig, local storage.MetricsStorage, registry *selfmetrics.Registry) (*Replicator, error) {
+	nodeID := config.ReplicationNodeID()
+	if nodeID == "" || strings.ContainsAny(nodeID, "=.") {
+		return nil, logger.WrapError(fmt.Sprintf("validate node id '%s'", nodeID), ErrInvalidNodeID)
+	}
+
+	peers := []*peer{}
+	for _, item := range config.ReplicationPeers() {
+		name, peerURL, ok := strings.Cut(item, "=")
+		if !ok || name == "" || name == nodeID || strings.Contains(name, ".") {
+			return nil, logger.WrapError(fmt.Sprintf("parse peer '%s'", item), ErrInvalidPeer)
+		}
+
+		parsed, err := url.Parse(peerURL)
+		if err != nil || parsed.Host == "" {
+			return nil, logger.WrapError(fmt.Sprintf("parse peer '%s'", item), ErrInvalidPeer)
+		}
+
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/") + ApplyPath
+		peers = append(peers, &peer{name: name, url: parsed.String(), notify: make(chan struct{}, 1)})
+	}
+
+	if config.ReplicationDir() == "" {
+		return nil, logger.WrapError("open replication log", ErrMissedDir)
+	}
+
+	log, err := OpenLog(config.ReplicationDir(), config.ReplicationRetention())
+	if err != nil {
+		return nil, logger.WrapError("open replication log", err)
+	}
+
+	replicator := &Replicator{
+		nodeID:     nodeID,
+		peers:      peers,
+		log:        log,
+		local:      local,
+		client:     &http.Client{Timeout: config.ReplicationTimeout()},
+		token:      config.ReplicationToken(),
+		batchSize:  config.ReplicationBatchSize(),
+		statePath:  filepath.Join(config.ReplicationDir(), stateFileName),
+		state:      state{Sent: map[string]uint64{}, Applied: map[string]uint64{}, Epochs: map[string]string{}},
+		retryDelay: defaultRetryDelay,
+		registry:   registry,
+		logSeq:     registry.Gauge("ReplicationLogSeq"),
+		logErrors:  registry.Counter("ReplicationLogErrors"),
+	}
+
+	err = replicator.loadState()
+	if err != nil {
+		_ = log.Close()
+		return nil, err
+	}
+
+	replicator.logSeq.Set(float64(log.LastSeq()))
+	return replicator, nil
+}
+
+// Record appends the local mutations to the log and wakes the senders up.
+// The mutations are already applied, so a log failure is reported but not returned.
+func (r *Replicator) Record(mutations []Mutation) {
+	err := r.log.Append(mutations)
+	if err != nil {
+		r.logErrors.Inc()
+		logger.SugarLogger.Errorf("Failed to record mutations for replication: %v", err)
+		return
+	}
+
+	r.logSeq.Set(float64(r.log.LastSeq()))
+	for _, target := range r.peers {
+		select {
+		case target.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run streams the log to every peer until ctx is done, the delay between failed attempts grows up to a minute.
+func (r *Replicator) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, target := range r.peers {
+		wg.Add(1)
+		go func(target *peer) {
+			defer wg.Done()
+			r.runPeer(ctx, target)
+		}(target)
+	}
+
+	wg.Wait()
+}
+
+// Flush sends the pending mutations to every peer once, an unavailable peer does not stop the others.
+func (r *Replicator) Flush(ctx context.Context) error {
+	var result error
+	for _, target := range r.peers {
+		for {
+			sent, err := r.send(ctx, target)
+			if err != nil {
+				result = logger.WrapError("replicate to peer "+target.name, err)
+				break
+			}
+			if !sent {
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// Apply applies the mutations of the origin node which were not applied yet and returns their count.
+func (r *Replicator) Apply(ctx context.Context, request *ApplyRequest) (int, error) {
+	if request.Origin == "" || strings.ContainsAny(request.Origin, "=.") {
+		return 0, logger.WrapError(fmt.Sprintf("validate origin '%s'", request.Origin), ErrInvalidNodeID)
+	}
+	if request.Origin == r.nodeID {
+		return 0, logger.WrapError("apply mutations", ErrOwnMutations)
+	}
+
+	for _, mutation := range request.Mutations {
+		err := validate(mutation)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+
+	epochChanged := r.checkEpoch(request.Origin, request.Epoch)
+	applied := r.applied(request.Origin)
+	pending := []Mutation{}
+	for _, mutation := range request.Mutations {
+		if mutation.Seq > applied {
+			pending = append(pending, mutation)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].Seq < pending[j].Seq })
+
+	if len(pending) > 0 && applied > 0 && pending[0].Seq > applied+1 {
+		logger.SugarLogger.Warnf("Missed mutations %v-%v of peer %v", applied+1, pending[0].Seq-1, request.Origin)
+	}
+
+	count, err := r.applyMutations(ctx, request.Origin, pending)
+	r.registry.Counter("ReplicationApplied." + request.Origin).Add(int64(count))
+	if count > 0 || epochChanged {
+		saveErr := r.saveState()
+		if saveErr != nil {
+			logger.SugarLogger.Errorf("Failed to save replication state: %v", saveErr)
+		}
+	}
+
+	return count, err
+}
+
+func (r *Replicator) Close() error {
+	return r.log.Close()
+}
+
+// applyMutations applies the runs of metric updates of a tenant at once, deletes are applied one by one.
+func (r *Replicator) applyMutations(ctx context.Context, origin string, pending []Mutation) (int, error) {
+	count := 0
+	for start := 0; start < len(pending); {
+		tenantCtx := identity.WithTenant(ctx, pending[start].Tenant)
+		end := start + 1
+		if pending[start].Op == OpDelete {
+			err := r.deleteMetric(tenantCtx, pending[start])
+			if err != nil {
+				return count, err
+			}
+		} else {
+			for end < len(pending) && pending[end].Op != OpDelete && pending[end].Tenant == pending[start].Tenant {
+				end++
+			}
+
+			metricsList := make([]metrics.Metric, 0, end-start)
+			for _, mutation := range pending[start:end] {
+				metricsList = append(metricsList, toMetric(mutation))
+			}
+
+			_, err := r.local.AddMetricValues(tenantCtx, metricsList)
+			if err != nil {
+				return count, logger.WrapError("apply peer metrics", err)
+			}
+		}
+
+		count += end - start
+		r.setApplied(origin, pending[end-1].Seq)
+		start = end
+	}
+
+	return count, nil
+}
+
+func (r *Replicator) deleteMetric(ctx context.Context, mutation Mutation) error {
+	deleter, ok := r.local.(storage.MetricsDeleter)
+	if !ok {
+		return logger.WrapError("apply peer delete", metrics.ErrDeleteNotSupported)
+	}
+
+	err := deleter.DeleteMetric(ctx, mutation.Type, mutation.Name)
+	if err != nil && !errors.Is(err, metrics.ErrMetricNotFound) {
+		return logger.WrapError("apply peer delete", err)
+	}
+
+	return nil
+}
+
+func (r *Replicator) runPeer(ctx context.Context, target *peer) {
+	delay := r.retryDelay
+	for {
+		wait := pollInterval
+		sent, err := r.send(ctx, target)
+		switch {
+		case err != nil:
+			r.registry.Counter("ReplicationSendErrors." + target.name).Inc()
+			logger.SugarLogger.Errorf("Failed to replicate to peer %v, retry in %v: %v", target.name, delay, err)
+			wait = delay
+			delay = min(delay*2, maxRetryDelay)
+		case sent:
+			delay = r.retryDelay
+			continue
+		default:
+			delay = r.retryDelay
+		}
+
+		if !r.wait(ctx, target, wait, err == nil) {
+			return
+		}
+	}
+}
+
+// wait sleeps the delay, new mutations interrupt the sleep unless the peer is failing. It returns false when ctx is done.
+func (r *Replicator) wait(ctx context.Context, target *peer, delay time.Duration, wakeOnNotify bool) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case <-target.notify:
+			if wakeOnNotify {
+				return true
+			}
+		}
+	}
+}
+
+// send pushes the next batch of mutations to the peer and reports whether there was anything to send.
+func (r *Replicator) send(ctx context.Context, target *peer) (bool, error) {
+	cursor := r.sent(target.name)
+	if first := r.log.FirstSeq(); first > cursor+1 {
+		logger.SugarLogger.Warnf("Peer %v missed mutations %v-%v removed from the replication log", target.name, cursor+1, first-1)
+		r.registry.Counter("ReplicationSkipped." + target.name).Add(int64(first - cursor - 1))
+	}
+
+	batch := r.log.After(cursor, r.batchSize)
+	if len(batch) == 0 {
+		r.registry.Gauge("ReplicationLag." + target.name).Set(0)
+		return false, nil
+	}
+
+	err := r.post(ctx, target, &ApplyRequest{Origin: r.nodeID, Epoch: r.log.Epoch(), Mutations: batch})
+	if err != nil {
+		return false, err
+	}
+
+	last := batch[len(batch)-1].Seq
+	r.setSent(target.name, last)
+	r.registry.Counter("ReplicationSent." + target.name).Add(int64(len(batch)))
+	r.registry.Gauge("ReplicationLag." + target.name).Set(float64(r.log.LastSeq() - last))
+
+	err = r.saveState()
+	if err != nil {
+		logger.SugarLogger.Errorf("Failed to save replication state: %v", err)
+	}
+
+	return true, nil
+}
+
+func (r *Replicator) post(ctx context.Context, target *peer, body *ApplyRequest) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return logger.WrapError("marshal apply request", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target.url, bytes.NewReader(content))
+	if err != nil {
+		return logger.WrapError("create apply request", err)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		request.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return logger.WrapError("send apply request", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return logger.WrapError(fmt.Sprintf("apply status %v: %s", response.StatusCode, message), ErrUnexpectedStatusCode)
+	}
+
+	return nil
+}
+
+func (r *Replicator) sent(peerName string) uint64 {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	return r.state.Sent[peerName]
+}
+
+func (r *Replicator) setSent(peerName string, seq uint64) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	r.state.Sent[peerName] = seq
+}
+
+func (r *Replicator) applied(origin string) uint64 {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	return r.state.Applied[origin]
+}
+
+func (r *Replicator) setApplied(origin string, seq uint64) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	r.state.Applied[origin] = seq
+}
+
+// checkEpoch resets the applied cursor of the origin when its log is recreated and reports whether the epoch changed.
+// The epoch of an origin is adopted as is the first time, e.g. after an upgrade from a version without epochs.
+func (r *Replicator) checkEpoch(origin string, epoch string) bool {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	known := r.state.Epochs[origin]
+	if epoch == "" || epoch == known {
+		return false
+	}
+
+	if known != "" {
+		logger.SugarLogger.Warnf("Replication log of peer %v is recreated (epoch %v -> %v), apply its mutations from the start", origin, known, epoch)
+		r.state.Applied[origin] = 0
+	}
+
+	r.state.Epochs[origin] = epoch
+	return true
+}
+
+func (r *Replicator) loadState() error {
+	content, err := os.ReadFile(r.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return logger.WrapError("read replication state", err)
+	}
+
+	loaded := state{}
+	err = json.Unmarshal(content, &loaded)
+	if err != nil {
+		return logger.WrapError("decode replication state", err)
+	}
+
+	for name, seq := range loaded.Sent {
+		r.state.Sent[name] = seq
+	}
+	for origin, seq := range loaded.Applied {
+		r.state.Applied[origin] = seq
+	}
+	for origin, epoch := range loaded.Epochs {
+		r.state.Epochs[origin] = epoch
+	}
+
+	return nil
+}
+
+func (r *Replicator) saveState() error {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+
+	content, err := json.Marshal(&r.state)
+	if err != nil {
+		return logger.WrapError("marshal replication state", err)
+	}
+
+	temp := r.statePath + ".tmp"
+	err = os.WriteFile(temp, content, 0o644)
+	if err != nil {
+		return logger.WrapError("write replication state", err)
+	}
+
+	return os.Rename(temp, r.statePath)
+}
+
+func validate(mutation Mutation) error {
+	valid := false
+	switch mutation.Op {
+	case OpCounterAdd:
+		valid = mutation.Type == "counter"
+	case OpGaugeSet:
+		valid = mutation.Type == "gauge"
+	case OpDelete:
+		valid = mutation.Type == "counter" || mutation.Type == "gauge"
+	}
+
+	if !valid || mutation.Seq == 0 || mutation.Name == "" {
+		return logger.WrapError(fmt.Sprintf("validate mutation %v '%s' of %s", mutation.Seq, mutation.Op, mutation.Type), ErrUnknownOperation)
+	}
+
+	return nil
+}
+
+func toMetric(mutation Mutation) metrics.Metric {
+	metricFactory := types.NewGaugeMetric
+	if mutation.Type == "counter" {
+		metricFactory = types.NewCounterMetric
+	}
+
+	metric := metricFactory(mutation.Name)
+	metric.SetValue(mutation.Value)
+	return metric
+}
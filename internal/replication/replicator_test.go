@@ -0,0 +1,207 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage/memory"
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type replicatorConf struct {
+	nodeID string
+	peers  []string
+	dir    string
+}
+
+type node struct {
+	local      storage.MetricsStorage
+	storage    storage.MetricsStorage
+	replicator *Replicator
+	server     *httptest.Server
+	available  atomic.Bool
+}
+
+func TestReplicator(t *testing.T) {
+	ctx := context.Background()
+	nodeA := startNode(t)
+	nodeB := startNode(t)
+	dirA := t.TempDir()
+	nodeA.connect(t, &replicatorConf{nodeID: "a", peers: []string{"b=" + nodeB.server.URL}, dir: dirA})
+	nodeB.connect(t, &replicatorConf{nodeID: "b", peers: []string{"a=" + nodeA.server.URL}, dir: t.TempDir()})
+
+	_, err := nodeA.storage.AddMetricValues(ctx, []metrics.Metric{test.CreateCounterMetric("PollCount", 5)})
+	require.NoError(t, err)
+	_, err = nodeB.storage.AddMetricValues(ctx, []metrics.Metric{test.CreateGaugeMetric("Alloc", 1.5)})
+	require.NoError(t, err)
+
+	require.NoError(t, nodeA.replicator.Flush(ctx))
+	require.NoError(t, nodeB.replicator.Flush(ctx))
+	require.NoError(t, nodeA.replicator.Flush(ctx))
+
+	expected := map[string]map[string]string{"counter": {"PollCount": "5"}, "gauge": {"Alloc": "1.5"}}
+	assertValues(t, expected, nodeA, nodeB)
+
+	// the applied mutations are not reflected back
+	assert.Equal(t, uint64(1), nodeA.replicator.log.LastSeq())
+	assert.Equal(t, uint64(1), nodeB.replicator.log.LastSeq())
+
+	// the peer catches up after an outage
+	nodeB.available.Store(false)
+	_, err = nodeA.storage.AddMetricValues(ctx, []metrics.Metric{test.CreateCounterMetric("PollCount", 3)})
+	require.NoError(t, err)
+	require.NoError(t, nodeA.storage.(storage.MetricsDeleter).DeleteMetric(ctx, "gauge", "Alloc"))
+	assert.ErrorIs(t, nodeA.replicator.Flush(ctx), ErrUnexpectedStatusCode)
+
+	nodeB.available.Store(true)
+	require.NoError(t, nodeA.replicator.Flush(ctx))
+
+	expected = map[string]map[string]string{"counter": {"PollCount": "8"}, "gauge": {}}
+	assertValues(t, expected, nodeA, nodeB)
+
+	// a restarted node does not resend the acknowledged mutations
+	require.NoError(t, nodeA.replicator.Close())
+	nodeA.connect(t, &replicatorConf{nodeID: "a", peers: []string{"b=" + nodeB.server.URL}, dir: dirA})
+	require.NoError(t, nodeA.replicator.Flush(ctx))
+	assertValues(t, expected, nodeB)
+
+	// the repeated mutations are skipped
+	applied, err := nodeB.replicator.Apply(ctx, &ApplyRequest{Origin: "a", Mutations: nodeA.replicator.log.After(0, 0)})
+	require.NoError(t, err)
+	assert.Equal(t, 0, applied)
+	assertValues(t, expected, nodeB)
+
+	_, err = nodeB.replicator.Apply(ctx, &ApplyRequest{Origin: "b", Mutations: nodeA.replicator.log.After(0, 0)})
+	assert.ErrorIs(t, err, ErrOwnMutations)
+
+	_, err = nodeB.replicator.Apply(ctx, &ApplyRequest{Origin: "a", Mutations: []Mutation{{Seq: 10, Op: "drop", Type: "gauge", Name: "Alloc"}}})
+	assert.ErrorIs(t, err, ErrUnknownOperation)
+
+	// the sequence numbers of a node which lost its log directory restart with a new epoch
+	require.NoError(t, nodeA.replicator.Close())
+	nodeA.connect(t, &replicatorConf{nodeID: "a", peers: []string{"b=" + nodeB.server.URL}, dir: t.TempDir()})
+	_, err = nodeA.storage.AddMetricValues(ctx, []metrics.Metric{test.CreateCounterMetric("PollCount", 2)})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), nodeA.replicator.log.LastSeq())
+	require.NoError(t, nodeA.replicator.Flush(ctx))
+
+	expected = map[string]map[string]string{"counter": {"PollCount": "10"}, "gauge": {}}
+	assertValues(t, expected, nodeA, nodeB)
+}
+
+func TestNewReplicator_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		conf          replicatorConf
+		expectedError error
+	}{
+		{
+			name:          "empty_node_id",
+			conf:          replicatorConf{},
+			expectedError: ErrInvalidNodeID,
+		},
+		{
+			name:          "self_peer",
+			conf:          replicatorConf{nodeID: "a", peers: []string{"a=http://localhost:8080"}},
+			expectedError: ErrInvalidPeer,
+		},
+		{
+			name:          "invalid_peer_url",
+			conf:          replicatorConf{nodeID: "a", peers: []string{"b=localhost"}},
+			expectedError: ErrInvalidPeer,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.dir = t.TempDir()
+			_, err := NewReplicator(&tt.conf, memory.NewInMemoryStorage(), nil)
+			assert.ErrorIs(t, err, tt.expectedError)
+		})
+	}
+
+	_, err := NewReplicator(&replicatorConf{nodeID: "a"}, memory.NewInMemoryStorage(), nil)
+	assert.ErrorIs(t, err, ErrMissedDir)
+}
+
+func startNode(t *testing.T) *node {
+	t.Helper()
+	result := &node{local: memory.NewInMemoryStorage()}
+	result.available.Store(true)
+	result.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !result.available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		request := &ApplyRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(request))
+		applied, err := result.replicator.Apply(r.Context(), request)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		require.NoError(t, json.NewEncoder(w).Encode(&ApplyResponse{Applied: applied}))
+	}))
+	t.Cleanup(result.server.Close)
+
+	return result
+}
+
+func (n *node) connect(t *testing.T, conf *replicatorConf) {
+	t.Helper()
+	replicator, err := NewReplicator(conf, n.local, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = replicator.Close() })
+
+	n.replicator = replicator
+	n.storage = NewReplicatingStorage(n.local, replicator)
+}
+
+func assertValues(t *testing.T, expected map[string]map[string]string, nodes ...*node) {
+	t.Helper()
+	for _, target := range nodes {
+		actual, err := target.local.GetMetricValues(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func (c *replicatorConf) ReplicationNodeID() string {
+	return c.nodeID
+}
+
+func (c *replicatorConf) ReplicationPeers() []string {
+	return c.peers
+}
+
+func (c *replicatorConf) ReplicationDir() string {
+	return c.dir
+}
+
+func (c *replicatorConf) ReplicationRetention() int {
+	return 100
+}
+
+func (c *replicatorConf) ReplicationBatchSize() int {
+	return 1
+}
+
+func (c *replicatorConf) ReplicationToken() string {
+	return ""
+}
+
+func (c *replicatorConf) ReplicationTimeout() time.Duration {
+	return time.Second
+}
@@ -0,0 +1,137 @@
+package selfmetrics
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	DurationBuckets  = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+	BatchSizeBuckets = []float64{1, 10, 50, 100, 500, 1000, 5000}
+)
+
+// Counter is a monotonically increasing value, all methods are safe for a nil Counter.
+type Counter struct {
+	value atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(delta int64) {
+	if c != nil {
+		c.value.Add(delta)
+	}
+}
+
+func (c *Counter) Value() int64 {
+	if c == nil {
+		return 0
+	}
+
+	return c.value.Load()
+}
+
+// Gauge is an arbitrary value, all methods are safe for a nil Gauge.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(value float64) {
+	if g != nil {
+		g.bits.Store(math.Float64bits(value))
+	}
+}
+
+func (g *Gauge) Add(delta float64) {
+	if g == nil {
+		return
+	}
+
+	for {
+		current := g.bits.Load()
+		if g.bits.CompareAndSwap(current, math.Float64bits(math.Float64frombits(current)+delta)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram counts observations into cumulative buckets, all methods are safe for a nil Histogram.
+type Histogram struct {
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+	lock   sync.Mutex
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	sorted := append([]float64{}, bounds...)
+	sort.Float64s(sorted)
+
+	return &Histogram{
+		bounds: sorted,
+		counts: make([]int64, len(sorted)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []int64
+	Count  int64
+	Sum    float64
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	if h == nil {
+		return HistogramSnapshot{}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: append([]int64{}, h.counts...),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+}
+
+func (s HistogramSnapshot) values(name string, visit func(name string, value float64)) {
+	for i, bound := range s.Bounds {
+		visit(name+".le_"+strconv.FormatFloat(bound, 'f', -1, 64), float64(s.Counts[i]))
+	}
+	visit(name+".le_inf", float64(s.Count))
+	visit(name+".count", float64(s.Count))
+	visit(name+".sum", s.Sum)
+}
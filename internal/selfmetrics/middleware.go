@@ -0,0 +1,57 @@
+package selfmetrics
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// Middleware counts requests by route and status and observes the request durations.
+func Middleware(registry *Registry) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if registry == nil {
+			return next
+		}
+
+		inFlight := registry.Gauge("HTTPRequestsInFlight")
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			inFlight.Add(1)
+			defer inFlight.Add(-1)
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			route := routeName(r)
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			registry.Counter("HTTPRequests." + route + "." + strconv.Itoa(status)).Inc()
+			registry.Histogram("HTTPRequestDuration."+route, DurationBuckets).Observe(time.Since(started).Seconds())
+		})
+	}
+}
+
+// routeName uses the route pattern to keep the metric names count bounded.
+func routeName(r *http.Request) string {
+	routeContext := chi.RouteContext(r.Context())
+	if routeContext == nil || len(routeContext.RoutePatterns) == 0 {
+		return "unmatched"
+	}
+
+	name := strings.Trim(unsafeNameChars.ReplaceAllString(routeContext.RoutePattern(), "_"), "_")
+	if name == "" {
+		return "root"
+	}
+
+	return name
+}
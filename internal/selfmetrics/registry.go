@@ -0,0 +1,125 @@
+package selfmetrics
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/types"
+)
+
+// ReservedPrefix marks self metrics stored as ordinary metrics, clients can not update such metrics.
+const ReservedPrefix = "_internal."
+
+// Registry keeps the server self metrics.
+// A nil Registry returns nil instruments, so the instrumented code works without it.
+type Registry struct {
+	counters   map[string]*Counter
+	gauges     map[string]*Gauge
+	histograms map[string]*Histogram
+	lock       sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   map[string]*Counter{},
+		gauges:     map[string]*Gauge{},
+		histograms: map[string]*Histogram{},
+	}
+}
+
+func (r *Registry) Counter(name string) *Counter {
+	if r == nil {
+		return nil
+	}
+
+	return getOrCreate(r, r.counters, name, func() *Counter { return &Counter{} })
+}
+
+func (r *Registry) Gauge(name string) *Gauge {
+	if r == nil {
+		return nil
+	}
+
+	return getOrCreate(r, r.gauges, name, func() *Gauge { return &Gauge{} })
+}
+
+// Histogram returns the histogram with the name, the bounds are used only when it is created.
+func (r *Registry) Histogram(name string, bounds []float64) *Histogram {
+	if r == nil {
+		return nil
+	}
+
+	return getOrCreate(r, r.histograms, name, func() *Histogram { return newHistogram(bounds) })
+}
+
+// Values returns the flattened values of all instruments by name,
+// a histogram is flattened into cumulative buckets, count and sum.
+func (r *Registry) Values() map[string]float64 {
+	result := map[string]float64{}
+	if r == nil {
+		return result
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for name, counter := range r.counters {
+		result[name] = float64(counter.Value())
+	}
+	for name, gauge := range r.gauges {
+		result[name] = gauge.Value()
+	}
+	for name, histogram := range r.histograms {
+		histogram.Snapshot().values(name, func(name string, value float64) {
+			result[name] = value
+		})
+	}
+
+	return result
+}
+
+// GetMetrics exports the values as gauges, so the registry can be used as a self-metrics provider.
+func (r *Registry) GetMetrics() <-chan metrics.Metric {
+	values := r.Values()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make(chan metrics.Metric)
+	go func() {
+		defer close(result)
+		for _, name := range names {
+			result <- types.NewGaugeMetricValue(name, values[name])
+		}
+	}()
+
+	return result
+}
+
+func (r *Registry) Update(context.Context) error {
+	return nil
+}
+
+func getOrCreate[T any](r *Registry, instruments map[string]T, name string, create func() T) T {
+	r.lock.RLock()
+	instrument, ok := instruments[name]
+	r.lock.RUnlock()
+	if ok {
+		return instrument
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	instrument, ok = instruments[name]
+	if !ok {
+		instrument = create()
+		instruments[name] = instrument
+	}
+
+	return instrument
+}
@@ -0,0 +1,73 @@
+package selfmetrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_Values(t *testing.T) {
+	registry := NewRegistry()
+
+	registry.Counter("Requests").Inc()
+	registry.Counter("Requests").Add(2)
+	registry.Gauge("InFlight").Set(5)
+	registry.Gauge("InFlight").Add(-1)
+
+	histogram := registry.Histogram("Duration", []float64{1, 0.1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	assert.Equal(t, map[string]float64{
+		"Requests":        3,
+		"InFlight":        4,
+		"Duration.le_0.1": 1,
+		"Duration.le_1":   2,
+		"Duration.le_inf": 3,
+		"Duration.count":  3,
+		"Duration.sum":    3.55,
+	}, registry.Values())
+
+	names := []string{}
+	for metric := range registry.GetMetrics() {
+		assert.Equal(t, "gauge", metric.GetType())
+		names = append(names, metric.GetName())
+	}
+	assert.Equal(t, []string{"Duration.count", "Duration.le_0.1", "Duration.le_1", "Duration.le_inf", "Duration.sum", "InFlight", "Requests"}, names)
+}
+
+func TestRegistry_Nil(t *testing.T) {
+	var registry *Registry
+
+	registry.Counter("Requests").Inc()
+	registry.Gauge("InFlight").Set(1)
+	registry.Histogram("Duration", DurationBuckets).Observe(1)
+
+	assert.Empty(t, registry.Values())
+}
+
+func TestMiddleware(t *testing.T) {
+	registry := NewRegistry()
+
+	router := chi.NewRouter()
+	router.Use(Middleware(registry))
+	router.Get("/value/{metricType}/{metricName}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, path := range []string{"/value/gauge/first", "/value/gauge/second", "/", "/unknown"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	values := registry.Values()
+	assert.Equal(t, float64(2), values["HTTPRequests.value_metricType_metricName.404"])
+	assert.Equal(t, float64(1), values["HTTPRequests.root.200"])
+	assert.Equal(t, float64(1), values["HTTPRequests.unmatched.404"])
+	assert.Equal(t, float64(2), values["HTTPRequestDuration.value_metricType_metricName.count"])
+	assert.Equal(t, float64(0), values["HTTPRequestsInFlight"])
+}
@@ -0,0 +1,217 @@
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+const subscriptionBufferSize = 256
+
+type brokerConfig interface {
+	StreamReplaySize() int
+	StreamMaxSubscribers() int
+}
+
+type Event struct {
+	ID uint64
+	storage.MetricChange
+}
+
+// Filter selects the events of the tenant, empty names or types match any.
+type Filter struct {
+	Tenant string
+	Names  map[string]bool
+	Types  map[string]bool
+}
+
+// Subscription receives the matched events, its channel is closed when the subscriber is too slow
+// or unsubscribed. A lagged subscriber should resubscribe from the last received event.
+type Subscription struct {
+	filter Filter
+	events chan Event
+	replay []Event
+	missed bool
+	lagged atomic.Bool
+}
+
+// Broker fans out storage changes to subscribers without blocking the publisher
+// and keeps the last events to resume subscriptions.
+type Broker struct {
+	replay         []Event
+	replayNext     int
+	nextID         uint64
+	maxSubscribers int
+	subscribers    map[*Subscription]struct{}
+	closed         bool
+	lock           sync.Mutex
+
+	subscribersGauge *selfmetrics.Gauge
+	publishedCounter *selfmetrics.Counter
+	laggedCounter    *selfmetrics.Counter
+}
+
+func NewBroker(config brokerConfig, registry *selfmetrics.Registry) *Broker {
+	return &Broker{
+		replay:           make([]Event, 0, config.StreamReplaySize()),
+		nextID:           1,
+		maxSubscribers:   config.StreamMaxSubscribers(),
+		subscribers:      map[*Subscription]struct{}{},
+		subscribersGauge: registry.Gauge("StreamSubscribers"),
+		publishedCounter: registry.Counter("StreamPublishedEvents"),
+		laggedCounter:    registry.Counter("StreamLaggedSubscribers"),
+	}
+}
+
+func NewFilter(tenant string, names []string, types []string) Filter {
+	filter := Filter{Tenant: tenant, Names: map[string]bool{}, Types: map[string]bool{}}
+	for _, name := range names {
+		filter.Names[name] = true
+	}
+	for _, metricType := range types {
+		filter.Types[metricType] = true
+	}
+
+	return filter
+}
+
+func (f *Filter) Match(change *storage.MetricChange) bool {
+	return change.Tenant == f.Tenant &&
+		(len(f.Names) == 0 || f.Names[change.Name]) &&
+		(len(f.Types) == 0 || f.Types[change.Type])
+}
+
+// Subscribe registers the subscriber, a non-zero lastEventID resumes the stream after this event.
+func (b *Broker) Subscribe(filter Filter, lastEventID uint64) (*Subscription, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	if b.maxSubscribers > 0 && len(b.subscribers) >= b.maxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+
+	subscription := &Subscription{
+		filter: filter,
+		events: make(chan Event, subscriptionBufferSize),
+		replay: []Event{},
+	}
+
+	if lastEventID > 0 {
+		kept := b.replayEvents()
+		oldestID := b.nextID
+		if len(kept) > 0 {
+			oldestID = kept[0].ID
+		}
+
+		// the event is from the previous server run or the next events are already evicted
+		subscription.missed = lastEventID >= b.nextID || oldestID > lastEventID+1
+		for _, event := range kept {
+			if event.ID > lastEventID && filter.Match(&event.MetricChange) {
+				subscription.replay = append(subscription.replay, event)
+			}
+		}
+	}
+
+	b.subscribers[subscription] = struct{}{}
+	b.subscribersGauge.Set(float64(len(b.subscribers)))
+
+	return subscription, nil
+}
+
+func (b *Broker) Unsubscribe(subscription *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.remove(subscription)
+}
+
+// ObserveChanges publishes the changes, a subscriber with the full buffer is dropped.
+func (b *Broker) ObserveChanges(changes []storage.MetricChange) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, change := range changes {
+		event := Event{ID: b.nextID, MetricChange: change}
+		b.nextID++
+		b.keep(event)
+		b.publishedCounter.Inc()
+
+		for subscription := range b.subscribers {
+			if !subscription.filter.Match(&event.MetricChange) {
+				continue
+			}
+
+			select {
+			case subscription.events <- event:
+			default:
+				subscription.lagged.Store(true)
+				b.laggedCounter.Inc()
+				b.remove(subscription)
+			}
+		}
+	}
+}
+
+// Close drops all subscribers and rejects new ones, it is used on the server shutdown.
+func (b *Broker) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	for subscription := range b.subscribers {
+		b.remove(subscription)
+	}
+}
+
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Replay returns the kept events after the last event ID the subscription was resumed from.
+func (s *Subscription) Replay() []Event {
+	return s.replay
+}
+
+// Missed reports whether some events after the last event ID are not kept anymore, so the subscriber should reload the state.
+func (s *Subscription) Missed() bool {
+	return s.missed
+}
+
+// Lagged reports whether the subscription was closed because the subscriber was too slow.
+func (s *Subscription) Lagged() bool {
+	return s.lagged.Load()
+}
+
+func (b *Broker) remove(subscription *Subscription) {
+	if _, ok := b.subscribers[subscription]; !ok {
+		return
+	}
+
+	delete(b.subscribers, subscription)
+	close(subscription.events)
+	b.subscribersGauge.Set(float64(len(b.subscribers)))
+}
+
+func (b *Broker) keep(event Event) {
+	if cap(b.replay) == 0 {
+		return
+	}
+
+	if len(b.replay) < cap(b.replay) {
+		b.replay = append(b.replay, event)
+		return
+	}
+
+	b.replay[b.replayNext] = event
+	b.replayNext = (b.replayNext + 1) % len(b.replay)
+}
+
+func (b *Broker) replayEvents() []Event {
+	return append(append([]Event{}, b.replay[b.replayNext:]...), b.replay[:b.replayNext]...)
+}
@@ -0,0 +1,191 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type brokerConf struct {
+	replaySize     int
+	maxSubscribers int
+}
+
+func TestBroker_Filter(t *testing.T) {
+	tests := []struct {
+		name          string
+		filter        Filter
+		expectedNames []string
+	}{
+		{
+			name:          "all_tenant_metrics",
+			filter:        NewFilter("", nil, nil),
+			expectedNames: []string{"Alloc", "PollCount", "Frees"},
+		},
+		{
+			name:          "by_name",
+			filter:        NewFilter("", []string{"Alloc", "PollCount"}, nil),
+			expectedNames: []string{"Alloc", "PollCount"},
+		},
+		{
+			name:          "by_type",
+			filter:        NewFilter("", nil, []string{"gauge"}),
+			expectedNames: []string{"Alloc", "Frees"},
+		},
+		{
+			name:          "by_name_and_type",
+			filter:        NewFilter("", []string{"Alloc", "PollCount"}, []string{"counter"}),
+			expectedNames: []string{"PollCount"},
+		},
+		{
+			name:          "other_tenant",
+			filter:        NewFilter("team-a", nil, nil),
+			expectedNames: []string{"Other"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewBroker(&brokerConf{replaySize: 10}, nil)
+			subscription, err := broker.Subscribe(tt.filter, 0)
+			require.NoError(t, err)
+
+			broker.ObserveChanges([]storage.MetricChange{
+				{Type: "gauge", Name: "Alloc", Value: 1},
+				{Type: "counter", Name: "PollCount", Value: 2},
+				{Type: "gauge", Name: "Frees", Value: 3},
+				{Tenant: "team-a", Type: "gauge", Name: "Other", Value: 4},
+			})
+			broker.Unsubscribe(subscription)
+
+			actualNames := []string{}
+			for event := range subscription.Events() {
+				actualNames = append(actualNames, event.Name)
+			}
+
+			assert.Equal(t, tt.expectedNames, actualNames)
+			assert.False(t, subscription.Lagged())
+		})
+	}
+}
+
+func TestBroker_Resume(t *testing.T) {
+	tests := []struct {
+		name           string
+		lastEventID    uint64
+		expectedIDs    []uint64
+		expectedMissed bool
+	}{
+		{
+			name:        "new_subscription",
+			lastEventID: 0,
+			expectedIDs: []uint64{},
+		},
+		{
+			name:        "resume_kept",
+			lastEventID: 3,
+			expectedIDs: []uint64{4, 5},
+		},
+		{
+			name:        "up_to_date",
+			lastEventID: 5,
+			expectedIDs: []uint64{},
+		},
+		{
+			name:           "evicted",
+			lastEventID:    1,
+			expectedIDs:    []uint64{3, 4, 5},
+			expectedMissed: true,
+		},
+		{
+			name:           "previous_run",
+			lastEventID:    100,
+			expectedIDs:    []uint64{},
+			expectedMissed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewBroker(&brokerConf{replaySize: 3}, nil)
+			for i := 0; i < 5; i++ {
+				broker.ObserveChanges([]storage.MetricChange{{Type: "gauge", Name: "Alloc", Value: float64(i)}})
+			}
+
+			subscription, err := broker.Subscribe(NewFilter("", nil, nil), tt.lastEventID)
+			require.NoError(t, err)
+
+			actualIDs := []uint64{}
+			for _, event := range subscription.Replay() {
+				actualIDs = append(actualIDs, event.ID)
+			}
+
+			assert.Equal(t, tt.expectedIDs, actualIDs)
+			assert.Equal(t, tt.expectedMissed, subscription.Missed())
+		})
+	}
+}
+
+func TestBroker_SlowSubscriber(t *testing.T) {
+	broker := NewBroker(&brokerConf{replaySize: 10}, nil)
+	slow, err := broker.Subscribe(NewFilter("", nil, nil), 0)
+	require.NoError(t, err)
+	fast, err := broker.Subscribe(NewFilter("", nil, nil), 0)
+	require.NoError(t, err)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < subscriptionBufferSize*2; i++ {
+			broker.ObserveChanges([]storage.MetricChange{{Type: "gauge", Name: "Alloc", Value: float64(i)}})
+
+			event, ok := <-fast.Events()
+			if !ok || event.Value != float64(i) {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "publisher is blocked by the slow subscriber")
+	}
+
+	assert.True(t, slow.Lagged())
+	assert.Len(t, slow.Events(), subscriptionBufferSize)
+
+	assert.False(t, fast.Lagged())
+
+	broker.Close()
+	_, ok := <-fast.Events()
+	assert.False(t, ok)
+
+	_, err = broker.Subscribe(NewFilter("", nil, nil), 0)
+	assert.ErrorIs(t, err, ErrBrokerClosed)
+}
+
+func TestBroker_MaxSubscribers(t *testing.T) {
+	broker := NewBroker(&brokerConf{maxSubscribers: 1}, nil)
+	subscription, err := broker.Subscribe(NewFilter("", nil, nil), 0)
+	require.NoError(t, err)
+
+	_, err = broker.Subscribe(NewFilter("", nil, nil), 0)
+	assert.ErrorIs(t, err, ErrTooManySubscribers)
+
+	broker.Unsubscribe(subscription)
+	_, err = broker.Subscribe(NewFilter("", nil, nil), 0)
+	assert.NoError(t, err)
+}
+
+func (c *brokerConf) StreamReplaySize() int {
+	return c.replaySize
+}
+
+func (c *brokerConf) StreamMaxSubscribers() int {
+	return c.maxSubscribers
+}
@@ -0,0 +1,8 @@
+package stream
+
+import "errors"
+
+var (
+	ErrTooManySubscribers = errors.New("too many subscribers")
+	ErrBrokerClosed       = errors.New("broker is closed")
+)
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type CertificateAuthority struct {
+	Certificate *x509.Certificate
+	Key         *ecdsa.PrivateKey
+	CertFile    string
+}
+
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CreateCertificateAuthority generates a self-signed CA and stores its certificate in a temp dir.
+func CreateCertificateAuthority(t *testing.T, commonName string) *CertificateAuthority {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(t.TempDir(), commonName+".crt")
+	writePEM(t, certFile, "CERTIFICATE", der)
+
+	return &CertificateAuthority{
+		Certificate: certificate,
+		Key:         key,
+		CertFile:    certFile,
+	}
+}
+
+// IssueCertificate issues a certificate valid for both server (127.0.0.1, localhost) and client usage.
+func (ca *CertificateAuthority) IssueCertificate(t *testing.T, commonName string) *CertificateFiles {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, &key.PublicKey, ca.Key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	result := &CertificateFiles{
+		CertFile: filepath.Join(dir, commonName+".crt"),
+		KeyFile:  filepath.Join(dir, commonName+".key"),
+	}
+	writePEM(t, result.CertFile, "CERTIFICATE", der)
+	writePEM(t, result.KeyFile, "EC PRIVATE KEY", keyDer)
+
+	return result
+}
+
+func writePEM(t *testing.T, filePath string, blockType string, content []byte) {
+	t.Helper()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: content})
+	require.NoError(t, os.WriteFile(filePath, data, 0o600))
+}
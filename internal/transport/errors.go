@@ -0,0 +1,8 @@
+package transport
+
+import "errors"
+
+var (
+	ErrInvalidCertificate = errors.New("no valid certificates found")
+	ErrMissedCertificate  = errors.New("server certificate is required for client authentication")
+)
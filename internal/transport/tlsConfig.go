@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+type ServerTLSConfig interface {
+	TLSCertFile() string
+	TLSKeyFile() string
+	TLSClientCAFile() string
+}
+
+type ClientTLSConfig interface {
+	TLSCAFile() string
+	TLSCertFile() string
+	TLSKeyFile() string
+}
+
+// NewServerTLSConfig builds the listener TLS configuration.
+// Returns nil when no certificate is configured, which means plaintext serving.
+// When a client CA is configured every client has to present a certificate signed by it (mTLS).
+func NewServerTLSConfig(config ServerTLSConfig) (*tls.Config, error) {
+	if config.TLSCertFile() == "" && config.TLSKeyFile() == "" {
+		if config.TLSClientCAFile() != "" {
+			return nil, logger.WrapError("create server tls config", ErrMissedCertificate)
+		}
+
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(config.TLSCertFile(), config.TLSKeyFile())
+	if err != nil {
+		return nil, logger.WrapError("load server key pair", err)
+	}
+
+	result := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}
+
+	if config.TLSClientCAFile() != "" {
+		pool, err := loadCertPool(config.TLSClientCAFile())
+		if err != nil {
+			return nil, logger.WrapError("load client ca", err)
+		}
+
+		result.ClientCAs = pool
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return result, nil
+}
+
+// NewClientTLSConfig builds the agent TLS configuration.
+// Returns nil when neither a CA nor a client certificate is configured.
+// The configured CA replaces the system roots, so only servers issued by it are trusted.
+func NewClientTLSConfig(config ClientTLSConfig) (*tls.Config, error) {
+	if config.TLSCAFile() == "" && config.TLSCertFile() == "" && config.TLSKeyFile() == "" {
+		return nil, nil
+	}
+
+	result := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.TLSCAFile() != "" {
+		pool, err := loadCertPool(config.TLSCAFile())
+		if err != nil {
+			return nil, logger.WrapError("load server ca", err)
+		}
+
+		result.RootCAs = pool
+	}
+
+	if config.TLSCertFile() != "" || config.TLSKeyFile() != "" {
+		certificate, err := tls.LoadX509KeyPair(config.TLSCertFile(), config.TLSKeyFile())
+		if err != nil {
+			return nil, logger.WrapError("load client key pair", err)
+		}
+
+		result.Certificates = []tls.Certificate{certificate}
+	}
+
+	return result, nil
+}
+
+// PeerCommonName returns the CN of the verified client certificate, if any.
+func PeerCommonName(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	commonName := state.VerifiedChains[0][0].Subject.CommonName
+	return commonName, commonName != ""
+}
+
+func loadCertPool(filePath string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, logger.WrapError("read ca file", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, logger.WrapError(fmt.Sprintf("parse ca file %s", filePath), ErrInvalidCertificate)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type serverConf struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+}
+
+type clientConf struct {
+	caFile   string
+	certFile string
+	keyFile  string
+}
+
+func TestNewServerTLSConfig_Disabled(t *testing.T) {
+	tlsConfig, err := NewServerTLSConfig(&serverConf{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	tlsConfig, err = NewServerTLSConfig(&serverConf{clientCAFile: "ca.crt"})
+	assert.ErrorIs(t, err, ErrMissedCertificate)
+	assert.Nil(t, tlsConfig)
+}
+
+func TestNewClientTLSConfig_Disabled(t *testing.T) {
+	tlsConfig, err := NewClientTLSConfig(&clientConf{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+}
+
+func TestTLSHandshake(t *testing.T) {
+	serverCA := test.CreateCertificateAuthority(t, "serverCA")
+	clientCA := test.CreateCertificateAuthority(t, "clientCA")
+	otherCA := test.CreateCertificateAuthority(t, "otherCA")
+
+	serverCert := serverCA.IssueCertificate(t, "server")
+	agentCert := clientCA.IssueCertificate(t, "agent-1")
+	foreignCert := otherCA.IssueCertificate(t, "intruder")
+
+	tests := []struct {
+		name             string
+		server           serverConf
+		client           clientConf
+		expectedError    bool
+		expectedIdentity string
+	}{
+		{
+			name:   "tls_pinned_ca",
+			server: serverConf{certFile: serverCert.CertFile, keyFile: serverCert.KeyFile},
+			client: clientConf{caFile: serverCA.CertFile},
+		},
+		{
+			name:          "tls_wrong_pinned_ca",
+			server:        serverConf{certFile: serverCert.CertFile, keyFile: serverCert.KeyFile},
+			client:        clientConf{caFile: otherCA.CertFile},
+			expectedError: true,
+		},
+		{
+			name:             "mtls_success",
+			server:           serverConf{certFile: serverCert.CertFile, keyFile: serverCert.KeyFile, clientCAFile: clientCA.CertFile},
+			client:           clientConf{caFile: serverCA.CertFile, certFile: agentCert.CertFile, keyFile: agentCert.KeyFile},
+			expectedIdentity: "agent-1",
+		},
+		{
+			name:          "mtls_missed_client_certificate",
+			server:        serverConf{certFile: serverCert.CertFile, keyFile: serverCert.KeyFile, clientCAFile: clientCA.CertFile},
+			client:        clientConf{caFile: serverCA.CertFile},
+			expectedError: true,
+		},
+		{
+			name:          "mtls_foreign_client_certificate",
+			server:        serverConf{certFile: serverCert.CertFile, keyFile: serverCert.KeyFile, clientCAFile: clientCA.CertFile},
+			client:        clientConf{caFile: serverCA.CertFile, certFile: foreignCert.CertFile, keyFile: foreignCert.KeyFile},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverTLS, err := NewServerTLSConfig(&tt.server)
+			require.NoError(t, err)
+
+			clientTLS, err := NewClientTLSConfig(&tt.client)
+			require.NoError(t, err)
+
+			actualIdentity := ""
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actualIdentity, _ = PeerCommonName(r.TLS)
+				w.WriteHeader(http.StatusOK)
+			}))
+			server.TLS = serverTLS
+			server.StartTLS()
+			defer server.Close()
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			response, err := client.Get(server.URL)
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			defer response.Body.Close()
+
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, tt.expectedIdentity, actualIdentity)
+		})
+	}
+}
+
+func (c *serverConf) TLSCertFile() string {
+	return c.certFile
+}
+
+func (c *serverConf) TLSKeyFile() string {
+	return c.keyFile
+}
+
+func (c *serverConf) TLSClientCAFile() string {
+	return c.clientCAFile
+}
+
+func (c *clientConf) TLSCAFile() string {
+	return c.caFile
+}
+
+func (c *clientConf) TLSCertFile() string {
+	return c.certFile
+}
+
+func (c *clientConf) TLSKeyFile() string {
+	return c.keyFile
+}
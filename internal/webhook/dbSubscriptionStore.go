@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/database"
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+type dbSubscriptionStore struct {
+	dataBase database.WebhookDataBase
+}
+
+func NewDBSubscriptionStore(dataBase database.WebhookDataBase) SubscriptionStore {
+	return &dbSubscriptionStore{dataBase: dataBase}
+}
+
+func (d *dbSubscriptionStore) ReadSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	records, err := d.dataBase.ReadWebhooks(ctx)
+	if err != nil {
+		return nil, logger.WrapError("read db webhooks", err)
+	}
+
+	result := make([]*Subscription, 0, len(records))
+	for _, record := range records {
+		subscription := &Subscription{
+			ID:     record.ID.String,
+			Tenant: record.Tenant.String,
+			URL:    record.URL.String,
+			Secret: record.Secret.String,
+			Selector: Selector{
+				Type: record.MetricType.String,
+				Name: record.MetricName.String,
+			},
+		}
+
+		if record.ConditionOp.Valid {
+			subscription.Condition = &Condition{Op: record.ConditionOp.String, Value: record.ConditionValue.Float64}
+		}
+
+		result = append(result, subscription)
+	}
+
+	return result, nil
+}
+
+func (d *dbSubscriptionStore) SaveSubscription(ctx context.Context, subscription *Subscription) error {
+	record := &database.WebhookItem{
+		ID:         sql.NullString{String: subscription.ID, Valid: true},
+		Tenant:     sql.NullString{String: subscription.Tenant, Valid: true},
+		URL:        sql.NullString{String: subscription.URL, Valid: true},
+		Secret:     sql.NullString{String: subscription.Secret, Valid: true},
+		MetricType: sql.NullString{String: subscription.Selector.Type, Valid: true},
+		MetricName: sql.NullString{String: subscription.Selector.Name, Valid: true},
+	}
+
+	if subscription.Condition != nil {
+		record.ConditionOp = sql.NullString{String: subscription.Condition.Op, Valid: true}
+		record.ConditionValue = sql.NullFloat64{Float64: subscription.Condition.Value, Valid: true}
+	}
+
+	err := d.dataBase.SaveWebhook(ctx, record)
+	if err != nil {
+		return logger.WrapError("save db webhook", err)
+	}
+
+	return nil
+}
+
+func (d *dbSubscriptionStore) DeleteSubscription(ctx context.Context, tenant string, id string) error {
+	err := d.dataBase.DeleteWebhook(ctx, tenant, id)
+	if err != nil {
+		return logger.WrapError("delete db webhook", err)
+	}
+
+	return nil
+}
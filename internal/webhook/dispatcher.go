@@ -0,0 +1,381 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+	"github.com/MlDenis/prometheus_wannabe/internal/selfmetrics"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+	EventIDHeader   = "X-Webhook-Event-ID"
+
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = time.Minute
+	deadLettersSize   = 1000
+)
+
+type dispatcherConfig interface {
+	WebhookQueueSize() int
+	WebhookWorkers() int
+	WebhookMaxAttempts() int
+	WebhookTimeout() time.Duration
+}
+
+// Event is the body of the webhook request.
+type Event struct {
+	ID            string    `json:"id"`
+	Subscription  string    `json:"subscription"`
+	Tenant        string    `json:"tenant"`
+	Type          string    `json:"type"`
+	Name          string    `json:"name"`
+	Value         float64   `json:"value"`
+	PreviousValue *float64  `json:"previousValue,omitempty"` // missed for the first change seen by the server
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// DeadLetter is an event which was not delivered after all attempts.
+type DeadLetter struct {
+	Event    Event     `json:"event"`
+	URL      string    `json:"url"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+type delivery struct {
+	subscription *Subscription
+	event        Event
+	attempt      int
+}
+
+type seriesKey struct {
+	tenant     string
+	metricType string
+	name       string
+}
+
+// Dispatcher matches storage changes with webhook subscriptions and delivers the events from a queue,
+// so ingestion never waits for a webhook receiver.
+type Dispatcher struct {
+	store       SubscriptionStore
+	client      *http.Client
+	queue       chan *delivery
+	workers     int
+	maxAttempts int
+	retryDelay  time.Duration
+
+	subscriptions map[string]*Subscription
+	lastValues    map[seriesKey]float64
+	deadLetters   []DeadLetter
+	lock          sync.Mutex
+	running       sync.WaitGroup
+
+	delivered *selfmetrics.Counter
+	retried   *selfmetrics.Counter
+	dead      *selfmetrics.Counter
+	dropped   *selfmetrics.Counter
+}
+
+func NewDispatcher(config dispatcherConfig, store SubscriptionStore, registry *selfmetrics.Registry) *Dispatcher {
+	return &Dispatcher{
+		store:         store,
+		client:        &http.Client{Timeout: config.WebhookTimeout()},
+		queue:         make(chan *delivery, config.WebhookQueueSize()),
+		workers:       config.WebhookWorkers(),
+		maxAttempts:   config.WebhookMaxAttempts(),
+		retryDelay:    defaultRetryDelay,
+		subscriptions: map[string]*Subscription{},
+		lastValues:    map[seriesKey]float64{},
+		deadLetters:   []DeadLetter{},
+		delivered:     registry.Counter("WebhookDelivered"),
+		retried:       registry.Counter("WebhookRetried"),
+		dead:          registry.Counter("WebhookDeadLetters"),
+		dropped:       registry.Counter("WebhookQueueOverflow"),
+	}
+}
+
+// Load reads the persisted subscriptions, it should be called before Start.
+func (d *Dispatcher) Load(ctx context.Context) error {
+	subscriptions, err := d.store.ReadSubscriptions(ctx)
+	if err != nil {
+		return logger.WrapError("read webhook subscriptions", err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, subscription := range subscriptions {
+		d.subscriptions[subscription.ID] = subscription
+	}
+
+	return nil
+}
+
+// Start runs the delivery workers until ctx is done.
+func (d *Dispatcher) Start(ctx context.Context) {
+	for i := 0; i < d.workers; i++ {
+		d.running.Add(1)
+		go func() {
+			defer d.running.Done()
+			d.work(ctx)
+		}()
+	}
+}
+
+// Wait returns once the workers are stopped, the scheduled retries are not waited for.
+func (d *Dispatcher) Wait() {
+	d.running.Wait()
+}
+
+// AddSubscription validates and persists the subscription, the result keeps the generated secret.
+func (d *Dispatcher) AddSubscription(ctx context.Context, subscription *Subscription) (*Subscription, error) {
+	err := subscription.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.store.SaveSubscription(ctx, subscription)
+	if err != nil {
+		return nil, logger.WrapError("save webhook subscription", err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.subscriptions[subscription.ID] = subscription
+	return subscription, nil
+}
+
+func (d *Dispatcher) RemoveSubscription(ctx context.Context, tenant string, id string) error {
+	d.lock.Lock()
+	subscription, ok := d.subscriptions[id]
+	d.lock.Unlock()
+
+	if !ok || subscription.Tenant != tenant {
+		return logger.WrapError(fmt.Sprintf("remove webhook subscription '%s'", id), ErrSubscriptionNotFound)
+	}
+
+	err := d.store.DeleteSubscription(ctx, tenant, id)
+	if err != nil {
+		return logger.WrapError("delete webhook subscription", err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.subscriptions, id)
+	return nil
+}
+
+// Subscriptions returns the tenant subscriptions without secrets.
+func (d *Dispatcher) Subscriptions(tenant string) []*Subscription {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	result := []*Subscription{}
+	for _, subscription := range d.subscriptions {
+		if subscription.Tenant == tenant {
+			result = append(result, subscription.WithoutSecret())
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// DeadLetters returns the last undelivered events of the tenant.
+func (d *Dispatcher) DeadLetters(tenant string) []DeadLetter {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	result := []DeadLetter{}
+	for _, deadLetter := range d.deadLetters {
+		if deadLetter.Event.Tenant == tenant {
+			result = append(result, deadLetter)
+		}
+	}
+
+	return result
+}
+
+// ObserveChanges enqueues events for the changed values matched by subscriptions.
+func (d *Dispatcher) ObserveChanges(changes []storage.MetricChange) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.subscriptions) == 0 {
+		return
+	}
+
+	for i := range changes {
+		change := &changes[i]
+		key := seriesKey{tenant: change.Tenant, metricType: change.Type, name: change.Name}
+		previous, seen := d.lastValues[key]
+		if seen && previous == change.Value {
+			continue
+		}
+
+		tracked := false
+		for _, subscription := range d.subscriptions {
+			if !subscription.selects(change) {
+				continue
+			}
+
+			tracked = true
+			if subscription.Condition != nil && !subscription.Condition.Holds(change.Value) {
+				continue
+			}
+
+			event := Event{
+				ID:           randomHex(16),
+				Subscription: subscription.ID,
+				Tenant:       change.Tenant,
+				Type:         change.Type,
+				Name:         change.Name,
+				Value:        change.Value,
+				Timestamp:    change.Time,
+			}
+			if seen {
+				previousValue := previous
+				event.PreviousValue = &previousValue
+			}
+
+			d.enqueue(&delivery{subscription: subscription, event: event}, "delivery queue is full")
+		}
+
+		// values are kept only for the selected series to bound the memory
+		if tracked {
+			d.lastValues[key] = change.Value
+		}
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case item := <-d.queue:
+			d.deliver(ctx, item)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, item *delivery) {
+	item.attempt++
+	err := d.send(ctx, item)
+	if err == nil {
+		d.delivered.Inc()
+		return
+	}
+
+	if item.attempt >= d.maxAttempts || ctx.Err() != nil {
+		d.lock.Lock()
+		d.deadLetter(item, err.Error())
+		d.lock.Unlock()
+		return
+	}
+
+	d.retried.Inc()
+	logger.SugarLogger.Warnf("Webhook %v delivery attempt %v failed, retry: %v", item.subscription.ID, item.attempt, err)
+
+	// the worker is not blocked while waiting for the retry
+	time.AfterFunc(d.backoff(item.attempt), func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		d.enqueue(item, "delivery queue is full on retry")
+	})
+}
+
+func (d *Dispatcher) send(ctx context.Context, item *delivery) error {
+	body, err := json.Marshal(&item.event)
+	if err != nil {
+		return logger.WrapError("serialise webhook event", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, item.subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return logger.WrapError("create webhook request", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventIDHeader, item.event.ID)
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, Sign(item.subscription.Secret, timestamp, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return logger.WrapError("send webhook request", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return logger.WrapError(fmt.Sprintf("send webhook request, status %v", response.StatusCode), ErrUnexpectedStatusCode)
+	}
+
+	return nil
+}
+
+// enqueue must be called under the lock.
+func (d *Dispatcher) enqueue(item *delivery, overflowReason string) {
+	select {
+	case d.queue <- item:
+	default:
+		d.dropped.Inc()
+		d.deadLetter(item, overflowReason)
+	}
+}
+
+// deadLetter must be called under the lock.
+func (d *Dispatcher) deadLetter(item *delivery, reason string) {
+	d.dead.Inc()
+	logger.SugarLogger.Errorf("Webhook %v event %v is not delivered after %v attempts: %v", item.subscription.ID, item.event.ID, item.attempt, reason)
+
+	if len(d.deadLetters) >= deadLettersSize {
+		d.deadLetters = d.deadLetters[1:]
+	}
+
+	d.deadLetters = append(d.deadLetters, DeadLetter{
+		Event:    item.event,
+		URL:      item.subscription.URL,
+		Attempts: item.attempt,
+		Error:    reason,
+		FailedAt: time.Now(),
+	})
+}
+
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.retryDelay << (attempt - 1)
+	if delay <= 0 || delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+
+	return delay
+}
+
+// Sign returns the signature header value: the hex HMAC-SHA256 of "<timestamp>.<body>" with the subscription secret.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
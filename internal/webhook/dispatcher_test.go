@@ -0,0 +1,316 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dispatcherConf struct {
+	queueSize   int
+	workers     int
+	maxAttempts int
+}
+
+type receiver struct {
+	server   *httptest.Server
+	statuses []int // response statuses by request, the last one is repeated
+	events   chan Event
+	requests int
+	lock     sync.Mutex
+
+	lastBody      []byte
+	lastTimestamp string
+	lastSignature string
+}
+
+func TestDispatcher_Deliver(t *testing.T) {
+	receiver := newReceiver(t, http.StatusOK)
+	dispatcher := startDispatcher(t, &dispatcherConf{queueSize: 10, workers: 1, maxAttempts: 1})
+
+	subscription, err := dispatcher.AddSubscription(context.Background(), &Subscription{
+		Tenant:    "team-a",
+		URL:       receiver.server.URL,
+		Selector:  Selector{Type: "counter", Name: "Deploy*"},
+		Condition: &Condition{Op: OpGreater, Value: 1},
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, subscription.Secret)
+
+	now := time.Now()
+	dispatcher.ObserveChanges([]storage.MetricChange{
+		{Tenant: "team-a", Type: "counter", Name: "Deployments", Value: 1, Time: now},
+		{Tenant: "team-a", Type: "gauge", Name: "Deployments", Value: 5, Time: now},
+		{Tenant: "team-b", Type: "counter", Name: "Deployments", Value: 5, Time: now},
+		{Tenant: "team-a", Type: "counter", Name: "Other", Value: 5, Time: now},
+	})
+	dispatcher.ObserveChanges([]storage.MetricChange{{Tenant: "team-a", Type: "counter", Name: "Deployments", Value: 2, Time: now}})
+	// unchanged value is not delivered again
+	dispatcher.ObserveChanges([]storage.MetricChange{{Tenant: "team-a", Type: "counter", Name: "Deployments", Value: 2, Time: now}})
+	dispatcher.ObserveChanges([]storage.MetricChange{{Tenant: "team-a", Type: "counter", Name: "Deployments", Value: 3, Time: now}})
+
+	first := receiver.next(t)
+	assert.Equal(t, subscription.ID, first.Subscription)
+	assert.Equal(t, "Deployments", first.Name)
+	assert.Equal(t, float64(2), first.Value)
+	require.NotNil(t, first.PreviousValue)
+	assert.Equal(t, float64(1), *first.PreviousValue)
+
+	second := receiver.next(t)
+	assert.Equal(t, float64(3), second.Value)
+	assert.Equal(t, float64(2), *second.PreviousValue)
+
+	receiver.lock.Lock()
+	assert.Equal(t, Sign(subscription.Secret, receiver.lastTimestamp, receiver.lastBody), receiver.lastSignature)
+	assert.NotEqual(t, Sign("other", receiver.lastTimestamp, receiver.lastBody), receiver.lastSignature)
+	receiver.lock.Unlock()
+
+	select {
+	case event := <-receiver.events:
+		assert.Fail(t, "unexpected event", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Empty(t, dispatcher.DeadLetters("team-a"))
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	tests := []struct {
+		name                string
+		statuses            []int
+		expectedRequests    int
+		expectedDelivered   bool
+		expectedDeadLetters int
+	}{
+		{
+			name:              "delivered_after_retry",
+			statuses:          []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusNoContent},
+			expectedRequests:  3,
+			expectedDelivered: true,
+		},
+		{
+			name:                "dead_letter",
+			statuses:            []int{http.StatusInternalServerError},
+			expectedRequests:    3,
+			expectedDeadLetters: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newReceiver(t, tt.statuses...)
+			dispatcher := startDispatcher(t, &dispatcherConf{queueSize: 10, workers: 1, maxAttempts: 3})
+
+			_, err := dispatcher.AddSubscription(context.Background(), &Subscription{URL: receiver.server.URL})
+			require.NoError(t, err)
+
+			dispatcher.ObserveChanges([]storage.MetricChange{{Type: "gauge", Name: "Alloc", Value: 1}})
+
+			assert.Eventually(t, func() bool {
+				return receiver.requestsCount() == tt.expectedRequests && len(dispatcher.DeadLetters("")) == tt.expectedDeadLetters
+			}, 5*time.Second, 5*time.Millisecond)
+
+			if tt.expectedDelivered {
+				assert.Equal(t, "Alloc", receiver.next(t).Name)
+			} else {
+				deadLetter := dispatcher.DeadLetters("")[0]
+				assert.Equal(t, tt.expectedRequests, deadLetter.Attempts)
+				assert.Equal(t, receiver.server.URL, deadLetter.URL)
+				assert.Contains(t, deadLetter.Error, "status 500")
+			}
+		})
+	}
+}
+
+func TestDispatcher_QueueOverflow(t *testing.T) {
+	dispatcher := NewDispatcher(&dispatcherConf{queueSize: 1, maxAttempts: 1}, NewFileSubscriptionStore(""), nil)
+	_, err := dispatcher.AddSubscription(context.Background(), &Subscription{URL: "http://localhost:1/hook"})
+	require.NoError(t, err)
+
+	// there are no workers, so the publisher must not wait for the queue
+	for i := 0; i < 3; i++ {
+		dispatcher.ObserveChanges([]storage.MetricChange{{Type: "gauge", Name: "Alloc", Value: float64(i)}})
+	}
+
+	deadLetters := dispatcher.DeadLetters("")
+	require.Len(t, deadLetters, 2)
+	assert.Equal(t, "delivery queue is full", deadLetters[0].Error)
+}
+
+func TestDispatcher_Wait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher := NewDispatcher(&dispatcherConf{queueSize: 1, workers: 2, maxAttempts: 1}, NewFileSubscriptionStore(""), nil)
+	dispatcher.Start(ctx)
+
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("workers are stopped before ctx is done")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("workers are not stopped")
+	}
+}
+
+func TestDispatcher_Subscriptions(t *testing.T) {
+	store := NewFileSubscriptionStore(t.TempDir() + "/webhooks.json")
+	dispatcher := NewDispatcher(&dispatcherConf{}, store, nil)
+
+	_, err := dispatcher.AddSubscription(context.Background(), &Subscription{Tenant: "team-a", URL: "ftp://localhost/hook"})
+	assert.ErrorIs(t, err, ErrInvalidSubscription)
+
+	subscription, err := dispatcher.AddSubscription(context.Background(), &Subscription{Tenant: "team-a", URL: "http://localhost/hook"})
+	require.NoError(t, err)
+
+	restored := NewDispatcher(&dispatcherConf{}, store, nil)
+	require.NoError(t, restored.Load(context.Background()))
+	assert.Equal(t, []*Subscription{subscription.WithoutSecret()}, restored.Subscriptions("team-a"))
+	assert.Empty(t, restored.Subscriptions("team-b"))
+
+	assert.ErrorIs(t, restored.RemoveSubscription(context.Background(), "team-b", subscription.ID), ErrSubscriptionNotFound)
+	require.NoError(t, restored.RemoveSubscription(context.Background(), "team-a", subscription.ID))
+	assert.Empty(t, restored.Subscriptions("team-a"))
+
+	persisted, err := store.ReadSubscriptions(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, persisted)
+}
+
+func TestSubscription_Validate(t *testing.T) {
+	tests := []struct {
+		name          string
+		subscription  Subscription
+		expectedError error
+	}{
+		{
+			name:         "minimal",
+			subscription: Subscription{URL: "https://example.com/hook"},
+		},
+		{
+			name:         "full",
+			subscription: Subscription{URL: "http://example.com/hook", Selector: Selector{Type: "gauge", Name: "Heap*"}, Condition: &Condition{Op: OpLessOrEqual}},
+		},
+		{
+			name:          "relative_url",
+			subscription:  Subscription{URL: "/hook"},
+			expectedError: ErrInvalidSubscription,
+		},
+		{
+			name:          "unknown_type",
+			subscription:  Subscription{URL: "http://example.com/hook", Selector: Selector{Type: "histogram"}},
+			expectedError: ErrInvalidSubscription,
+		},
+		{
+			name:          "bad_pattern",
+			subscription:  Subscription{URL: "http://example.com/hook", Selector: Selector{Name: "Heap["}},
+			expectedError: ErrInvalidSubscription,
+		},
+		{
+			name:          "unknown_operator",
+			subscription:  Subscription{URL: "http://example.com/hook", Condition: &Condition{Op: "~"}},
+			expectedError: ErrInvalidSubscription,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.subscription.Validate()
+			assert.ErrorIs(t, err, tt.expectedError)
+			if tt.expectedError == nil {
+				assert.NotEmpty(t, tt.subscription.ID)
+				assert.NotEmpty(t, tt.subscription.Secret)
+			}
+		})
+	}
+}
+
+func startDispatcher(t *testing.T, conf *dispatcherConf) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	dispatcher := NewDispatcher(conf, NewFileSubscriptionStore(""), nil)
+	dispatcher.retryDelay = time.Millisecond
+	dispatcher.Start(ctx)
+	return dispatcher
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	result := &receiver{statuses: statuses, events: make(chan Event, 10)}
+	result.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		result.lock.Lock()
+		status := result.statuses[min(result.requests, len(result.statuses)-1)]
+		result.requests++
+		result.lastBody = body
+		result.lastTimestamp = r.Header.Get(TimestampHeader)
+		result.lastSignature = r.Header.Get(SignatureHeader)
+		result.lock.Unlock()
+
+		if status < 300 {
+			var event Event
+			require.NoError(t, json.Unmarshal(body, &event))
+			assert.Equal(t, event.ID, r.Header.Get(EventIDHeader))
+			result.events <- event
+		}
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(result.server.Close)
+
+	return result
+}
+
+func (r *receiver) next(t *testing.T) Event {
+	select {
+	case event := <-r.events:
+		return event
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "webhook event is not delivered")
+		return Event{}
+	}
+}
+
+func (r *receiver) requestsCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.requests
+}
+
+func (c *dispatcherConf) WebhookQueueSize() int {
+	return c.queueSize
+}
+
+func (c *dispatcherConf) WebhookWorkers() int {
+	return c.workers
+}
+
+func (c *dispatcherConf) WebhookMaxAttempts() int {
+	return c.maxAttempts
+}
+
+func (c *dispatcherConf) WebhookTimeout() time.Duration {
+	return time.Second
+}
@@ -0,0 +1,9 @@
+package webhook
+
+import "errors"
+
+var (
+	ErrInvalidSubscription  = errors.New("invalid webhook subscription")
+	ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+	ErrUnexpectedStatusCode = errors.New("unexpected webhook response status code")
+)
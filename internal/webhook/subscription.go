@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+	"github.com/MlDenis/prometheus_wannabe/internal/metrics/storage"
+)
+
+const (
+	OpGreater        = ">"
+	OpGreaterOrEqual = ">="
+	OpLess           = "<"
+	OpLessOrEqual    = "<="
+	OpEqual          = "=="
+	OpNotEqual       = "!="
+)
+
+type Subscription struct {
+	ID        string     `json:"id"`
+	Tenant    string     `json:"tenant"`
+	URL       string     `json:"url"`
+	Secret    string     `json:"secret,omitempty"` // HMAC key of the event signature
+	Selector  Selector   `json:"selector"`
+	Condition *Condition `json:"condition,omitempty"`
+}
+
+// Selector matches the metric type exactly and the name by a shell pattern, empty fields match any.
+type Selector struct {
+	Type string `json:"type,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Condition compares the new metric value with the threshold.
+type Condition struct {
+	Op    string  `json:"op"`
+	Value float64 `json:"value"`
+}
+
+// Validate checks the subscription fields and fills the missed ID and secret.
+func (s *Subscription) Validate() error {
+	target, err := url.Parse(s.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return logger.WrapError(fmt.Sprintf("validate url '%s'", s.URL), ErrInvalidSubscription)
+	}
+
+	if s.Selector.Type != "" && s.Selector.Type != "gauge" && s.Selector.Type != "counter" {
+		return logger.WrapError(fmt.Sprintf("validate metric type '%s'", s.Selector.Type), ErrInvalidSubscription)
+	}
+
+	if _, err = path.Match(s.Selector.Name, ""); err != nil {
+		return logger.WrapError(fmt.Sprintf("validate name pattern '%s'", s.Selector.Name), ErrInvalidSubscription)
+	}
+
+	if s.Condition != nil {
+		switch s.Condition.Op {
+		case OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual, OpEqual, OpNotEqual:
+		default:
+			return logger.WrapError(fmt.Sprintf("validate condition operator '%s'", s.Condition.Op), ErrInvalidSubscription)
+		}
+	}
+
+	if s.ID == "" {
+		s.ID = randomHex(8)
+	}
+
+	if s.Secret == "" {
+		s.Secret = randomHex(32)
+	}
+
+	return nil
+}
+
+// Holds reports whether the value satisfies the condition.
+func (c *Condition) Holds(value float64) bool {
+	switch c.Op {
+	case OpGreater:
+		return value > c.Value
+	case OpGreaterOrEqual:
+		return value >= c.Value
+	case OpLess:
+		return value < c.Value
+	case OpLessOrEqual:
+		return value <= c.Value
+	case OpEqual:
+		return value == c.Value
+	case OpNotEqual:
+		return value != c.Value
+	default:
+		return false
+	}
+}
+
+// WithoutSecret returns the copy of the subscription safe to show to clients.
+func (s *Subscription) WithoutSecret() *Subscription {
+	result := *s
+	result.Secret = ""
+	return &result
+}
+
+// selects reports whether the change is selected by the subscription, the condition is not checked.
+func (s *Subscription) selects(change *storage.MetricChange) bool {
+	if change.Tenant != s.Tenant || s.Selector.Type != "" && change.Type != s.Selector.Type {
+		return false
+	}
+
+	if s.Selector.Name == "" {
+		return true
+	}
+
+	ok, _ := path.Match(s.Selector.Name, change.Name)
+	return ok
+}
+
+func randomHex(size int) string {
+	buffer := make([]byte, size)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		panic(logger.WrapError("read random bytes", err))
+	}
+
+	return hex.EncodeToString(buffer)
+}
@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/MlDenis/prometheus_wannabe/internal/logger"
+)
+
+// the file keeps the subscription secrets
+const subscriptionsFileMode os.FileMode = 0o600
+
+type SubscriptionStore interface {
+	ReadSubscriptions(ctx context.Context) ([]*Subscription, error)
+	SaveSubscription(ctx context.Context, subscription *Subscription) error
+	DeleteSubscription(ctx context.Context, tenant string, id string) error
+}
+
+type fileSubscriptionStore struct {
+	filePath string
+	lock     sync.Mutex
+}
+
+// NewFileSubscriptionStore keeps subscriptions as a JSON array in the file, an empty path keeps nothing.
+func NewFileSubscriptionStore(filePath string) SubscriptionStore {
+	return &fileSubscriptionStore{filePath: filePath}
+}
+
+func (f *fileSubscriptionStore) ReadSubscriptions(context.Context) ([]*Subscription, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.read()
+}
+
+func (f *fileSubscriptionStore) SaveSubscription(_ context.Context, subscription *Subscription) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	subscriptions, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	return f.write(append(subscriptions, subscription))
+}
+
+func (f *fileSubscriptionStore) DeleteSubscription(_ context.Context, tenant string, id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	subscriptions, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	result := []*Subscription{}
+	for _, subscription := range subscriptions {
+		if subscription.Tenant != tenant || subscription.ID != id {
+			result = append(result, subscription)
+		}
+	}
+
+	return f.write(result)
+}
+
+func (f *fileSubscriptionStore) read() ([]*Subscription, error) {
+	result := []*Subscription{}
+	if f.filePath == "" {
+		return result, nil
+	}
+
+	content, err := os.ReadFile(f.filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return result, nil
+		}
+
+		return nil, logger.WrapError("read subscriptions file", err)
+	}
+
+	err = json.Unmarshal(content, &result)
+	if err != nil {
+		return nil, logger.WrapError("decode subscriptions file", err)
+	}
+
+	return result, nil
+}
+
+func (f *fileSubscriptionStore) write(subscriptions []*Subscription) error {
+	if f.filePath == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(subscriptions)
+	if err != nil {
+		return logger.WrapError("encode subscriptions", err)
+	}
+
+	// the file is replaced at once, so a crash does not leave a partially written file
+	tempFile, err := os.CreateTemp(filepath.Dir(f.filePath), filepath.Base(f.filePath)+".*.tmp")
+	if err != nil {
+		return logger.WrapError("create subscriptions temp file", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(content)
+	if err == nil {
+		err = tempFile.Chmod(subscriptionsFileMode)
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return logger.WrapError("write subscriptions temp file", err)
+	}
+
+	err = os.Rename(tempFile.Name(), f.filePath)
+	if err != nil {
+		return logger.WrapError("replace subscriptions file", err)
+	}
+
+	return nil
+}